@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/proxy"
+)
+
+// 网关认证过滤器
+// 按路由的认证策略校验请求携带的访问令牌，校验通过后将用户信息以受信任的请求头传给上游服务，
+// 客户端自行携带的同名请求头总是被移除，上游服务只需信任网关注入的值
+
+// 注入上游请求的用户信息头
+const (
+	HeaderUserId          = "X-User-Id"
+	HeaderUserAuthorities = "X-User-Authorities"
+)
+
+var (
+	ErrMissingToken = errors.New("missing access token")
+	ErrInvalidToken = errors.New("invalid access token")
+	ErrExpiredToken = errors.New("access token is expired")
+	// 无法完成校验，如oauth服务不可用，不代表令牌无效
+	ErrVerifierUnavailable = errors.New("token verifier unavailable")
+)
+
+// 令牌对应的用户
+type Principal struct {
+	UserId      int64
+	Username    string
+	ClientId    string
+	Authorities []string
+	// 令牌过期时间，为零值时表示未知
+	ExpiresAt time.Time
+}
+
+// 是否具备全部权限
+func (p *Principal) HasAuthorities(authorities []string) bool {
+	for _, required := range authorities {
+		found := false
+		for _, authority := range p.Authorities {
+			if authority == required {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+type principalKey struct{}
+
+// 从请求上下文中获取认证通过的用户，未认证时返回nil
+func PrincipalFromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// 令牌校验器
+type Verifier interface {
+	Verify(ctx context.Context, token string) (*Principal, error)
+}
+
+// 创建认证过滤器
+func Filter(verifier Verifier, logger log.Logger) proxy.Filter {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			req.Header.Del(HeaderUserId)
+			req.Header.Del(HeaderUserAuthorities)
+			policy := proxy.RouteFromContext(req.Context()).Auth
+			if policy == nil {
+				next.ServeHTTP(w, req)
+				return
+			}
+			token := tokenFromRequest(req)
+			if token == "" {
+				if policy.Required {
+					unauthorized(w, req, ErrMissingToken)
+					return
+				}
+				next.ServeHTTP(w, req)
+				return
+			}
+			principal, err := verifier.Verify(req.Context(), token)
+			if err != nil {
+				logger.Log("auth", "verify token", "err", err)
+				if errors.Is(err, ErrVerifierUnavailable) {
+					// 校验服务故障时返回503，客户端不应因此丢弃令牌
+					proxy.Error(w, req, http.StatusServiceUnavailable, ErrVerifierUnavailable.Error())
+					return
+				}
+				unauthorized(w, req, err)
+				return
+			}
+			if !principal.HasAuthorities(policy.Authorities) {
+				proxy.Error(w, req, http.StatusForbidden, "insufficient authorities")
+				return
+			}
+			if policy.StripAuthorization {
+				req.Header.Del("Authorization")
+			}
+			req.Header.Set(HeaderUserId, strconv.FormatInt(principal.UserId, 10))
+			req.Header.Set(HeaderUserAuthorities, strings.Join(principal.Authorities, ","))
+			next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), principalKey{}, principal)))
+		})
+	}
+}
+
+// 从Authorization头获取令牌，兼容oauth服务使用的不带Bearer前缀的形式
+func tokenFromRequest(req *http.Request) string {
+	value := strings.TrimSpace(req.Header.Get("Authorization"))
+	if len(value) > 7 && strings.EqualFold(value[:7], "bearer ") {
+		return strings.TrimSpace(value[7:])
+	}
+	if strings.Contains(value, " ") {
+		// 其他认证方式，如Basic
+		return ""
+	}
+	return value
+}
+
+func unauthorized(w http.ResponseWriter, req *http.Request, err error) {
+	w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	proxy.Error(w, req, http.StatusUnauthorized, err.Error())
+}
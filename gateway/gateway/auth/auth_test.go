@@ -0,0 +1,217 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-kit/kit/log"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/proxy"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/route"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/upstream"
+)
+
+// 按oauth服务的方式签发令牌
+func sign(t *testing.T, secret string, authorities []string, expiresAt time.Time) string {
+	claims := &oauthClaims{StandardClaims: jwt.StandardClaims{ExpiresAt: expiresAt.Unix(), Issuer: "System"}}
+	claims.UserDetails.UserId = 7
+	claims.UserDetails.Username = "simple"
+	claims.UserDetails.Authorities = authorities
+	claims.ClientDetails.ClientId = "clientId"
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// 所有服务都解析到测试上游
+type staticResolver struct {
+	instance *upstream.Instance
+}
+
+func (s staticResolver) Instances(ctx context.Context, serviceName string) ([]*upstream.Instance, error) {
+	return []*upstream.Instance{s.instance}, nil
+}
+
+func backendResolver(t *testing.T, rawurl string) upstream.Resolver {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := strconv.Atoi(u.Port())
+	return staticResolver{&upstream.Instance{ID: "backend", Address: u.Hostname(), Port: port}}
+}
+
+func TestFilter(t *testing.T) {
+	var upstreamHeaders http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeaders = r.Header.Clone()
+	}))
+	defer backend.Close()
+
+	config, err := route.Parse([]byte(`
+routes:
+  - {name: public, service: backend, match: {pathPrefix: /public}}
+  - {name: optional, service: backend, match: {pathPrefix: /optional}, auth: {}}
+  - {name: user, service: backend, match: {pathPrefix: /user}, auth: {required: true, stripAuthorization: true}}
+  - {name: admin, service: backend, match: {pathPrefix: /admin}, auth: {authorities: [Admin]}}
+`), "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := route.NewStore()
+	routes.Update(config, "test")
+	handler := proxy.NewHandler(routes, backendResolver(t, backend.URL), log.NewNopLogger())
+	handler.Use(Filter(NewJWTVerifier("secret"), log.NewNopLogger()))
+
+	userToken := sign(t, "secret", []string{"Simple"}, time.Now().Add(time.Hour))
+	adminToken := sign(t, "secret", []string{"Simple", "Admin"}, time.Now().Add(time.Hour))
+	cases := []struct {
+		path, authorization string
+		status              int
+		userId              string
+		authorization2      string
+	}{
+		{"/public", "", http.StatusOK, "", ""},
+		{"/optional", "", http.StatusOK, "", ""},
+		{"/optional", "Bearer " + userToken, http.StatusOK, "7", "Bearer " + userToken},
+		{"/user", "", http.StatusUnauthorized, "", ""},
+		{"/user", "Bearer " + userToken, http.StatusOK, "7", ""},
+		// oauth服务使用的不带Bearer前缀的形式
+		{"/user", userToken, http.StatusOK, "7", ""},
+		{"/user", "Bearer " + sign(t, "other", nil, time.Now().Add(time.Hour)), http.StatusUnauthorized, "", ""},
+		{"/user", "Bearer " + sign(t, "secret", nil, time.Now().Add(-time.Hour)), http.StatusUnauthorized, "", ""},
+		{"/admin", "Bearer " + userToken, http.StatusForbidden, "", ""},
+		{"/admin", "Bearer " + adminToken, http.StatusOK, "7", "Bearer " + adminToken},
+	}
+	for i, c := range cases {
+		upstreamHeaders = nil
+		req := httptest.NewRequest("GET", c.path, nil)
+		if c.authorization != "" {
+			req.Header.Set("Authorization", c.authorization)
+		}
+		// 客户端伪造的用户头必须被移除
+		req.Header.Set(HeaderUserId, "1")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != c.status {
+			t.Fatalf("case %d: expected status %d, got %d %s", i, c.status, rec.Code, rec.Body)
+		}
+		if c.status != http.StatusOK {
+			if c.status == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Fatalf("case %d: expected WWW-Authenticate header", i)
+			}
+			continue
+		}
+		if got := upstreamHeaders.Get(HeaderUserId); got != c.userId {
+			t.Fatalf("case %d: expected user id %q, got %q", i, c.userId, got)
+		}
+		if got := upstreamHeaders.Get("Authorization"); got != c.authorization2 {
+			t.Fatalf("case %d: expected authorization %q, got %q", i, c.authorization2, got)
+		}
+	}
+}
+
+type verifierFunc func(ctx context.Context, token string) (*Principal, error)
+
+func (f verifierFunc) Verify(ctx context.Context, token string) (*Principal, error) {
+	return f(ctx, token)
+}
+
+func TestFilterVerifierUnavailable(t *testing.T) {
+	config, err := route.Parse([]byte(`
+routes:
+  - {name: user, service: backend, match: {pathPrefix: /user}, auth: {required: true}}
+`), "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := route.NewStore()
+	routes.Update(config, "test")
+	handler := proxy.NewHandler(routes, backendResolver(t, "http://127.0.0.1:1"), log.NewNopLogger())
+	handler.Use(Filter(verifierFunc(func(ctx context.Context, token string) (*Principal, error) {
+		return nil, fmt.Errorf("%w: connection refused", ErrVerifierUnavailable)
+	}), log.NewNopLogger()))
+	req := httptest.NewRequest("GET", "/user", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("WWW-Authenticate") != "" {
+		t.Fatalf("expected 503 without invalidating token, got %d %v", rec.Code, rec.Header())
+	}
+}
+
+func TestRemoteVerifier(t *testing.T) {
+	var calls int32
+	var exp int64
+	oauth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if id, secret, _ := r.BasicAuth(); id != "clientId" || secret != "clientSecret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if token := r.URL.Query().Get("token"); token != "good" && token != "expiring" {
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid token"})
+			return
+		}
+		w.Write([]byte(`{"o_auth_details":{"Client":{"ClientId":"clientId"},"User":{"UserId":7,"Username":"simple","Authorities":["Simple"]}},"exp":` + strconv.FormatInt(atomic.LoadInt64(&exp), 10) + `,"error":""}`))
+	}))
+	defer oauth.Close()
+
+	v := NewRemoteVerifier(&RemoteConfig{
+		CheckTokenURL: oauth.URL + "/oauth/check_token",
+		ClientId:      "clientId",
+		ClientSecret:  "clientSecret",
+		CacheTTL:      time.Minute,
+	})
+	now := time.Unix(1600000000, 0)
+	v.now = func() time.Time { return now }
+	for i := 0; i < 3; i++ {
+		principal, err := v.Verify(context.Background(), "good")
+		if err != nil || principal.UserId != 7 || principal.Authorities[0] != "Simple" {
+			t.Fatalf("unexpected principal %+v %v", principal, err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("expected cached result, got %d calls", calls)
+	}
+	now = now.Add(2 * time.Minute)
+	v.Verify(context.Background(), "good")
+	if calls != 2 {
+		t.Fatalf("expected cache expired, got %d calls", calls)
+	}
+	if _, err := v.Verify(context.Background(), "bad"); err != ErrInvalidToken {
+		t.Fatalf("expected %v, got %v", ErrInvalidToken, err)
+	}
+
+	// 缓存时间不超过令牌过期时间
+	atomic.StoreInt64(&exp, now.Add(10*time.Second).Unix())
+	principal, err := v.Verify(context.Background(), "expiring")
+	if err != nil || !principal.ExpiresAt.Equal(now.Add(10*time.Second)) {
+		t.Fatalf("expected expiry from check token response, got %+v %v", principal, err)
+	}
+	now = now.Add(11 * time.Second)
+	if _, err = v.Verify(context.Background(), "expiring"); err != ErrExpiredToken {
+		t.Fatalf("expected %v after token expired, got %v", ErrExpiredToken, err)
+	}
+
+	// oauth服务不可用时不判定令牌无效
+	v.config.ClientSecret = "wrong"
+	if _, err = v.Verify(context.Background(), "other"); !errors.Is(err, ErrVerifierUnavailable) {
+		t.Fatalf("expected %v, got %v", ErrVerifierUnavailable, err)
+	}
+	oauth.Close()
+	if _, err = v.Verify(context.Background(), "other"); !errors.Is(err, ErrVerifierUnavailable) {
+		t.Fatalf("expected %v, got %v", ErrVerifierUnavailable, err)
+	}
+}
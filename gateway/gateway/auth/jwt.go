@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"context"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// 本地校验oauth服务签发的jwt令牌，与oauth服务共享签名密钥
+
+// oauth服务jwt令牌中的声明
+type oauthClaims struct {
+	UserDetails struct {
+		UserId      int64
+		Username    string
+		Authorities []string
+	}
+	ClientDetails struct {
+		ClientId string
+	}
+	jwt.StandardClaims
+}
+
+// jwt令牌校验器
+type JWTVerifier struct {
+	secretKey []byte
+}
+
+func NewJWTVerifier(secretKey string) *JWTVerifier {
+	return &JWTVerifier{secretKey: []byte(secretKey)}
+}
+
+func (v *JWTVerifier) Verify(ctx context.Context, token string) (*Principal, error) {
+	claims := &oauthClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
+		// 只接受oauth服务使用的HMAC签名，防止算法替换攻击
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, ErrInvalidToken
+		}
+		return v.secretKey, nil
+	})
+	if err != nil {
+		if ve, ok := err.(*jwt.ValidationError); ok && ve.Errors&jwt.ValidationErrorExpired != 0 {
+			return nil, ErrExpiredToken
+		}
+		return nil, ErrInvalidToken
+	}
+	principal := &Principal{
+		UserId:      claims.UserDetails.UserId,
+		Username:    claims.UserDetails.Username,
+		ClientId:    claims.ClientDetails.ClientId,
+		Authorities: claims.UserDetails.Authorities,
+	}
+	if claims.ExpiresAt > 0 {
+		principal.ExpiresAt = time.Unix(claims.ExpiresAt, 0)
+	}
+	return principal, nil
+}
@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// 通过oauth服务的 /oauth/check_token 接口校验令牌，校验结果在本地缓存一段时间
+
+// 远程令牌校验配置
+type RemoteConfig struct {
+	// check_token接口地址，如 http://127.0.0.1:10086/oauth/check_token
+	CheckTokenURL string
+	// 网关在oauth服务中的客户端凭证
+	ClientId     string
+	ClientSecret string
+	// 校验结果缓存时间，不超过令牌过期时间，0表示不缓存
+	CacheTTL time.Duration
+	// 最多缓存的令牌数
+	CacheSize  int
+	HTTPClient *http.Client
+}
+
+type cacheEntry struct {
+	principal *Principal
+	expiresAt time.Time
+}
+
+// 远程令牌校验器
+type RemoteVerifier struct {
+	config RemoteConfig
+	client *http.Client
+	mu     sync.Mutex
+	cache  map[string]cacheEntry
+	now    func() time.Time
+}
+
+func NewRemoteVerifier(config *RemoteConfig) *RemoteVerifier {
+	c := *config
+	if c.CacheSize <= 0 {
+		c.CacheSize = 10000
+	}
+	client := c.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 3 * time.Second}
+	}
+	return &RemoteVerifier{
+		config: c,
+		client: client,
+		cache:  make(map[string]cacheEntry),
+		now:    time.Now,
+	}
+}
+
+// check_token接口的响应
+type checkTokenResponse struct {
+	OAuthDetails *struct {
+		Client struct {
+			ClientId string
+		}
+		User struct {
+			UserId      int64
+			Username    string
+			Authorities []string
+		}
+	} `json:"o_auth_details"`
+	// 令牌过期时间，Unix秒
+	Exp   int64  `json:"exp"`
+	Error string `json:"error"`
+}
+
+func (v *RemoteVerifier) Verify(ctx context.Context, token string) (*Principal, error) {
+	if principal, ok := v.cached(token); ok {
+		return principal, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", v.config.CheckTokenURL+"?token="+url.QueryEscape(token), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(v.config.ClientId, v.config.ClientSecret)
+	// 请求失败或响应异常时无法判断令牌是否有效
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: check token err : %s", ErrVerifierUnavailable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: check token http request errCode : %v", ErrVerifierUnavailable, resp.StatusCode)
+	}
+	var result checkTokenResponse
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("%w: decode check token response err : %s", ErrVerifierUnavailable, err)
+	}
+	if result.Error != "" || result.OAuthDetails == nil {
+		return nil, ErrInvalidToken
+	}
+	principal := &Principal{
+		UserId:      result.OAuthDetails.User.UserId,
+		Username:    result.OAuthDetails.User.Username,
+		ClientId:    result.OAuthDetails.Client.ClientId,
+		Authorities: result.OAuthDetails.User.Authorities,
+	}
+	if result.Exp > 0 {
+		principal.ExpiresAt = time.Unix(result.Exp, 0)
+		if !v.now().Before(principal.ExpiresAt) {
+			return nil, ErrExpiredToken
+		}
+	}
+	v.store(token, principal)
+	return principal, nil
+}
+
+func (v *RemoteVerifier) cached(token string) (*Principal, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	entry, ok := v.cache[token]
+	if !ok {
+		return nil, false
+	}
+	if !v.now().Before(entry.expiresAt) {
+		delete(v.cache, token)
+		return nil, false
+	}
+	return entry.principal, true
+}
+
+func (v *RemoteVerifier) store(token string, principal *Principal) {
+	if v.config.CacheTTL <= 0 {
+		return
+	}
+	now := v.now()
+	expiresAt := now.Add(v.config.CacheTTL)
+	if !principal.ExpiresAt.IsZero() && principal.ExpiresAt.Before(expiresAt) {
+		expiresAt = principal.ExpiresAt
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(v.cache) >= v.config.CacheSize {
+		// 缓存已满时先清理过期项，仍然满时清空
+		for k, entry := range v.cache {
+			if !now.Before(entry.expiresAt) {
+				delete(v.cache, k)
+			}
+		}
+		if len(v.cache) >= v.config.CacheSize {
+			v.cache = make(map[string]cacheEntry)
+		}
+	}
+	v.cache[token] = cacheEntry{principal: principal, expiresAt: expiresAt}
+}
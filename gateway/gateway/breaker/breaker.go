@@ -0,0 +1,174 @@
+package breaker
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/afex/hystrix-go/hystrix"
+)
+
+// 上游服务熔断
+// 每个上游服务对应一个hystrix熔断器，统计窗口内失败率超过阈值后熔断，
+// 熔断期间直接拒绝请求，经过休眠窗口后放行单个请求探测服务是否恢复
+
+var (
+	ErrOpen           = hystrix.ErrCircuitOpen
+	ErrMaxConcurrency = hystrix.ErrMaxConcurrency
+	ErrTimeout        = hystrix.ErrTimeout
+)
+
+// 熔断及重试预算配置，对所有上游服务生效
+type Config struct {
+	// 单次调用超时时间，超时计为失败
+	Timeout time.Duration
+	// 单个服务的最大并发请求数
+	MaxConcurrent int
+	// 统计窗口（10秒）内请求数达到该值才会计算失败率
+	RequestVolume int
+	// 失败率阈值，百分比
+	ErrorPercent int
+	// 熔断后经过多久放行探测请求
+	SleepWindow time.Duration
+	// 重试次数不超过请求数的该比例
+	RetryRatio float64
+	// 每秒额外允许的重试次数，保证低流量时也能重试
+	MinRetriesPerSecond int
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Timeout:             30 * time.Second,
+		MaxConcurrent:       100,
+		RequestVolume:       20,
+		ErrorPercent:        50,
+		SleepWindow:         5 * time.Second,
+		RetryRatio:          0.2,
+		MinRetriesPerSecond: 3,
+	}
+}
+
+// 单个服务的熔断器状态
+type State struct {
+	Service string `json:"service"`
+	Open    bool   `json:"open"`
+	// 累计请求数、失败数及被熔断或并发限制拒绝的请求数
+	Requests uint64 `json:"requests"`
+	Failures uint64 `json:"failures"`
+	Rejected uint64 `json:"rejected"`
+	// 剩余的重试次数
+	RetryBudget int `json:"retryBudget"`
+}
+
+type service struct {
+	// 原子操作的计数放在结构体开头以保证64位对齐
+	requests uint64
+	failures uint64
+	rejected uint64
+	name     string
+	budget   *Budget
+}
+
+// 按服务管理熔断器
+type Breakers struct {
+	config   *Config
+	mu       sync.Mutex
+	services map[string]*service
+}
+
+func New(config *Config) *Breakers {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	return &Breakers{
+		config:   config,
+		services: make(map[string]*service),
+	}
+}
+
+// 首次使用时配置服务的熔断器
+func (b *Breakers) get(name string) *service {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s, ok := b.services[name]
+	if !ok {
+		hystrix.ConfigureCommand(name, hystrix.CommandConfig{
+			Timeout:                int(b.config.Timeout / time.Millisecond),
+			MaxConcurrentRequests:  b.config.MaxConcurrent,
+			RequestVolumeThreshold: b.config.RequestVolume,
+			ErrorPercentThreshold:  b.config.ErrorPercent,
+			SleepWindow:            int(b.config.SleepWindow / time.Millisecond),
+		})
+		s = &service{
+			name:   name,
+			budget: NewBudget(b.config.RetryRatio, b.config.MinRetriesPerSecond),
+		}
+		b.services[name] = s
+	}
+	return s
+}
+
+// 通过服务的熔断器执行调用，run返回错误时计为失败，
+// 熔断时返回ErrOpen，超过并发限制时返回ErrMaxConcurrency，超时返回ErrTimeout
+func (b *Breakers) Do(ctx context.Context, name string, run func(ctx context.Context) error) error {
+	s := b.get(name)
+	atomic.AddUint64(&s.requests, 1)
+	err := hystrix.DoC(ctx, name, run, nil)
+	if err == ErrOpen || err == ErrMaxConcurrency {
+		atomic.AddUint64(&s.rejected, 1)
+	} else if err != nil {
+		atomic.AddUint64(&s.failures, 1)
+	}
+	return err
+}
+
+// 服务的重试预算
+func (b *Breakers) Budget(name string) *Budget {
+	return b.get(name).budget
+}
+
+// 所有已使用服务的熔断器状态，按服务名排序
+func (b *Breakers) States() []*State {
+	b.mu.Lock()
+	services := make([]*service, 0, len(b.services))
+	for _, s := range b.services {
+		services = append(services, s)
+	}
+	b.mu.Unlock()
+	states := make([]*State, 0, len(services))
+	for _, s := range services {
+		state := &State{
+			Service:     s.name,
+			Requests:    atomic.LoadUint64(&s.requests),
+			Failures:    atomic.LoadUint64(&s.failures),
+			Rejected:    atomic.LoadUint64(&s.rejected),
+			RetryBudget: s.budget.Remaining(),
+		}
+		if circuit, _, err := hystrix.GetCircuit(s.name); err == nil {
+			state.Open = circuit.IsOpen()
+		}
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Service < states[j].Service
+	})
+	return states
+}
+
+// 管理接口，返回各服务的熔断器状态
+func AdminHandler(b *Breakers) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json;charset=utf-8")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"breakers": b.States(),
+		})
+	})
+}
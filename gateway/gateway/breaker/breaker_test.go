@@ -0,0 +1,76 @@
+package breaker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBudget(t *testing.T) {
+	now := time.Unix(1000, 0)
+	budget := NewBudget(0.5, 0)
+	budget.now = func() time.Time { return now }
+	if budget.Retry() {
+		t.Fatal("expected no retry without requests")
+	}
+	for i := 0; i < 4; i++ {
+		budget.Request()
+	}
+	// 4个请求最多重试2次
+	if !budget.Retry() || !budget.Retry() || budget.Retry() {
+		t.Fatal("expected 2 retries allowed")
+	}
+	// 统计窗口过后预算重新计算
+	now = now.Add(budgetWindow * time.Second)
+	budget.Request()
+	budget.Request()
+	if budget.Remaining() != 1 {
+		t.Fatalf("expected 1 retry remaining, got %d", budget.Remaining())
+	}
+
+	budget = NewBudget(0, 3)
+	budget.now = func() time.Time { return now }
+	if budget.Remaining() != 3*budgetWindow {
+		t.Fatalf("expected %d retries remaining, got %d", 3*budgetWindow, budget.Remaining())
+	}
+}
+
+func TestBreakers(t *testing.T) {
+	config := DefaultConfig()
+	config.RequestVolume = 2
+	config.SleepWindow = time.Hour
+	breakers := New(config)
+	failure := errors.New("failure")
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		err := breakers.Do(context.Background(), "breaker-test", func(ctx context.Context) error {
+			return failure
+		})
+		if err == ErrOpen {
+			break
+		}
+		if err != failure {
+			t.Fatalf("expected run error, got %v", err)
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected circuit to open")
+		}
+		// 等待hystrix异步更新统计
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	w := httptest.NewRecorder()
+	AdminHandler(breakers).ServeHTTP(w, httptest.NewRequest("GET", "/admin/breakers", nil))
+	var body struct {
+		Breakers []*State `json:"breakers"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Breakers) != 1 || !body.Breakers[0].Open || body.Breakers[0].Failures < 2 || body.Breakers[0].Rejected != 1 {
+		t.Fatalf("unexpected breaker state %+v", body.Breakers[0])
+	}
+}
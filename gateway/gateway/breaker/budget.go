@@ -0,0 +1,83 @@
+package breaker
+
+import (
+	"sync"
+	"time"
+)
+
+// 重试预算
+// 统计最近10秒内的请求数和重试数，重试数不超过请求数的 ratio 倍加上每秒 minPerSecond 次，
+// 避免上游故障时重试成倍放大流量
+
+// 统计窗口的秒数
+const budgetWindow = 10
+
+type budgetBucket struct {
+	second   int64
+	requests int
+	retries  int
+}
+
+type Budget struct {
+	ratio        float64
+	minPerSecond int
+	mu           sync.Mutex
+	buckets      [budgetWindow]budgetBucket
+	now          func() time.Time
+}
+
+func NewBudget(ratio float64, minPerSecond int) *Budget {
+	return &Budget{
+		ratio:        ratio,
+		minPerSecond: minPerSecond,
+		now:          time.Now,
+	}
+}
+
+// 记录一次请求，重试不计入
+func (b *Budget) Request() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.current(b.now()).requests++
+}
+
+// 预算充足时记录一次重试并返回true
+func (b *Budget) Retry() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	if b.remaining(now) <= 0 {
+		return false
+	}
+	b.current(now).retries++
+	return true
+}
+
+// 当前剩余的重试次数
+func (b *Budget) Remaining() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.remaining(b.now())
+}
+
+func (b *Budget) remaining(now time.Time) int {
+	var requests, retries int
+	second := now.Unix()
+	for _, bucket := range b.buckets {
+		if bucket.second > second-budgetWindow {
+			requests += bucket.requests
+			retries += bucket.retries
+		}
+	}
+	return int(b.ratio*float64(requests)) + b.minPerSecond*budgetWindow - retries
+}
+
+// 当前秒对应的桶，桶已过期时重置
+func (b *Budget) current(now time.Time) *budgetBucket {
+	second := now.Unix()
+	bucket := &b.buckets[second%budgetWindow]
+	if bucket.second != second {
+		*bucket = budgetBucket{second: second}
+	}
+	return bucket
+}
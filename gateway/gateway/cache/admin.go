@@ -0,0 +1,37 @@
+package cache
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// 缓存清除接口，DELETE /admin/cache?route=goods&path=/goods/12，
+// 不指定路径时清除路由的全部缓存，不指定路由时清除全部缓存
+func AdminHandler(store Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		routeName, path := r.URL.Query().Get("route"), r.URL.Query().Get("path")
+		prefix := "cache:"
+		if routeName != "" {
+			prefix = KeyPrefix(routeName, path)
+		} else if path != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		n, err := store.Purge(r.Context(), prefix)
+		w.Header().Set("Content-Type", "application/json;charset=utf-8")
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error": err.Error(),
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"purged": n,
+		})
+	})
+}
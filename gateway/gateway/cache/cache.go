@@ -0,0 +1,461 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/proxy"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/route"
+)
+
+// 网关响应缓存
+// 配置了缓存策略的路由按 Cache-Control、Expires 计算GET响应的缓存时间，路由的ttl优先；
+// 上游响应带有Vary时按对应请求头的值分别缓存；同一缓存键的并发未命中只有一个请求访问上游，
+// 其他请求等待结果；过期的缓存带有ETag或Last-Modified时保留一段时间，向上游发送条件请求重新验证
+
+// 标识响应是否来自缓存的响应头，取值 HIT、MISS 或 REVALIDATED
+const HeaderCache = "X-Cache"
+
+// 过期后仍保留用于重新验证的时间
+const staleTTL = 10 * time.Minute
+
+// 缓存的响应
+type Entry struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+	// 非空时为变体索引，记录上游Vary的请求头，各变体按请求头的值存放在不同的键中
+	Vary []string `json:"vary,omitempty"`
+	// 存入时间及新鲜期截止时间
+	StoredAt time.Time `json:"storedAt"`
+	Expires  time.Time `json:"expires"`
+}
+
+// 是否可以通过ETag或Last-Modified重新验证
+func (e *Entry) validatable() bool {
+	return e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+// 缓存存储
+type Store interface {
+	// 获取缓存，不存在时返回nil
+	Get(ctx context.Context, key string) (*Entry, error)
+	// 保存缓存，ttl后删除
+	Set(ctx context.Context, key string, entry *Entry, ttl time.Duration) error
+	// 删除键以prefix开头的全部缓存，返回删除的数量
+	Purge(ctx context.Context, prefix string) (int, error)
+}
+
+type cacher struct {
+	store  Store
+	logger log.Logger
+	// 超过该长度的响应不缓存
+	maxEntrySize int64
+	mu           sync.Mutex
+	// 缓存键到进行中的上游请求的映射，请求完成时关闭
+	calls map[string]chan struct{}
+	now   func() time.Time
+}
+
+// 创建缓存过滤器，需在认证、限流及灰度发布之后执行，缓存不会绕过认证和限流
+func Filter(store Store, maxEntrySize int64, logger log.Logger) proxy.Filter {
+	c := &cacher{
+		store:        store,
+		logger:       logger,
+		maxEntrySize: maxEntrySize,
+		calls:        make(map[string]chan struct{}),
+		now:          time.Now,
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			rt := proxy.RouteFromContext(req.Context())
+			if rt.Cache == nil || !cacheable(req) {
+				next.ServeHTTP(w, req)
+				return
+			}
+			c.serveHTTP(w, req, rt, next)
+		})
+	}
+}
+
+// 只缓存GET请求，长连接及要求不使用缓存的请求直接转发
+func cacheable(req *http.Request) bool {
+	if req.Method != http.MethodGet || req.Header.Get("Upgrade") != "" ||
+		strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
+		return false
+	}
+	_, noStore := parseCacheControl(req.Header.Get("Cache-Control"))["no-store"]
+	return !noStore
+}
+
+func (c *cacher) serveHTTP(w http.ResponseWriter, req *http.Request, rt *route.Route, next http.Handler) {
+	ctx := req.Context()
+	key := Key(req, rt)
+	// 客户端要求不使用缓存时仍可用旧缓存重新验证，并更新缓存
+	_, noCache := parseCacheControl(req.Header.Get("Cache-Control"))["no-cache"]
+	noCache = noCache || req.Header.Get("Pragma") == "no-cache"
+	entry := c.lookup(ctx, key, req)
+	if entry != nil && !noCache && c.now().Before(entry.Expires) {
+		c.serve(w, req, entry, "HIT")
+		return
+	}
+	done, leader := c.acquire(key)
+	if !leader {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			proxy.Error(w, req, http.StatusGatewayTimeout, "upstream "+rt.Service+" timeout")
+			return
+		}
+		entry = c.lookup(ctx, key, req)
+		if entry != nil && c.now().Before(entry.Expires) {
+			c.serve(w, req, entry, "HIT")
+			return
+		}
+		// 响应不可缓存，单独访问上游
+		c.fetch(w, req, rt, key, entry, next)
+		return
+	}
+	defer c.release(key, done)
+	c.fetch(w, req, rt, key, entry, next)
+}
+
+// 获取缓存键上的进行中请求，没有时当前请求成为执行者
+func (c *cacher) acquire(key string) (chan struct{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if done, ok := c.calls[key]; ok {
+		return done, false
+	}
+	done := make(chan struct{})
+	c.calls[key] = done
+	return done, true
+}
+
+func (c *cacher) release(key string, done chan struct{}) {
+	c.mu.Lock()
+	delete(c.calls, key)
+	c.mu.Unlock()
+	close(done)
+}
+
+// 访问上游，响应同时写给客户端和缓存；有旧缓存时发送条件请求，上游返回304时使用旧缓存
+func (c *cacher) fetch(w http.ResponseWriter, req *http.Request, rt *route.Route, key string, stale *Entry, next http.Handler) {
+	out := req
+	revalidate := stale != nil && stale.validatable() &&
+		req.Header.Get("If-None-Match") == "" && req.Header.Get("If-Modified-Since") == ""
+	if revalidate {
+		out = req.Clone(req.Context())
+		if etag := stale.Header.Get("ETag"); etag != "" {
+			out.Header.Set("If-None-Match", etag)
+		}
+		if lastModified := stale.Header.Get("Last-Modified"); lastModified != "" {
+			out.Header.Set("If-Modified-Since", lastModified)
+		}
+	}
+	rec := &recorder{w: w, header: make(http.Header), intercept: revalidate, limit: c.maxEntrySize}
+	next.ServeHTTP(rec, out)
+	if rec.notModified {
+		// 以304响应的缓存头更新旧缓存
+		refreshed := *stale
+		refreshed.Header = stale.Header.Clone()
+		for _, k := range []string{"Cache-Control", "Expires", "Date", "ETag", "Last-Modified"} {
+			if v := rec.header.Get(k); v != "" {
+				refreshed.Header.Set(k, v)
+			}
+		}
+		if c.save(req, rt, key, &refreshed) {
+			c.serve(w, req, &refreshed, "REVALIDATED")
+		} else {
+			// 上游不再允许缓存，旧缓存已确认未变化，仍可返回给当前请求
+			c.serve(w, req, stale, "REVALIDATED")
+		}
+		return
+	}
+	if !rec.wroteHeader || rec.overflow {
+		return
+	}
+	c.save(req, rt, key, &Entry{
+		Status: rec.status,
+		Header: rec.header,
+		Body:   rec.body.Bytes(),
+	})
+}
+
+// 按缓存策略保存响应，返回是否保存
+func (c *cacher) save(req *http.Request, rt *route.Route, key string, entry *Entry) bool {
+	ttl, ok := freshness(req, rt, entry.Status, entry.Header, c.now())
+	if !ok {
+		return false
+	}
+	vary := varyHeaders(entry.Header)
+	for _, name := range vary {
+		if name == "*" {
+			return false
+		}
+	}
+	now := c.now()
+	entry.StoredAt = now
+	entry.Expires = now.Add(ttl)
+	keep := ttl
+	if entry.validatable() {
+		keep += staleTTL
+	}
+	ctx := req.Context()
+	if len(vary) > 0 {
+		index := &Entry{Vary: vary, StoredAt: now, Expires: entry.Expires}
+		if err := c.store.Set(ctx, key, index, keep); err != nil {
+			c.logger.Log("route", rt.Name, "cache", key, "err", err)
+			return false
+		}
+		key = variantKey(key, vary, req)
+	}
+	if err := c.store.Set(ctx, key, entry, keep); err != nil {
+		c.logger.Log("route", rt.Name, "cache", key, "err", err)
+		return false
+	}
+	return true
+}
+
+// 查找请求对应的缓存，上游响应带有Vary时按请求头查找变体
+func (c *cacher) lookup(ctx context.Context, key string, req *http.Request) *Entry {
+	entry, err := c.store.Get(ctx, key)
+	if err == nil && entry != nil && len(entry.Vary) > 0 {
+		entry, err = c.store.Get(ctx, variantKey(key, entry.Vary, req))
+	}
+	if err != nil {
+		c.logger.Log("cache", key, "err", err)
+		return nil
+	}
+	return entry
+}
+
+// 返回缓存的响应，满足客户端的条件请求时返回304
+func (c *cacher) serve(w http.ResponseWriter, req *http.Request, entry *Entry, status string) {
+	h := w.Header()
+	for k, v := range entry.Header {
+		h[k] = append(h[k], v...)
+	}
+	h.Set("Age", strconv.Itoa(int(c.now().Sub(entry.StoredAt)/time.Second)))
+	h.Set(HeaderCache, status)
+	if notModified(req, entry) {
+		h.Del("Content-Length")
+		h.Del("Content-Type")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(entry.Status)
+	w.Write(entry.Body)
+}
+
+// 缓存键，按路由、路径、Host、查询参数及灰度子集区分，路径在前便于按路径清除
+func Key(req *http.Request, rt *route.Route) string {
+	key := KeyPrefix(rt.Name, req.URL.EscapedPath()) + req.Host + " " + req.URL.RawQuery
+	if subset := proxy.SubsetFromContext(req.Context()); subset != nil {
+		key += " subset=" + subset.Name
+	}
+	return key
+}
+
+// 路由或路由下指定路径的缓存键前缀，path为空时为路由的全部缓存
+func KeyPrefix(routeName, path string) string {
+	prefix := "cache:" + routeName + ":"
+	if path != "" {
+		prefix += path + " "
+	}
+	return prefix
+}
+
+func variantKey(key string, vary []string, req *http.Request) string {
+	var b strings.Builder
+	b.WriteString(key)
+	b.WriteString(" vary")
+	for _, name := range vary {
+		b.WriteString(" " + name + "=" + strings.Join(req.Header.Values(name), ","))
+	}
+	return b.String()
+}
+
+func varyHeaders(header http.Header) []string {
+	var names []string
+	for _, v := range header.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// 响应可缓存的状态码
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+// 计算响应的缓存时间，不可缓存时返回false
+func freshness(req *http.Request, rt *route.Route, status int, header http.Header, now time.Time) (time.Duration, bool) {
+	if !cacheableStatus[status] || header.Get("Set-Cookie") != "" {
+		return 0, false
+	}
+	cc := parseCacheControl(header.Get("Cache-Control"))
+	if _, ok := cc["no-store"]; ok {
+		return 0, false
+	}
+	if _, ok := cc["private"]; ok {
+		return 0, false
+	}
+	if _, ok := cc["no-cache"]; ok {
+		return 0, false
+	}
+	// 共享缓存只能保存明确允许共享的认证请求响应，缓存键不区分用户，路由ttl也不能放宽这一限制
+	_, public := cc["public"]
+	sMaxAge, shared := cc["s-maxage"]
+	if req.Header.Get("Authorization") != "" && !public && !shared {
+		return 0, false
+	}
+	if rt.Cache.TTL > 0 {
+		return time.Duration(rt.Cache.TTL), true
+	}
+	var ttl time.Duration
+	if shared {
+		ttl = seconds(sMaxAge)
+	} else if maxAge, ok := cc["max-age"]; ok {
+		ttl = seconds(maxAge)
+	} else if expires, err := http.ParseTime(header.Get("Expires")); err == nil {
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = now
+		}
+		ttl = expires.Sub(date)
+	}
+	if age, err := strconv.Atoi(header.Get("Age")); err == nil {
+		ttl -= time.Duration(age) * time.Second
+	}
+	return ttl, ttl > 0
+}
+
+func seconds(s string) time.Duration {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(n) * time.Second
+}
+
+// 解析Cache-Control，指令名转换为小写
+func parseCacheControl(value string) map[string]string {
+	directives := make(map[string]string)
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, arg := part, ""
+		if i := strings.Index(part, "="); i >= 0 {
+			name, arg = part[:i], strings.Trim(part[i+1:], `"`)
+		}
+		directives[strings.ToLower(name)] = arg
+	}
+	return directives
+}
+
+// 客户端的条件请求是否与缓存匹配
+func notModified(req *http.Request, entry *Entry) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(entry.Header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(entry.Header.Get("Last-Modified"))
+	return err == nil && !lastModified.After(since)
+}
+
+// 将上游响应同时写给客户端和缓存
+type recorder struct {
+	w           http.ResponseWriter
+	header      http.Header
+	status      int
+	wroteHeader bool
+	// 重新验证时拦截上游的304响应，不写给客户端
+	intercept   bool
+	notModified bool
+	body        bytes.Buffer
+	limit       int64
+	// 响应超过缓存长度限制
+	overflow bool
+}
+
+func (r *recorder) Header() http.Header {
+	return r.header
+}
+
+func (r *recorder) WriteHeader(status int) {
+	if r.wroteHeader {
+		return
+	}
+	r.wroteHeader = true
+	r.status = status
+	if r.intercept && status == http.StatusNotModified {
+		r.notModified = true
+		return
+	}
+	h := r.w.Header()
+	for k, v := range r.header {
+		h[k] = append(h[k], v...)
+	}
+	h.Set(HeaderCache, "MISS")
+	r.w.WriteHeader(status)
+}
+
+func (r *recorder) Write(p []byte) (int, error) {
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+	if r.notModified {
+		return len(p), nil
+	}
+	if !r.overflow {
+		if int64(r.body.Len()+len(p)) > r.limit {
+			r.overflow = true
+			r.body = bytes.Buffer{}
+		} else {
+			r.body.Write(p)
+		}
+	}
+	return r.w.Write(p)
+}
+
+func (r *recorder) Flush() {
+	if r.notModified {
+		return
+	}
+	if flusher, ok := r.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
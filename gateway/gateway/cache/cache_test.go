@@ -0,0 +1,327 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gomodule/redigo/redis"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/proxy"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/route"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/upstream"
+)
+
+// 所有服务都解析到测试上游
+type staticResolver struct {
+	instance *upstream.Instance
+}
+
+func (s staticResolver) Instances(ctx context.Context, serviceName string) ([]*upstream.Instance, error) {
+	return []*upstream.Instance{s.instance}, nil
+}
+
+func TestFilter(t *testing.T) {
+	var mu sync.Mutex
+	hits := make(map[string]int)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.URL.Path]++
+		n := hits[r.URL.Path]
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/goods/1":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("ETag", `"v1"`)
+		case "/goods/slow":
+			time.Sleep(100 * time.Millisecond)
+			w.Header().Set("Cache-Control", "max-age=60")
+		case "/goods/private":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		case "/goods/public":
+			w.Header().Set("Cache-Control", "public, max-age=60")
+		case "/goods/vary":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "Accept-Language")
+			w.Write([]byte(r.Header.Get("Accept-Language")))
+			return
+		case "/goods/etag":
+			w.Header().Set("Cache-Control", "max-age=1")
+			w.Header().Set("ETag", `"e"`)
+			if r.Header.Get("If-None-Match") == `"e"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/ttl/user":
+			w.Write([]byte(r.Header.Get("Authorization")))
+			return
+		case "/ttl/public":
+			w.Header().Set("Cache-Control", "public")
+		case "/goods/large":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Write([]byte(strings.Repeat("x", 2048)))
+			return
+		}
+		w.Write([]byte(r.URL.Path + " " + strconv.Itoa(n)))
+	}))
+	defer backend.Close()
+	u, _ := url.Parse(backend.URL)
+	port, _ := strconv.Atoi(u.Port())
+	resolver := staticResolver{&upstream.Instance{ID: "backend", Address: u.Hostname(), Port: port}}
+
+	config, err := route.Parse([]byte(`
+routes:
+  - {name: ttl, service: goods, match: {pathPrefix: /ttl}, cache: {ttl: 1m}}
+  - {name: goods, service: goods, match: {pathPrefix: /goods}, cache: {}}
+  - {name: plain, service: goods, match: {pathPrefix: /}}
+`), "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := route.NewStore()
+	routes.Update(config, "test")
+	store := NewMemoryStore(1 << 20)
+	handler := proxy.NewHandler(routes, resolver, log.NewNopLogger())
+	handler.Use(Filter(store, 1024, log.NewNopLogger()))
+
+	get := func(path string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	expect := func(path string, header map[string]string, status int, cache, body string) {
+		t.Helper()
+		rec := get(path, header)
+		if rec.Code != status || rec.Header().Get(HeaderCache) != cache || body != "" && rec.Body.String() != body {
+			t.Fatalf("%s %v: unexpected response %d %s %q", path, header, rec.Code, rec.Header().Get(HeaderCache), rec.Body)
+		}
+	}
+
+	t.Run("cache control", func(t *testing.T) {
+		expect("/goods/1", nil, http.StatusOK, "MISS", "/goods/1 1")
+		expect("/goods/1", nil, http.StatusOK, "HIT", "/goods/1 1")
+		expect("/goods/1?page=2", nil, http.StatusOK, "MISS", "/goods/1 2")
+		// 客户端的条件请求由缓存直接响应
+		expect("/goods/1", map[string]string{"If-None-Match": `"v1"`}, http.StatusNotModified, "HIT", "")
+		// 客户端要求不使用缓存时重新请求上游
+		expect("/goods/1", map[string]string{"Cache-Control": "no-cache"}, http.StatusOK, "MISS", "/goods/1 3")
+		expect("/goods/1", nil, http.StatusOK, "HIT", "/goods/1 3")
+		// 上游未声明缓存时间，按路由ttl缓存
+		expect("/ttl", nil, http.StatusOK, "MISS", "/ttl 1")
+		expect("/ttl", nil, http.StatusOK, "HIT", "/ttl 1")
+		// 不可缓存的响应
+		expect("/goods/private", nil, http.StatusOK, "MISS", "/goods/private 1")
+		expect("/goods/private", nil, http.StatusOK, "MISS", "/goods/private 2")
+		expect("/goods/large", nil, http.StatusOK, "MISS", "")
+		expect("/goods/large", nil, http.StatusOK, "MISS", "")
+		expect("/other", nil, http.StatusOK, "", "/other 1")
+		expect("/other", nil, http.StatusOK, "", "/other 2")
+		// 携带令牌的请求只缓存明确允许共享的响应
+		auth := map[string]string{"Authorization": "Bearer token"}
+		expect("/goods/auth", auth, http.StatusOK, "MISS", "/goods/auth 1")
+		expect("/goods/auth", auth, http.StatusOK, "MISS", "/goods/auth 2")
+		expect("/goods/public", auth, http.StatusOK, "MISS", "/goods/public 1")
+		expect("/goods/public", auth, http.StatusOK, "HIT", "/goods/public 1")
+		// 路由ttl不会把一个用户的响应返回给其他用户
+		alice := map[string]string{"Authorization": "Bearer alice"}
+		bob := map[string]string{"Authorization": "Bearer bob"}
+		expect("/ttl/user", alice, http.StatusOK, "MISS", "Bearer alice")
+		expect("/ttl/user", bob, http.StatusOK, "MISS", "Bearer bob")
+		expect("/ttl/user", alice, http.StatusOK, "MISS", "Bearer alice")
+		expect("/ttl/public", alice, http.StatusOK, "MISS", "/ttl/public 1")
+		expect("/ttl/public", bob, http.StatusOK, "HIT", "/ttl/public 1")
+	})
+
+	t.Run("vary", func(t *testing.T) {
+		zh := map[string]string{"Accept-Language": "zh"}
+		en := map[string]string{"Accept-Language": "en"}
+		expect("/goods/vary", zh, http.StatusOK, "MISS", "zh")
+		expect("/goods/vary", en, http.StatusOK, "MISS", "en")
+		expect("/goods/vary", zh, http.StatusOK, "HIT", "zh")
+		expect("/goods/vary", en, http.StatusOK, "HIT", "en")
+	})
+
+	t.Run("coalescing", func(t *testing.T) {
+		var wg sync.WaitGroup
+		var served int32
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if rec := get("/goods/slow", nil); rec.Body.String() == "/goods/slow 1" {
+					atomic.AddInt32(&served, 1)
+				}
+			}()
+		}
+		wg.Wait()
+		mu.Lock()
+		n := hits["/goods/slow"]
+		mu.Unlock()
+		if n != 1 || served != 10 {
+			t.Fatalf("expected one upstream request for concurrent misses, got %d, served %d", n, served)
+		}
+	})
+
+	t.Run("revalidate", func(t *testing.T) {
+		expect("/goods/etag", nil, http.StatusOK, "MISS", "/goods/etag 1")
+		time.Sleep(1100 * time.Millisecond)
+		// 过期后上游返回304，继续使用旧缓存
+		expect("/goods/etag", nil, http.StatusOK, "REVALIDATED", "/goods/etag 1")
+		expect("/goods/etag", nil, http.StatusOK, "HIT", "/goods/etag 1")
+		mu.Lock()
+		n := hits["/goods/etag"]
+		mu.Unlock()
+		if n != 2 {
+			t.Fatalf("expected 2 upstream requests, got %d", n)
+		}
+	})
+
+	t.Run("purge", func(t *testing.T) {
+		admin := AdminHandler(store)
+		purge := func(query string) int {
+			rec := httptest.NewRecorder()
+			admin.ServeHTTP(rec, httptest.NewRequest("DELETE", "/admin/cache?"+query, nil))
+			var result struct {
+				Purged int `json:"purged"`
+			}
+			if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+				t.Fatal(err)
+			}
+			return result.Purged
+		}
+		// /goods/1 及其带查询参数的缓存
+		if n := purge("route=goods&path=/goods/1"); n != 2 {
+			t.Fatalf("expected 2 entries purged, got %d", n)
+		}
+		expect("/goods/1", nil, http.StatusOK, "MISS", "/goods/1 4")
+		expect("/goods/vary", map[string]string{"Accept-Language": "zh"}, http.StatusOK, "HIT", "zh")
+		if n := purge("route=goods"); n == 0 {
+			t.Fatal("expected route entries purged")
+		}
+		expect("/goods/vary", map[string]string{"Accept-Language": "zh"}, http.StatusOK, "MISS", "zh")
+		expect("/ttl", nil, http.StatusOK, "HIT", "/ttl 1")
+	})
+}
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore(100)
+	now := time.Unix(1600000000, 0)
+	s.now = func() time.Time { return now }
+	entry := func(size int) *Entry {
+		return &Entry{Status: http.StatusOK, Body: make([]byte, size)}
+	}
+	s.Set(ctx, "a", entry(40), time.Minute)
+	s.Set(ctx, "b", entry(40), time.Minute)
+	// 访问a后，b成为最久未访问的缓存
+	if e, _ := s.Get(ctx, "a"); e == nil {
+		t.Fatal("expected a cached")
+	}
+	s.Set(ctx, "c", entry(40), time.Second)
+	if e, _ := s.Get(ctx, "b"); e != nil {
+		t.Fatal("expected b evicted")
+	}
+	if e, _ := s.Get(ctx, "a"); e == nil {
+		t.Fatal("expected a kept")
+	}
+	// 超过总大小的缓存不保存
+	s.Set(ctx, "d", entry(200), time.Minute)
+	if e, _ := s.Get(ctx, "d"); e != nil {
+		t.Fatal("expected oversized entry skipped")
+	}
+	now = now.Add(2 * time.Second)
+	if e, _ := s.Get(ctx, "c"); e != nil {
+		t.Fatal("expected c expired")
+	}
+}
+
+// 支持GET、SET、SCAN、DEL的redis连接
+type fakeRedis struct {
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+type fakeConn struct {
+	redis *fakeRedis
+}
+
+func (c fakeConn) Close() error { return nil }
+func (c fakeConn) Err() error   { return nil }
+func (c fakeConn) Send(commandName string, args ...interface{}) error {
+	return errors.New("not supported")
+}
+func (c fakeConn) Flush() error                  { return nil }
+func (c fakeConn) Receive() (interface{}, error) { return nil, errors.New("not supported") }
+
+func (c fakeConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	c.redis.mu.Lock()
+	defer c.redis.mu.Unlock()
+	switch commandName {
+	case "GET":
+		if v, ok := c.redis.data[args[0].(string)]; ok {
+			return v, nil
+		}
+		return nil, nil
+	case "SET":
+		if args[2] != "PX" || args[3].(int64) <= 0 {
+			return nil, errors.New("expected expire time")
+		}
+		c.redis.data[args[0].(string)] = args[1].([]byte)
+		return "OK", nil
+	case "SCAN":
+		// 一次返回全部匹配的键
+		prefix := strings.NewReplacer(`\*`, "*", `\?`, "?").Replace(strings.TrimSuffix(args[2].(string), "*"))
+		var keys []interface{}
+		for k := range c.redis.data {
+			if strings.HasPrefix(k, prefix) {
+				keys = append(keys, []byte(k))
+			}
+		}
+		return []interface{}{[]byte("0"), keys}, nil
+	case "DEL":
+		for _, k := range args {
+			delete(c.redis.data, string(k.([]byte)))
+		}
+		return int64(len(args)), nil
+	}
+	return nil, errors.New("unexpected command " + commandName)
+}
+
+func TestRedisStore(t *testing.T) {
+	ctx := context.Background()
+	fake := &fakeRedis{data: make(map[string][]byte)}
+	s := NewRedisStore(&redis.Pool{Dial: func() (redis.Conn, error) {
+		return fakeConn{fake}, nil
+	}})
+	if e, err := s.Get(ctx, "cache:goods:/goods/1 "); e != nil || err != nil {
+		t.Fatalf("expected miss, got %v %v", e, err)
+	}
+	header := http.Header{"Etag": {`"v1"`}}
+	if err := s.Set(ctx, "cache:goods:/goods/1 gw ", &Entry{Status: http.StatusOK, Header: header, Body: []byte("goods")}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	s.Set(ctx, "cache:goods:/goods/2 gw ", &Entry{Status: http.StatusOK}, time.Minute)
+	e, err := s.Get(ctx, "cache:goods:/goods/1 gw ")
+	if err != nil || e.Status != http.StatusOK || string(e.Body) != "goods" || e.Header.Get("ETag") != `"v1"` {
+		t.Fatalf("unexpected entry %+v %v", e, err)
+	}
+	if n, err := s.Purge(ctx, KeyPrefix("goods", "/goods/1")); n != 1 || err != nil {
+		t.Fatalf("expected 1 entry purged, got %d %v", n, err)
+	}
+	if e, _ := s.Get(ctx, "cache:goods:/goods/2 gw "); e == nil {
+		t.Fatal("expected other entries kept")
+	}
+}
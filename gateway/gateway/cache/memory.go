@@ -0,0 +1,104 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 本地LRU缓存，总大小超过限制时淘汰最久未访问的缓存
+type MemoryStore struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	ll       *list.List
+	items    map[string]*list.Element
+	now      func() time.Time
+}
+
+type item struct {
+	key       string
+	entry     *Entry
+	size      int64
+	expiresAt time.Time
+}
+
+// 创建本地缓存，maxBytes为响应体及响应头的总大小上限
+func NewMemoryStore(maxBytes int64) *MemoryStore {
+	return &MemoryStore{
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+		now:      time.Now,
+	}
+}
+
+func (s *MemoryStore) Get(ctx context.Context, key string) (*Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.items[key]
+	if !ok {
+		return nil, nil
+	}
+	it := e.Value.(*item)
+	if !s.now().Before(it.expiresAt) {
+		s.remove(e)
+		return nil, nil
+	}
+	s.ll.MoveToFront(e)
+	return it.entry, nil
+}
+
+func (s *MemoryStore) Set(ctx context.Context, key string, entry *Entry, ttl time.Duration) error {
+	size := entrySize(key, entry)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.items[key]; ok {
+		s.remove(e)
+	}
+	if size > s.maxBytes {
+		return nil
+	}
+	s.items[key] = s.ll.PushFront(&item{key: key, entry: entry, size: size, expiresAt: s.now().Add(ttl)})
+	s.size += size
+	for s.size > s.maxBytes {
+		s.remove(s.ll.Back())
+	}
+	return nil
+}
+
+func (s *MemoryStore) Purge(ctx context.Context, prefix string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for key, e := range s.items {
+		if strings.HasPrefix(key, prefix) {
+			s.remove(e)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *MemoryStore) remove(e *list.Element) {
+	it := s.ll.Remove(e).(*item)
+	delete(s.items, it.key)
+	s.size -= it.size
+}
+
+// 估算缓存占用的内存
+func entrySize(key string, entry *Entry) int64 {
+	size := int64(len(key) + len(entry.Body))
+	for k, v := range entry.Header {
+		size += int64(len(k))
+		for _, s := range v {
+			size += int64(len(s))
+		}
+	}
+	for _, name := range entry.Vary {
+		size += int64(len(name))
+	}
+	return size
+}
@@ -0,0 +1,127 @@
+package canary
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/auth"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/proxy"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/route"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/upstream"
+	"github.com/yunfeiyang1916/micro-go-course/loadbalancer"
+)
+
+// 灰度发布过滤器
+// 按路由的流量拆分策略为请求选择实例子集，子集以权重作为一致性哈希环上的结点权重，
+// 同一用户（或ip、请求头、cookie）总是分配到同一子集，并转发到子集中的同一实例，调整权重时只有少量用户切换版本。
+// 测试人员可通过请求头或cookie直接指定子集；按权重分配的子集没有健康实例时，
+// 按声明顺序退化到其他有实例的子集，直接指定的子集不退化
+
+// 创建灰度发布过滤器，需在认证之后执行，按用户分配时需要认证结果
+func Filter(resolver upstream.Resolver) proxy.Filter {
+	s := &splitter{resolver: resolver, rings: make(map[string]*ring)}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			rt := proxy.RouteFromContext(req.Context())
+			if rt.Split == nil {
+				next.ServeHTTP(w, req)
+				return
+			}
+			key := HashKey(req, rt.Split)
+			subset := s.choose(req, rt, key)
+			// 子集内同样按哈希键选择实例
+			ctx := proxy.WithBalanceKey(proxy.WithSubset(req.Context(), subset), key)
+			next.ServeHTTP(w, req.WithContext(ctx))
+		})
+	}
+}
+
+// 路由的哈希环，拆分策略变化后重新生成
+type ring struct {
+	split *route.Split
+	hash  *loadbalancer.HashRing
+}
+
+type splitter struct {
+	resolver upstream.Resolver
+	mu       sync.Mutex
+	// 路由名到哈希环的映射
+	rings map[string]*ring
+}
+
+// 选择请求的实例子集
+func (s *splitter) choose(req *http.Request, rt *route.Route, key string) *route.Subset {
+	split := rt.Split
+	if subset := override(req, split); subset != nil {
+		return subset
+	}
+	subset := split.Subset(s.ring(rt.Name, split).GetNode(key))
+	instances, err := s.resolver.Instances(req.Context(), rt.Service)
+	if err != nil || len(proxy.SubsetInstances(instances, subset)) > 0 {
+		return subset
+	}
+	for _, fallback := range split.Subsets {
+		if fallback.Weight > 0 && len(proxy.SubsetInstances(instances, fallback)) > 0 {
+			return fallback
+		}
+	}
+	return subset
+}
+
+func (s *splitter) ring(name string, split *route.Split) *loadbalancer.HashRing {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.rings[name]
+	if !ok || r.split != split {
+		weights := make(map[string]int, len(split.Subsets))
+		for _, subset := range split.Subsets {
+			if subset.Weight > 0 {
+				weights[subset.Name] = subset.Weight
+			}
+		}
+		r = &ring{split: split, hash: loadbalancer.NewHashRing()}
+		r.hash.AddNodes(weights)
+		s.rings[name] = r
+	}
+	return r.hash
+}
+
+// 测试人员通过请求头或cookie指定的子集，未指定或子集不存在时返回nil
+func override(req *http.Request, split *route.Split) *route.Subset {
+	if split.OverrideHeader != "" {
+		if subset := split.Subset(req.Header.Get(split.OverrideHeader)); subset != nil {
+			return subset
+		}
+	}
+	if split.OverrideCookie != "" {
+		if cookie, err := req.Cookie(split.OverrideCookie); err == nil {
+			return split.Subset(cookie.Value)
+		}
+	}
+	return nil
+}
+
+// 计算粘性分配的哈希键，取不到时退化为ip
+func HashKey(req *http.Request, split *route.Split) string {
+	switch split.HashOn {
+	case route.HashOnUser:
+		if principal := auth.PrincipalFromContext(req.Context()); principal != nil {
+			return "user:" + strconv.FormatInt(principal.UserId, 10)
+		}
+	case route.HashOnHeader:
+		if v := req.Header.Get(split.HashName); v != "" {
+			return "header:" + v
+		}
+	case route.HashOnCookie:
+		if cookie, err := req.Cookie(split.HashName); err == nil && cookie.Value != "" {
+			return "cookie:" + cookie.Value
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return "ip:" + host
+}
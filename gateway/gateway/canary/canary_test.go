@@ -0,0 +1,153 @@
+package canary
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/proxy"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/route"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/upstream"
+)
+
+// 可修改实例列表的解析器
+type staticResolver struct {
+	mu        sync.Mutex
+	instances []*upstream.Instance
+}
+
+func (s *staticResolver) Instances(ctx context.Context, serviceName string) ([]*upstream.Instance, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.instances, nil
+}
+
+func (s *staticResolver) set(instances ...*upstream.Instance) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.instances = instances
+}
+
+// 返回版本号的上游实例
+func versionBackend(t *testing.T, version string) (*httptest.Server, *upstream.Instance) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(version))
+	}))
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := strconv.Atoi(u.Port())
+	return server, &upstream.Instance{ID: version, Address: u.Hostname(), Port: port, Meta: map[string]string{"version": version}}
+}
+
+func TestFilter(t *testing.T) {
+	v1, stable := versionBackend(t, "v1")
+	defer v1.Close()
+	v2, canary := versionBackend(t, "v2")
+	defer v2.Close()
+	resolver := &staticResolver{}
+	resolver.set(stable, canary)
+
+	config, err := route.Parse([]byte(`
+routes:
+  - name: goods
+    service: goods
+    match: {pathPrefix: /goods}
+    split:
+      hashOn: header
+      hashName: X-User
+      overrideHeader: X-Canary
+      overrideCookie: canary
+      subsets:
+        - {name: stable, weight: 80, meta: {version: v1}}
+        - {name: canary, weight: 20, meta: {version: v2}}
+`), "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := route.NewStore()
+	routes.Update(config, "test")
+	handler := proxy.NewHandler(routes, resolver, log.NewNopLogger())
+	handler.Use(Filter(resolver))
+
+	get := func(user, remoteAddr string, header http.Header) (int, string) {
+		req := httptest.NewRequest("GET", "/goods", nil)
+		if user != "" {
+			req.Header.Set("X-User", user)
+		}
+		if remoteAddr != "" {
+			req.RemoteAddr = remoteAddr
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		body, _ := ioutil.ReadAll(rec.Body)
+		return rec.Code, string(body)
+	}
+
+	// 同一用户总是分配到同一版本，整体比例接近权重
+	assigned := make(map[string]string)
+	canaryUsers := 0
+	for i := 0; i < 500; i++ {
+		user := strconv.Itoa(i)
+		_, version := get(user, "", nil)
+		for j := 0; j < 3; j++ {
+			if _, again := get(user, "10.0.0."+strconv.Itoa(j)+":1234", nil); again != version {
+				t.Fatalf("user %s moved from %s to %s", user, version, again)
+			}
+		}
+		assigned[user] = version
+		if version == "v2" {
+			canaryUsers++
+		}
+	}
+	if canaryUsers < 50 || canaryUsers > 150 {
+		t.Fatalf("expected about 20%% canary users, got %d of 500", canaryUsers)
+	}
+	// 没有哈希键时按ip分配
+	_, version := get("", "10.1.1.1:1000", nil)
+	if _, again := get("", "10.1.1.1:2000", nil); again != version {
+		t.Fatalf("ip moved from %s to %s", version, again)
+	}
+
+	// 测试人员通过请求头或cookie指定版本
+	var stableUser string
+	for user, version := range assigned {
+		if version == "v1" {
+			stableUser = user
+			break
+		}
+	}
+	if _, version := get(stableUser, "", http.Header{"X-Canary": {"canary"}}); version != "v2" {
+		t.Fatalf("expected override header to select v2, got %s", version)
+	}
+	if _, version := get(stableUser, "", http.Header{"Cookie": {"canary=canary"}}); version != "v2" {
+		t.Fatalf("expected override cookie to select v2, got %s", version)
+	}
+	if _, version := get(stableUser, "", http.Header{"X-Canary": {"unknown"}}); version != "v1" {
+		t.Fatalf("expected unknown subset to be ignored, got %s", version)
+	}
+
+	// 灰度实例下线后退化到稳定版本，直接指定时不退化
+	resolver.set(stable)
+	for user, version := range assigned {
+		if version != "v2" {
+			continue
+		}
+		if _, got := get(user, "", nil); got != "v1" {
+			t.Fatalf("expected canary user %s to fall back to v1, got %s", user, got)
+		}
+	}
+	if code, _ := get(stableUser, "", http.Header{"X-Canary": {"canary"}}); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503 for empty subset, got %d", code)
+	}
+}
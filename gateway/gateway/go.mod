@@ -3,6 +3,30 @@ module github.com/yunfeiyang1916/micro-go-course/gateway/gateway
 go 1.14
 
 require (
+	github.com/afex/hystrix-go v0.0.0-20180502004556-fa1af6a1f4f5
+	github.com/andybalholm/brotli v1.0.4
+	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/go-kit/kit v0.10.0
+	github.com/gomodule/redigo v2.0.0+incompatible
 	github.com/hashicorp/consul/api v1.8.1
+	github.com/openzipkin/zipkin-go v0.2.5
+	github.com/prometheus/client_golang v1.11.0
+	github.com/yunfeiyang1916/micro-go-course/grpc-kit v0.0.0
+	github.com/yunfeiyang1916/micro-go-course/instrument v0.0.0
+	github.com/yunfeiyang1916/micro-go-course/loadbalancer v0.0.0
+	github.com/yunfeiyang1916/micro-go-course/tracing v0.0.0
+	go.etcd.io/etcd/client/v3 v3.5.0
+	go.etcd.io/etcd/server/v3 v3.5.0
+	golang.org/x/net v0.0.0-20210405180319-a5a99cb37ef4
+	google.golang.org/grpc v1.38.0
+	google.golang.org/protobuf v1.26.0
+	gopkg.in/yaml.v2 v2.4.0
 )
+
+replace github.com/yunfeiyang1916/micro-go-course/grpc-kit => ../../grpc-kit
+
+replace github.com/yunfeiyang1916/micro-go-course/instrument => ../../instrument
+
+replace github.com/yunfeiyang1916/micro-go-course/loadbalancer => ../../loadbalancer
+
+replace github.com/yunfeiyang1916/micro-go-course/tracing => ../../tracing
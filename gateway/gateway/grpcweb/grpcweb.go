@@ -0,0 +1,140 @@
+package grpcweb
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/proxy"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/route"
+)
+
+// gRPC-Web转换
+// 浏览器无法直接发起gRPC请求，gRPC-Web请求可通过HTTP/1.1发送，响应的trailer编码在响应体的最后一帧中。
+// 过滤器把匹配gRPC路由的gRPC-Web请求转换为gRPC请求转发给上游，再把上游响应转换回gRPC-Web格式，
+// 支持 application/grpc-web[+proto] 及base64编码的 application/grpc-web-text[+proto]
+
+const (
+	contentTypeText = "application/grpc-web-text"
+	// trailer帧的标志位
+	trailerFlag = 0x80
+)
+
+// 创建gRPC-Web转换过滤器，需在其他过滤器之前执行
+func Filter() proxy.Filter {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			rt := proxy.RouteFromContext(req.Context())
+			contentType := req.Header.Get("Content-Type")
+			if rt.Protocol != route.ProtocolGRPC || !strings.HasPrefix(contentType, proxy.ContentTypeGRPCWeb) {
+				next.ServeHTTP(w, req)
+				return
+			}
+			text := strings.HasPrefix(contentType, contentTypeText)
+			out := req.Clone(req.Context())
+			// 保留 +proto 等编码后缀
+			suffix := strings.TrimPrefix(strings.TrimPrefix(contentType, contentTypeText), proxy.ContentTypeGRPCWeb)
+			out.Header.Set("Content-Type", proxy.ContentTypeGRPC+suffix)
+			out.Header.Set("Te", "trailers")
+			if text {
+				out.Body = ioutil.NopCloser(base64.NewDecoder(base64.StdEncoding, req.Body))
+				out.ContentLength = -1
+				out.Header.Del("Content-Length")
+			}
+			rw := &responseWriter{
+				w:           w,
+				header:      make(http.Header),
+				contentType: contentType,
+				text:        text,
+			}
+			next.ServeHTTP(rw, out)
+			rw.finish()
+		})
+	}
+}
+
+// 将gRPC响应转换为gRPC-Web响应
+type responseWriter struct {
+	w           http.ResponseWriter
+	header      http.Header
+	contentType string
+	text        bool
+	wroteHeader bool
+}
+
+func (r *responseWriter) Header() http.Header {
+	return r.header
+}
+
+func (r *responseWriter) WriteHeader(status int) {
+	if r.wroteHeader {
+		return
+	}
+	r.wroteHeader = true
+	h := r.w.Header()
+	for k, v := range r.header {
+		// trailer写入响应体，不作为HTTP trailer发送
+		if k == "Trailer" || strings.HasPrefix(k, http.TrailerPrefix) {
+			continue
+		}
+		h[k] = v
+	}
+	h.Set("Content-Type", r.contentType)
+	h.Del("Content-Length")
+	r.w.WriteHeader(status)
+}
+
+func (r *responseWriter) Write(p []byte) (int, error) {
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+	if r.text {
+		if _, err := io.WriteString(r.w, base64.StdEncoding.EncodeToString(p)); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	return r.w.Write(p)
+}
+
+func (r *responseWriter) Flush() {
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+	if flusher, ok := r.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// 将上游返回的trailer作为最后一帧写入响应体
+func (r *responseWriter) finish() {
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+	trailer := proxy.Trailers(r.header)
+	// Trailers-Only响应的状态已在响应头中
+	if len(trailer) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(trailer))
+	for k := range trailer {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var body strings.Builder
+	for _, k := range keys {
+		for _, v := range trailer[k] {
+			body.WriteString(strings.ToLower(k) + ": " + v + "\r\n")
+		}
+	}
+	frame := make([]byte, 5, 5+body.Len())
+	frame[0] = trailerFlag
+	binary.BigEndian.PutUint32(frame[1:], uint32(body.Len()))
+	frame = append(frame, body.String()...)
+	r.Write(frame)
+	r.Flush()
+}
@@ -0,0 +1,118 @@
+package grpcweb
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/proxy"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/route"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/upstream"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// 所有服务都解析到测试上游
+type staticResolver struct {
+	instance *upstream.Instance
+}
+
+func (s staticResolver) Instances(ctx context.Context, serviceName string) ([]*upstream.Instance, error) {
+	return []*upstream.Instance{s.instance}, nil
+}
+
+// 长度前缀的消息帧
+func frame(flag byte, data string) []byte {
+	b := make([]byte, 5, 5+len(data))
+	b[0] = flag
+	binary.BigEndian.PutUint32(b[1:], uint32(len(data)))
+	return append(b, data...)
+}
+
+func newTestHandler(t *testing.T) *proxy.Handler {
+	// 模拟gRPC上游：原样返回请求中的消息帧，状态放在trailer中
+	backend := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/grpc+proto" || r.Header.Get("Te") != "trailers" {
+			w.Header().Set("Grpc-Status", "3")
+			w.Header().Set("Grpc-Message", "unexpected request "+r.Header.Get("Content-Type"))
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if len(body) == 0 {
+			// Trailers-Only响应
+			w.Header().Set("Grpc-Status", "5")
+			return
+		}
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.Write(body)
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set("Grpc-Message", "ok")
+	}), &http2.Server{}))
+	t.Cleanup(backend.Close)
+
+	config, err := route.Parse([]byte(`
+routes:
+  - {name: grpc, service: backend, match: {grpcService: pb.UserService}}
+`), "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := route.NewStore()
+	routes.Update(config, "test")
+	u, _ := url.Parse(backend.URL)
+	port, _ := strconv.Atoi(u.Port())
+	handler := proxy.NewHandler(routes, staticResolver{&upstream.Instance{ID: "backend", Address: u.Hostname(), Port: port}}, log.NewNopLogger())
+	handler.Use(Filter())
+	return handler
+}
+
+func TestFilter(t *testing.T) {
+	handler := newTestHandler(t)
+	message := frame(0, "hello")
+	trailer := frame(trailerFlag, "grpc-message: ok\r\ngrpc-status: 0\r\n")
+	cases := []struct {
+		contentType string
+		body        []byte
+		expected    []byte
+	}{
+		{"application/grpc-web+proto", message, append(append([]byte{}, message...), trailer...)},
+		// 文本模式的请求和响应都经过base64编码
+		{"application/grpc-web-text+proto", []byte(base64.StdEncoding.EncodeToString(message)),
+			[]byte(base64.StdEncoding.EncodeToString(message) + base64.StdEncoding.EncodeToString(trailer))},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("POST", "/pb.UserService/CheckPassword", bytes.NewReader(c.body))
+		req.Header.Set("Content-Type", c.contentType)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != c.contentType {
+			t.Fatalf("%s: unexpected response %d %v", c.contentType, rec.Code, rec.Header())
+		}
+		if rec.Header().Get("Trailer") != "" || rec.Header().Get("Grpc-Status") != "" {
+			t.Fatalf("%s: expected status in trailer frame, got header %v", c.contentType, rec.Header())
+		}
+		if !bytes.Equal(rec.Body.Bytes(), c.expected) {
+			t.Fatalf("%s: expected body %q, got %q", c.contentType, c.expected, rec.Body.Bytes())
+		}
+	}
+}
+
+func TestFilterTrailersOnly(t *testing.T) {
+	handler := newTestHandler(t)
+	req := httptest.NewRequest("POST", "/pb.UserService/CheckPassword", nil)
+	req.Header.Set("Content-Type", "application/grpc-web+proto")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	// 状态已在响应头中，不再追加trailer帧
+	if rec.Header().Get("Grpc-Status") != "5" || rec.Body.Len() != 0 {
+		t.Fatalf("expected trailers-only response, got %v %q", rec.Header(), rec.Body.Bytes())
+	}
+}
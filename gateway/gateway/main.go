@@ -3,25 +3,101 @@ package main
 import (
 	"flag"
 	"fmt"
-	"math/rand"
 	"net/http"
-	"net/http/httputil"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
 
 	"github.com/go-kit/kit/log"
-	"github.com/hashicorp/consul/api"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/server"
+	// 注册UserService的proto描述，供REST转gRPC使用
+	_ "github.com/yunfeiyang1916/micro-go-course/grpc-kit/pb"
 )
 
+// 网关，追踪、日志、监控指标、请求响应转换、gRPC-Web转换、认证、限流、灰度发布、响应缓存、REST转gRPC中间件通过 -middlewares 启用
 func main() {
+	config := server.DefaultConfig()
 	// 创建环境变量
 	var (
-		consulHost = flag.String("consul.host", "127.0.0.1", "consul server ip address")
-		consulPort = flag.String("consul.port", "8500", "consul server port")
+		listenAddr    = flag.String("listen.addr", config.ListenAddr, "gateway listen address")
+		idleTimeout   = flag.Duration("idle.timeout", config.IdleTimeout, "idle timeout of client connections")
+		enableH2C     = flag.Bool("h2c", config.H2C, "accept HTTP/2 cleartext clients, required by grpc clients")
+		consulHost    = flag.String("consul.host", "127.0.0.1", "consul server ip address")
+		consulPort    = flag.String("consul.port", "8500", "consul server port")
+		routeFile     = flag.String("route.file", config.RouteFile, "route config file, yaml or json")
+		etcdEndpoints = flag.String("route.etcd.endpoints", "", "comma separated etcd endpoints, load routes from etcd instead of file if set")
+		etcdKey       = flag.String("route.etcd.key", config.EtcdKey, "etcd key of route config")
+		adminAddr     = flag.String("admin.addr", config.AdminAddr, "admin server address, disabled if empty")
+		middlewares   = flag.String("middlewares", strings.Join(config.Middlewares, ","), "comma separated middlewares to enable: tracing, logging, metrics, transform, grpcweb, auth, ratelimit, canary, cache, transcode")
+		exporter      = flag.String("tracing.exporter", config.Tracing.Exporter, "tracing exporter: zipkin, otlp or none")
+		zipkinURL     = flag.String("zipkin.url", config.Tracing.ZipkinURL, "Zipkin server url")
+		otlpURL       = flag.String("otlp.url", config.Tracing.OTLPURL, "OTLP/HTTP traces endpoint of OpenTelemetry Collector")
+		sampleRate    = flag.Float64("tracing.sample.rate", config.Tracing.SampleRate, "ratio of new traces to sample, between 0 and 1")
+		serviceName   = flag.String("tracing.service", config.Tracing.ServiceName, "service name reported to tracing backend")
+		jwtSecret     = flag.String("auth.jwt.secret", "", "verify jwt tokens locally with the oauth signing key if set")
+		checkTokenURL = flag.String("auth.checktoken.url", config.Auth.CheckTokenURL, "oauth check_token endpoint")
+		clientId      = flag.String("auth.client.id", config.Auth.ClientId, "oauth client id of the gateway")
+		clientSecret  = flag.String("auth.client.secret", config.Auth.ClientSecret, "oauth client secret of the gateway")
+		authCacheTTL  = flag.Duration("auth.cache.ttl", config.Auth.CacheTTL, "cache time of check_token results")
+		redisAddr     = flag.String("ratelimit.redis.addr", "", "redis address shared by gateway instances for rate limiting, use local limiter if empty")
+		redisPassword = flag.String("ratelimit.redis.password", "", "redis password")
+		cacheRedis    = flag.String("cache.redis.addr", "", "redis address shared by gateway instances for response caching, use local cache if empty")
+		cachePassword = flag.String("cache.redis.password", "", "redis password of response cache")
+		cacheMaxBytes = flag.Int64("cache.max.bytes", config.Cache.MaxBytes, "max total size of local response cache")
+		cacheMaxEntry = flag.Int64("cache.max.entry", config.Cache.MaxEntrySize, "max body size of a cached response")
+		breakerVolume = flag.Int("breaker.volume", config.Breaker.RequestVolume, "minimum requests in 10s before a service circuit can open")
+		breakerErrors = flag.Int("breaker.error.percent", config.Breaker.ErrorPercent, "error percent of a service that opens the circuit")
+		breakerSleep  = flag.Duration("breaker.sleep", config.Breaker.SleepWindow, "time to wait before probing an open circuit")
+		maxConcurrent = flag.Int("breaker.max.concurrent", config.Breaker.MaxConcurrent, "max concurrent requests per service")
+		retryRatio    = flag.Float64("retry.budget.ratio", config.Breaker.RetryRatio, "max ratio of retries to requests per service")
+		minRetries    = flag.Int("retry.budget.min", config.Breaker.MinRetriesPerSecond, "retries per second allowed per service regardless of ratio")
 	)
 	flag.Parse()
+	config.ListenAddr = *listenAddr
+	config.IdleTimeout = *idleTimeout
+	config.H2C = *enableH2C
+	config.AdminAddr = *adminAddr
+	config.ConsulAddr = *consulHost + ":" + *consulPort
+	config.RouteFile = *routeFile
+	if *etcdEndpoints != "" {
+		config.EtcdEndpoints = strings.Split(*etcdEndpoints, ",")
+	}
+	config.EtcdKey = *etcdKey
+	config.Middlewares = nil
+	for _, m := range strings.Split(*middlewares, ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			config.Middlewares = append(config.Middlewares, m)
+		}
+	}
+	config.Tracing = server.TracingConfig{
+		Exporter:    *exporter,
+		ZipkinURL:   *zipkinURL,
+		OTLPURL:     *otlpURL,
+		ServiceName: *serviceName,
+		SampleRate:  *sampleRate,
+	}
+	config.Auth = server.AuthConfig{
+		JWTSecret:     *jwtSecret,
+		CheckTokenURL: *checkTokenURL,
+		ClientId:      *clientId,
+		ClientSecret:  *clientSecret,
+		CacheTTL:      *authCacheTTL,
+	}
+	config.RateLimit = server.RateLimitConfig{RedisAddr: *redisAddr, RedisPassword: *redisPassword}
+	config.Cache = server.CacheConfig{
+		RedisAddr:     *cacheRedis,
+		RedisPassword: *cachePassword,
+		MaxBytes:      *cacheMaxBytes,
+		MaxEntrySize:  *cacheMaxEntry,
+	}
+	config.Breaker.RequestVolume = *breakerVolume
+	config.Breaker.ErrorPercent = *breakerErrors
+	config.Breaker.SleepWindow = *breakerSleep
+	config.Breaker.MaxConcurrent = *maxConcurrent
+	config.Breaker.RetryRatio = *retryRatio
+	config.Breaker.MinRetriesPerSecond = *minRetries
+
 	//创建日志组件
 	var logger log.Logger
 	{
@@ -30,63 +106,31 @@ func main() {
 		logger = log.With(logger, "caller", log.DefaultCaller)
 	}
 
-	// 创建consul api客户端
-	consulConfig := api.DefaultConfig()
-	consulConfig.Address = "http://" + *consulHost + ":" + *consulPort
-	consulClient, err := api.NewClient(consulConfig)
+	gateway, err := server.New(config, logger)
 	if err != nil {
 		logger.Log("err", err)
 		os.Exit(1)
 	}
-	// 创建反向代理
-	proxy := NewReverseProxy(consulClient, logger)
+	defer gateway.Close()
 
 	errc := make(chan error)
 	go func() {
-		c := make(chan os.Signal)
+		c := make(chan os.Signal, 1)
 		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
 		errc <- fmt.Errorf("%s", <-c)
 	}()
+	// 管理接口只在内网地址监听
+	if config.AdminAddr != "" {
+		go func() {
+			logger.Log("transport", "HTTP", "admin", config.AdminAddr)
+			errc <- http.ListenAndServe(config.AdminAddr, gateway.AdminHandler())
+		}()
+	}
 	// 开始监听
 	go func() {
-		logger.Log("transport", "HTTP", "addr", "10086")
-		errc <- http.ListenAndServe(":10086", proxy)
+		logger.Log("transport", "HTTP", "addr", config.ListenAddr)
+		errc <- gateway.HTTPServer().ListenAndServe()
 	}()
 	// 开始运行，等待结束
 	logger.Log("exit", <-errc)
 }
-
-// 创建反向代理
-func NewReverseProxy(client *api.Client, logger log.Logger) *httputil.ReverseProxy {
-	// 创建主动处理程序
-	director := func(req *http.Request) {
-		// 查询原始请求路径
-		reqPath := req.URL.Path
-		if reqPath == "" {
-			return
-		}
-		// 按照分隔符'/'对路径进行分解，获取服务名称serviceName
-		pathArray := strings.Split(reqPath, "/")
-		serviceName := pathArray[1]
-		// 调用consul api查询serviceName的服务实例列表
-		result, _, err := client.Catalog().Service(serviceName, "", nil)
-		if err != nil {
-			logger.Log("ReverseProxy failed", "query service instance error", err.Error())
-			return
-		}
-		if len(result) == 0 {
-			logger.Log("ReverseProxy failed", "no such service instance", serviceName)
-			return
-		}
-		// 重新组织请求路径，去掉服务名称不符
-		destPath := strings.Join(pathArray[2:], "/")
-		// 随机选择一个服务实例
-		tgt := result[rand.Int()%len(result)]
-		logger.Log("service id", tgt.ServiceID)
-		// 设置代理服务地址信息
-		req.URL.Scheme = "http"
-		req.URL.Host = fmt.Sprintf("%s:%d", tgt.ServiceAddress, tgt.ServicePort)
-		req.URL.Path = "/" + destPath
-	}
-	return &httputil.ReverseProxy{Director: director}
-}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/upstream"
+	"github.com/yunfeiyang1916/micro-go-course/loadbalancer"
+)
+
+type balanceKey struct{}
+
+// 指定选择实例使用的哈希key，同一key的请求转发到同一实例
+func WithBalanceKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, balanceKey{}, key)
+}
+
+// 从请求上下文中获取选择实例使用的哈希key
+func BalanceKeyFromContext(ctx context.Context) string {
+	key, _ := ctx.Value(balanceKey{}).(string)
+	return key
+}
+
+// 上游实例选择，有哈希key时使用一致性哈希，否则使用权重平滑轮询
+type balancer struct {
+	lb     loadbalancer.LoadBalancer
+	hashLb loadbalancer.LoadBalancer
+	// 以服务名、实例ID为键的权重平滑负载均衡当前权重
+	curWeights map[string]map[string]int
+	mu         sync.Mutex
+}
+
+func newBalancer() *balancer {
+	return &balancer{
+		lb:         &loadbalancer.WeightRoundRobinLoadBalancer{},
+		hashLb:     &loadbalancer.HashLoadBalancer{},
+		curWeights: make(map[string]map[string]int),
+	}
+}
+
+// 从未尝试过的实例中选择一个，都已尝试过时从全部实例中选择
+func (b *balancer) pick(service string, instances []*upstream.Instance, tried map[string]bool, key string) *upstream.Instance {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	lbInstances := make([]*loadbalancer.InstanceInfo, 0, len(instances))
+	byId := make(map[string]*upstream.Instance, len(instances))
+	for _, instance := range instances {
+		byId[instance.ID] = instance
+		if !tried[instance.ID] {
+			lbInstances = append(lbInstances, b.instanceInfo(service, instance))
+		}
+	}
+	if len(lbInstances) == 0 {
+		for _, instance := range instances {
+			lbInstances = append(lbInstances, b.instanceInfo(service, instance))
+		}
+	}
+	var selected *loadbalancer.InstanceInfo
+	if key != "" {
+		selected, _ = b.hashLb.SelectServiceByKey(lbInstances, key)
+	} else {
+		selected, _ = b.lb.SelectService(lbInstances)
+		// 未参与本次选择的实例保留原权重，已下线的实例不再占用内存
+		curWeights := make(map[string]int, len(instances))
+		for _, instance := range instances {
+			if weight, ok := b.curWeights[service][instance.ID]; ok {
+				curWeights[instance.ID] = weight
+			}
+		}
+		for _, info := range lbInstances {
+			curWeights[info.Address] = info.CurWeight
+		}
+		b.curWeights[service] = curWeights
+	}
+	if selected == nil {
+		return instances[0]
+	}
+	return byId[selected.Address]
+}
+
+// 以实例ID作为负载均衡器中的实例地址，未设置权重时按1计算
+func (b *balancer) instanceInfo(service string, instance *upstream.Instance) *loadbalancer.InstanceInfo {
+	weight := instance.Weight
+	if weight <= 0 {
+		weight = 1
+	}
+	return &loadbalancer.InstanceInfo{
+		CurWeight: b.curWeights[service][instance.ID],
+		Weight:    weight,
+		Address:   instance.ID,
+		Tags:      instance.Tags,
+		Meta:      instance.Meta,
+	}
+}
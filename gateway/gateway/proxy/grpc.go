@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// gRPC请求的错误响应
+// gRPC客户端无法解析JSON错误，网关自身产生的错误以 Trailers-Only 形式返回，
+// 即HTTP 200加 grpc-status、grpc-message 响应头
+
+const (
+	ContentTypeGRPC    = "application/grpc"
+	ContentTypeGRPCWeb = "application/grpc-web"
+)
+
+// 是否为gRPC或gRPC-Web请求
+func IsGRPC(req *http.Request) bool {
+	return strings.HasPrefix(req.Header.Get("Content-Type"), ContentTypeGRPC)
+}
+
+// 网关错误的HTTP状态码对应的gRPC状态码
+func GRPCStatus(httpStatus int) codes.Code {
+	switch httpStatus {
+	case http.StatusBadRequest:
+		return codes.Internal
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.Unimplemented
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return codes.Unavailable
+	case http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	}
+	return codes.Unknown
+}
+
+// gRPC状态码对应的HTTP状态码，与grpc-gateway的映射一致
+func HTTPStatus(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		// 客户端关闭请求
+		return 499
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// 按请求类型输出错误，gRPC及gRPC-Web请求返回gRPC状态，其他请求返回JSON
+func Error(w http.ResponseWriter, req *http.Request, statusCode int, msg string) {
+	if !IsGRPC(req) {
+		WriteError(w, statusCode, msg)
+		return
+	}
+	contentType := req.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, ContentTypeGRPCWeb) {
+		contentType = ContentTypeGRPC
+	}
+	st := status.New(GRPCStatus(statusCode), msg)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Grpc-Status", strconv.Itoa(int(st.Code())))
+	w.Header().Set("Grpc-Message", EncodeGRPCMessage(st.Message()))
+	w.WriteHeader(http.StatusOK)
+}
+
+// 按gRPC协议对grpc-message进行百分号编码
+func EncodeGRPCMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c >= ' ' && c <= '~' && c != '%' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// 解码百分号编码的grpc-message
+func DecodeGRPCMessage(msg string) string {
+	decoded, err := url.PathUnescape(msg)
+	if err != nil {
+		return msg
+	}
+	return decoded
+}
+
+// 收集反向代理写入响应头的trailer，包括预先声明的和以 http.TrailerPrefix 为前缀的
+func Trailers(header http.Header) http.Header {
+	trailer := make(http.Header)
+	for _, keys := range header["Trailer"] {
+		for _, k := range strings.Split(keys, ",") {
+			k = http.CanonicalHeaderKey(strings.TrimSpace(k))
+			if v, ok := header[k]; ok {
+				trailer[k] = v
+			}
+		}
+	}
+	for k, v := range header {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			trailer[http.CanonicalHeaderKey(strings.TrimPrefix(k, http.TrailerPrefix))] = v
+		}
+	}
+	return trailer
+}
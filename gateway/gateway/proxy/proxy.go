@@ -0,0 +1,429 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/breaker"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/route"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/upstream"
+)
+
+// 网关反向代理
+// 根据路由表匹配请求，从本地缓存的健康实例中选择一个转发，
+// 未匹配路由返回404，没有可用实例或熔断时返回503，上游出错返回502，超时返回504。
+// 请求上下文中指定了实例子集时只转发到子集中的实例；
+// 实例按权重平滑轮询选择，请求上下文中指定了哈希key时按一致性哈希选择；
+// 配置了熔断器时每次转发都经过上游服务的熔断器，上游返回5xx计为失败；
+// 路由配置了重试时，幂等且不带请求体的请求在连接失败、单次超时或返回502/503/504时
+// 换一个未尝试过的实例重试，重试次数受服务的重试预算限制
+
+// 请求体超过路由限制，返回413
+var ErrBodyTooLarge = errors.New("request body too large")
+
+type routeKey struct{}
+
+type instanceKey struct{}
+
+type subsetKey struct{}
+
+// 从请求上下文中获取匹配的路由
+func RouteFromContext(ctx context.Context) *route.Route {
+	r, _ := ctx.Value(routeKey{}).(*route.Route)
+	return r
+}
+
+// 从请求上下文中获取选中的上游实例
+func InstanceFromContext(ctx context.Context) *upstream.Instance {
+	i, _ := ctx.Value(instanceKey{}).(*upstream.Instance)
+	return i
+}
+
+// 指定请求转发到的实例子集
+func WithSubset(ctx context.Context, subset *route.Subset) context.Context {
+	return context.WithValue(ctx, subsetKey{}, subset)
+}
+
+// 从请求上下文中获取指定的实例子集
+func SubsetFromContext(ctx context.Context) *route.Subset {
+	s, _ := ctx.Value(subsetKey{}).(*route.Subset)
+	return s
+}
+
+// 路由匹配后、转发前执行的过滤器，可从请求上下文中获取匹配的路由
+type Filter func(next http.Handler) http.Handler
+
+// 转发前修改上游请求，在路径重写之后执行，可从请求上下文中获取匹配的路由
+type Director func(req *http.Request)
+
+// 返回前修改上游响应，resp.Request 为上游请求
+type ResponseModifier func(resp *http.Response) error
+
+// 网关处理器
+type Handler struct {
+	routes   *route.Store
+	resolver upstream.Resolver
+	proxy    *httputil.ReverseProxy
+	// 按上游协议发送请求的transport
+	transports map[string]http.RoundTripper
+	breakers   *breaker.Breakers
+	logger     log.Logger
+	filters    []Filter
+	directors  []Director
+	modifiers  []ResponseModifier
+	// 过滤器链及转发处理器
+	next http.Handler
+	// 路由名到当前并发请求数的映射
+	conns sync.Map
+	// 上游实例选择
+	balancer *balancer
+}
+
+// 创建网关处理器
+func NewHandler(routes *route.Store, resolver upstream.Resolver, logger log.Logger) *Handler {
+	h := &Handler{
+		routes:   routes,
+		resolver: resolver,
+		transports: map[string]http.RoundTripper{
+			route.ProtocolHTTP: http.DefaultTransport,
+		},
+		logger:   logger,
+		balancer: newBalancer(),
+	}
+	// gRPC基于明文HTTP/2，两者共用连接
+	h2c := NewH2CTransport()
+	h.transports[route.ProtocolH2C] = h2c
+	h.transports[route.ProtocolGRPC] = h2c
+	h.proxy = &httputil.ReverseProxy{
+		Director:       h.director,
+		Transport:      roundTripperFunc(h.roundTrip),
+		ModifyResponse: h.modifyResponse,
+		ErrorHandler:   h.errorHandler,
+	}
+	h.next = h.proxy
+	return h
+}
+
+// 设置上游服务熔断器，未设置时不熔断，重试也不受预算限制
+func (h *Handler) SetBreakers(breakers *breaker.Breakers) {
+	h.breakers = breakers
+}
+
+// 设置上游协议使用的transport，如带追踪的transport，
+// 默认http使用http.DefaultTransport，h2c和grpc使用NewH2CTransport
+func (h *Handler) SetTransport(protocol string, transport http.RoundTripper) {
+	h.transports[protocol] = transport
+}
+
+// 添加过滤器，按添加顺序执行
+func (h *Handler) Use(filters ...Filter) {
+	next := http.Handler(h.proxy)
+	h.filters = append(h.filters, filters...)
+	for i := len(h.filters) - 1; i >= 0; i-- {
+		next = h.filters[i](next)
+	}
+	h.next = next
+}
+
+// 添加修改上游请求的函数，按添加顺序执行
+func (h *Handler) UseDirector(directors ...Director) {
+	h.directors = append(h.directors, directors...)
+}
+
+// 添加修改上游响应的函数，按添加顺序执行，返回错误时按上游出错处理
+func (h *Handler) UseResponseModifier(modifiers ...ResponseModifier) {
+	h.modifiers = append(h.modifiers, modifiers...)
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	rt := h.routes.Match(req)
+	if rt == nil {
+		Error(w, req, http.StatusNotFound, "no route matches "+req.Method+" "+req.URL.Path)
+		return
+	}
+	if rt.MaxConnections > 0 {
+		conns := h.connections(rt.Name)
+		if atomic.AddInt64(conns, 1) > int64(rt.MaxConnections) {
+			atomic.AddInt64(conns, -1)
+			Error(w, req, http.StatusServiceUnavailable, "too many connections on route "+rt.Name)
+			return
+		}
+		defer atomic.AddInt64(conns, -1)
+	}
+	ctx := context.WithValue(req.Context(), routeKey{}, rt)
+	// 长连接不受路由超时限制，由空闲超时控制
+	if rt.Timeout > 0 && !isStreaming(req) {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(rt.Timeout))
+		defer cancel()
+	}
+	h.next.ServeHTTP(w, req.WithContext(ctx))
+}
+
+// 设置代理服务地址信息，实例在transport中选择
+func (h *Handler) director(req *http.Request) {
+	rt := RouteFromContext(req.Context())
+	req.URL.Scheme = "http"
+	req.URL.Host = rt.Service
+	req.URL.Path = rt.RewritePath(req.URL.Path)
+	req.URL.RawPath = ""
+	for _, d := range h.directors {
+		d(req)
+	}
+}
+
+func (h *Handler) modifyResponse(resp *http.Response) error {
+	for _, m := range h.modifiers {
+		if err := m(resp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// 没有可用实例或熔断器拒绝请求，返回503
+type unavailableError struct {
+	err error
+}
+
+func (e *unavailableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *unavailableError) Unwrap() error {
+	return e.err
+}
+
+// 上游返回5xx，计为熔断器失败，响应仍返回给客户端
+type statusError struct {
+	code int
+}
+
+func (e *statusError) Error() string {
+	return "upstream status " + strconv.Itoa(e.code)
+}
+
+// 选择实例转发，失败时按路由的重试策略换实例重试
+func (h *Handler) roundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	rt := RouteFromContext(ctx)
+	retries := 0
+	if rt.Retry != nil && retryable(req) {
+		retries = rt.Retry.Attempts
+	}
+	if h.breakers != nil {
+		h.breakers.Budget(rt.Service).Request()
+	}
+	tried := make(map[string]bool)
+	for attempt := 0; ; attempt++ {
+		instances, err := h.resolver.Instances(ctx, rt.Service)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, &unavailableError{err}
+		}
+		if subset := SubsetFromContext(ctx); subset != nil {
+			instances = SubsetInstances(instances, subset)
+		}
+		instances = upstream.ProtocolInstances(instances, upstreamProtocol(rt))
+		if len(instances) == 0 {
+			return nil, &unavailableError{upstream.ErrNoInstance}
+		}
+		instance := h.balancer.pick(rt.Service, instances, tried, BalanceKeyFromContext(ctx))
+		tried[instance.ID] = true
+		resp, err := h.try(req, rt, instance)
+		if attempt >= retries || len(tried) >= len(instances) || !shouldRetry(ctx, resp, err) || !h.allowRetry(rt.Service) {
+			return resp, err
+		}
+		if resp != nil {
+			err = &statusError{resp.StatusCode}
+			resp.Body.Close()
+		}
+		h.logger.Log("route", rt.Name, "service id", instance.ID, "retry", attempt+1, "err", err)
+	}
+}
+
+// 向指定实例发送一次请求
+func (h *Handler) try(req *http.Request, rt *route.Route, instance *upstream.Instance) (*http.Response, error) {
+	ctx, cancel := req.Context(), context.CancelFunc(func() {})
+	streaming := isStreaming(req)
+	if rt.Retry != nil && rt.Retry.PerTryTimeout > 0 && !streaming {
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(rt.Retry.PerTryTimeout))
+	}
+	out := req.Clone(context.WithValue(ctx, instanceKey{}, instance))
+	out.URL.Host = instance.Host()
+	resp, err := h.call(out, rt)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// 读取完响应体后再取消单次超时
+	body := &upstreamBody{ReadCloser: resp.Body, cancel: cancel}
+	if streaming && rt.IdleTimeout > 0 {
+		body.timeout = time.Duration(rt.IdleTimeout)
+		body.idle = time.AfterFunc(body.timeout, func() {
+			body.Close()
+		})
+	}
+	resp.Body = body
+	return resp, nil
+}
+
+// 经过熔断器发送请求
+func (h *Handler) call(req *http.Request, rt *route.Route) (*http.Response, error) {
+	transport := h.transports[rt.Protocol]
+	if transport == nil {
+		transport = h.transports[route.ProtocolHTTP]
+	}
+	if h.breakers == nil {
+		return transport.RoundTrip(req)
+	}
+	// 熔断器超时或请求取消时不等待调用结束，取消上游请求，之后返回的响应直接关闭
+	var (
+		mu        sync.Mutex
+		done      bool
+		abandoned bool
+		resp      *http.Response
+	)
+	ctx, cancel := context.WithCancel(req.Context())
+	err := h.breakers.Do(ctx, rt.Service, func(ctx context.Context) error {
+		r, err := transport.RoundTrip(req.WithContext(ctx))
+		mu.Lock()
+		defer mu.Unlock()
+		if abandoned {
+			if r != nil {
+				r.Body.Close()
+			}
+		} else {
+			resp, done = r, true
+		}
+		if err != nil {
+			return err
+		}
+		if r.StatusCode >= http.StatusInternalServerError {
+			return &statusError{r.StatusCode}
+		}
+		return nil
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if !done {
+		abandoned = true
+	}
+	var statusErr *statusError
+	switch {
+	case err == nil || errors.As(err, &statusErr):
+		// 读取完响应体后再取消上游请求
+		resp.Body = &upstreamBody{ReadCloser: resp.Body, cancel: cancel}
+		return resp, nil
+	case err == breaker.ErrOpen || err == breaker.ErrMaxConcurrency:
+		cancel()
+		return nil, &unavailableError{err}
+	}
+	if resp != nil {
+		resp.Body.Close()
+	}
+	cancel()
+	return nil, err
+}
+
+func (h *Handler) allowRetry(service string) bool {
+	return h.breakers == nil || h.breakers.Budget(service).Retry()
+}
+
+// 只重试幂等且不带请求体的请求，请求体已被读取无法重放
+func retryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete, http.MethodTrace:
+		return req.Body == nil || req.Body == http.NoBody
+	}
+	return false
+}
+
+// 连接失败、单次尝试超时及上游返回502/503/504时重试，路由超时或客户端取消后不再重试
+func shouldRetry(ctx context.Context, resp *http.Response, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		// 熔断针对整个服务，换实例重试没有意义
+		var unavailable *unavailableError
+		return !errors.As(err, &unavailable)
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// 过滤出属于子集的实例
+func SubsetInstances(instances []*upstream.Instance, subset *route.Subset) []*upstream.Instance {
+	result := make([]*upstream.Instance, 0, len(instances))
+	for _, instance := range instances {
+		if subset.Matches(instance.Tags, instance.Meta) {
+			result = append(result, instance)
+		}
+	}
+	return result
+}
+
+// 路由转发使用的服务描述协议，h2c与http共用http端口
+func upstreamProtocol(rt *route.Route) string {
+	if rt.Protocol == route.ProtocolGRPC {
+		return route.ProtocolGRPC
+	}
+	return route.ProtocolHTTP
+}
+
+// 上游请求失败时返回502，超时返回504，不可用返回503，请求体过大返回413
+func (h *Handler) errorHandler(w http.ResponseWriter, req *http.Request, err error) {
+	rt := RouteFromContext(req.Context())
+	h.logger.Log("route", rt.Name, "service", rt.Service, "err", err)
+	var unavailable *unavailableError
+	switch {
+	case errors.As(err, &unavailable) && unavailable.err == breaker.ErrOpen:
+		Error(w, req, http.StatusServiceUnavailable, "circuit open for service "+rt.Service)
+	case errors.As(err, &unavailable):
+		Error(w, req, http.StatusServiceUnavailable, "service "+rt.Service+" unavailable: "+unavailable.err.Error())
+	case errors.Is(err, ErrBodyTooLarge):
+		Error(w, req, http.StatusRequestEntityTooLarge, err.Error())
+	case isTimeout(err):
+		Error(w, req, http.StatusGatewayTimeout, "upstream "+rt.Service+" timeout")
+	default:
+		Error(w, req, http.StatusBadGateway, "upstream "+rt.Service+" error")
+	}
+}
+
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || err == breaker.ErrTimeout {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// 输出JSON格式的错误
+func WriteError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": msg,
+	})
+}
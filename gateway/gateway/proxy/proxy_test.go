@@ -0,0 +1,302 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/breaker"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/route"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/upstream"
+)
+
+// 固定实例列表的解析器
+type staticResolver map[string][]*upstream.Instance
+
+func (s staticResolver) Instances(ctx context.Context, serviceName string) ([]*upstream.Instance, error) {
+	instances := s[serviceName]
+	if len(instances) == 0 {
+		return nil, upstream.ErrNoInstance
+	}
+	return instances, nil
+}
+
+func instanceOf(t *testing.T, rawurl string) *upstream.Instance {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := strconv.Atoi(u.Port())
+	return &upstream.Instance{ID: u.Host, Address: u.Hostname(), Port: port}
+}
+
+func TestHandler(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer backend.Close()
+	// 已关闭端口上的实例
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	closedAddr := "http://" + listener.Addr().String()
+	listener.Close()
+
+	config, err := route.Parse([]byte(`
+routes:
+  - {name: user, service: user, match: {pathPrefix: /user}, rewrite: {prefix: /}, timeout: 100ms}
+  - {name: down, service: down, match: {pathPrefix: /down}}
+  - {name: none, service: none, match: {pathPrefix: /none}}
+`), "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := route.NewStore()
+	routes.Update(config, "test")
+	resolver := staticResolver{
+		"user": {instanceOf(t, backend.URL)},
+		"down": {instanceOf(t, closedAddr)},
+	}
+	server := httptest.NewServer(NewHandler(routes, resolver, log.NewNopLogger()))
+	defer server.Close()
+
+	cases := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/user/login", http.StatusOK, "/login"},
+		{"/unknown", http.StatusNotFound, ""},
+		{"/none/a", http.StatusServiceUnavailable, ""},
+		{"/down/a", http.StatusBadGateway, ""},
+		{"/user/slow", http.StatusGatewayTimeout, ""},
+	}
+	for _, c := range cases {
+		resp, err := http.Get(server.URL + c.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != c.status {
+			t.Fatalf("%s: expected status %d, got %d", c.path, c.status, resp.StatusCode)
+		}
+		if c.status == http.StatusOK {
+			var body [64]byte
+			n, _ := resp.Body.Read(body[:])
+			if string(body[:n]) != c.body {
+				t.Fatalf("%s: expected body %s, got %s", c.path, c.body, body[:n])
+			}
+		} else {
+			var e map[string]string
+			if err = json.NewDecoder(resp.Body).Decode(&e); err != nil || e["error"] == "" {
+				t.Fatalf("%s: expected json error, got %v %v", c.path, e, err)
+			}
+		}
+		resp.Body.Close()
+	}
+}
+
+func TestRetry(t *testing.T) {
+	var failed, slow int32
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&failed, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	slowBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&slow, 1)
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slowBackend.Close()
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer ok.Close()
+
+	config, err := route.Parse([]byte(`
+routes:
+  - {name: retry, service: retry, match: {pathPrefix: /retry}, retry: {attempts: 1}}
+  - {name: once, service: retry, match: {pathPrefix: /once}}
+  - {name: slow, service: slow, match: {pathPrefix: /slow}, retry: {attempts: 2, perTryTimeout: 50ms}}
+`), "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := route.NewStore()
+	routes.Update(config, "test")
+	resolver := staticResolver{
+		"retry": {instanceOf(t, failing.URL), instanceOf(t, ok.URL)},
+		"slow":  {instanceOf(t, slowBackend.URL), instanceOf(t, ok.URL)},
+	}
+	handler := NewHandler(routes, resolver, log.NewNopLogger())
+	handler.SetBreakers(breaker.New(nil))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	status := func(method, path string) int {
+		req, _ := http.NewRequest(method, server.URL+path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	// 幂等请求失败后换实例重试
+	for i := 0; i < 10; i++ {
+		if s := status(http.MethodGet, "/retry"); s != http.StatusOK {
+			t.Fatalf("expected retried request to succeed, got %d", s)
+		}
+		if s := status(http.MethodGet, "/slow"); s != http.StatusOK {
+			t.Fatalf("expected request to be retried after per try timeout, got %d", s)
+		}
+	}
+	if atomic.LoadInt32(&failed) == 0 || atomic.LoadInt32(&slow) == 0 {
+		t.Fatal("expected failing instances to be tried")
+	}
+	// 非幂等请求及未配置重试的路由不重试
+	unavailable := 0
+	for i := 0; i < 20; i++ {
+		if status(http.MethodPost, "/retry") == http.StatusServiceUnavailable {
+			unavailable++
+		}
+		if status(http.MethodGet, "/once") == http.StatusServiceUnavailable {
+			unavailable++
+		}
+	}
+	if unavailable == 0 {
+		t.Fatal("expected requests without retry to fail")
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer backend.Close()
+	config, err := route.Parse([]byte(`
+routes:
+  - {name: broken, service: proxy-test-broken, match: {pathPrefix: /broken}}
+`), "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := route.NewStore()
+	routes.Update(config, "test")
+	resolver := staticResolver{"proxy-test-broken": {instanceOf(t, backend.URL)}}
+	breakerConfig := breaker.DefaultConfig()
+	breakerConfig.RequestVolume = 3
+	breakerConfig.SleepWindow = time.Hour
+	breakers := breaker.New(breakerConfig)
+	handler := NewHandler(routes, resolver, log.NewNopLogger())
+	handler.SetBreakers(breakers)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	// 失败率超过阈值后熔断，返回503
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		resp, err := http.Get(server.URL + "/broken")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			break
+		}
+		if resp.StatusCode != http.StatusInternalServerError {
+			t.Fatalf("expected upstream status 500, got %d", resp.StatusCode)
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected circuit to open")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	states := breakers.States()
+	if len(states) != 1 || !states[0].Open || states[0].Rejected == 0 {
+		t.Fatalf("unexpected breaker state %+v", states)
+	}
+}
+
+func TestBreakerTimeout(t *testing.T) {
+	canceled := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			close(canceled)
+		case <-time.After(2 * time.Second):
+		}
+	}))
+	defer backend.Close()
+	config, err := route.Parse([]byte(`
+routes:
+  - {name: slow, service: proxy-test-slow, match: {pathPrefix: /slow}}
+`), "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := route.NewStore()
+	routes.Update(config, "test")
+	resolver := staticResolver{"proxy-test-slow": {instanceOf(t, backend.URL)}}
+	breakerConfig := breaker.DefaultConfig()
+	breakerConfig.Timeout = 50 * time.Millisecond
+	handler := NewHandler(routes, resolver, log.NewNopLogger())
+	handler.SetBreakers(breaker.New(breakerConfig))
+	// 熔断器超时后取消仍在进行的上游请求，不依赖客户端请求结束
+	req := httptest.NewRequest("GET", backend.URL+"/slow", nil).WithContext(context.Background())
+	req.RequestURI = ""
+	if _, err := handler.call(req, config.Routes[0]); err != breaker.ErrTimeout {
+		t.Fatalf("expected breaker timeout, got %v", err)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("expected upstream request canceled")
+	}
+}
+
+func TestBalancer(t *testing.T) {
+	b := newBalancer()
+	instances := []*upstream.Instance{{ID: "a", Weight: 3}, {ID: "b", Weight: 1}, {ID: "c"}}
+	// 按权重平滑轮询，未设置权重按1计算
+	counts := make(map[string]int)
+	for i := 0; i < 50; i++ {
+		counts[b.pick("svc", instances, nil, "").ID]++
+	}
+	if counts["a"] != 30 || counts["b"] != 10 || counts["c"] != 10 {
+		t.Fatalf("unexpected distribution %v", counts)
+	}
+	// 重试时跳过已尝试过的实例
+	tried := map[string]bool{"a": true, "b": true}
+	if instance := b.pick("svc", instances, tried, ""); instance.ID != "c" {
+		t.Fatalf("expected untried instance c, got %s", instance.ID)
+	}
+	tried["c"] = true
+	if instance := b.pick("svc", instances, tried, ""); instance == nil {
+		t.Fatal("expected instance when all tried")
+	}
+	// 下线实例的当前权重被清理
+	b.pick("svc", instances[:1], nil, "")
+	if weights := b.curWeights["svc"]; len(weights) != 1 {
+		t.Fatalf("expected weights of removed instances dropped, got %v", weights)
+	}
+
+	// 同一key总是选择同一实例，排除已尝试的实例后选择其他实例
+	first := b.pick("svc", instances, nil, "user:1")
+	for i := 0; i < 10; i++ {
+		if instance := b.pick("svc", instances, nil, "user:1"); instance != first {
+			t.Fatalf("expected sticky instance %s, got %s", first.ID, instance.ID)
+		}
+	}
+	if instance := b.pick("svc", instances, map[string]bool{first.ID: true}, "user:1"); instance == first {
+		t.Fatalf("expected instance other than tried %s", first.ID)
+	}
+}
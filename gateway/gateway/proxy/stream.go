@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// 长连接及HTTP/2上游
+// WebSocket等协议升级由ReverseProxy接管连接后双向转发，SSE响应逐条刷新给客户端，
+// 长连接不受路由超时和单次超时限制，配置了空闲超时时双向都没有数据超过该时间后断开
+
+var errNotWritable = errors.New("upstream body is not writable")
+
+// WebSocket等协议升级请求及SSE请求为长连接
+func isStreaming(req *http.Request) bool {
+	if req.Header.Get("Upgrade") != "" {
+		return true
+	}
+	return strings.Contains(req.Header.Get("Accept"), "text/event-stream")
+}
+
+// 明文HTTP/2 transport，用于h2c上游
+func NewH2CTransport() http.RoundTripper {
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}
+}
+
+// 上游响应体，关闭时取消单次超时，长连接空闲超时后自动关闭
+type upstreamBody struct {
+	io.ReadCloser
+	cancel    context.CancelFunc
+	timeout   time.Duration
+	idle      *time.Timer
+	closeOnce sync.Once
+}
+
+func (b *upstreamBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.touch()
+	return n, err
+}
+
+// 协议升级后的响应体是与上游的连接，ReverseProxy通过它转发客户端数据
+func (b *upstreamBody) Write(p []byte) (int, error) {
+	w, ok := b.ReadCloser.(io.Writer)
+	if !ok {
+		return 0, errNotWritable
+	}
+	n, err := w.Write(p)
+	b.touch()
+	return n, err
+}
+
+func (b *upstreamBody) Close() error {
+	var err error
+	b.closeOnce.Do(func() {
+		if b.idle != nil {
+			b.idle.Stop()
+		}
+		err = b.ReadCloser.Close()
+		b.cancel()
+	})
+	return err
+}
+
+// 有数据时重新计算空闲时间
+func (b *upstreamBody) touch() {
+	if b.idle != nil {
+		b.idle.Reset(b.timeout)
+	}
+}
+
+// 路由当前的并发请求数
+func (h *Handler) connections(name string) *int64 {
+	conns, _ := h.conns.LoadOrStore(name, new(int64))
+	return conns.(*int64)
+}
@@ -0,0 +1,73 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// 本地令牌桶限流器，桶容量为limit，每 period/limit 补充一个令牌
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	period time.Duration
+}
+
+type LocalLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	// 上次清理空闲桶的时间
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func NewLocalLimiter() *LocalLimiter {
+	return &LocalLimiter{
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+func (l *LocalLimiter) Allow(ctx context.Context, key string, limit int, period time.Duration) (*Result, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sweep(now)
+	interval := period / time.Duration(limit)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit), last: now, period: period}
+		l.buckets[key] = b
+	}
+	// 按经过的时间补充令牌
+	b.tokens += float64(now.Sub(b.last)) / float64(interval)
+	if b.tokens > float64(limit) {
+		b.tokens = float64(limit)
+	}
+	b.last = now
+	result := &Result{Limit: limit}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = time.Duration((1 - b.tokens) * float64(interval))
+	}
+	result.Remaining = int(b.tokens)
+	result.ResetAfter = time.Duration((float64(limit) - b.tokens) * float64(interval))
+	return result, nil
+}
+
+// 定期清理空闲超过一个周期的桶，这些桶已经补满，删除后与新建等价，
+// 避免按ip或用户限流时桶的数量无限增长
+func (l *LocalLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= b.period {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/auth"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/proxy"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/route"
+)
+
+// 网关限流过滤器
+// 按路由的限流策略计算限流键，超过限制时返回429，并通过响应头告知客户端限额和重试时间。
+// 单实例网关使用本地令牌桶，多实例网关使用基于redis的滑动窗口共享限额
+
+// 限流响应头
+const (
+	HeaderLimit     = "X-RateLimit-Limit"
+	HeaderRemaining = "X-RateLimit-Remaining"
+	HeaderReset     = "X-RateLimit-Reset"
+)
+
+// 限流结果
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// 被拒绝时距离可以重试的时间
+	RetryAfter time.Duration
+	// 距离限额完全恢复的时间
+	ResetAfter time.Duration
+}
+
+// 限流器
+type Limiter interface {
+	// 消耗一个请求额度
+	Allow(ctx context.Context, key string, limit int, period time.Duration) (*Result, error)
+}
+
+// 创建限流过滤器，限流器出错时放行请求
+func Filter(limiter Limiter, logger log.Logger) proxy.Filter {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			rt := proxy.RouteFromContext(req.Context())
+			policy := rt.RateLimit
+			if policy == nil {
+				next.ServeHTTP(w, req)
+				return
+			}
+			key := Key(req, rt)
+			result, err := limiter.Allow(req.Context(), key, policy.Limit, time.Duration(policy.Period))
+			if err != nil {
+				logger.Log("ratelimit", key, "err", err)
+				next.ServeHTTP(w, req)
+				return
+			}
+			w.Header().Set(HeaderLimit, strconv.Itoa(result.Limit))
+			w.Header().Set(HeaderRemaining, strconv.Itoa(result.Remaining))
+			w.Header().Set(HeaderReset, strconv.Itoa(seconds(result.ResetAfter)))
+			if !result.Allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(seconds(result.RetryAfter)))
+				proxy.Error(w, req, http.StatusTooManyRequests, "rate limit exceeded")
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// 计算限流键，client和user维度在请求未认证时退化为ip维度
+func Key(req *http.Request, rt *route.Route) string {
+	prefix := "ratelimit:" + rt.Name + ":"
+	principal := auth.PrincipalFromContext(req.Context())
+	switch rt.RateLimit.Key {
+	case route.RateLimitByClient:
+		if principal != nil && principal.ClientId != "" {
+			return prefix + "client:" + principal.ClientId
+		}
+	case route.RateLimitByUser:
+		if principal != nil {
+			return prefix + "user:" + strconv.FormatInt(principal.UserId, 10)
+		}
+	case route.RateLimitByIP:
+	default:
+		return prefix + "route"
+	}
+	return prefix + "ip:" + clientIP(req)
+}
+
+// 使用连接的对端地址，不信任客户端可伪造的X-Forwarded-For
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// 向上取整的秒数
+func seconds(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,182 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gomodule/redigo/redis"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/proxy"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/route"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/upstream"
+)
+
+func TestLocalLimiter(t *testing.T) {
+	l := NewLocalLimiter()
+	now := time.Unix(1600000000, 0)
+	l.now = func() time.Time { return now }
+	for i := 0; i < 3; i++ {
+		result, _ := l.Allow(context.Background(), "a", 3, 3*time.Second)
+		if !result.Allowed || result.Remaining != 2-i {
+			t.Fatalf("request %d: unexpected result %+v", i, result)
+		}
+	}
+	result, _ := l.Allow(context.Background(), "a", 3, 3*time.Second)
+	if result.Allowed || result.RetryAfter != time.Second || result.ResetAfter != 3*time.Second {
+		t.Fatalf("expected rejected, got %+v", result)
+	}
+	// 其他键不受影响
+	if result, _ = l.Allow(context.Background(), "b", 3, 3*time.Second); !result.Allowed {
+		t.Fatal("expected other key allowed")
+	}
+	now = now.Add(time.Second)
+	if result, _ = l.Allow(context.Background(), "a", 3, 3*time.Second); !result.Allowed || result.Remaining != 0 {
+		t.Fatalf("expected one token refilled, got %+v", result)
+	}
+
+	// 空闲的桶被清理
+	now = now.Add(2 * time.Minute)
+	l.Allow(context.Background(), "c", 3, 3*time.Second)
+	if len(l.buckets) != 1 {
+		t.Fatalf("expected idle buckets swept, got %d", len(l.buckets))
+	}
+}
+
+// 以Go实现滑动窗口脚本语义的redis连接
+type fakeRedis struct {
+	mu      sync.Mutex
+	entries map[string][]int64
+}
+
+type fakeConn struct {
+	redis *fakeRedis
+}
+
+func (c fakeConn) Close() error { return nil }
+func (c fakeConn) Err() error   { return nil }
+func (c fakeConn) Send(commandName string, args ...interface{}) error {
+	return errors.New("not supported")
+}
+func (c fakeConn) Flush() error                  { return nil }
+func (c fakeConn) Receive() (interface{}, error) { return nil, errors.New("not supported") }
+
+func (c fakeConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	if commandName != "EVALSHA" && commandName != "EVAL" {
+		return nil, errors.New("unexpected command " + commandName)
+	}
+	key := args[2].(string)
+	now, window, limit := args[3].(int64), args[4].(int64), args[5].(int)
+	c.redis.mu.Lock()
+	defer c.redis.mu.Unlock()
+	kept := make([]int64, 0)
+	for _, score := range c.redis.entries[key] {
+		if score > now-window {
+			kept = append(kept, score)
+		}
+	}
+	allowed := int64(0)
+	if len(kept) < limit {
+		kept = append(kept, now)
+		allowed = 1
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i] < kept[j] })
+	c.redis.entries[key] = kept
+	return []interface{}{allowed, int64(len(kept)), []byte(strconv.FormatInt(kept[0], 10)), []byte(strconv.FormatInt(kept[len(kept)-1], 10))}, nil
+}
+
+func TestRedisLimiter(t *testing.T) {
+	fake := &fakeRedis{entries: make(map[string][]int64)}
+	pool := &redis.Pool{Dial: func() (redis.Conn, error) {
+		return fakeConn{fake}, nil
+	}}
+	l := NewRedisLimiter(pool)
+	now := time.Unix(1600000000, 0)
+	l.now = func() time.Time { return now }
+	for i := 0; i < 2; i++ {
+		result, err := l.Allow(context.Background(), "a", 2, 10*time.Second)
+		if err != nil || !result.Allowed || result.Remaining != 1-i {
+			t.Fatalf("request %d: unexpected result %+v %v", i, result, err)
+		}
+		now = now.Add(time.Second)
+	}
+	result, err := l.Allow(context.Background(), "a", 2, 10*time.Second)
+	if err != nil || result.Allowed || result.Remaining != 0 {
+		t.Fatalf("expected rejected, got %+v %v", result, err)
+	}
+	// 最早的请求在8秒后移出窗口，最晚的请求在9秒后移出窗口
+	if result.RetryAfter != 8*time.Second || result.ResetAfter != 9*time.Second {
+		t.Fatalf("unexpected retry after %s reset after %s", result.RetryAfter, result.ResetAfter)
+	}
+	now = now.Add(8 * time.Second)
+	if result, _ = l.Allow(context.Background(), "a", 2, 10*time.Second); !result.Allowed {
+		t.Fatalf("expected allowed after window slides, got %+v", result)
+	}
+}
+
+type staticResolver struct{}
+
+func (staticResolver) Instances(ctx context.Context, serviceName string) ([]*upstream.Instance, error) {
+	return nil, upstream.ErrNoInstance
+}
+
+// 出错的限流器
+type errLimiter struct{}
+
+func (errLimiter) Allow(ctx context.Context, key string, limit int, period time.Duration) (*Result, error) {
+	return nil, errors.New("redis unavailable")
+}
+
+func TestFilter(t *testing.T) {
+	config, err := route.Parse([]byte(`
+routes:
+  - {name: open, service: open, match: {pathPrefix: /open}}
+  - {name: ip, service: ip, match: {pathPrefix: /ip}, rateLimit: {key: ip, limit: 1, period: 1m}}
+`), "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := route.NewStore()
+	routes.Update(config, "test")
+	newHandler := func(limiter Limiter) http.Handler {
+		handler := proxy.NewHandler(routes, staticResolver{}, log.NewNopLogger())
+		handler.Use(Filter(limiter, log.NewNopLogger()))
+		return handler
+	}
+	do := func(handler http.Handler, path, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	handler := newHandler(NewLocalLimiter())
+	// 未被限流的请求继续转发，测试中没有可用实例返回503
+	for i := 0; i < 3; i++ {
+		if rec := do(handler, "/open", "10.0.0.1:1234"); rec.Code != http.StatusServiceUnavailable || rec.Header().Get(HeaderLimit) != "" {
+			t.Fatalf("expected unlimited route, got %d %v", rec.Code, rec.Header())
+		}
+	}
+	rec := do(handler, "/ip", "10.0.0.1:1234")
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get(HeaderLimit) != "1" || rec.Header().Get(HeaderRemaining) != "0" {
+		t.Fatalf("expected first request allowed, got %d %v", rec.Code, rec.Header())
+	}
+	rec = do(handler, "/ip", "10.0.0.1:5678")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "60" || rec.Header().Get(HeaderReset) != "60" {
+		t.Fatalf("expected 429, got %d %v", rec.Code, rec.Header())
+	}
+	if rec = do(handler, "/ip", "10.0.0.2:1234"); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected other ip allowed, got %d", rec.Code)
+	}
+
+	// 限流器出错时放行
+	if rec = do(newHandler(errLimiter{}), "/ip", "10.0.0.1:1234"); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected fail open, got %d", rec.Code)
+	}
+}
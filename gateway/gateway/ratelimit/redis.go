@@ -0,0 +1,107 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 基于redis有序集合的滑动窗口限流器，多个网关实例共享限额。
+// 每个请求以毫秒时间戳为分值写入有序集合，先移除窗口外的记录，窗口内记录数未达到限额时放行
+
+// 返回 {是否放行, 窗口内请求数, 最早请求时间, 最晚请求时间}
+var slidingWindowScript = redis.NewScript(1, `
+local key = KEYS[1]
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+redis.call('ZREMRANGEBYSCORE', key, '-inf', now - window)
+local count = redis.call('ZCARD', key)
+local allowed = 0
+if count < limit then
+	redis.call('ZADD', key, now, ARGV[4])
+	count = count + 1
+	allowed = 1
+end
+redis.call('PEXPIRE', key, window)
+local oldest = redis.call('ZRANGE', key, 0, 0, 'WITHSCORES')
+local newest = redis.call('ZRANGE', key, -1, -1, 'WITHSCORES')
+return {allowed, count, oldest[2] or now, newest[2] or now}
+`)
+
+type RedisLimiter struct {
+	pool *redis.Pool
+	now  func() time.Time
+}
+
+func NewRedisLimiter(pool *redis.Pool) *RedisLimiter {
+	return &RedisLimiter{pool: pool, now: time.Now}
+}
+
+// 创建redis连接池
+func NewPool(addr, password string) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     20,
+		IdleTimeout: 240 * time.Second,
+		MaxActive:   50,
+		Dial: func() (redis.Conn, error) {
+			c, err := redis.Dial("tcp", addr, redis.DialConnectTimeout(time.Second),
+				redis.DialReadTimeout(time.Second), redis.DialWriteTimeout(time.Second))
+			if err != nil {
+				return nil, err
+			}
+			if password != "" {
+				if _, err := c.Do("AUTH", password); err != nil {
+					c.Close()
+					return nil, err
+				}
+			}
+			return c, nil
+		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+}
+
+func (l *RedisLimiter) Allow(ctx context.Context, key string, limit int, period time.Duration) (*Result, error) {
+	conn, err := l.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	now := l.now().UnixNano() / int64(time.Millisecond)
+	window := int64(period / time.Millisecond)
+	member := strconv.FormatInt(now, 10) + "-" + strconv.FormatInt(rand.Int63(), 36)
+	values, err := redis.Values(slidingWindowScript.Do(conn, key, now, window, limit, member))
+	if err != nil {
+		return nil, err
+	}
+	if len(values) != 4 {
+		return nil, fmt.Errorf("unexpected sliding window result %v", values)
+	}
+	allowed, _ := redis.Int64(values[0], nil)
+	count, _ := redis.Int(values[1], nil)
+	oldest, _ := redis.Int64(values[2], nil)
+	newest, _ := redis.Int64(values[3], nil)
+	result := &Result{
+		Allowed:   allowed == 1,
+		Limit:     limit,
+		Remaining: limit - count,
+		// 最晚的请求移出窗口后限额完全恢复
+		ResetAfter: time.Duration(newest+window-now) * time.Millisecond,
+	}
+	if result.Remaining < 0 {
+		result.Remaining = 0
+	}
+	if !result.Allowed {
+		// 最早的请求移出窗口后可以重试
+		result.RetryAfter = time.Duration(oldest+window-now) * time.Millisecond
+	}
+	return result, nil
+}
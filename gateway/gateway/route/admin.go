@@ -0,0 +1,18 @@
+package route
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// 管理接口，返回当前生效的路由表
+func AdminHandler(store *Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json;charset=utf-8")
+		json.NewEncoder(w).Encode(store.Table())
+	})
+}
@@ -0,0 +1,565 @@
+package route
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// 网关路由
+// 路由按声明顺序匹配，第一个满足全部匹配条件的路由生效，
+// 只有在路由表中声明的服务才会通过网关对外暴露
+
+var (
+	ErrRouteNoService = errors.New("route has no upstream service")
+	ErrRouteNoPath    = errors.New("route has neither path nor pathPrefix")
+)
+
+// 支持 "5s"、"300ms" 格式的时长
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return d.parse(s)
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	return d.parse(s)
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) parse(s string) error {
+	if s == "" {
+		*d = 0
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// 路由匹配条件，未设置的条件不参与匹配
+type Match struct {
+	// 精确匹配路径
+	Path string `yaml:"path" json:"path,omitempty"`
+	// 按路径段匹配前缀，/user 匹配 /user 和 /user/login，不匹配 /users
+	PathPrefix string `yaml:"pathPrefix" json:"pathPrefix,omitempty"`
+	// 匹配Host，支持 *.example.com 形式的通配
+	Host string `yaml:"host" json:"host,omitempty"`
+	// 匹配任一请求方法
+	Methods []string `yaml:"methods" json:"methods,omitempty"`
+	// 请求头需全部匹配，值为 * 时只要求请求头存在
+	Headers map[string]string `yaml:"headers" json:"headers,omitempty"`
+	// 匹配gRPC服务的全部方法，如 pb.UserService，或单个方法，如 pb.UserService/CheckPassword
+	GRPCService string `yaml:"grpcService" json:"grpcService,omitempty"`
+}
+
+// 路径重写规则，前缀替换和正则替换二选一
+type Rewrite struct {
+	// 将匹配的路径前缀替换为该前缀
+	Prefix string `yaml:"prefix" json:"prefix,omitempty"`
+	// 按正则表达式替换路径，替换串中可用 $1 引用分组，如 ^/goods/(\d+)/detail$ 替换为 /v2/goods/$1
+	Regex       string `yaml:"regex" json:"regex,omitempty"`
+	Replacement string `yaml:"replacement" json:"replacement,omitempty"`
+	regex       *regexp.Regexp
+}
+
+// 请求头或响应头的修改规则，按 重命名 -> 移除 -> 添加 的顺序执行
+type HeaderRules struct {
+	// 设置的头，覆盖同名的头
+	Add    map[string]string `yaml:"add" json:"add,omitempty"`
+	Remove []string          `yaml:"remove" json:"remove,omitempty"`
+	// 旧名称到新名称的映射
+	Rename map[string]string `yaml:"rename" json:"rename,omitempty"`
+}
+
+// 修改请求头或响应头
+func (r *HeaderRules) Apply(header http.Header) {
+	for from, to := range r.Rename {
+		if v, ok := header[http.CanonicalHeaderKey(from)]; ok {
+			header.Del(from)
+			header[http.CanonicalHeaderKey(to)] = v
+		}
+	}
+	for _, name := range r.Remove {
+		header.Del(name)
+	}
+	for name, value := range r.Add {
+		header.Set(name, value)
+	}
+}
+
+// 跨域策略
+type CORS struct {
+	// 允许的来源，* 表示任意来源
+	AllowOrigins []string `yaml:"allowOrigins" json:"allowOrigins"`
+	// 预检请求允许的方法，默认为路由匹配的方法，路由未限制方法时为 GET、POST、PUT、DELETE
+	AllowMethods []string `yaml:"allowMethods" json:"allowMethods,omitempty"`
+	// 预检请求允许的请求头，为空时允许请求的全部头
+	AllowHeaders []string `yaml:"allowHeaders" json:"allowHeaders,omitempty"`
+	// 浏览器可读取的响应头
+	ExposeHeaders    []string `yaml:"exposeHeaders" json:"exposeHeaders,omitempty"`
+	AllowCredentials bool     `yaml:"allowCredentials" json:"allowCredentials,omitempty"`
+	// 预检结果的缓存时间
+	MaxAge Duration `yaml:"maxAge" json:"maxAge,omitempty"`
+}
+
+// 来源是否被允许
+func (c *CORS) AllowOrigin(origin string) bool {
+	for _, o := range c.AllowOrigins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// 响应压缩策略，客户端支持时按 br、gzip 的优先级压缩，上游已压缩的响应不再压缩
+type Compression struct {
+	// 压缩的响应类型，默认文本、JSON、JavaScript及XML
+	Types []string `yaml:"types" json:"types,omitempty"`
+	// 已知长度小于该值的响应不压缩，默认1024字节
+	MinSize int64 `yaml:"minSize" json:"minSize,omitempty"`
+}
+
+// 响应缓存策略，只缓存GET请求，默认按上游的 Cache-Control、Expires 计算缓存时间
+type Cache struct {
+	// 覆盖上游响应头的缓存时间，携带令牌的请求仍需上游声明 public 或 s-maxage 才缓存
+	TTL Duration `yaml:"ttl" json:"ttl,omitempty"`
+}
+
+// 跨域预检请求
+func IsPreflight(req *http.Request) bool {
+	return req.Method == http.MethodOptions && req.Header.Get("Origin") != "" && req.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// 认证策略
+type Auth struct {
+	// 是否要求携带有效令牌，为false时只在携带令牌时校验
+	Required bool `yaml:"required" json:"required"`
+	// 用户需具备的全部权限
+	Authorities []string `yaml:"authorities" json:"authorities,omitempty"`
+	// 转发前移除请求中的Authorization头
+	StripAuthorization bool `yaml:"stripAuthorization" json:"stripAuthorization,omitempty"`
+}
+
+// 限流维度
+const (
+	RateLimitByRoute  = "route"
+	RateLimitByClient = "client"
+	RateLimitByUser   = "user"
+	RateLimitByIP     = "ip"
+)
+
+// 限流策略，每个限流键在 Period 内最多允许 Limit 个请求
+type RateLimit struct {
+	// 限流维度，route、client、user 或 ip，默认route
+	Key    string   `yaml:"key" json:"key"`
+	Limit  int      `yaml:"limit" json:"limit"`
+	Period Duration `yaml:"period" json:"period"`
+}
+
+// REST转gRPC配置，JSON请求体转换为gRPC请求消息，响应消息转换为JSON
+type Transcode struct {
+	// 调用的gRPC方法，如 pb.UserService/CheckPassword
+	Method string `yaml:"method" json:"method"`
+}
+
+// 流量拆分的哈希键
+const (
+	HashOnUser   = "user"
+	HashOnIP     = "ip"
+	HashOnHeader = "header"
+	HashOnCookie = "cookie"
+)
+
+// 实例子集，按consul标签和元数据选择上游实例，如 meta: {version: v2}
+type Subset struct {
+	Name string `yaml:"name" json:"name"`
+	// 流量权重，按各子集权重的比例分配
+	Weight int `yaml:"weight" json:"weight"`
+	// 实例需包含的全部标签
+	Tags []string `yaml:"tags" json:"tags,omitempty"`
+	// 实例元数据需匹配的全部键值
+	Meta map[string]string `yaml:"meta" json:"meta,omitempty"`
+}
+
+// 实例是否属于子集
+func (s *Subset) Matches(tags []string, meta map[string]string) bool {
+	for _, tag := range s.Tags {
+		found := false
+		for _, t := range tags {
+			if t == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for k, v := range s.Meta {
+		if meta[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// 流量拆分策略，按权重把请求分配到实例子集，同一哈希键总是分配到同一子集
+type Split struct {
+	Subsets []*Subset `yaml:"subsets" json:"subsets"`
+	// 哈希键，user、ip、header 或 cookie，默认user，取不到时退化为ip
+	HashOn string `yaml:"hashOn" json:"hashOn"`
+	// hashOn为header或cookie时的名称
+	HashName string `yaml:"hashName" json:"hashName,omitempty"`
+	// 测试人员可通过该请求头或cookie指定子集名，不受权重影响
+	OverrideHeader string `yaml:"overrideHeader" json:"overrideHeader,omitempty"`
+	OverrideCookie string `yaml:"overrideCookie" json:"overrideCookie,omitempty"`
+}
+
+// 按名称查找子集
+func (s *Split) Subset(name string) *Subset {
+	for _, subset := range s.Subsets {
+		if subset.Name == name {
+			return subset
+		}
+	}
+	return nil
+}
+
+func (s *Split) validate() error {
+	if len(s.Subsets) == 0 {
+		return errors.New("split requires subsets")
+	}
+	names := make(map[string]bool, len(s.Subsets))
+	total := 0
+	for _, subset := range s.Subsets {
+		if subset.Name == "" || names[subset.Name] {
+			return fmt.Errorf("split subset name %q is empty or duplicate", subset.Name)
+		}
+		names[subset.Name] = true
+		if subset.Weight < 0 {
+			return fmt.Errorf("split subset %s has negative weight", subset.Name)
+		}
+		if len(subset.Tags) == 0 && len(subset.Meta) == 0 {
+			return fmt.Errorf("split subset %s requires tags or meta", subset.Name)
+		}
+		total += subset.Weight
+	}
+	if total == 0 {
+		return errors.New("split requires positive total weight")
+	}
+	if s.HashOn == "" {
+		s.HashOn = HashOnUser
+	}
+	switch s.HashOn {
+	case HashOnUser, HashOnIP:
+	case HashOnHeader, HashOnCookie:
+		if s.HashName == "" {
+			return fmt.Errorf("split hashOn %s requires hashName", s.HashOn)
+		}
+	default:
+		return fmt.Errorf("unknown split hashOn %s", s.HashOn)
+	}
+	return nil
+}
+
+// 上游协议
+const (
+	ProtocolHTTP = "http"
+	// 明文HTTP/2
+	ProtocolH2C = "h2c"
+	// 基于明文HTTP/2的gRPC，网关错误以gRPC状态返回
+	ProtocolGRPC = "grpc"
+)
+
+// 重试策略，只重试幂等且不带请求体的请求，每次重试选择不同的实例
+type Retry struct {
+	// 首次请求失败后的最大重试次数
+	Attempts int `yaml:"attempts" json:"attempts"`
+	// 单次尝试的超时时间，0表示只受路由超时限制
+	PerTryTimeout Duration `yaml:"perTryTimeout" json:"perTryTimeout,omitempty"`
+}
+
+// 路由
+type Route struct {
+	Name    string   `yaml:"name" json:"name"`
+	Match   Match    `yaml:"match" json:"match"`
+	Rewrite *Rewrite `yaml:"rewrite" json:"rewrite,omitempty"`
+	// 上游服务名
+	Service string `yaml:"service" json:"service"`
+	// 请求超时时间，0表示不限制
+	Timeout Duration `yaml:"timeout" json:"timeout,omitempty"`
+	// 认证策略，为空时不校验令牌
+	Auth *Auth `yaml:"auth" json:"auth,omitempty"`
+	// 限流策略，为空时不限流
+	RateLimit *RateLimit `yaml:"rateLimit" json:"rateLimit,omitempty"`
+	// 重试策略，为空时不重试
+	Retry *Retry `yaml:"retry" json:"retry,omitempty"`
+	// 流量拆分策略，为空时在服务的全部实例间负载均衡
+	Split *Split `yaml:"split" json:"split,omitempty"`
+	// 转发前修改请求头
+	RequestHeaders *HeaderRules `yaml:"requestHeaders" json:"requestHeaders,omitempty"`
+	// 返回前修改上游响应头
+	ResponseHeaders *HeaderRules `yaml:"responseHeaders" json:"responseHeaders,omitempty"`
+	// 跨域策略，为空时不处理跨域请求
+	CORS *CORS `yaml:"cors" json:"cors,omitempty"`
+	// 请求体最大字节数，超过时返回413，0表示不限制
+	MaxBodySize int64 `yaml:"maxBodySize" json:"maxBodySize,omitempty"`
+	// 响应缓存策略，为空时不缓存
+	Cache *Cache `yaml:"cache" json:"cache,omitempty"`
+	// 响应压缩策略，为空时不压缩
+	Compression *Compression `yaml:"compression" json:"compression,omitempty"`
+	// REST转gRPC配置，为空时不转换
+	Transcode *Transcode `yaml:"transcode" json:"transcode,omitempty"`
+	// 上游协议，http、h2c 或 grpc，匹配gRPC服务或转换为gRPC调用时默认grpc，否则默认http
+	Protocol string `yaml:"protocol" json:"protocol,omitempty"`
+	// 长连接（WebSocket、SSE）双向都没有数据时的断开时间，0表示不限制，长连接不受Timeout限制
+	IdleTimeout Duration `yaml:"idleTimeout" json:"idleTimeout,omitempty"`
+	// 最大并发请求数，包括长连接，超过时返回503，0表示不限制
+	MaxConnections int `yaml:"maxConnections" json:"maxConnections,omitempty"`
+}
+
+// 路由配置
+type Config struct {
+	Routes []*Route `yaml:"routes" json:"routes"`
+}
+
+// 校验路由配置
+func (c *Config) Validate() error {
+	names := make(map[string]bool, len(c.Routes))
+	for i, r := range c.Routes {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("route-%d", i)
+		}
+		if names[r.Name] {
+			return fmt.Errorf("duplicate route name %s", r.Name)
+		}
+		names[r.Name] = true
+		if r.Service == "" {
+			return fmt.Errorf("route %s: %s", r.Name, ErrRouteNoService)
+		}
+		for i, m := range r.Match.Methods {
+			r.Match.Methods[i] = strings.ToUpper(m)
+		}
+		if r.Match.GRPCService != "" {
+			if r.Match.Path != "" || r.Match.PathPrefix != "" || strings.HasPrefix(r.Match.GRPCService, "/") {
+				return fmt.Errorf("route %s: grpcService must be package.Service[/Method] without path", r.Name)
+			}
+			if r.Protocol == "" {
+				r.Protocol = ProtocolGRPC
+			}
+		} else if r.Match.Path == "" && r.Match.PathPrefix == "" {
+			return fmt.Errorf("route %s: %s", r.Name, ErrRouteNoPath)
+		}
+		for _, p := range []string{r.Match.Path, r.Match.PathPrefix} {
+			if p != "" && !strings.HasPrefix(p, "/") {
+				return fmt.Errorf("route %s: path %s must start with /", r.Name, p)
+			}
+		}
+		if rw := r.Rewrite; rw != nil {
+			if rw.Regex != "" {
+				if rw.Prefix != "" {
+					return fmt.Errorf("route %s: rewrite prefix and regex are exclusive", r.Name)
+				}
+				re, err := regexp.Compile(rw.Regex)
+				if err != nil {
+					return fmt.Errorf("route %s: invalid rewrite regex: %s", r.Name, err)
+				}
+				rw.regex = re
+			} else if r.Match.PathPrefix == "" {
+				return fmt.Errorf("route %s: rewrite requires pathPrefix", r.Name)
+			}
+		}
+		if c := r.CORS; c != nil {
+			if len(c.AllowOrigins) == 0 {
+				return fmt.Errorf("route %s: cors requires allowOrigins", r.Name)
+			}
+			for _, o := range c.AllowOrigins {
+				// 携带凭证时浏览器不接受通配来源
+				if o == "*" && c.AllowCredentials {
+					return fmt.Errorf("route %s: cors cannot allow credentials from any origin", r.Name)
+				}
+			}
+			for i, m := range c.AllowMethods {
+				c.AllowMethods[i] = strings.ToUpper(m)
+			}
+			if len(c.AllowMethods) == 0 {
+				c.AllowMethods = r.Match.Methods
+			}
+			if len(c.AllowMethods) == 0 {
+				c.AllowMethods = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete}
+			}
+		}
+		if r.Cache != nil && r.Cache.TTL < 0 {
+			return fmt.Errorf("route %s: negative cache ttl", r.Name)
+		}
+		if r.MaxBodySize < 0 {
+			return fmt.Errorf("route %s: negative max body size", r.Name)
+		}
+		if c := r.Compression; c != nil {
+			if len(c.Types) == 0 {
+				c.Types = []string{"text/", "application/json", "application/javascript", "application/xml"}
+			}
+			if c.MinSize == 0 {
+				c.MinSize = 1024
+			}
+		}
+		if t := r.Transcode; t != nil {
+			if parts := strings.Split(t.Method, "/"); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				return fmt.Errorf("route %s: transcode method must be package.Service/Method", r.Name)
+			}
+			if r.Match.GRPCService != "" || r.Rewrite != nil {
+				return fmt.Errorf("route %s: transcode cannot be combined with grpcService or rewrite", r.Name)
+			}
+			if r.Protocol == "" {
+				r.Protocol = ProtocolGRPC
+			}
+			if r.Protocol != ProtocolGRPC {
+				return fmt.Errorf("route %s: transcode requires grpc protocol", r.Name)
+			}
+		}
+		if r.Split != nil {
+			if err := r.Split.validate(); err != nil {
+				return fmt.Errorf("route %s: %s", r.Name, err)
+			}
+		}
+		if r.Auth != nil && len(r.Auth.Authorities) > 0 {
+			// 要求权限时必须携带令牌
+			r.Auth.Required = true
+		}
+		if l := r.RateLimit; l != nil {
+			if l.Key == "" {
+				l.Key = RateLimitByRoute
+			}
+			switch l.Key {
+			case RateLimitByRoute, RateLimitByClient, RateLimitByUser, RateLimitByIP:
+			default:
+				return fmt.Errorf("route %s: unknown rate limit key %s", r.Name, l.Key)
+			}
+			if l.Limit <= 0 || l.Period <= 0 {
+				return fmt.Errorf("route %s: rate limit requires positive limit and period", r.Name)
+			}
+		}
+		if r.Timeout < 0 {
+			return fmt.Errorf("route %s: negative timeout", r.Name)
+		}
+		if r.Retry != nil && (r.Retry.Attempts < 0 || r.Retry.PerTryTimeout < 0) {
+			return fmt.Errorf("route %s: negative retry attempts or timeout", r.Name)
+		}
+		if r.Protocol == "" {
+			r.Protocol = ProtocolHTTP
+		}
+		if r.Protocol != ProtocolHTTP && r.Protocol != ProtocolH2C && r.Protocol != ProtocolGRPC {
+			return fmt.Errorf("route %s: unknown protocol %s", r.Name, r.Protocol)
+		}
+		if r.IdleTimeout < 0 || r.MaxConnections < 0 {
+			return fmt.Errorf("route %s: negative idle timeout or max connections", r.Name)
+		}
+	}
+	return nil
+}
+
+// 请求是否匹配路由
+func (r *Route) Matches(req *http.Request) bool {
+	m := r.Match
+	if m.Path != "" && req.URL.Path != m.Path {
+		return false
+	}
+	if m.PathPrefix != "" && !hasPathPrefix(req.URL.Path, m.PathPrefix) {
+		return false
+	}
+	if m.GRPCService != "" && !matchGRPC(req.URL.Path, m.GRPCService) {
+		return false
+	}
+	if m.Host != "" && !matchHost(req.Host, m.Host) {
+		return false
+	}
+	if len(m.Methods) > 0 {
+		// 跨域预检请求按实际请求的方法匹配
+		method := req.Method
+		if r.CORS != nil && IsPreflight(req) {
+			method = req.Header.Get("Access-Control-Request-Method")
+		}
+		found := false
+		for _, allowed := range m.Methods {
+			if allowed == method {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for name, value := range m.Headers {
+		v := req.Header.Get(name)
+		if value == "*" && v == "" || value != "*" && v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// 按重写规则生成上游请求路径
+func (r *Route) RewritePath(path string) string {
+	if r.Rewrite == nil {
+		return path
+	}
+	if r.Rewrite.regex != nil {
+		return r.Rewrite.regex.ReplaceAllString(path, r.Rewrite.Replacement)
+	}
+	rest := strings.TrimPrefix(path, strings.TrimSuffix(r.Match.PathPrefix, "/"))
+	result := strings.TrimSuffix(r.Rewrite.Prefix, "/") + rest
+	if !strings.HasPrefix(result, "/") {
+		result = "/" + result
+	}
+	return result
+}
+
+func hasPathPrefix(path, prefix string) bool {
+	if prefix == "/" {
+		return true
+	}
+	prefix = strings.TrimSuffix(prefix, "/")
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// gRPC请求路径为 /package.Service/Method
+func matchGRPC(path, service string) bool {
+	if strings.Contains(service, "/") {
+		return path == "/"+service
+	}
+	return strings.HasPrefix(path, "/"+service+"/")
+}
+
+func matchHost(host, pattern string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	pattern = strings.ToLower(pattern)
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return host == pattern
+}
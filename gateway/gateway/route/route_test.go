@@ -0,0 +1,274 @@
+package route
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+const testRoutes = `
+routes:
+  - name: user-login
+    match:
+      path: /user/login
+      methods: [post]
+    rewrite:
+      prefix: /
+    service: user
+  - name: admin
+    match:
+      pathPrefix: /api
+      host: "*.admin.example.com"
+      headers:
+        X-Admin: "*"
+    service: admin
+    timeout: 2s
+  - name: api
+    match:
+      pathPrefix: /api/
+    rewrite:
+      prefix: /v1
+    service: api
+  - name: check-password
+    match:
+      grpcService: pb.UserService/CheckPassword
+    service: user-grpc
+    timeout: 1s
+  - name: user-grpc
+    match:
+      grpcService: pb.UserService
+    service: user-grpc
+  - name: goods-detail
+    match:
+      pathPrefix: /goods
+      methods: [get]
+    rewrite:
+      regex: ^/goods/(\d+)/detail$
+      replacement: /v2/goods/$1
+    cors:
+      allowOrigins: [https://shop.example.com]
+    service: goods
+`
+
+func TestMatch(t *testing.T) {
+	config, err := Parse([]byte(testRoutes), "yaml")
+	if err == nil {
+		t.Fatal("expected rewrite without pathPrefix to be rejected")
+	}
+	config, err = Parse([]byte(strings.Replace(testRoutes, "path: /user/login", "pathPrefix: /user/login", 1)), "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Duration(config.Routes[1].Timeout) != 2*time.Second {
+		t.Fatalf("unexpected timeout %v", config.Routes[1].Timeout)
+	}
+	if config.Routes[3].Protocol != ProtocolGRPC || config.Routes[0].Protocol != ProtocolHTTP {
+		t.Fatalf("unexpected protocols %s %s", config.Routes[3].Protocol, config.Routes[0].Protocol)
+	}
+	table := &Table{Routes: config.Routes}
+	cases := []struct {
+		method, url string
+		header      map[string]string
+		route, path string
+	}{
+		{"POST", "http://gw/user/login", nil, "user-login", "/"},
+		{"GET", "http://gw/user/login", nil, "", ""},
+		{"POST", "http://gw/user/loginx", nil, "", ""},
+		{"GET", "http://a.admin.example.com:8080/api/users", map[string]string{"X-Admin": "1"}, "admin", "/api/users"},
+		{"GET", "http://a.admin.example.com/api/users", nil, "api", "/v1/users"},
+		{"GET", "http://gw/api", nil, "api", "/v1"},
+		{"GET", "http://gw/apis", nil, "", ""},
+		{"POST", "http://gw/pb.UserService/CheckPassword", nil, "check-password", "/pb.UserService/CheckPassword"},
+		{"POST", "http://gw/pb.UserService/Register", nil, "user-grpc", "/pb.UserService/Register"},
+		{"POST", "http://gw/pb.UserServiceX/Register", nil, "", ""},
+		{"GET", "http://gw/goods/12/detail", nil, "goods-detail", "/v2/goods/12"},
+		{"GET", "http://gw/goods/12", nil, "goods-detail", "/goods/12"},
+		// 跨域预检请求按实际请求的方法匹配
+		{"OPTIONS", "http://gw/goods/12/detail", map[string]string{"Origin": "https://shop.example.com", "Access-Control-Request-Method": "GET"}, "goods-detail", "/v2/goods/12"},
+		{"OPTIONS", "http://gw/goods/12/detail", nil, "", ""},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, c.url, nil)
+		for k, v := range c.header {
+			req.Header.Set(k, v)
+		}
+		r := table.Match(req)
+		if c.route == "" {
+			if r != nil {
+				t.Fatalf("%s %s: expected no route, got %s", c.method, c.url, r.Name)
+			}
+			continue
+		}
+		if r == nil || r.Name != c.route {
+			t.Fatalf("%s %s: expected route %s, got %v", c.method, c.url, c.route, r)
+		}
+		if path := r.RewritePath(req.URL.Path); path != c.path {
+			t.Fatalf("%s %s: expected path %s, got %s", c.method, c.url, c.path, path)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	invalid := []string{
+		"routes:\n  - match: {pathPrefix: /a}\n",
+		"routes:\n  - service: a\n",
+		"routes:\n  - {name: a, service: a, match: {pathPrefix: /a}}\n  - {name: a, service: b, match: {pathPrefix: /b}}\n",
+		"routes:\n  - {service: a, match: {pathPrefix: a}}\n",
+		"routes:\n  - {service: a, timeout: abc, match: {pathPrefix: /a}}\n",
+		"routes:\n  - {service: a, unknown: 1, match: {pathPrefix: /a}}\n",
+		"routes:\n  - {service: a, retry: {attempts: -1}, match: {pathPrefix: /a}}\n",
+		"routes:\n  - {service: a, protocol: h3, match: {pathPrefix: /a}}\n",
+		"routes:\n  - {service: a, match: {grpcService: /pb.UserService}}\n",
+		"routes:\n  - {service: a, transcode: {method: pb.UserService}, match: {path: /a}}\n",
+		"routes:\n  - {service: a, split: {subsets: [{name: v1, weight: 0, tags: [v1]}]}, match: {path: /a}}\n",
+		"routes:\n  - {service: a, rewrite: {regex: \"(\"}, match: {path: /a}}\n",
+		"routes:\n  - {service: a, cors: {allowOrigins: [\"*\"], allowCredentials: true}, match: {path: /a}}\n",
+		"routes:\n  - {service: a, maxBodySize: -1, match: {path: /a}}\n",
+		"routes:\n  - {service: a, cache: {ttl: -1s}, match: {path: /a}}\n",
+		"routes:\n  - {service: a, split: {subsets: [{name: v1, weight: 1}]}, match: {path: /a}}\n",
+		"routes:\n  - {service: a, split: {hashOn: header, subsets: [{name: v1, weight: 1, tags: [v1]}]}, match: {path: /a}}\n",
+		"routes:\n  - {service: a, transcode: {method: pb.UserService/Check}, protocol: http, match: {path: /a}}\n",
+	}
+	for _, s := range invalid {
+		if _, err := Parse([]byte(s), "yaml"); err == nil {
+			t.Fatalf("expected error for %q", s)
+		}
+	}
+}
+
+func TestWatchFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "route")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "routes.yaml")
+	write := func(content string, modTime time.Time) {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, modTime, modTime)
+	}
+	write("routes:\n  - {name: a, service: a, match: {pathPrefix: /a}}\n", time.Unix(1600000000, 0))
+	store := NewStore()
+	if err = LoadFile(store, path); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go WatchFile(ctx, store, path, 10*time.Millisecond)
+
+	// 无效配置不替换当前路由表
+	write("routes:\n  - {name: b, match: {pathPrefix: /b}}\n", time.Unix(1600000100, 0))
+	time.Sleep(50 * time.Millisecond)
+	if table := store.Table(); table.Version != 1 || table.Routes[0].Name != "a" {
+		t.Fatalf("expected routes unchanged, got %+v", table)
+	}
+
+	write("routes:\n  - {name: b, service: b, match: {pathPrefix: /b}}\n", time.Unix(1600000200, 0))
+	deadline := time.Now().Add(3 * time.Second)
+	for store.Table().Version != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for reload")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if store.Match(httptest.NewRequest("GET", "/b/x", nil)) == nil {
+		t.Fatal("expected reloaded route to match")
+	}
+
+	rec := httptest.NewRecorder()
+	AdminHandler(store).ServeHTTP(rec, httptest.NewRequest("GET", "/admin/routes", nil))
+	var table Table
+	json.NewDecoder(rec.Body).Decode(&table)
+	if table.Source != path || len(table.Routes) != 1 || table.Routes[0].Service != "b" {
+		t.Fatalf("unexpected admin response %+v", table)
+	}
+}
+
+func TestEtcdSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "etcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// 启动进程内的单节点etcd
+	config := embed.NewConfig()
+	config.Dir = dir
+	config.LogOutputs = []string{filepath.Join(dir, "etcd.log")}
+	clientURL, _ := url.Parse("http://" + freeAddr(t))
+	peerURL, _ := url.Parse("http://" + freeAddr(t))
+	config.LCUrls, config.ACUrls = []url.URL{*clientURL}, []url.URL{*clientURL}
+	config.LPUrls, config.APUrls = []url.URL{*peerURL}, []url.URL{*peerURL}
+	config.InitialCluster = config.InitialClusterFromName(config.Name)
+	etcd, err := embed.StartEtcd(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer etcd.Close()
+	select {
+	case <-etcd.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for etcd")
+	}
+
+	client, err := NewEtcdClient([]string{clientURL.String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	put := func(value string) {
+		if _, err := client.Put(ctx, "/gateway/routes", value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put("routes:\n  - {name: a, service: a, match: {pathPrefix: /a}}\n")
+
+	store := NewStore()
+	source := &EtcdSource{Client: client, Key: "/gateway/routes"}
+	go source.Watch(ctx, store)
+	waitVersion := func(version int64) {
+		deadline := time.Now().Add(3 * time.Second)
+		for store.Table().Version < version {
+			if time.Now().After(deadline) {
+				t.Fatalf("timeout waiting for version %d", version)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitVersion(1)
+	if store.Table().Source != "etcd:/gateway/routes" {
+		t.Fatalf("unexpected source %s", store.Table().Source)
+	}
+	put("routes:\n  - {name: b, service: b, match: {pathPrefix: /b}}\n")
+	waitVersion(2)
+	// 无效的配置不替换当前路由表
+	put("routes: [")
+	put("routes:\n  - {name: c, service: c, match: {pathPrefix: /c}}\n")
+	waitVersion(3)
+	if store.Match(httptest.NewRequest("GET", "/c", nil)) == nil {
+		t.Fatal("expected reloaded route to match")
+	}
+}
+
+// 获取一个空闲的本地地址
+func freeAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
@@ -0,0 +1,159 @@
+package route
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// 路由表来源
+// 文件来源定期检查文件修改时间，etcd来源通过clientv3监听键的变化，
+// 配置解析或校验失败时保留原有路由表
+
+// 加载路由文件
+func LoadFile(store *Store, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	config, err := Parse(data, formatOf(path))
+	if err != nil {
+		return err
+	}
+	store.Update(config, path)
+	return nil
+}
+
+// 定期检查路由文件，修改后重新加载，ctx取消后返回
+func WatchFile(ctx context.Context, store *Store, path string, interval time.Duration) {
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	var modTime time.Time
+	if info, err := os.Stat(path); err == nil {
+		modTime = info.ModTime()
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Printf("stat route file %s err: %s", path, err)
+			continue
+		}
+		if info.ModTime().Equal(modTime) {
+			continue
+		}
+		modTime = info.ModTime()
+		if err = LoadFile(store, path); err != nil {
+			log.Printf("reload route file %s err: %s, keep current routes", path, err)
+			continue
+		}
+		log.Printf("reload route file %s success", path)
+	}
+}
+
+// 创建etcd客户端，路由来源和其他需要访问etcd的组件共用
+func NewEtcdClient(endpoints []string) (*clientv3.Client, error) {
+	if len(endpoints) == 0 {
+		endpoints = []string{"http://127.0.0.1:2379"}
+	}
+	return clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: 5 * time.Second,
+	})
+}
+
+// etcd路由来源
+type EtcdSource struct {
+	Client *clientv3.Client
+	// 保存路由配置的键，值为yaml或json
+	Key    string
+	Format string
+}
+
+// 从etcd加载路由表，返回读取时的版本号
+func (s *EtcdSource) Load(ctx context.Context, store *Store) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	resp, err := s.Client.Get(ctx, s.Key)
+	if err != nil {
+		return 0, err
+	}
+	revision := resp.Header.Revision
+	if len(resp.Kvs) == 0 {
+		return revision, fmt.Errorf("route key %s not found", s.Key)
+	}
+	config, err := Parse(resp.Kvs[0].Value, s.Format)
+	if err != nil {
+		return revision, err
+	}
+	store.Update(config, "etcd:"+s.Key)
+	return revision, nil
+}
+
+// 监听etcd中的路由配置，变化后重新加载，ctx取消后返回
+func (s *EtcdSource) Watch(ctx context.Context, store *Store) {
+	backoff := time.Second
+	for {
+		revision, err := s.Load(ctx, store)
+		if err != nil && revision == 0 {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("load routes from etcd err: %s, retry after %s", err, backoff)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > 30*time.Second {
+				backoff = 30 * time.Second
+			}
+			continue
+		}
+		if err != nil {
+			log.Printf("load routes from etcd err: %s, keep current routes", err)
+		}
+		backoff = time.Second
+		if err = s.watchOnce(ctx, revision+1); err != nil && ctx.Err() == nil {
+			log.Printf("watch routes from etcd err: %s", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(backoff):
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// 从指定版本开始监听键，收到第一个变化事件后返回
+func (s *EtcdSource) watchOnce(ctx context.Context, startRevision int64) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for resp := range s.Client.Watch(clientv3.WithRequireLeader(ctx), s.Key, clientv3.WithRev(startRevision)) {
+		if err := resp.Err(); err != nil {
+			return err
+		}
+		if len(resp.Events) > 0 {
+			return nil
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return errors.New("watch channel closed")
+}
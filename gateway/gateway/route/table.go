@@ -0,0 +1,92 @@
+package route
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// 生效中的路由表
+type Table struct {
+	Routes []*Route `json:"routes"`
+	// 路由表来源，如文件路径或etcd键
+	Source string `json:"source"`
+	// 加载时间
+	LoadedAt time.Time `json:"loadedAt"`
+	// 每次加载递增
+	Version int64 `json:"version"`
+}
+
+// 查找第一个匹配请求的路由，没有匹配时返回nil
+func (t *Table) Match(req *http.Request) *Route {
+	for _, r := range t.Routes {
+		if r.Matches(req) {
+			return r
+		}
+	}
+	return nil
+}
+
+// 解析路由配置，format为 json 或 yaml，为空时按yaml解析
+func Parse(data []byte, format string) (*Config, error) {
+	var config Config
+	var err error
+	if format == "json" {
+		err = json.Unmarshal(data, &config)
+	} else {
+		err = yaml.UnmarshalStrict(data, &config)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = config.Validate(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// 根据文件扩展名判断配置格式
+func formatOf(path string) string {
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		return "json"
+	}
+	return "yaml"
+}
+
+// 路由表存储，支持并发读取和原子替换
+type Store struct {
+	table   atomic.Value
+	version int64
+}
+
+// 创建空路由表存储
+func NewStore() *Store {
+	s := &Store{}
+	s.table.Store(&Table{})
+	return s
+}
+
+// 当前路由表
+func (s *Store) Table() *Table {
+	return s.table.Load().(*Table)
+}
+
+// 查找匹配请求的路由
+func (s *Store) Match(req *http.Request) *Route {
+	return s.Table().Match(req)
+}
+
+// 替换路由表，配置需已校验
+func (s *Store) Update(config *Config, source string) {
+	s.table.Store(&Table{
+		Routes:   config.Routes,
+		Source:   source,
+		LoadedAt: time.Now(),
+		Version:  atomic.AddInt64(&s.version, 1),
+	})
+}
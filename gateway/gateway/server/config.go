@@ -0,0 +1,183 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/breaker"
+	"github.com/yunfeiyang1916/micro-go-course/tracing"
+)
+
+// 中间件名称
+const (
+	// 追踪网关及上游请求
+	MiddlewareTracing = "tracing"
+	// 记录访问日志
+	MiddlewareLogging = "logging"
+	// 按路由统计请求数、耗时及处理中的请求数
+	MiddlewareMetrics = "metrics"
+	// 按路由认证策略校验令牌
+	MiddlewareAuth = "auth"
+	// 按路由限流策略限流
+	MiddlewareRateLimit = "ratelimit"
+	// 按路由规则处理跨域、限制请求体大小、修改请求头和响应头、压缩响应
+	MiddlewareTransform = "transform"
+	// 将gRPC路由的gRPC-Web请求转换为gRPC请求
+	MiddlewareGRPCWeb = "grpcweb"
+	// 按路由的流量拆分策略选择实例子集
+	MiddlewareCanary = "canary"
+	// 按路由缓存策略缓存上游响应
+	MiddlewareCache = "cache"
+	// 将配置了transcode的路由的JSON请求转换为gRPC调用
+	MiddlewareTranscode = "transcode"
+)
+
+// 追踪配置
+type TracingConfig struct {
+	// 上报方式，zipkin、otlp或none
+	Exporter string
+	// zipkin span上报地址
+	ZipkinURL string
+	// OTLP/HTTP traces接口地址
+	OTLPURL string
+	// 上报的服务名
+	ServiceName string
+	// 新建追踪的采样率，0到1之间
+	SampleRate float64
+}
+
+// 认证配置，配置了jwt密钥时本地校验，否则调用oauth服务的check_token接口
+type AuthConfig struct {
+	JWTSecret     string
+	CheckTokenURL string
+	ClientId      string
+	ClientSecret  string
+	// check_token结果的缓存时间
+	CacheTTL time.Duration
+}
+
+// 限流配置，配置了redis地址时多个网关实例共享限额，否则使用本地限流器
+type RateLimitConfig struct {
+	RedisAddr     string
+	RedisPassword string
+}
+
+// 响应缓存配置，配置了redis地址时多个网关实例共享缓存，否则使用本地缓存
+type CacheConfig struct {
+	RedisAddr     string
+	RedisPassword string
+	// 本地缓存的总大小上限
+	MaxBytes int64
+	// 单个响应体的大小上限，超过时不缓存
+	MaxEntrySize int64
+}
+
+// 网关配置
+type Config struct {
+	// 网关监听地址
+	ListenAddr string
+	// 读取请求头的超时时间
+	ReadHeaderTimeout time.Duration
+	// 客户端连接的空闲超时时间，0表示不限制
+	IdleTimeout time.Duration
+	// 是否接受明文HTTP/2（h2c）客户端，gRPC客户端需要
+	H2C bool
+	// 管理接口监听地址，为空时不启动管理接口
+	AdminAddr string
+	// consul地址，host:port
+	ConsulAddr string
+	// 路由表文件，yaml或json
+	RouteFile string
+	// 配置了etcd地址时从etcd加载路由表
+	EtcdEndpoints []string
+	EtcdKey       string
+	// 启用的中间件，追踪和日志作用于所有请求，监控指标、请求响应转换、gRPC-Web转换、认证、限流、灰度发布、响应缓存和REST转gRPC在路由匹配后执行
+	Middlewares []string
+	Tracing     TracingConfig
+	Auth        AuthConfig
+	RateLimit   RateLimitConfig
+	Cache       CacheConfig
+	Breaker     *breaker.Config
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		ListenAddr:        ":10080",
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       90 * time.Second,
+		AdminAddr:         "127.0.0.1:10081",
+		ConsulAddr:        "127.0.0.1:8500",
+		RouteFile:         "routes.yaml",
+		EtcdKey:           "/gateway/routes",
+		H2C:               true,
+		Middlewares: []string{MiddlewareLogging, MiddlewareMetrics, MiddlewareTransform, MiddlewareGRPCWeb, MiddlewareAuth,
+			MiddlewareRateLimit, MiddlewareCanary, MiddlewareCache, MiddlewareTranscode},
+		Tracing: TracingConfig{
+			Exporter:    tracing.ExporterZipkin,
+			ZipkinURL:   "http://127.0.0.1:9411/api/v2/spans",
+			OTLPURL:     "http://127.0.0.1:4318/v1/traces",
+			ServiceName: "gateway-service",
+			SampleRate:  1,
+		},
+		Auth: AuthConfig{
+			CheckTokenURL: "http://127.0.0.1:10086/oauth/check_token",
+			ClientId:      "clientId",
+			ClientSecret:  "clientSecret",
+			CacheTTL:      time.Minute,
+		},
+		Cache: CacheConfig{
+			MaxBytes:     64 << 20,
+			MaxEntrySize: 1 << 20,
+		},
+		Breaker: breaker.DefaultConfig(),
+	}
+}
+
+// 是否启用了中间件
+func (c *Config) Enabled(middleware string) bool {
+	for _, m := range c.Middlewares {
+		if m == middleware {
+			return true
+		}
+	}
+	return false
+}
+
+// 校验配置
+func (c *Config) Validate() error {
+	for _, m := range c.Middlewares {
+		switch m {
+		case MiddlewareTracing, MiddlewareLogging, MiddlewareMetrics, MiddlewareAuth, MiddlewareRateLimit, MiddlewareTransform, MiddlewareGRPCWeb,
+			MiddlewareCanary, MiddlewareCache, MiddlewareTranscode:
+		default:
+			return fmt.Errorf("unknown middleware %s", m)
+		}
+	}
+	if c.ListenAddr == "" {
+		return fmt.Errorf("listen address is required")
+	}
+	if c.Enabled(MiddlewareTracing) {
+		if err := c.tracing().Validate(); err != nil {
+			return err
+		}
+	}
+	if c.Enabled(MiddlewareAuth) && c.Auth.JWTSecret == "" && c.Auth.CheckTokenURL == "" {
+		return fmt.Errorf("auth requires jwt secret or check_token url")
+	}
+	if c.Enabled(MiddlewareCache) && c.Cache.RedisAddr == "" && c.Cache.MaxBytes <= 0 {
+		return fmt.Errorf("cache requires redis address or max bytes")
+	}
+	return nil
+}
+
+// 追踪器配置
+func (c *Config) tracing() *tracing.Config {
+	return &tracing.Config{
+		ServiceName: c.Tracing.ServiceName,
+		HostPort:    c.ListenAddr,
+		Exporter:    c.Tracing.Exporter,
+		ZipkinURL:   c.Tracing.ZipkinURL,
+		OTLPURL:     c.Tracing.OTLPURL,
+		SampleRate:  c.Tracing.SampleRate,
+	}
+}
@@ -0,0 +1,243 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/yunfeiyang1916/micro-go-course/grpc-kit/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+type userService struct {
+	pb.UnimplementedUserServiceServer
+}
+
+func (s *userService) CheckPassword(ctx context.Context, req *pb.LoginReq) (*pb.LoginResp, error) {
+	if req.Username == "" {
+		return nil, status.Error(codes.InvalidArgument, "username is required")
+	}
+	if req.Username == "admin" && req.Password == "admin" {
+		return &pb.LoginResp{Ret: "success"}, nil
+	}
+	return &pb.LoginResp{Ret: "fail"}, nil
+}
+
+// 长度前缀的gRPC消息帧
+func frame(t *testing.T, flag byte, data []byte) []byte {
+	b := make([]byte, 5, 5+len(data))
+	b[0] = flag
+	binary.BigEndian.PutUint32(b[1:], uint32(len(data)))
+	return append(b, data...)
+}
+
+// 解析gRPC-Web响应体，返回消息帧和trailer
+func parseFrames(t *testing.T, body []byte) ([][]byte, string) {
+	var messages [][]byte
+	var trailer string
+	for len(body) > 0 {
+		if len(body) < 5 {
+			t.Fatalf("truncated frame %q", body)
+		}
+		n := binary.BigEndian.Uint32(body[1:5])
+		data := body[5 : 5+n]
+		if body[0]&0x80 != 0 {
+			trailer = string(data)
+		} else {
+			messages = append(messages, data)
+		}
+		body = body[5+n:]
+	}
+	return messages, trailer
+}
+
+func TestGRPC(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcServer := grpc.NewServer()
+	pb.RegisterUserServiceServer(grpcServer, &userService{})
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+	consul := httptest.NewServer(fakeConsul{
+		"user-grpc": {entryOf(t, "user-grpc", "http://"+listener.Addr().String())},
+	})
+	defer consul.Close()
+
+	dir, err := ioutil.TempDir("", "gateway")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	routeFile := filepath.Join(dir, "routes.yaml")
+	ioutil.WriteFile(routeFile, []byte(`
+routes:
+  - {name: user-grpc, service: user-grpc, match: {grpcService: pb.UserService}, timeout: 5s}
+  - {name: missing, service: missing, match: {grpcService: pb.MissingService}}
+  - {name: check-password, service: user-grpc, match: {path: /user/check-password, methods: [POST]}, transcode: {method: pb.UserService/CheckPassword}}
+  - {name: unavailable, service: missing, match: {path: /user/unavailable}, transcode: {method: pb.UserService/CheckPassword}}
+  - {name: unknown, service: user-grpc, match: {path: /unknown}, transcode: {method: pb.MissingService/Do}}
+`), 0644)
+	config := DefaultConfig()
+	config.ConsulAddr = strings.TrimPrefix(consul.URL, "http://")
+	config.RouteFile = routeFile
+	config.Middlewares = []string{MiddlewareLogging, MiddlewareGRPCWeb, MiddlewareTranscode}
+	gateway, err := New(config, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gateway.Close()
+	server := httptest.NewServer(gateway.Handler())
+	defer server.Close()
+
+	t.Run("grpc", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn, err := grpc.DialContext(ctx, strings.TrimPrefix(server.URL, "http://"), grpc.WithInsecure(), grpc.WithBlock())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		client := pb.NewUserServiceClient(conn)
+		resp, err := client.CheckPassword(ctx, &pb.LoginReq{Username: "admin", Password: "admin"})
+		if err != nil || resp.Ret != "success" {
+			t.Fatalf("unexpected response %v %v", resp, err)
+		}
+		// 上游返回的错误原样透传
+		_, err = client.CheckPassword(ctx, &pb.LoginReq{})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("expected InvalidArgument, got %v", err)
+		}
+		// 网关错误转换为gRPC状态
+		err = conn.Invoke(ctx, "/pb.MissingService/Do", &pb.LoginReq{}, &pb.LoginResp{})
+		if status.Code(err) != codes.Unavailable {
+			t.Fatalf("expected Unavailable, got %v", err)
+		}
+		err = conn.Invoke(ctx, "/pb.UnknownService/Do", &pb.LoginReq{}, &pb.LoginResp{})
+		if status.Code(err) != codes.Unimplemented {
+			t.Fatalf("expected Unimplemented, got %v", err)
+		}
+	})
+
+	grpcWeb := func(t *testing.T, contentType string, req *pb.LoginReq) (*http.Response, [][]byte, string) {
+		data, err := proto.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := frame(t, 0, data)
+		text := strings.HasPrefix(contentType, "application/grpc-web-text")
+		if text {
+			body = []byte(base64.StdEncoding.EncodeToString(body))
+		}
+		resp, err := http.Post(server.URL+"/pb.UserService/CheckPassword", contentType, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.ProtoMajor != 1 {
+			t.Fatalf("expected HTTP/1 response, got %s", resp.Proto)
+		}
+		body, _ = ioutil.ReadAll(resp.Body)
+		if text {
+			// 每次写入单独编码
+			var decoded []byte
+			for len(body) > 0 {
+				n := bytes.Index(body, []byte("=")) + 1
+				for n > 0 && n < len(body) && body[n] == '=' {
+					n++
+				}
+				if n == 0 {
+					n = len(body)
+				}
+				chunk, err := base64.StdEncoding.DecodeString(string(body[:n]))
+				if err != nil {
+					t.Fatal(err)
+				}
+				decoded = append(decoded, chunk...)
+				body = body[n:]
+			}
+			body = decoded
+		}
+		messages, trailer := parseFrames(t, body)
+		return resp, messages, trailer
+	}
+
+	for _, contentType := range []string{"application/grpc-web+proto", "application/grpc-web-text"} {
+		t.Run(contentType, func(t *testing.T) {
+			resp, messages, trailer := grpcWeb(t, contentType, &pb.LoginReq{Username: "admin", Password: "admin"})
+			if resp.Header.Get("Content-Type") != contentType {
+				t.Fatalf("unexpected content type %s", resp.Header.Get("Content-Type"))
+			}
+			if len(messages) != 1 || !strings.Contains(trailer, "grpc-status: 0\r\n") {
+				t.Fatalf("unexpected response %q %q", messages, trailer)
+			}
+			var loginResp pb.LoginResp
+			if err := proto.Unmarshal(messages[0], &loginResp); err != nil || loginResp.Ret != "success" {
+				t.Fatalf("unexpected response %v %v", loginResp.Ret, err)
+			}
+		})
+	}
+	t.Run("grpc-web unavailable", func(t *testing.T) {
+		resp, err := http.Post(server.URL+"/pb.MissingService/Do", "application/grpc-web+proto", bytes.NewReader(frame(t, 0, nil)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.Header.Get("Grpc-Status") != "14" || resp.Header.Get("Content-Type") != "application/grpc-web+proto" {
+			t.Fatalf("unexpected response %v", resp.Header)
+		}
+	})
+	t.Run("grpc-web error", func(t *testing.T) {
+		// 上游以Trailers-Only形式返回错误，状态在响应头中
+		resp, messages, trailer := grpcWeb(t, "application/grpc-web+proto", &pb.LoginReq{})
+		if len(messages) != 0 || trailer != "" || resp.Header.Get("Grpc-Status") != "3" {
+			t.Fatalf("unexpected response %v %q %q", resp.Header, messages, trailer)
+		}
+	})
+
+	t.Run("transcode", func(t *testing.T) {
+		cases := []struct {
+			path, body string
+			status     int
+			response   string
+		}{
+			{"/user/check-password", `{"Username": "admin", "Password": "admin"}`, http.StatusOK, `"Ret":"success"`},
+			{"/user/check-password", `{"Username": "admin"}`, http.StatusOK, `"err":""`},
+			// gRPC状态码转换为HTTP状态码
+			{"/user/check-password", `{}`, http.StatusBadRequest, "username is required"},
+			{"/user/check-password", ``, http.StatusBadRequest, "username is required"},
+			{"/user/check-password", `{"Nickname": "admin"}`, http.StatusBadRequest, "invalid request"},
+			{"/user/unavailable", `{}`, http.StatusServiceUnavailable, "service missing unavailable"},
+			{"/unknown", `{}`, http.StatusNotImplemented, "unknown grpc method"},
+		}
+		for _, c := range cases {
+			resp, err := http.Post(server.URL+c.path, "application/json", strings.NewReader(c.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != c.status || !strings.Contains(string(body), c.response) {
+				t.Fatalf("%s %s: unexpected response %d %s", c.path, c.body, resp.StatusCode, body)
+			}
+			if !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+				t.Fatalf("%s %s: unexpected content type %s", c.path, c.body, resp.Header.Get("Content-Type"))
+			}
+		}
+	})
+}
@@ -0,0 +1,266 @@
+package server
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/go-kit/kit/log"
+	"github.com/hashicorp/consul/api"
+	"github.com/openzipkin/zipkin-go"
+	zipkinhttpsvr "github.com/openzipkin/zipkin-go/middleware/http"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/auth"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/breaker"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/cache"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/canary"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/grpcweb"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/proxy"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/ratelimit"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/route"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/transcode"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/transform"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/upstream"
+	"github.com/yunfeiyang1916/micro-go-course/instrument"
+	"github.com/yunfeiyang1916/micro-go-course/tracing"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// 网关服务
+// 组装路由表、实例缓存、熔断器及按配置启用的中间件，
+// 请求依次经过 追踪 -> 访问日志 -> 路由匹配 -> 监控指标 -> 跨域及请求体限制 -> gRPC-Web转换 -> 认证 -> 限流 -> 灰度发布 -> 响应缓存 -> REST转gRPC -> 熔断重试转发
+
+type Server struct {
+	config   *Config
+	logger   log.Logger
+	routes   *route.Store
+	breakers *breaker.Breakers
+	// 未启用缓存时为空
+	cache   cache.Store
+	handler http.Handler
+	// 关闭时按相反顺序执行
+	closers []func()
+}
+
+// 创建网关，加载路由表并开始监听路由变化
+func New(config *Config, logger log.Logger) (*Server, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	s := &Server{
+		config: config,
+		logger: logger,
+		routes: route.NewStore(),
+	}
+	if err := s.init(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Server) init() error {
+	config := s.config
+	ctx, cancel := context.WithCancel(context.Background())
+	s.closers = append(s.closers, cancel)
+
+	// 加载路由表并监听变化
+	if len(config.EtcdEndpoints) > 0 {
+		etcdClient, err := route.NewEtcdClient(config.EtcdEndpoints)
+		if err != nil {
+			return err
+		}
+		// 先停止监听再关闭客户端
+		s.closers = append(s.closers, func() {
+			cancel()
+			etcdClient.Close()
+		})
+		source := &route.EtcdSource{Client: etcdClient, Key: config.EtcdKey}
+		if _, err := source.Load(ctx, s.routes); err != nil {
+			return err
+		}
+		go source.Watch(ctx, s.routes)
+	} else {
+		if err := route.LoadFile(s.routes, config.RouteFile); err != nil {
+			return err
+		}
+		go route.WatchFile(ctx, s.routes, config.RouteFile, 0)
+	}
+
+	// 创建consul api客户端及实例缓存
+	consulConfig := api.DefaultConfig()
+	consulConfig.Address = config.ConsulAddr
+	consulClient, err := api.NewClient(consulConfig)
+	if err != nil {
+		return err
+	}
+	resolver := upstream.NewConsulResolver(consulClient)
+	s.closers = append(s.closers, resolver.Close)
+
+	// 创建反向代理，按服务熔断
+	handler := proxy.NewHandler(s.routes, resolver, s.logger)
+	s.breakers = breaker.New(config.Breaker)
+	handler.SetBreakers(s.breakers)
+
+	// 路由匹配后执行的过滤器，先认证再限流，按用户或客户端限流时需要认证结果
+	var filters []proxy.Filter
+	// 最先执行，统计被之后的过滤器拒绝的请求
+	if config.Enabled(MiddlewareMetrics) {
+		filters = append(filters, instrument.DefaultMetrics.HTTPMiddleware("gateway", routeName))
+	}
+	// 跨域预检请求不携带令牌，需在认证之前处理
+	if config.Enabled(MiddlewareTransform) {
+		filters = append(filters, transform.Filter())
+		handler.UseDirector(transform.Director())
+		handler.UseResponseModifier(transform.ModifyResponse())
+	}
+	// gRPC-Web转换需在认证之前执行，之后的过滤器按gRPC请求处理
+	if config.Enabled(MiddlewareGRPCWeb) {
+		filters = append(filters, grpcweb.Filter())
+	}
+	if config.Enabled(MiddlewareAuth) {
+		filters = append(filters, auth.Filter(s.verifier(), s.logger))
+	}
+	if config.Enabled(MiddlewareRateLimit) {
+		filters = append(filters, ratelimit.Filter(s.limiter(), s.logger))
+	}
+	// 按用户分配版本时需要认证结果
+	if config.Enabled(MiddlewareCanary) {
+		filters = append(filters, canary.Filter(resolver))
+	}
+	// 缓存键包含灰度选择的实例子集，命中时跳过之后的过滤器
+	if config.Enabled(MiddlewareCache) {
+		s.cache = s.cacheStore()
+		filters = append(filters, cache.Filter(s.cache, config.Cache.MaxEntrySize, s.logger))
+	}
+	// REST转gRPC最后执行，之前的过滤器仍按JSON请求返回错误，proto描述由导入的pb包注册
+	if config.Enabled(MiddlewareTranscode) {
+		filters = append(filters, transcode.Filter(protoregistry.GlobalFiles, s.logger))
+	}
+	handler.Use(filters...)
+
+	// 作用于所有请求的中间件
+	s.handler = handler
+	if config.Enabled(MiddlewareLogging) {
+		s.handler = loggingMiddleware(s.logger)(s.handler)
+	}
+	if config.Enabled(MiddlewareTracing) {
+		tracer, err := s.tracer()
+		if err != nil {
+			return err
+		}
+		// 追踪上游请求，每次重试单独记录
+		transport, err := zipkinhttpsvr.NewTransport(tracer, zipkinhttpsvr.TransportTrace(true))
+		if err != nil {
+			return err
+		}
+		h2cTransport, err := zipkinhttpsvr.NewTransport(tracer, zipkinhttpsvr.TransportTrace(true), zipkinhttpsvr.RoundTripper(proxy.NewH2CTransport()))
+		if err != nil {
+			return err
+		}
+		handler.SetTransport(route.ProtocolHTTP, transport)
+		handler.SetTransport(route.ProtocolH2C, h2cTransport)
+		handler.SetTransport(route.ProtocolGRPC, h2cTransport)
+		tags := map[string]string{
+			"component": "gateway_server",
+		}
+		s.handler = zipkinhttpsvr.NewServerMiddleware(tracer, zipkinhttpsvr.SpanName("gateway"), zipkinhttpsvr.TagResponseSize(true), zipkinhttpsvr.ServerTags(tags))(s.handler)
+	}
+	// 接受明文HTTP/2客户端，HTTP/1请求不受影响
+	if config.H2C {
+		s.handler = h2c.NewHandler(s.handler, &http2.Server{IdleTimeout: config.IdleTimeout})
+	}
+	return nil
+}
+
+// 以路由名作为监控指标的方法标签
+func routeName(req *http.Request) string {
+	return proxy.RouteFromContext(req.Context()).Name
+}
+
+// 令牌校验器，配置了jwt密钥时本地校验，否则调用oauth服务
+func (s *Server) verifier() auth.Verifier {
+	config := s.config.Auth
+	if config.JWTSecret != "" {
+		return auth.NewJWTVerifier(config.JWTSecret)
+	}
+	return auth.NewRemoteVerifier(&auth.RemoteConfig{
+		CheckTokenURL: config.CheckTokenURL,
+		ClientId:      config.ClientId,
+		ClientSecret:  config.ClientSecret,
+		CacheTTL:      config.CacheTTL,
+	})
+}
+
+// 限流器，多实例部署时通过redis共享限额
+func (s *Server) limiter() ratelimit.Limiter {
+	config := s.config.RateLimit
+	if config.RedisAddr == "" {
+		return ratelimit.NewLocalLimiter()
+	}
+	pool := ratelimit.NewPool(config.RedisAddr, config.RedisPassword)
+	s.closers = append(s.closers, func() {
+		pool.Close()
+	})
+	return ratelimit.NewRedisLimiter(pool)
+}
+
+// 响应缓存，多实例部署时通过redis共享
+func (s *Server) cacheStore() cache.Store {
+	config := s.config.Cache
+	if config.RedisAddr == "" {
+		return cache.NewMemoryStore(config.MaxBytes)
+	}
+	pool := ratelimit.NewPool(config.RedisAddr, config.RedisPassword)
+	s.closers = append(s.closers, func() {
+		pool.Close()
+	})
+	return cache.NewRedisStore(pool)
+}
+
+func (s *Server) tracer() (*zipkin.Tracer, error) {
+	config := s.config.tracing()
+	tracer, closer, err := tracing.New(config)
+	if err != nil {
+		return nil, err
+	}
+	s.closers = append(s.closers, closer)
+	s.logger.Log("tracer", config.Exporter, "sampleRate", config.SampleRate)
+	return tracer, nil
+}
+
+// 网关处理器
+func (s *Server) Handler() http.Handler {
+	return s.handler
+}
+
+// 网关的http服务，不设置写超时，避免断开WebSocket、SSE等长连接
+func (s *Server) HTTPServer() *http.Server {
+	return &http.Server{
+		Addr:              s.config.ListenAddr,
+		Handler:           s.handler,
+		ReadHeaderTimeout: s.config.ReadHeaderTimeout,
+		IdleTimeout:       s.config.IdleTimeout,
+	}
+}
+
+// 管理接口，返回路由表、熔断器状态及监控指标，启用缓存时可清除缓存
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/admin/routes", route.AdminHandler(s.routes))
+	mux.Handle("/admin/breakers", breaker.AdminHandler(s.breakers))
+	mux.Handle("/metrics", promhttp.Handler())
+	if s.cache != nil {
+		mux.Handle("/admin/cache", cache.AdminHandler(s.cache))
+	}
+	return mux
+}
+
+// 停止监听路由及实例变化，上报剩余的追踪数据
+func (s *Server) Close() {
+	for i := len(s.closers) - 1; i >= 0; i-- {
+		s.closers[i]()
+	}
+	s.closers = nil
+}
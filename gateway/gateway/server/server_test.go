@@ -0,0 +1,224 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-kit/kit/log"
+	"github.com/hashicorp/consul/api"
+)
+
+// 模拟consul健康查询接口，阻塞查询一直等待到请求取消
+type fakeConsul map[string][]*api.ServiceEntry
+
+func (f fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("index") != "" {
+		<-r.Context().Done()
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/v1/health/service/")
+	w.Header().Set("X-Consul-Index", "1")
+	json.NewEncoder(w).Encode(f[name])
+}
+
+// 线程安全的日志缓冲
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func sign(t *testing.T, secret string) string {
+	claims := jwt.MapClaims{
+		"UserDetails":   map[string]interface{}{"UserId": 1, "Username": "aoho"},
+		"ClientDetails": map[string]interface{}{"ClientId": "clientId"},
+		"exp":           time.Now().Add(time.Hour).Unix(),
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestServer(t *testing.T) {
+	// 上游服务返回收到的路径、用户及追踪头
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"path":    r.URL.Path,
+			"user":    r.Header.Get("X-User-Id"),
+			"traceId": r.Header.Get("X-B3-TraceId"),
+		})
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+	port, _ := strconv.Atoi(u.Port())
+	consul := httptest.NewServer(fakeConsul{
+		"goods": {{
+			Node:    &api.Node{Address: "127.0.0.1"},
+			Service: &api.AgentService{ID: "goods-1", Service: "goods", Port: port},
+		}},
+	})
+	defer consul.Close()
+	// 接收上报的span
+	var spans int
+	var spansMu sync.Mutex
+	zipkin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch []map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&batch)
+		spansMu.Lock()
+		spans += len(batch)
+		spansMu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer zipkin.Close()
+
+	dir, err := ioutil.TempDir("", "gateway")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	routeFile := filepath.Join(dir, "routes.yaml")
+	ioutil.WriteFile(routeFile, []byte(`
+routes:
+  - {name: goods, service: goods, match: {pathPrefix: /goods}, rewrite: {prefix: /}, auth: {required: true}}
+  - {name: public, service: goods, match: {pathPrefix: /public}}
+  - {name: missing, service: missing, match: {pathPrefix: /missing}}
+`), 0644)
+
+	logs := &syncBuffer{}
+	config := DefaultConfig()
+	config.ConsulAddr = strings.TrimPrefix(consul.URL, "http://")
+	config.RouteFile = routeFile
+	config.Middlewares = []string{MiddlewareTracing, MiddlewareLogging, MiddlewareMetrics, MiddlewareAuth, MiddlewareRateLimit}
+	config.Tracing.ZipkinURL = zipkin.URL
+	config.Auth.JWTSecret = "secret"
+	gateway, err := New(config, log.NewLogfmtLogger(logs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(gateway.Handler())
+	defer server.Close()
+
+	get := func(path, token string) (int, map[string]string) {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body map[string]string
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body
+	}
+
+	status, body := get("/public/list", "")
+	if status != http.StatusOK || body["path"] != "/public/list" || body["traceId"] == "" {
+		t.Fatalf("unexpected response %d %v", status, body)
+	}
+	if status, _ = get("/goods/list", ""); status != http.StatusUnauthorized {
+		t.Fatalf("expected status 401 without token, got %d", status)
+	}
+	status, body = get("/goods/list", sign(t, "secret"))
+	if status != http.StatusOK || body["path"] != "/list" || body["user"] != "1" {
+		t.Fatalf("unexpected response %d %v", status, body)
+	}
+	if status, _ = get("/missing/a", ""); status != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503 for service without instances, got %d", status)
+	}
+	if status, _ = get("/unknown", ""); status != http.StatusNotFound {
+		t.Fatalf("expected status 404, got %d", status)
+	}
+	if !strings.Contains(logs.String(), "path=/goods/list status=401") {
+		t.Fatalf("expected access log, got %s", logs.String())
+	}
+
+	// 管理接口
+	w := httptest.NewRecorder()
+	gateway.AdminHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/breakers", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"service":"goods"`) {
+		t.Fatalf("unexpected breakers %d %s", w.Code, w.Body.String())
+	}
+	// 被认证拒绝的请求也按路由统计
+	w = httptest.NewRecorder()
+	gateway.AdminHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(w.Body.String(), `http_requests_total{method="goods",service="gateway",status="401"}`) {
+		t.Fatalf("expected route metrics, got %s", w.Body.String())
+	}
+
+	// 关闭时上报剩余的span
+	gateway.Close()
+	spansMu.Lock()
+	defer spansMu.Unlock()
+	if spans == 0 {
+		t.Fatal("expected spans reported to zipkin")
+	}
+}
+
+func TestMiddlewaresDisabled(t *testing.T) {
+	if _, err := New(&Config{ListenAddr: ":0", Middlewares: []string{"unknown"}}, log.NewNopLogger()); err == nil {
+		t.Fatal("expected error for unknown middleware")
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-B3-TraceId")))
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+	port, _ := strconv.Atoi(u.Port())
+	consul := httptest.NewServer(fakeConsul{
+		"goods": {{
+			Node:    &api.Node{Address: "127.0.0.1"},
+			Service: &api.AgentService{ID: "goods-1", Service: "goods", Port: port},
+		}},
+	})
+	defer consul.Close()
+	dir, err := ioutil.TempDir("", "gateway")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	routeFile := filepath.Join(dir, "routes.yaml")
+	ioutil.WriteFile(routeFile, []byte("routes:\n  - {name: goods, service: goods, match: {pathPrefix: /goods}, auth: {required: true}}\n"), 0644)
+
+	config := DefaultConfig()
+	config.ConsulAddr = strings.TrimPrefix(consul.URL, "http://")
+	config.RouteFile = routeFile
+	config.Middlewares = nil
+	gateway, err := New(config, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gateway.Close()
+	// 未启用认证和追踪时直接转发
+	w := httptest.NewRecorder()
+	gateway.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/goods/list", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "" {
+		t.Fatalf("unexpected response %d %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/hashicorp/consul/api"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func entryOf(t *testing.T, service, rawurl string) *api.ServiceEntry {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := strconv.Atoi(u.Port())
+	return &api.ServiceEntry{
+		Node:    &api.Node{Address: u.Hostname()},
+		Service: &api.AgentService{ID: service + "-1", Service: service, Port: port},
+	}
+}
+
+// 回显数据的WebSocket上游，只完成握手，不解析帧
+func echoUpgrade(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upgrade") != "websocket" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	conn, brw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	brw.Flush()
+	io.Copy(conn, brw)
+}
+
+func TestStreaming(t *testing.T) {
+	// 每50ms推送一个事件，共推送4个
+	events := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 4; i++ {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+		}
+	}))
+	defer events.Close()
+	ws := httptest.NewServer(http.HandlerFunc(echoUpgrade))
+	defer ws.Close()
+	h2 := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}), &http2.Server{}))
+	defer h2.Close()
+	consul := httptest.NewServer(fakeConsul{
+		"events": {entryOf(t, "events", events.URL)},
+		"ws":     {entryOf(t, "ws", ws.URL)},
+		"h2":     {entryOf(t, "h2", h2.URL)},
+	})
+	defer consul.Close()
+
+	dir, err := ioutil.TempDir("", "gateway")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	routeFile := filepath.Join(dir, "routes.yaml")
+	ioutil.WriteFile(routeFile, []byte(`
+routes:
+  - {name: events, service: events, match: {pathPrefix: /events}, timeout: 50ms, maxConnections: 1}
+  - {name: ws, service: ws, match: {pathPrefix: /ws}, timeout: 50ms, idleTimeout: 200ms}
+  - {name: h2, service: h2, match: {pathPrefix: /h2}, protocol: h2c}
+`), 0644)
+	config := DefaultConfig()
+	config.ConsulAddr = strings.TrimPrefix(consul.URL, "http://")
+	config.RouteFile = routeFile
+	config.Middlewares = []string{MiddlewareLogging}
+	config.H2C = true
+	gateway, err := New(config, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gateway.Close()
+	server := httptest.NewServer(gateway.Handler())
+	defer server.Close()
+
+	t.Run("sse", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/events", nil)
+		req.Header.Set("Accept", "text/event-stream")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		// 首个事件在上游结束前到达
+		reader := bufio.NewReader(resp.Body)
+		line, err := reader.ReadString('\n')
+		if err != nil || line != "data: 0\n" {
+			t.Fatalf("expected first event, got %q %v", line, err)
+		}
+		// 流未结束时超过路由的最大连接数
+		second, err := http.Get(server.URL + "/events")
+		if err != nil {
+			t.Fatal(err)
+		}
+		second.Body.Close()
+		if second.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("expected status 503 over max connections, got %d", second.StatusCode)
+		}
+		// 超过路由超时的流不会被中断
+		rest, err := ioutil.ReadAll(reader)
+		if err != nil || !strings.HasSuffix(string(rest), "data: 3\n\n") {
+			t.Fatalf("expected all events, got %q %v", rest, err)
+		}
+	})
+
+	t.Run("websocket", func(t *testing.T) {
+		conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "GET /ws HTTP/1.1\r\nHost: gateway\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("expected status 101, got %d", resp.StatusCode)
+		}
+		// 超过路由超时后连接仍然可用
+		time.Sleep(100 * time.Millisecond)
+		conn.Write([]byte("ping"))
+		buf := make([]byte, 4)
+		if _, err = io.ReadFull(reader, buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("expected echo, got %q %v", buf, err)
+		}
+		// 空闲超时后断开
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err = reader.ReadByte(); err != io.EOF {
+			t.Fatalf("expected connection closed after idle timeout, got %v", err)
+		}
+	})
+
+	t.Run("h2c", func(t *testing.T) {
+		resp, err := http.Get(server.URL + "/h2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		if string(body) != "HTTP/2.0" {
+			t.Fatalf("expected h2c upstream, got %q", body)
+		}
+		// h2c客户端
+		client := &http.Client{Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			},
+		}}
+		resp, err = client.Get(server.URL + "/h2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.ProtoMajor != 2 {
+			t.Fatalf("expected HTTP/2 response, got %s", resp.Proto)
+		}
+	})
+}
@@ -0,0 +1,183 @@
+package transcode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/proxy"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// REST转gRPC
+// 配置了transcode的路由把JSON请求体按方法的proto描述转换为gRPC请求消息，调用上游gRPC实例，
+// 成功时把响应消息转换为JSON返回，失败时按gRPC状态码返回对应的HTTP状态码及错误信息。
+// proto描述从注册表中查找，需导入对应的pb包，只支持一元调用
+
+// 请求体的最大长度，与gRPC默认的最大接收消息长度一致
+const maxMessageSize = 4 << 20
+
+var (
+	errMissingStatus = errors.New("missing grpc-status")
+	errInvalidFrame  = errors.New("invalid grpc message frame")
+)
+
+// 输出JSON时保留零值字段，客户端不用区分字段缺失和零值
+var marshaler = protojson.MarshalOptions{EmitUnpopulated: true}
+
+// 创建REST转gRPC过滤器，从files中查找方法的proto描述，需在其他过滤器之后执行
+func Filter(files *protoregistry.Files, logger log.Logger) proxy.Filter {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			rt := proxy.RouteFromContext(req.Context())
+			if rt.Transcode == nil {
+				next.ServeHTTP(w, req)
+				return
+			}
+			method, err := findMethod(files, rt.Transcode.Method)
+			if err != nil {
+				logger.Log("route", rt.Name, "method", rt.Transcode.Method, "err", err)
+				proxy.WriteError(w, http.StatusNotImplemented, err.Error())
+				return
+			}
+			data, status, err := decodeRequest(req.Body, method)
+			if err != nil {
+				proxy.WriteError(w, status, err.Error())
+				return
+			}
+			out := req.Clone(req.Context())
+			out.Method = http.MethodPost
+			out.URL.Path = "/" + rt.Transcode.Method
+			out.URL.RawPath = ""
+			out.URL.RawQuery = ""
+			out.Header.Set("Content-Type", proxy.ContentTypeGRPC+"+proto")
+			out.Header.Set("Te", "trailers")
+			out.Header.Del("Content-Length")
+			out.Header.Del("Accept-Encoding")
+			out.Body = ioutil.NopCloser(bytes.NewReader(data))
+			out.ContentLength = int64(len(data))
+			rec := &recorder{header: make(http.Header), status: http.StatusOK}
+			next.ServeHTTP(rec, out)
+			if err := writeResponse(w, rec, method); err != nil {
+				logger.Log("route", rt.Name, "method", rt.Transcode.Method, "err", err)
+				proxy.WriteError(w, http.StatusBadGateway, "upstream "+rt.Service+" error")
+			}
+		})
+	}
+}
+
+// 查找一元调用方法的proto描述，method形如 pb.UserService/CheckPassword
+func findMethod(files *protoregistry.Files, method string) (protoreflect.MethodDescriptor, error) {
+	name := protoreflect.FullName(strings.Replace(method, "/", ".", 1))
+	d, err := files.FindDescriptorByName(name)
+	if err != nil {
+		return nil, errors.New("unknown grpc method " + method)
+	}
+	md, ok := d.(protoreflect.MethodDescriptor)
+	if !ok {
+		return nil, errors.New("unknown grpc method " + method)
+	}
+	if md.IsStreamingClient() || md.IsStreamingServer() {
+		return nil, errors.New("streaming method " + method + " cannot be transcoded")
+	}
+	return md, nil
+}
+
+// 将JSON请求体转换为gRPC消息帧，空请求体对应空消息，出错时返回对应的HTTP状态码
+func decodeRequest(body io.Reader, method protoreflect.MethodDescriptor) ([]byte, int, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(body, maxMessageSize+1))
+	if errors.Is(err, proxy.ErrBodyTooLarge) {
+		return nil, http.StatusRequestEntityTooLarge, err
+	}
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if len(data) > maxMessageSize {
+		return nil, http.StatusRequestEntityTooLarge, errors.New("request body too large")
+	}
+	in := dynamicpb.NewMessage(method.Input())
+	if len(bytes.TrimSpace(data)) > 0 {
+		if err := protojson.Unmarshal(data, in); err != nil {
+			return nil, http.StatusBadRequest, errors.New("invalid request: " + err.Error())
+		}
+	}
+	msg, err := proto.Marshal(in)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...), 0, nil
+}
+
+// 将gRPC响应转换为JSON，上游响应不符合gRPC协议时返回错误
+func writeResponse(w http.ResponseWriter, rec *recorder, method protoreflect.MethodDescriptor) error {
+	if rec.status != http.StatusOK {
+		return errors.New("upstream http status " + strconv.Itoa(rec.status))
+	}
+	// Trailers-Only响应的状态在响应头中
+	trailer := proxy.Trailers(rec.header)
+	if trailer.Get("Grpc-Status") == "" {
+		trailer = rec.header
+	}
+	code, err := strconv.Atoi(trailer.Get("Grpc-Status"))
+	if err != nil {
+		return errMissingStatus
+	}
+	st := status.New(codes.Code(code), proxy.DecodeGRPCMessage(trailer.Get("Grpc-Message")))
+	if st.Code() != codes.OK {
+		proxy.WriteError(w, proxy.HTTPStatus(st.Code()), st.Message())
+		return nil
+	}
+	body := rec.body.Bytes()
+	// 未压缩的单个消息帧
+	if len(body) < 5 || body[0] != 0 || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+		return errInvalidFrame
+	}
+	out := dynamicpb.NewMessage(method.Output())
+	if err := proto.Unmarshal(body[5:], out); err != nil {
+		return err
+	}
+	data, err := marshaler.Marshal(out)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(data)
+	return err
+}
+
+// 缓存上游gRPC响应
+type recorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *recorder) Header() http.Header {
+	return r.header
+}
+
+func (r *recorder) WriteHeader(status int) {
+	r.status = status
+}
+
+func (r *recorder) Write(p []byte) (int, error) {
+	return r.body.Write(p)
+}
+
+// 一元调用只在响应结束后转换，无需刷新
+func (r *recorder) Flush() {}
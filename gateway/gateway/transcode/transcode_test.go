@@ -0,0 +1,125 @@
+package transcode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/proxy"
+	"github.com/yunfeiyang1916/micro-go-course/grpc-kit/pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+func checkPassword(t *testing.T) protoreflect.MethodDescriptor {
+	method, err := findMethod(protoregistry.GlobalFiles, "pb.UserService/CheckPassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return method
+}
+
+func TestDecodeRequest(t *testing.T) {
+	method := checkPassword(t)
+	data, _, err := decodeRequest(strings.NewReader(`{"Username": "admin", "Password": "secret"}`), method)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[0] != 0 || int(binary.BigEndian.Uint32(data[1:5])) != len(data)-5 {
+		t.Fatalf("invalid message frame %q", data)
+	}
+	req := &pb.LoginReq{}
+	if err = proto.Unmarshal(data[5:], req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Username != "admin" || req.Password != "secret" {
+		t.Fatalf("unexpected message %v", req)
+	}
+
+	// 空请求体对应空消息
+	if data, _, err = decodeRequest(strings.NewReader(""), method); err != nil || len(data) != 5 {
+		t.Fatalf("expected empty message, got %q %v", data, err)
+	}
+	cases := []string{`{"Username": 1}`, `{"Unknown": "x"}`, `not json`}
+	for _, body := range cases {
+		if _, status, err := decodeRequest(strings.NewReader(body), method); err == nil || status != http.StatusBadRequest {
+			t.Fatalf("%s: expected bad request, got %d %v", body, status, err)
+		}
+	}
+	if _, err = findMethod(protoregistry.GlobalFiles, "pb.UserService/Missing"); err == nil {
+		t.Fatal("expected unknown method error")
+	}
+}
+
+func TestWriteResponse(t *testing.T) {
+	method := checkPassword(t)
+	msg, err := proto.Marshal(&pb.LoginResp{Ret: "success"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	frame = append(frame, msg...)
+
+	cases := []struct {
+		code   codes.Code
+		status int
+	}{
+		{codes.OK, http.StatusOK},
+		{codes.InvalidArgument, http.StatusBadRequest},
+		{codes.Unauthenticated, http.StatusUnauthorized},
+		{codes.Unavailable, http.StatusServiceUnavailable},
+	}
+	for _, c := range cases {
+		if status := proxy.HTTPStatus(c.code); status != c.status {
+			t.Fatalf("grpc status %d: expected http status %d, got %d", c.code, c.status, status)
+		}
+		rec := &recorder{header: make(http.Header), status: http.StatusOK}
+		rec.header.Set("Trailer", "Grpc-Status, Grpc-Message")
+		if c.code == codes.OK {
+			rec.Write(frame)
+		}
+		rec.header.Set("Grpc-Status", strconv.Itoa(int(c.code)))
+		rec.header.Set("Grpc-Message", "status%20"+strconv.Itoa(int(c.code)))
+		w := httptest.NewRecorder()
+		if err := writeResponse(w, rec, method); err != nil {
+			t.Fatalf("grpc status %d: %v", c.code, err)
+		}
+		if w.Code != c.status {
+			t.Fatalf("grpc status %d: expected http status %d, got %d", c.code, c.status, w.Code)
+		}
+		var body map[string]string
+		json.Unmarshal(w.Body.Bytes(), &body)
+		if c.code == codes.OK && body["Ret"] != "success" {
+			t.Fatalf("expected json response, got %s", w.Body)
+		}
+		if c.code != codes.OK && body["error"] != "status "+strconv.Itoa(int(c.code)) {
+			t.Fatalf("grpc status %d: expected decoded message, got %s", c.code, w.Body)
+		}
+	}
+
+	// Trailers-Only响应的状态在响应头中
+	rec := &recorder{header: http.Header{"Grpc-Status": {"16"}}, status: http.StatusOK}
+	w := httptest.NewRecorder()
+	if err := writeResponse(w, rec, method); err != nil || w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 from trailers-only response, got %d %v", w.Code, err)
+	}
+	// 不符合gRPC协议的上游响应
+	bad := []*recorder{
+		{header: make(http.Header), status: http.StatusNotFound},
+		{header: make(http.Header), status: http.StatusOK},
+		{header: http.Header{"Grpc-Status": {"0"}}, status: http.StatusOK, body: *bytes.NewBuffer([]byte{0, 0, 0, 0, 9})},
+	}
+	for i, rec := range bad {
+		if err := writeResponse(httptest.NewRecorder(), rec, method); err == nil {
+			t.Fatalf("case %d: expected error", i)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package transform
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/proxy"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/route"
+)
+
+// 请求及响应转换
+// Filter 在路由匹配后处理跨域请求并限制请求体大小，需最先执行，预检请求不携带令牌；
+// Director 在转发前按路由规则修改请求头；
+// ModifyResponse 在返回前按路由规则修改响应头并压缩响应
+
+// 创建跨域及请求体大小限制过滤器
+func Filter() proxy.Filter {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			rt := proxy.RouteFromContext(req.Context())
+			if rt.CORS != nil && req.Header.Get("Origin") != "" {
+				if done := cors(w, req, rt.CORS); done {
+					return
+				}
+			}
+			if rt.MaxBodySize > 0 && req.Body != nil && req.Body != http.NoBody {
+				if req.ContentLength > rt.MaxBodySize {
+					proxy.Error(w, req, http.StatusRequestEntityTooLarge, proxy.ErrBodyTooLarge.Error())
+					return
+				}
+				// 未声明长度的请求体在读取时校验
+				req.Body = &limitedBody{ReadCloser: req.Body, remaining: rt.MaxBodySize}
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// 设置跨域响应头，预检请求直接返回，返回是否已响应
+func cors(w http.ResponseWriter, req *http.Request, c *route.CORS) bool {
+	origin := req.Header.Get("Origin")
+	preflight := route.IsPreflight(req)
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	if !c.AllowOrigin(origin) {
+		if preflight {
+			proxy.Error(w, req, http.StatusForbidden, "origin "+origin+" not allowed")
+			return true
+		}
+		// 不设置跨域头，由浏览器拦截响应
+		return false
+	}
+	if len(c.AllowOrigins) == 1 && c.AllowOrigins[0] == "*" {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+	if c.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if !preflight {
+		if len(c.ExposeHeaders) > 0 {
+			h.Set("Access-Control-Expose-Headers", strings.Join(c.ExposeHeaders, ", "))
+		}
+		return false
+	}
+	h.Set("Access-Control-Allow-Methods", strings.Join(c.AllowMethods, ", "))
+	if len(c.AllowHeaders) > 0 {
+		h.Set("Access-Control-Allow-Headers", strings.Join(c.AllowHeaders, ", "))
+	} else if headers := req.Header.Get("Access-Control-Request-Headers"); headers != "" {
+		h.Set("Access-Control-Allow-Headers", headers)
+	}
+	if c.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(time.Duration(c.MaxAge)/time.Second)))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// 超过长度限制时返回 proxy.ErrBodyTooLarge 的请求体
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	err       error
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	// 多读一个字节以判断是否超过限制
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) <= b.remaining {
+		b.remaining -= int64(n)
+		return n, err
+	}
+	n = int(b.remaining)
+	b.remaining = 0
+	b.err = proxy.ErrBodyTooLarge
+	return n, b.err
+}
+
+// 按路由规则修改上游请求头
+func Director() proxy.Director {
+	return func(req *http.Request) {
+		rt := proxy.RouteFromContext(req.Context())
+		if rt.RequestHeaders != nil {
+			rt.RequestHeaders.Apply(req.Header)
+		}
+	}
+}
+
+// 按路由规则修改上游响应头并压缩响应
+func ModifyResponse() proxy.ResponseModifier {
+	return func(resp *http.Response) error {
+		rt := proxy.RouteFromContext(resp.Request.Context())
+		if rt.CORS != nil {
+			// 跨域头由网关统一设置，避免与上游重复
+			for k := range resp.Header {
+				if strings.HasPrefix(k, "Access-Control-") {
+					delete(resp.Header, k)
+				}
+			}
+		}
+		if rt.ResponseHeaders != nil {
+			rt.ResponseHeaders.Apply(resp.Header)
+		}
+		if rt.Compression != nil {
+			compress(resp, rt.Compression)
+		}
+		return nil
+	}
+}
+
+// 客户端支持且响应适合压缩时压缩响应体
+func compress(resp *http.Response, c *route.Compression) {
+	if resp.Header.Get("Content-Encoding") != "" || resp.Request.Method == http.MethodHead {
+		return
+	}
+	if resp.StatusCode < http.StatusOK || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength < c.MinSize {
+		return
+	}
+	if !compressible(resp.Header.Get("Content-Type"), c.Types) {
+		return
+	}
+	encoding := negotiate(resp.Request.Header.Get("Accept-Encoding"))
+	if encoding == "" {
+		return
+	}
+	resp.Header.Set("Content-Encoding", encoding)
+	resp.Header.Del("Content-Length")
+	resp.Header.Add("Vary", "Accept-Encoding")
+	resp.ContentLength = -1
+	body := resp.Body
+	pr, pw := io.Pipe()
+	go func() {
+		var w io.WriteCloser
+		if encoding == "br" {
+			w = brotli.NewWriter(pw)
+		} else {
+			w = gzip.NewWriter(pw)
+		}
+		_, err := io.Copy(w, body)
+		if err == nil {
+			err = w.Close()
+		}
+		body.Close()
+		pw.CloseWithError(err)
+	}()
+	resp.Body = pr
+}
+
+// 响应类型是否需要压缩，SSE需要逐条推送，不压缩
+func compressible(contentType string, types []string) bool {
+	if contentType == "" || strings.HasPrefix(contentType, "text/event-stream") {
+		return false
+	}
+	for _, t := range types {
+		if strings.HasPrefix(contentType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// 按 br、gzip 的优先级选择客户端接受的编码，q=0 表示不接受
+func negotiate(acceptEncoding string) string {
+	qualities := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, _ = strconv.ParseFloat(param[2:], 64)
+			}
+		}
+		qualities[name] = q
+	}
+	for _, encoding := range []string{"br", "gzip"} {
+		q, ok := qualities[encoding]
+		if !ok {
+			q, ok = qualities["*"]
+		}
+		if ok && q > 0 {
+			return encoding
+		}
+	}
+	return ""
+}
@@ -0,0 +1,225 @@
+package transform
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/go-kit/kit/log"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/proxy"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/route"
+	"github.com/yunfeiyang1916/micro-go-course/gateway/gateway/upstream"
+)
+
+// 所有服务都解析到测试上游
+type staticResolver struct {
+	instance *upstream.Instance
+}
+
+func (s staticResolver) Instances(ctx context.Context, serviceName string) ([]*upstream.Instance, error) {
+	return []*upstream.Instance{s.instance}, nil
+}
+
+func TestTransform(t *testing.T) {
+	var (
+		mu          sync.Mutex
+		upstreamReq *http.Request
+	)
+	lastRequest := func() *http.Request {
+		mu.Lock()
+		defer mu.Unlock()
+		return upstreamReq
+	}
+	payload := strings.Repeat("hello gateway ", 200)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		upstreamReq = r.Clone(context.Background())
+		mu.Unlock()
+		if _, err := ioutil.ReadAll(r.Body); err != nil {
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("X-Powered-By", "go")
+		w.Header().Set("X-Internal", "1")
+		switch r.URL.Path {
+		case "/goods/small":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{}`))
+		case "/goods/encoded":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Encoding", "identity")
+			w.Write([]byte(payload))
+		default:
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Write([]byte(payload))
+		}
+	}))
+	defer backend.Close()
+	u, _ := url.Parse(backend.URL)
+	port, _ := strconv.Atoi(u.Port())
+	resolver := staticResolver{&upstream.Instance{ID: "backend", Address: u.Hostname(), Port: port}}
+
+	config, err := route.Parse([]byte(`
+routes:
+  - name: goods
+    service: goods
+    match: {pathPrefix: /goods, methods: [GET, POST]}
+    rewrite: {regex: "^/goods/(\\d+)$", replacement: /v2/goods/$1}
+    requestHeaders:
+      add: {X-Gateway: "1"}
+      remove: [X-Debug]
+      rename: {X-Token: X-Upstream-Token}
+    responseHeaders:
+      remove: [X-Powered-By]
+      rename: {X-Internal: X-Served-By}
+    cors:
+      allowOrigins: [https://shop.example.com]
+      exposeHeaders: [X-Served-By]
+      allowCredentials: true
+      maxAge: 10m
+    maxBodySize: 16
+    compression: {}
+  - {name: plain, service: plain, match: {pathPrefix: /}}
+`), "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := route.NewStore()
+	routes.Update(config, "test")
+	handler := proxy.NewHandler(routes, resolver, log.NewNopLogger())
+	handler.Use(Filter())
+	handler.UseDirector(Director())
+	handler.UseResponseModifier(ModifyResponse())
+
+	serve := func(method, path string, body io.Reader, header map[string]string) *httptest.ResponseRecorder {
+		mu.Lock()
+		upstreamReq = nil
+		mu.Unlock()
+		req := httptest.NewRequest(method, path, body)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("headers", func(t *testing.T) {
+		rec := serve("GET", "/goods/12", nil, map[string]string{"X-Debug": "1", "X-Token": "abc", "Origin": "https://shop.example.com"})
+		upstreamReq := lastRequest()
+		if rec.Code != http.StatusOK || upstreamReq == nil {
+			t.Fatalf("unexpected status %d", rec.Code)
+		}
+		if upstreamReq.URL.Path != "/v2/goods/12" {
+			t.Fatalf("expected rewritten path, got %s", upstreamReq.URL.Path)
+		}
+		h := upstreamReq.Header
+		if h.Get("X-Gateway") != "1" || h.Get("X-Debug") != "" || h.Get("X-Token") != "" || h.Get("X-Upstream-Token") != "abc" {
+			t.Fatalf("unexpected upstream headers %v", h)
+		}
+		h = rec.Header()
+		if h.Get("X-Powered-By") != "" || h.Get("X-Internal") != "" || h.Get("X-Served-By") != "1" {
+			t.Fatalf("unexpected response headers %v", h)
+		}
+		// 上游的跨域头被网关的替换
+		if v := h["Access-Control-Allow-Origin"]; len(v) != 1 || v[0] != "https://shop.example.com" {
+			t.Fatalf("unexpected allow origin %v", v)
+		}
+		if h.Get("Access-Control-Allow-Credentials") != "true" || h.Get("Access-Control-Expose-Headers") != "X-Served-By" {
+			t.Fatalf("unexpected cors headers %v", h)
+		}
+		// 未配置转换的路由原样转发
+		rec = serve("GET", "/other", nil, map[string]string{"X-Debug": "1"})
+		if lastRequest().Header.Get("X-Debug") != "1" || rec.Header().Get("X-Powered-By") != "go" {
+			t.Fatalf("expected untouched headers")
+		}
+	})
+
+	t.Run("cors preflight", func(t *testing.T) {
+		rec := serve("OPTIONS", "/goods/12", nil, map[string]string{
+			"Origin":                         "https://shop.example.com",
+			"Access-Control-Request-Method":  "POST",
+			"Access-Control-Request-Headers": "Authorization, Content-Type",
+		})
+		h := rec.Header()
+		if rec.Code != http.StatusNoContent || lastRequest() != nil {
+			t.Fatalf("expected preflight answered by gateway, got %d", rec.Code)
+		}
+		if h.Get("Access-Control-Allow-Methods") != "GET, POST" || h.Get("Access-Control-Allow-Headers") != "Authorization, Content-Type" || h.Get("Access-Control-Max-Age") != "600" {
+			t.Fatalf("unexpected preflight headers %v", h)
+		}
+		rec = serve("OPTIONS", "/goods/12", nil, map[string]string{
+			"Origin":                        "https://evil.example.com",
+			"Access-Control-Request-Method": "POST",
+		})
+		if rec.Code != http.StatusForbidden || rec.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Fatalf("expected disallowed origin rejected, got %d %v", rec.Code, rec.Header())
+		}
+	})
+
+	t.Run("body size", func(t *testing.T) {
+		if rec := serve("POST", "/goods/12", strings.NewReader("0123456789"), nil); rec.Code != http.StatusOK {
+			t.Fatalf("expected small body accepted, got %d", rec.Code)
+		}
+		if rec := serve("POST", "/goods/12", strings.NewReader(strings.Repeat("0", 17)), nil); rec.Code != http.StatusRequestEntityTooLarge || lastRequest() != nil {
+			t.Fatalf("expected status 413, got %d", rec.Code)
+		}
+		// 未声明长度的请求体在转发时校验
+		req := httptest.NewRequest("POST", "/goods/12", ioutil.NopCloser(strings.NewReader(strings.Repeat("0", 64))))
+		req.ContentLength = -1
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusRequestEntityTooLarge {
+			t.Fatalf("expected status 413 for chunked body, got %d %s", rec.Code, rec.Body)
+		}
+	})
+
+	t.Run("compression", func(t *testing.T) {
+		cases := []struct {
+			path, acceptEncoding, encoding string
+		}{
+			{"/goods/12", "gzip, deflate, br", "br"},
+			{"/goods/12", "gzip", "gzip"},
+			{"/goods/12", "br;q=0, *", "gzip"},
+			{"/goods/12", "", ""},
+			// 小于最小长度及上游已编码的响应不压缩
+			{"/goods/small", "gzip", ""},
+			{"/goods/encoded", "gzip", "identity"},
+		}
+		for _, c := range cases {
+			rec := serve("GET", c.path, nil, map[string]string{"Accept-Encoding": c.acceptEncoding})
+			if got := rec.Header().Get("Content-Encoding"); got != c.encoding {
+				t.Fatalf("%s %q: expected encoding %q, got %q", c.path, c.acceptEncoding, c.encoding, got)
+			}
+			var reader io.Reader = rec.Body
+			switch c.encoding {
+			case "br":
+				reader = brotli.NewReader(rec.Body)
+			case "gzip":
+				gz, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				reader = gz
+			default:
+				continue
+			}
+			body, err := ioutil.ReadAll(reader)
+			if err != nil || string(body) != payload {
+				t.Fatalf("%s %q: unexpected body %v", c.path, c.acceptEncoding, err)
+			}
+			if rec.Header().Get("Content-Length") != "" || rec.Header().Get("Vary") == "" {
+				t.Fatalf("unexpected headers %v", rec.Header())
+			}
+		}
+	})
+}
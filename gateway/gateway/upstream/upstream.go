@@ -0,0 +1,228 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// 上游服务实例缓存
+// 每个服务首次被请求时启动一个协程，通过consul阻塞查询监听健康实例的变化，
+// 请求只读取本地缓存，consul暂时不可用时继续使用最近一次的实例列表
+
+var (
+	ErrNoInstance = errors.New("no healthy instance available")
+)
+
+// 上游服务实例
+type Instance struct {
+	ID      string            `json:"id"`
+	Service string            `json:"service"`
+	Address string            `json:"address"`
+	Port    int               `json:"port"`
+	Tags    []string          `json:"tags,omitempty"`
+	Meta    map[string]string `json:"meta,omitempty"`
+	Weight  int               `json:"weight"`
+}
+
+// 实例的 host:port 地址
+func (i *Instance) Host() string {
+	return i.Address + ":" + strconv.Itoa(i.Port)
+}
+
+// 服务描述中协议端口的meta键前缀，与 register-kit 注册时写入的服务描述一致，如 svc_proto_grpc=8081
+const metaProtocolPrefix = "svc_proto_"
+
+// 实例上指定协议的端口，未声明任何协议的实例按注册端口处理所有协议
+func (i *Instance) ProtocolPort(protocol string) (int, bool) {
+	declared := false
+	for k, v := range i.Meta {
+		if !strings.HasPrefix(k, metaProtocolPrefix) {
+			continue
+		}
+		declared = true
+		if strings.TrimPrefix(k, metaProtocolPrefix) == protocol {
+			port, err := strconv.Atoi(v)
+			return port, err == nil
+		}
+	}
+	return i.Port, !declared
+}
+
+// 筛选支持指定协议的实例，协议端口与注册端口不同时返回使用协议端口的副本
+func ProtocolInstances(instances []*Instance, protocol string) []*Instance {
+	result := make([]*Instance, 0, len(instances))
+	for _, instance := range instances {
+		port, ok := instance.ProtocolPort(protocol)
+		if !ok {
+			continue
+		}
+		if port != instance.Port {
+			copied := *instance
+			copied.Port = port
+			instance = &copied
+		}
+		result = append(result, instance)
+	}
+	return result
+}
+
+// 服务实例解析器
+type Resolver interface {
+	// 获取服务的健康实例列表
+	Instances(ctx context.Context, serviceName string) ([]*Instance, error)
+}
+
+// 单个服务的实例缓存
+type serviceCache struct {
+	// 首次加载完成后关闭
+	ready     chan struct{}
+	readyOnce sync.Once
+	mu        sync.RWMutex
+	instances []*Instance
+	err       error
+}
+
+func (c *serviceCache) set(instances []*Instance, err error) {
+	c.mu.Lock()
+	if err == nil {
+		c.instances, c.err = instances, nil
+	} else if c.instances == nil {
+		// 从未加载成功时才记录错误，否则继续使用旧列表
+		c.err = err
+	}
+	c.mu.Unlock()
+	c.readyOnce.Do(func() {
+		close(c.ready)
+	})
+}
+
+func (c *serviceCache) get() ([]*Instance, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.instances, c.err
+}
+
+// 基于consul健康查询的实例缓存
+type ConsulResolver struct {
+	client   *api.Client
+	mu       sync.Mutex
+	services map[string]*serviceCache
+	ctx      context.Context
+	cancel   context.CancelFunc
+	// 阻塞查询的最长等待时间
+	waitTime time.Duration
+	// 查询出错后的重试退避时间
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+// 创建consul实例缓存
+func NewConsulResolver(client *api.Client) *ConsulResolver {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &ConsulResolver{
+		client:     client,
+		services:   make(map[string]*serviceCache),
+		ctx:        ctx,
+		cancel:     cancel,
+		waitTime:   5 * time.Minute,
+		minBackoff: time.Second,
+		maxBackoff: 30 * time.Second,
+	}
+}
+
+// 获取服务的健康实例，首次请求时等待初始加载完成
+func (r *ConsulResolver) Instances(ctx context.Context, serviceName string) ([]*Instance, error) {
+	r.mu.Lock()
+	cache, ok := r.services[serviceName]
+	if !ok {
+		cache = &serviceCache{ready: make(chan struct{})}
+		r.services[serviceName] = cache
+		go r.watch(serviceName, cache)
+	}
+	r.mu.Unlock()
+	select {
+	case <-cache.ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	instances, err := cache.get()
+	if err != nil {
+		return nil, err
+	}
+	if len(instances) == 0 {
+		return nil, ErrNoInstance
+	}
+	return instances, nil
+}
+
+// 停止所有监听
+func (r *ConsulResolver) Close() {
+	r.cancel()
+}
+
+// 监听服务的健康实例
+func (r *ConsulResolver) watch(serviceName string, cache *serviceCache) {
+	var index uint64
+	backoff := r.minBackoff
+	for {
+		options := (&api.QueryOptions{WaitIndex: index, WaitTime: r.waitTime}).WithContext(r.ctx)
+		entries, meta, err := r.client.Health().Service(serviceName, "", true, options)
+		if r.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("watch service %s err: %s, retry after %s", serviceName, err, backoff)
+			cache.set(nil, err)
+			select {
+			case <-r.ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > r.maxBackoff {
+				backoff = r.maxBackoff
+			}
+			continue
+		}
+		backoff = r.minBackoff
+		// 索引回退时重新开始阻塞查询
+		if meta.LastIndex < index {
+			index = 0
+		} else {
+			index = meta.LastIndex
+		}
+		cache.set(toInstances(entries), nil)
+	}
+}
+
+func toInstances(entries []*api.ServiceEntry) []*Instance {
+	instances := make([]*Instance, 0, len(entries))
+	for _, entry := range entries {
+		service := entry.Service
+		address := service.Address
+		if address == "" && entry.Node != nil {
+			// 未指定服务地址时使用节点地址
+			address = entry.Node.Address
+		}
+		weight := service.Weights.Passing
+		if weight <= 0 {
+			weight = 1
+		}
+		instances = append(instances, &Instance{
+			ID:      service.ID,
+			Service: service.Service,
+			Address: address,
+			Port:    service.Port,
+			Tags:    service.Tags,
+			Meta:    service.Meta,
+			Weight:  weight,
+		})
+	}
+	return instances
+}
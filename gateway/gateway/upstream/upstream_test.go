@@ -0,0 +1,171 @@
+package upstream
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// 模拟consul健康查询接口，支持阻塞查询
+type fakeConsul struct {
+	mu        sync.Mutex
+	index     uint64
+	instances map[string][]*api.ServiceEntry
+	changed   chan struct{}
+	requests  int
+	down      bool
+}
+
+func newFakeConsul() *fakeConsul {
+	return &fakeConsul{index: 1, instances: make(map[string][]*api.ServiceEntry), changed: make(chan struct{})}
+}
+
+func (f *fakeConsul) set(service string, ports ...int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	entries := make([]*api.ServiceEntry, 0, len(ports))
+	for _, port := range ports {
+		entries = append(entries, &api.ServiceEntry{
+			Node:    &api.Node{Address: "127.0.0.1"},
+			Service: &api.AgentService{ID: service + "-" + strconv.Itoa(port), Service: service, Port: port},
+		})
+	}
+	f.instances[service] = entries
+	f.index++
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/v1/health/service/")
+	f.mu.Lock()
+	f.requests++
+	if f.down {
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	for index >= f.index {
+		changed := f.changed
+		f.mu.Unlock()
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+		f.mu.Lock()
+	}
+	if f.down {
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	entries := f.instances[name]
+	if entries == nil {
+		entries = []*api.ServiceEntry{}
+	}
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+	f.mu.Unlock()
+	json.NewEncoder(w).Encode(entries)
+}
+
+func newTestResolver(t *testing.T, consul *fakeConsul) (*ConsulResolver, func()) {
+	server := httptest.NewServer(consul)
+	config := api.DefaultConfig()
+	config.Address = server.URL
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewConsulResolver(client)
+	r.minBackoff = 10 * time.Millisecond
+	return r, func() {
+		r.Close()
+		server.Close()
+	}
+}
+
+func TestConsulResolver(t *testing.T) {
+	consul := newFakeConsul()
+	consul.set("user", 10086)
+	r, closeAll := newTestResolver(t, consul)
+	defer closeAll()
+
+	instances, err := r.Instances(context.Background(), "user")
+	if err != nil || len(instances) != 1 || instances[0].Host() != "127.0.0.1:10086" {
+		t.Fatalf("unexpected instances %v %v", instances, err)
+	}
+	if _, err = r.Instances(context.Background(), "unknown"); err != ErrNoInstance {
+		t.Fatalf("expected %v, got %v", ErrNoInstance, err)
+	}
+
+	// 实例变化后缓存随之更新，请求不访问consul
+	consul.set("user", 10086, 10087)
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		instances, _ = r.Instances(context.Background(), "user")
+		if len(instances) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for instances update")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	consul.mu.Lock()
+	requests := consul.requests
+	consul.mu.Unlock()
+	for i := 0; i < 10; i++ {
+		r.Instances(context.Background(), "user")
+	}
+	consul.mu.Lock()
+	if consul.requests != requests {
+		t.Fatalf("expected cached lookups, got %d extra consul requests", consul.requests-requests)
+	}
+	// consul不可用时继续使用缓存
+	consul.down = true
+	consul.mu.Unlock()
+	consul.set("user", 10086, 10087, 10088)
+	time.Sleep(50 * time.Millisecond)
+	if instances, err = r.Instances(context.Background(), "user"); err != nil || len(instances) != 2 {
+		t.Fatalf("expected stale instances, got %v %v", instances, err)
+	}
+}
+
+func TestConsulResolverUnavailable(t *testing.T) {
+	consul := newFakeConsul()
+	consul.down = true
+	r, closeAll := newTestResolver(t, consul)
+	defer closeAll()
+	if _, err := r.Instances(context.Background(), "user"); err == nil || err == ErrNoInstance {
+		t.Fatalf("expected consul error, got %v", err)
+	}
+}
+
+func TestProtocolInstances(t *testing.T) {
+	instances := []*Instance{
+		// 未声明协议的实例按注册端口处理
+		{ID: "plain", Port: 10086},
+		{ID: "http-only", Port: 10086, Meta: map[string]string{"svc_proto_http": "10086"}},
+		{ID: "both", Port: 10086, Meta: map[string]string{"svc_proto_http": "10086", "svc_proto_grpc": "8081"}},
+	}
+	grpcInstances := ProtocolInstances(instances, "grpc")
+	if len(grpcInstances) != 2 || grpcInstances[0].ID != "plain" || grpcInstances[1].ID != "both" || grpcInstances[1].Port != 8081 {
+		t.Fatalf("unexpected grpc instances %+v", grpcInstances)
+	}
+	if instances[2].Port != 10086 {
+		t.Fatal("expected cached instance not modified")
+	}
+	if httpInstances := ProtocolInstances(instances, "http"); len(httpInstances) != 3 || httpInstances[2] != instances[2] {
+		t.Fatalf("unexpected http instances %+v", httpInstances)
+	}
+}
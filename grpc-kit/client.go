@@ -2,16 +2,28 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
 
+	zipkingrpc "github.com/openzipkin/zipkin-go/middleware/grpc"
 	"github.com/yunfeiyang1916/micro-go-course/grpc-kit/pb"
+	"github.com/yunfeiyang1916/micro-go-course/tracing"
 	"google.golang.org/grpc"
 )
 
 func main() {
+	tracingConfig := tracing.DefaultConfig("user-client", "")
+	tracingConfig.BindFlags(flag.CommandLine)
+	flag.Parse()
+	tracer, closeTracer, err := tracing.New(tracingConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closeTracer()
 	serviceAddr := "127.0.0.1:1234"
-	conn, err := grpc.Dial(serviceAddr, grpc.WithInsecure())
+	// 在gRPC元数据中注入追踪上下文
+	conn, err := grpc.Dial(serviceAddr, grpc.WithInsecure(), grpc.WithStatsHandler(zipkingrpc.NewClientHandler(tracer)))
 	if err != nil {
 		panic("connect error")
 	}
@@ -20,6 +32,7 @@ func main() {
 	stringReq := &pb.LoginReq{Username: "admin", Password: "admin"}
 	reply, err := userClient.CheckPassword(context.Background(), stringReq)
 	if err != nil {
+		closeTracer()
 		log.Fatal("userClient.CheckPassword error:", err)
 	}
 	fmt.Printf("CheckPassword ret is %s\n", reply.Ret)
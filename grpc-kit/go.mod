@@ -5,7 +5,15 @@ go 1.14
 require (
 	github.com/go-kit/kit v0.10.0
 	github.com/golang/protobuf v1.5.0
+	github.com/openzipkin/zipkin-go v0.2.2
+	github.com/prometheus/client_golang v1.3.0
+	github.com/yunfeiyang1916/micro-go-course/instrument v0.0.0
+	github.com/yunfeiyang1916/micro-go-course/tracing v0.0.0
 	golang.org/x/time v0.0.0-20191024005414-555d28b269f0
 	google.golang.org/grpc v1.31.0
 	google.golang.org/protobuf v1.26.0
 )
+
+replace github.com/yunfeiyang1916/micro-go-course/instrument => ../instrument
+
+replace github.com/yunfeiyang1916/micro-go-course/tracing => ../tracing
@@ -3,11 +3,17 @@ package main
 import (
 	"context"
 	"flag"
-	"fmt"
 	"net"
+	"net/http"
+	"os"
 	"time"
 
+	"github.com/go-kit/kit/log"
+	kitzipkin "github.com/go-kit/kit/tracing/zipkin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/yunfeiyang1916/micro-go-course/grpc-kit/pb"
+	"github.com/yunfeiyang1916/micro-go-course/instrument"
+	"github.com/yunfeiyang1916/micro-go-course/tracing"
 	"google.golang.org/grpc"
 
 	"golang.org/x/time/rate"
@@ -16,11 +22,20 @@ import (
 )
 
 func main() {
+	metricsAddr := flag.String("metrics.addr", "127.0.0.1:1235", "address to expose prometheus metrics, disabled if empty")
+	tracingConfig := tracing.DefaultConfig("user", "127.0.0.1:1234")
+	tracingConfig.BindFlags(flag.CommandLine)
 	flag.Parse()
+	logger := log.NewLogfmtLogger(os.Stderr)
+	logger = log.With(logger, "ts", log.DefaultTimestampUTC)
+	logger = log.With(logger, "caller", log.DefaultCaller)
+	tracer, closeTracer, err := tracing.New(tracingConfig)
+	if err != nil {
+		logger.Log("tracing", err)
+		os.Exit(-1)
+	}
+	defer closeTracer()
 	var (
-		//logger = log.NewLogfmtLogger(os.Stderr)
-		//logger = log.With(logger, "ts", log.DefaultTimestampUTC)
-		//logger = log.With(logger, "caller", log.DefaultCaller)
 		ctx = context.Background()
 		// 服务
 		svc = user.UserServiceImpl{}
@@ -30,19 +45,40 @@ func main() {
 		ratebucket = rate.NewLimiter(rate.Every(time.Second*1), 100)
 	)
 	endpoint = user.NewTokenBucketLimitterWithBuildIn(ratebucket)(endpoint)
+	endpoint = kitzipkin.TraceEndpoint(tracer, "CheckPassword")(endpoint)
+	// 被限流的请求也计入监控指标
+	endpoint = instrument.DefaultMetrics.EndpointMiddleware("user", "CheckPassword")(endpoint)
 
 	endpts := user.Endpoints{
 		UserEndpoint: endpoint,
 	}
 	// 使用transport构造UserServiceServer
-	handler := user.NewUserServer(ctx, endpts)
+	// 从gRPC元数据中提取追踪上下文，创建服务端span
+	handler := user.NewUserServer(ctx, endpts, kitzipkin.GRPCServerTrace(tracer))
 	// 监听端口，建立gRPC网络服务器，注册RPC服务
 	ls, err := net.Listen("tcp", "127.0.0.1:1234")
 	if err != nil {
-		fmt.Println("Listen error:", err)
-		return
+		logger.Log("listen", err)
+		os.Exit(-1)
+	}
+	if *metricsAddr != "" {
+		// 先监听端口，端口被占用等错误在启动时暴露
+		metricsListener, err := net.Listen("tcp", *metricsAddr)
+		if err != nil {
+			logger.Log("metrics", err)
+			os.Exit(-1)
+		}
+		go func() {
+			logger.Log("metrics", http.Serve(metricsListener, promhttp.Handler()))
+		}()
 	}
-	grpcServer := grpc.NewServer()
+	grpcServer := grpc.NewServer(
+		grpc.UnaryInterceptor(instrument.DefaultMetrics.UnaryServerInterceptor("user")),
+		grpc.StreamInterceptor(instrument.DefaultMetrics.StreamServerInterceptor("user")),
+	)
 	pb.RegisterUserServiceServer(grpcServer, handler)
-	grpcServer.Serve(ls)
+	if err = grpcServer.Serve(ls); err != nil {
+		logger.Log("serve", err)
+		os.Exit(-1)
+	}
 }
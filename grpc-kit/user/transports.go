@@ -17,9 +17,10 @@ type grpcServer struct {
 	checkPassword grpc.Handler
 }
 
-func NewUserServer(ctx context.Context, endpoints Endpoints) pb.UserServiceServer {
+// options 用于添加追踪等服务端选项
+func NewUserServer(ctx context.Context, endpoints Endpoints, options ...grpc.ServerOption) pb.UserServiceServer {
 	return &grpcServer{
-		checkPassword: grpc.NewServer(endpoints.UserEndpoint, DecodeLoginRequest, EncodeLoginResponse),
+		checkPassword: grpc.NewServer(endpoints.UserEndpoint, DecodeLoginRequest, EncodeLoginResponse, options...),
 	}
 }
 
@@ -3,45 +3,72 @@ package main
 import (
 	"context"
 	"flag"
-	"fmt"
 	"log"
 	"net/http"
-	"os"
-	"os/signal"
 	"strconv"
-	"syscall"
+	"time"
 
+	kitzipkin "github.com/go-kit/kit/tracing/zipkin"
+	"github.com/google/uuid"
 	"github.com/yunfeiyang1916/micro-go-course/hystrix/comment/endpoint"
 	"github.com/yunfeiyang1916/micro-go-course/hystrix/comment/service"
 	"github.com/yunfeiyang1916/micro-go-course/hystrix/comment/transport"
+	"github.com/yunfeiyang1916/micro-go-course/instrument"
+	"github.com/yunfeiyang1916/micro-go-course/register/discovery"
+	"github.com/yunfeiyang1916/micro-go-course/register/lifecycle"
+	"github.com/yunfeiyang1916/micro-go-course/register/registry"
+	"github.com/yunfeiyang1916/micro-go-course/tracing"
 )
 
 func main() {
 	servicePort := flag.Int("service.port", 10087, "service port")
+	// 服务注册配置，商品服务通过服务名 comments 发现评论服务
+	serviceName := flag.String("service.name", "comments", "service name")
+	serviceAddr := flag.String("service.addr", "localhost", "service addr")
+	consulAddr := flag.String("consul.addr", "127.0.0.1", "consul address")
+	consulPort := flag.Int("consul.port", 8500, "consul port")
+	drainPeriod := flag.Duration("drain.period", 5*time.Second, "time to wait for callers to drain traffic before shutdown")
+	shutdownTimeout := flag.Duration("shutdown.timeout", 10*time.Second, "max time to wait for in-flight requests on shutdown")
+	tracingConfig := tracing.DefaultConfig("", "")
+	tracingConfig.BindFlags(flag.CommandLine)
 
 	flag.Parse()
 
-	errChan := make(chan error)
+	tracingConfig.ServiceName = *serviceName
+	tracingConfig.HostPort = *serviceAddr + ":" + strconv.Itoa(*servicePort)
+	tracer, closeTracer, err := tracing.New(tracingConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closeTracer()
 
 	srv := service.NewGoodsServiceImpl()
 
+	commentsListEndpoint := endpoint.MakeCommentsListEndpoint(srv)
+	commentsListEndpoint = kitzipkin.TraceEndpoint(tracer, "CommentsList")(commentsListEndpoint)
+	commentsListEndpoint = instrument.DefaultMetrics.EndpointMiddleware("comments", "CommentsList")(commentsListEndpoint)
 	endpoints := endpoint.CommentsEndpoints{
-		CommentsListEndpoint: endpoint.MakeCommentsListEndpoint(srv),
+		CommentsListEndpoint: commentsListEndpoint,
 	}
 
-	handler := transport.MakeHttpHandler(context.Background(), &endpoints)
-
-	go func() {
-		errChan <- http.ListenAndServe(":"+strconv.Itoa(*servicePort), handler)
-	}()
+	handler := transport.MakeHttpHandler(context.Background(), &endpoints, tracer)
+	server := &http.Server{
+		Addr:    ":" + strconv.Itoa(*servicePort),
+		Handler: handler,
+	}
 
-	go func() {
-		// 监控系统信号，等待 ctrl + c 系统信号通知服务关闭
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
-		errChan <- fmt.Errorf("%s", <-c)
-	}()
+	// 注册到consul，由consul定期请求 /health 检查实例健康
+	client := discovery.NewDiscoveryClient(*consulAddr, *consulPort)
+	instanceId := *serviceName + "-" + uuid.New().String()
+	err = client.Register(context.Background(), *serviceName, instanceId, "/health", *serviceAddr, *servicePort, nil, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	err := <-errChan
+	// 收到退出信号后先摘除流量，再关闭服务器并注销实例
+	config := lifecycle.DefaultConfig(instanceId)
+	config.DrainPeriod = *drainPeriod
+	config.ShutdownTimeout = *shutdownTimeout
+	err = lifecycle.New(config, registry.NewConsulRegistry(client), server).Run(server.ListenAndServe)
 	log.Printf("listen err : %s", err)
 }
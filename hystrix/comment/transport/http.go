@@ -9,8 +9,12 @@ import (
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/transport"
+	kithttp "github.com/go-kit/kit/transport/http"
 	"github.com/gorilla/mux"
+	"github.com/openzipkin/zipkin-go"
 	"github.com/yunfeiyang1916/micro-go-course/hystrix/comment/endpoint"
+	"github.com/yunfeiyang1916/micro-go-course/instrument"
+	"github.com/yunfeiyang1916/micro-go-course/tracing"
 )
 
 var (
@@ -18,7 +22,7 @@ var (
 )
 
 // MakeHttpHandler make http handler use mux
-func MakeHttpHandler(ctx context.Context, endpoints *endpoint.CommentsEndpoints) http.Handler {
+func MakeHttpHandler(ctx context.Context, endpoints *endpoint.CommentsEndpoints, tracer *zipkin.Tracer) http.Handler {
 	r := mux.NewRouter()
 
 	kitLog := log.NewLogfmtLogger(os.Stderr)
@@ -26,11 +30,17 @@ func MakeHttpHandler(ctx context.Context, endpoints *endpoint.CommentsEndpoints)
 	kitLog = log.With(kitLog, "ts", log.DefaultTimestampUTC)
 	kitLog = log.With(kitLog, "caller", log.DefaultCaller)
 
+	instrument.WrapRouter(r, "comments")
 	options := []kithttp.ServerOption{
 		kithttp.ServerErrorHandler(transport.NewLogErrorHandler(kitLog)),
 		kithttp.ServerErrorEncoder(encodeError),
+		tracing.HTTPServerTrace(tracer),
 	}
 
+	// 健康检查，供注册中心判断实例是否可用
+	r.Methods("GET").Path("/health").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encodeJSONResponse(ctx, w, map[string]bool{"status": true})
+	})
 	r.Methods("GET").Path("/comments/detail").Handler(kithttp.NewServer(
 		endpoints.CommentsListEndpoint,
 		decodeCommentsListRequest,
@@ -14,30 +14,66 @@ import (
 	"golang.org/x/time/rate"
 
 	"github.com/afex/hystrix-go/hystrix"
+	kitzipkin "github.com/go-kit/kit/tracing/zipkin"
+	zipkinhttp "github.com/openzipkin/zipkin-go/middleware/http"
 
 	"github.com/yunfeiyang1916/micro-go-course/hystrix/goods/endpoint"
 	"github.com/yunfeiyang1916/micro-go-course/hystrix/goods/service"
 	"github.com/yunfeiyang1916/micro-go-course/hystrix/goods/transport"
+	"github.com/yunfeiyang1916/micro-go-course/instrument"
+	"github.com/yunfeiyang1916/micro-go-course/register/client"
+	"github.com/yunfeiyang1916/micro-go-course/register/discovery"
+	"github.com/yunfeiyang1916/micro-go-course/tracing"
 )
 
 func main() {
 	servicePort := flag.Int("service.port", 10086, "service port")
+	consulAddr := flag.String("consul.addr", "127.0.0.1", "consul address")
+	consulPort := flag.Int("consul.port", 8500, "consul port")
+	tracingConfig := tracing.DefaultConfig("goods", "")
+	tracingConfig.BindFlags(flag.CommandLine)
 
 	flag.Parse()
 
 	errChan := make(chan error)
 
-	srv := service.NewGoodsServiceImpl()
+	tracingConfig.HostPort = ":" + strconv.Itoa(*servicePort)
+	tracer, closeTracer, err := tracing.New(tracingConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closeTracer()
+
+	// 调用评论服务时在请求头中注入追踪上下文，每次重试记录为单独的客户端span
+	tracingTransport, err := zipkinhttp.NewTransport(tracer, zipkinhttp.TransportTrace(false))
+	if err != nil {
+		log.Fatal(err)
+	}
+	// 通过服务发现和负载均衡调用评论服务
+	discoveryClient := discovery.NewDiscoveryClient(*consulAddr, *consulPort)
+	clientConfig := client.DefaultConfig()
+	clientConfig.Transport = tracingTransport
+	commentsClient := client.NewClient(discoveryClient, clientConfig)
+	defer commentsClient.Close()
+
+	srv := service.NewGoodsServiceImpl(commentsClient.HTTPClient(), tracer)
+	// 从etcd读取并监听是否调用评论服务的配置
+	configCtx, cancelConfig := context.WithCancel(context.Background())
+	defer cancelConfig()
+	go srv.InitConfig(configCtx)
 
 	// 限流器
 	// 第一个参数代表系统每秒钟向令牌桶中放入多少个令牌，也就是限流器平稳状态下每秒可以允许多少请求通过
 	// 第二个参数代表令牌桶的上限或者整体大小，也就是限流器允许多大的瞬时请求流量通过
 	limiter := rate.NewLimiter(1, 1)
 
+	goodsDetailEndpoint := endpoint.MakeGoodsDetailEndpoint(srv, limiter)
+	goodsDetailEndpoint = kitzipkin.TraceEndpoint(tracer, "GoodsDetail")(goodsDetailEndpoint)
+	goodsDetailEndpoint = instrument.DefaultMetrics.EndpointMiddleware("goods", "GoodsDetail")(goodsDetailEndpoint)
 	endpoints := endpoint.GoodsEndpoints{
-		GoodsDetailEndpoint: endpoint.MakeGoodsDetailEndpoint(srv, limiter),
+		GoodsDetailEndpoint: goodsDetailEndpoint,
 	}
-	handler := transport.MakeHttpHandler(context.Background(), &endpoints)
+	handler := transport.MakeHttpHandler(context.Background(), &endpoints, tracer)
 	// 修改断路器最低启动阈值为 4 次
 	hystrix.ConfigureCommand("Comments", hystrix.CommandConfig{
 		RequestVolumeThreshold: 4,
@@ -54,6 +90,6 @@ func main() {
 		errChan <- fmt.Errorf("%s", <-c)
 	}()
 
-	err := <-errChan
+	err = <-errChan
 	log.Printf("listen err : %s", err)
 }
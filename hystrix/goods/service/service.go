@@ -9,13 +9,15 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"go.etcd.io/etcd/clientv3"
 
-	"github.com/afex/hystrix-go/hystrix"
+	"github.com/openzipkin/zipkin-go"
 
 	"github.com/yunfeiyang1916/micro-go-course/hystrix/goods/common"
+	"github.com/yunfeiyang1916/micro-go-course/tracing"
 )
 
 // 商品详情视图对象
@@ -34,21 +36,29 @@ type Service interface {
 	InitConfig(ctx context.Context)
 }
 
-func NewGoodsServiceImpl() Service {
-	return &GoodsDetailServiceImpl{}
+// 评论服务名
+const CommentsServiceName = "comments"
+
+// client 用于调用评论服务，请求地址的host为服务名，由客户端负载均衡解析为服务实例，
+// tracer 记录熔断器命令并通过请求上下文传递给client
+func NewGoodsServiceImpl(client *http.Client, tracer *zipkin.Tracer) Service {
+	return &GoodsDetailServiceImpl{client: client, tracer: tracer}
 }
 
 // 商品详情服务实现
 type GoodsDetailServiceImpl struct {
-	// 是否开启了降级，降级后不在调用评论服务
-	callCommentService int
+	// 是否开启了降级，降级后不在调用评论服务，由配置监听协程修改，需原子访问
+	callCommentService int32
+	// 调用评论服务的客户端
+	client *http.Client
+	tracer *zipkin.Tracer
 }
 
 // 获取商品详情
 func (g *GoodsDetailServiceImpl) GetGoodsDetail(ctx context.Context, id string) (GoodsDetailVO, error) {
 	detail := GoodsDetailVO{Id: id, Name: "商品A"}
-	if g.callCommentService != 0 {
-		commentResult, err := GetGoodsComments(id)
+	if atomic.LoadInt32(&g.callCommentService) != 0 {
+		commentResult, err := GetGoodsComments(ctx, g.tracer, g.client, id)
 		if err != nil {
 			return detail, err
 		}
@@ -60,51 +70,71 @@ func (g *GoodsDetailServiceImpl) GetGoodsDetail(ctx context.Context, id string)
 // 初始化配置
 func (g *GoodsDetailServiceImpl) InitConfig(ctx context.Context) {
 	log.Printf("InitConfig")
-	cli, _ := clientv3.New(clientv3.Config{
+	cli, err := clientv3.New(clientv3.Config{
 		Endpoints:   []string{"127.0.0.1:2379"},
 		DialTimeout: 5 * time.Second,
 	})
+	if err != nil {
+		log.Printf("connect etcd err : %s", err)
+		return
+	}
+	defer cli.Close()
 	// get
-	resp, _ := cli.Get(ctx, "call_service_d")
+	resp, err := cli.Get(ctx, "call_service_d")
+	if err != nil {
+		log.Printf("get call_service_d err : %s", err)
+		return
+	}
 	for _, ev := range resp.Kvs {
 		fmt.Printf("%s:%s\n", ev.Key, ev.Value)
 		if string(ev.Key) == "call_service_d" {
-			service.callCommentService, _ = strconv.Atoi(string(ev.Value))
+			g.setCallCommentService(ev.Value)
 		}
 	}
 
-	rch := cli.Watch(context.Background(), "call_service_d") // <-chan WatchResponse
+	rch := cli.Watch(ctx, "call_service_d") // <-chan WatchResponse
 	for wresp := range rch {
 		for _, ev := range wresp.Events {
 			fmt.Printf("Type: %s Key:%s Value:%s\n", ev.Type, ev.Kv.Key, ev.Kv.Value)
 			if string(ev.Kv.Key) == "call_service_d" {
-				service.callCommentService, _ = strconv.Atoi(string(ev.Kv.Value))
+				g.setCallCommentService(ev.Kv.Value)
 			}
 		}
 	}
 }
 
-// 获取商品评论集合,使用断路器控制熔断
-func GetGoodsComments(id string) (common.CommentResult, error) {
+// 按配置值开启或关闭评论服务调用
+func (g *GoodsDetailServiceImpl) setCallCommentService(value []byte) {
+	n, _ := strconv.Atoi(string(value))
+	atomic.StoreInt32(&g.callCommentService, int32(n))
+}
+
+// 获取商品评论集合,使用断路器控制熔断，请求携带ctx中的追踪上下文
+func GetGoodsComments(ctx context.Context, tracer *zipkin.Tracer, client *http.Client, id string) (common.CommentResult, error) {
 	var result common.CommentResult
 	serviceName := "Comments"
-	err := hystrix.Do(serviceName, func() error {
+	err := tracing.Do(ctx, tracer, serviceName, func(ctx context.Context) error {
 		reqUrl := url.URL{
 			Scheme:   "http",
-			Host:     "127.0.0.1:10087",
+			Host:     CommentsServiceName,
 			Path:     "/comments/detail",
 			RawQuery: "id=" + id,
 		}
-		resp, err := http.Get(reqUrl.String())
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqUrl.String(), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
 		if err != nil {
 			return err
 		}
+		defer resp.Body.Close()
 		body, _ := ioutil.ReadAll(resp.Body)
 		if jsonErr := json.Unmarshal(body, &result); jsonErr != nil {
 			return jsonErr
 		}
 		return nil
-	}, func(err error) error {
+	}, func(ctx context.Context, err error) error {
 		return err
 	})
 	return result, err
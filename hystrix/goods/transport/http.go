@@ -11,7 +11,10 @@ import (
 	"github.com/go-kit/kit/transport"
 	kithttp "github.com/go-kit/kit/transport/http"
 	"github.com/gorilla/mux"
+	"github.com/openzipkin/zipkin-go"
 	"github.com/yunfeiyang1916/micro-go-course/hystrix/goods/endpoint"
+	"github.com/yunfeiyang1916/micro-go-course/instrument"
+	"github.com/yunfeiyang1916/micro-go-course/tracing"
 )
 
 var (
@@ -19,7 +22,7 @@ var (
 )
 
 // MakeHttpHandler make http handler use mux
-func MakeHttpHandler(ctx context.Context, endpoints *endpoint.GoodsEndpoints) http.Handler {
+func MakeHttpHandler(ctx context.Context, endpoints *endpoint.GoodsEndpoints, tracer *zipkin.Tracer) http.Handler {
 	r := mux.NewRouter()
 
 	kitLog := log.NewLogfmtLogger(os.Stderr)
@@ -27,9 +30,11 @@ func MakeHttpHandler(ctx context.Context, endpoints *endpoint.GoodsEndpoints) ht
 	kitLog = log.With(kitLog, "ts", log.DefaultTimestampUTC)
 	kitLog = log.With(kitLog, "caller", log.DefaultCaller)
 
+	instrument.WrapRouter(r, "goods")
 	options := []kithttp.ServerOption{
 		kithttp.ServerErrorHandler(transport.NewLogErrorHandler(kitLog)),
 		kithttp.ServerErrorEncoder(encodeError),
+		tracing.HTTPServerTrace(tracer),
 	}
 
 	r.Methods("GET").Path("/goods/detail").Handler(kithttp.NewServer(
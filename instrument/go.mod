@@ -0,0 +1,10 @@
+module github.com/yunfeiyang1916/micro-go-course/instrument
+
+go 1.14
+
+require (
+	github.com/go-kit/kit v0.10.0
+	github.com/gorilla/mux v1.7.4
+	github.com/prometheus/client_golang v1.3.0
+	google.golang.org/grpc v1.26.0
+)
@@ -0,0 +1,28 @@
+package instrument
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// gRPC一元调用拦截器，方法标签为完整方法名，状态标签为gRPC状态码
+func (m *Metrics) UnaryServerInterceptor(service string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		done := m.grpc.begin(service, info.FullMethod)
+		resp, err := handler(ctx, req)
+		done(status.Code(err).String())
+		return resp, err
+	}
+}
+
+// gRPC流式调用拦截器，耗时为整个流的持续时间
+func (m *Metrics) StreamServerInterceptor(service string) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		done := m.grpc.begin(service, info.FullMethod)
+		err := handler(srv, ss)
+		done(status.Code(err).String())
+		return err
+	}
+}
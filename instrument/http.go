@@ -0,0 +1,83 @@
+package instrument
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// 请求的方法标签，按路由取值，避免标签数量不受限制
+type MethodFunc func(req *http.Request) string
+
+// 未匹配路由的请求的方法标签
+const Unmatched = "unmatched"
+
+// 使用请求方法及匹配的mux路由路径模板作为方法标签，用于路由匹配后执行的中间件，如mux.Router.Use，
+// 未匹配路由时返回Unmatched
+func Path(req *http.Request) string {
+	route := mux.CurrentRoute(req)
+	if route == nil {
+		return Unmatched
+	}
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return Unmatched
+	}
+	return req.Method + " " + template
+}
+
+// HTTP中间件，状态标签为响应状态码
+func (m *Metrics) HTTPMiddleware(service string, method MethodFunc) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			done := m.http.begin(service, method(req))
+			recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			defer func() {
+				done(strconv.Itoa(recorder.status))
+			}()
+			next.ServeHTTP(recorder, req)
+		})
+	}
+}
+
+// 记录响应状态码
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	r.wroteHeader = true
+	return r.ResponseWriter.Write(p)
+}
+
+// 流式响应需要及时发送
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// 协议升级时接管连接，WebSocket需要
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	r.status = http.StatusSwitchingProtocols
+	r.wroteHeader = true
+	return hijacker.Hijack()
+}
@@ -0,0 +1,101 @@
+package instrument
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/metrics"
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// 状态标签
+const (
+	StatusOK    = "ok"
+	StatusError = "error"
+)
+
+// 注册到默认registry的指标，通过 promhttp.Handler() 暴露
+var DefaultMetrics = New(prometheus.DefaultRegisterer)
+
+// 一组请求指标
+type collectors struct {
+	requests metrics.Counter
+	latency  metrics.Histogram
+	inflight metrics.Gauge
+}
+
+func newCollectors(registerer prometheus.Registerer, subsystem string) *collectors {
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: subsystem,
+		Name:      "requests_total",
+		Help:      "Total number of requests.",
+	}, []string{"service", "method", "status"})
+	latency := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Subsystem: subsystem,
+		Name:      "request_duration_seconds",
+		Help:      "Request latency in seconds.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"service", "method", "status"})
+	inflight := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: subsystem,
+		Name:      "requests_in_flight",
+		Help:      "Number of requests being served.",
+	}, []string{"service", "method"})
+	registerer.MustRegister(requests, latency, inflight)
+	return &collectors{
+		requests: kitprometheus.NewCounter(requests),
+		latency:  kitprometheus.NewHistogram(latency),
+		inflight: kitprometheus.NewGauge(inflight),
+	}
+}
+
+// 开始处理请求，返回的函数在请求结束时按状态记录
+func (c *collectors) begin(service, method string) func(status string) {
+	begin := time.Now()
+	inflight := c.inflight.With("service", service, "method", method)
+	inflight.Add(1)
+	return func(status string) {
+		inflight.Add(-1)
+		labels := []string{"service", service, "method", method, "status", status}
+		c.requests.With(labels...).Add(1)
+		c.latency.With(labels...).Observe(time.Since(begin).Seconds())
+	}
+}
+
+// 服务监控指标，按服务、方法及状态统计请求数、耗时及处理中的请求数，
+// endpoint、HTTP及gRPC请求分别使用不同前缀的指标，避免同一请求被重复统计
+type Metrics struct {
+	endpoint *collectors
+	http     *collectors
+	grpc     *collectors
+}
+
+// 创建监控指标并注册到registerer，同一registerer只能创建一次
+func New(registerer prometheus.Registerer) *Metrics {
+	return &Metrics{
+		endpoint: newCollectors(registerer, "endpoint"),
+		http:     newCollectors(registerer, "http"),
+		grpc:     newCollectors(registerer, "grpc"),
+	}
+}
+
+// endpoint中间件，返回错误或响应实现了endpoint.Failer且失败时状态为error
+func (m *Metrics) EndpointMiddleware(service, method string) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+			done := m.endpoint.begin(service, method)
+			defer func() {
+				status := StatusOK
+				if err != nil {
+					status = StatusError
+				} else if f, ok := response.(endpoint.Failer); ok && f.Failed() != nil {
+					status = StatusError
+				}
+				done(status)
+			}()
+			return next(ctx, request)
+		}
+	}
+}
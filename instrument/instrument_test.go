@@ -0,0 +1,169 @@
+package instrument
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	kithttp "github.com/go-kit/kit/transport/http"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type failedResponse struct {
+	err error
+}
+
+func (r failedResponse) Failed() error {
+	return r.err
+}
+
+// 返回标签完全匹配的指标值，直方图返回样本数
+func value(t *testing.T, registry *prometheus.Registry, name string, labels map[string]string) float64 {
+	t.Helper()
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, m := range family.Metric {
+			if len(m.Label) != len(labels) {
+				continue
+			}
+			for _, label := range m.Label {
+				if labels[label.GetName()] != label.GetValue() {
+					continue metrics
+				}
+			}
+			switch {
+			case m.Counter != nil:
+				return m.Counter.GetValue()
+			case m.Gauge != nil:
+				return m.Gauge.GetValue()
+			case m.Histogram != nil:
+				return float64(m.Histogram.GetSampleCount())
+			}
+		}
+	}
+	return 0
+}
+
+func TestEndpointMiddleware(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m := New(registry)
+	var inflight float64
+	e := m.EndpointMiddleware("user", "Login")(func(ctx context.Context, request interface{}) (interface{}, error) {
+		inflight = value(t, registry, "endpoint_requests_in_flight", map[string]string{"service": "user", "method": "Login"})
+		switch request {
+		case "error":
+			return nil, errors.New("error")
+		case "failed":
+			return failedResponse{errors.New("failed")}, nil
+		}
+		return failedResponse{}, nil
+	})
+	for _, request := range []string{"ok", "ok", "error", "failed"} {
+		e(context.Background(), request)
+	}
+	if inflight != 1 {
+		t.Fatalf("expected 1 request in flight, got %v", inflight)
+	}
+	ok := map[string]string{"service": "user", "method": "Login", "status": StatusOK}
+	failed := map[string]string{"service": "user", "method": "Login", "status": StatusError}
+	if n := value(t, registry, "endpoint_requests_total", ok); n != 2 {
+		t.Fatalf("expected 2 ok requests, got %v", n)
+	}
+	if n := value(t, registry, "endpoint_requests_total", failed); n != 2 {
+		t.Fatalf("expected 2 failed requests, got %v", n)
+	}
+	if n := value(t, registry, "endpoint_request_duration_seconds", ok); n != 2 {
+		t.Fatalf("expected 2 latency samples, got %v", n)
+	}
+	if n := value(t, registry, "endpoint_requests_in_flight", map[string]string{"service": "user", "method": "Login"}); n != 0 {
+		t.Fatalf("expected no request in flight, got %v", n)
+	}
+}
+
+func TestHTTPMiddleware(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m := New(registry)
+	middleware := m.HTTPMiddleware("goods", Path)
+	r := mux.NewRouter()
+	r.Use(middleware)
+	r.Path("/goods/{id}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if mux.Vars(r)["id"] == "missing" {
+			w.WriteHeader(http.StatusNotFound)
+			// 重复写状态码不影响统计
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		w.Write([]byte("ok"))
+		w.(http.Flusher).Flush()
+	})
+	for _, path := range []string{"/goods/1", "/goods/2", "/goods/missing"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	// 不同路径按路由模板统计
+	if n := value(t, registry, "http_requests_total", map[string]string{"service": "goods", "method": "GET /goods/{id}", "status": "200"}); n != 2 {
+		t.Fatalf("expected 2 requests with status 200, got %v", n)
+	}
+	if n := value(t, registry, "http_requests_total", map[string]string{"service": "goods", "method": "GET /goods/{id}", "status": "404"}); n != 1 {
+		t.Fatalf("expected 1 request with status 404, got %v", n)
+	}
+	// 路由之外的请求使用固定标签
+	handler := middleware(http.NotFoundHandler())
+	for _, path := range []string{"/a", "/b"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	if n := value(t, registry, "http_requests_total", map[string]string{"service": "goods", "method": Unmatched, "status": "404"}); n != 2 {
+		t.Fatalf("expected 2 unmatched requests, got %v", n)
+	}
+}
+
+func TestWrapRouter(t *testing.T) {
+	r := mux.NewRouter()
+	WrapRouter(r, "router-test")
+	r.Methods("GET").Path("/detail").Handler(kithttp.NewServer(
+		func(ctx context.Context, request interface{}) (interface{}, error) {
+			return nil, nil
+		},
+		kithttp.NopRequestDecoder,
+		func(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+			return nil
+		},
+	))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/detail", nil))
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), `http_requests_total{method="GET /detail",service="router-test",status="200"} 1`) {
+		t.Fatalf("expected request counted in /metrics, got %s", rec.Body)
+	}
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m := New(registry)
+	interceptor := m.UnaryServerInterceptor("user")
+	info := &grpc.UnaryServerInfo{FullMethod: "/pb.UserService/CheckPassword"}
+	interceptor(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	})
+	interceptor(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, status.Error(codes.InvalidArgument, "invalid")
+	})
+	for _, code := range []codes.Code{codes.OK, codes.InvalidArgument} {
+		labels := map[string]string{"service": "user", "method": info.FullMethod, "status": code.String()}
+		if n := value(t, registry, "grpc_requests_total", labels); n != 1 {
+			t.Fatalf("expected 1 request with status %s, got %v", code, n)
+		}
+	}
+}
@@ -0,0 +1,12 @@
+package instrument
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// go-kit服务路由的公共监控设置：统计路由匹配后的请求，并在 /metrics 暴露监控指标
+func WrapRouter(r *mux.Router, service string) {
+	r.Use(DefaultMetrics.HTTPMiddleware(service, Path))
+	r.Path("/metrics").Handler(promhttp.Handler())
+}
@@ -0,0 +1,3 @@
+module github.com/yunfeiyang1916/micro-go-course/loadbalancer
+
+go 1.14
@@ -69,3 +69,25 @@ func TestHash1(t *testing.T) {
 	c1, c2, c3 = getNodesCount(hash.nodes)
 	t.Logf("len of nodes is %v after AddNode node1:%v, node2:%v, node3:%v", len(hash.nodes), c1, c2, c3)
 }
+
+// 一致性哈希负载均衡器单元测试
+func TestHashLoadBalancer(t *testing.T) {
+	lb := &HashLoadBalancer{}
+	single := []*InstanceInfo{{Address: node1}}
+	if instance, err := lb.SelectServiceByKey(single, "1"); err != nil || instance == nil || instance.Address != node1 {
+		t.Fatalf("expected %v got %v %v", node1, instance, err)
+	}
+	services := []*InstanceInfo{{Address: node1, Weight: 1}, {Address: node2, Weight: 1}, {Address: node3, Weight: 1}}
+	selected := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		instance, _ := lb.SelectServiceByKey(services, string(rune('a'+i%26))+string(rune('a'+i/26)))
+		selected[instance.Address] = true
+		again, _ := lb.SelectServiceByKey(services, string(rune('a'+i%26))+string(rune('a'+i/26)))
+		if again != instance {
+			t.Fatalf("expected same instance for same key")
+		}
+	}
+	if len(selected) != 3 {
+		t.Fatalf("expected all instances selected, got %v", selected)
+	}
+}
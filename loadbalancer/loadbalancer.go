@@ -3,6 +3,7 @@ package loadbalancer
 import (
 	"errors"
 	"math/rand"
+	"strconv"
 )
 
 var (
@@ -17,6 +18,10 @@ type InstanceInfo struct {
 	Weight int
 	// 地址
 	Address string
+	// 标签，可用于选择实例子集
+	Tags []string
+	// 元数据，如可用区、版本等
+	Meta map[string]string
 }
 
 // 负载均衡器
@@ -39,6 +44,11 @@ func (r *RandomLoadBalancer) SelectService(services []*InstanceInfo) (*InstanceI
 	return services[rand.Intn(len(services))], nil
 }
 
+// 根据key选择服务器，随机负载均衡不关心key
+func (r *RandomLoadBalancer) SelectServiceByKey(services []*InstanceInfo, key string) (*InstanceInfo, error) {
+	return r.SelectService(services)
+}
+
 // 权重平滑负载均衡器
 type WeightRoundRobinLoadBalancer struct {
 }
@@ -72,10 +82,20 @@ func (w *WeightRoundRobinLoadBalancer) SelectService(services []*InstanceInfo) (
 	return best, nil
 }
 
+// 根据key选择服务器，权重平滑负载均衡不关心key
+func (w *WeightRoundRobinLoadBalancer) SelectServiceByKey(services []*InstanceInfo, key string) (*InstanceInfo, error) {
+	return w.SelectService(services)
+}
+
 // 一致性哈希负载均衡器
 type HashLoadBalancer struct {
 }
 
+// 选择服务器，没有key时使用随机key
+func (h *HashLoadBalancer) SelectService(services []*InstanceInfo) (*InstanceInfo, error) {
+	return h.SelectServiceByKey(services, strconv.Itoa(rand.Int()))
+}
+
 // 根据key选择服务器
 func (h *HashLoadBalancer) SelectServiceByKey(services []*InstanceInfo, key string) (*InstanceInfo, error) {
 	if len(services) == 0 {
@@ -85,7 +105,12 @@ func (h *HashLoadBalancer) SelectServiceByKey(services []*InstanceInfo, key stri
 	instanceMap := make(map[string]*InstanceInfo)
 	for i := 0; i < len(services); i++ {
 		instance := services[i]
-		nodeWeight[instance.Address] = i
+		// 以实例权重作为哈希环上的结点权重，未设置权重时按1计算
+		weight := instance.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		nodeWeight[instance.Address] = weight
 		instanceMap[instance.Address] = instance
 	}
 	// sort.Sort()
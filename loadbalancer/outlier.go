@@ -0,0 +1,243 @@
+package loadbalancer
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 离群检测，被动健康检查
+// 根据调用方上报的调用结果统计各个服务实例的连续失败次数和延迟，
+// 将表现异常的实例暂时驱逐出负载均衡列表，驱逐结束后再逐步恢复流量
+
+var (
+	// 服务端返回5xx状态码
+	ErrServerStatus = errors.New("server responded with 5xx status")
+)
+
+// 调用结果上报接口，负载均衡器实现该接口后可以感知服务实例的调用结果
+type ResultReporter interface {
+	// 上报一次调用结果，err不为nil表示调用失败
+	Report(address string, latency time.Duration, err error)
+}
+
+// 实例健康状态查询接口
+type HealthChecker interface {
+	// 服务实例当前是否健康
+	IsHealthy(address string) bool
+}
+
+// 离群检测配置
+type OutlierConfig struct {
+	// 连续失败多少次后驱逐实例，小于等于0表示不根据失败次数驱逐
+	ConsecutiveErrors int
+	// 平均延迟超过该值时驱逐实例，0表示不根据延迟驱逐
+	MaxLatency time.Duration
+	// 延迟判断所需的最少样本数
+	MinLatencySamples int
+	// 基础驱逐时间，实际驱逐时间为基础驱逐时间乘以驱逐次数
+	BaseEjectionTime time.Duration
+	// 最大驱逐时间
+	MaxEjectionTime time.Duration
+	// 最多允许驱逐的实例百分比
+	MaxEjectionPercent int
+	// 恢复期，驱逐结束后在该时间内逐步恢复实例的流量，0表示立即完全恢复
+	RecoveryWindow time.Duration
+}
+
+// 默认离群检测配置
+func DefaultOutlierConfig() *OutlierConfig {
+	return &OutlierConfig{
+		ConsecutiveErrors:  5,
+		MinLatencySamples:  10,
+		BaseEjectionTime:   30 * time.Second,
+		MaxEjectionTime:    5 * time.Minute,
+		MaxEjectionPercent: 50,
+		RecoveryWindow:     30 * time.Second,
+	}
+}
+
+// 服务实例的调用统计
+type outlierStat struct {
+	// 连续失败次数
+	consecutiveErrors int
+	// 延迟的指数加权移动平均值
+	avgLatency time.Duration
+	// 延迟样本数
+	latencySamples int
+	// 被驱逐的次数
+	ejectionCount int
+	// 最近一次驱逐时间
+	ejectedAt time.Time
+	// 驱逐结束时间
+	ejectedUntil time.Time
+}
+
+// 离群检测负载均衡器，包装任意负载均衡器
+type OutlierLoadBalancer struct {
+	lb     LoadBalancer
+	config OutlierConfig
+	// 以服务地址为键的调用统计
+	stats map[string]*outlierStat
+	mu    sync.Mutex
+	// 便于测试替换
+	now    func() time.Time
+	random func() float64
+}
+
+// 创建离群检测负载均衡器，config为nil时使用默认配置
+func NewOutlierLoadBalancer(lb LoadBalancer, config *OutlierConfig) *OutlierLoadBalancer {
+	if config == nil {
+		config = DefaultOutlierConfig()
+	}
+	return &OutlierLoadBalancer{
+		lb:     lb,
+		config: *config,
+		stats:  make(map[string]*outlierStat),
+		now:    time.Now,
+		random: rand.Float64,
+	}
+}
+
+// 选择服务器
+func (o *OutlierLoadBalancer) SelectService(services []*InstanceInfo) (*InstanceInfo, error) {
+	return o.lb.SelectService(o.filter(services))
+}
+
+// 根据key选择服务器
+func (o *OutlierLoadBalancer) SelectServiceByKey(services []*InstanceInfo, key string) (*InstanceInfo, error) {
+	return o.lb.SelectServiceByKey(o.filter(services), key)
+}
+
+// 上报一次调用结果
+func (o *OutlierLoadBalancer) Report(address string, latency time.Duration, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	now := o.now()
+	stat, ok := o.stats[address]
+	if !ok {
+		stat = &outlierStat{}
+		o.stats[address] = stat
+	}
+	// 驱逐期间的调用结果不再统计
+	if now.Before(stat.ejectedUntil) {
+		return
+	}
+	// 驱逐结束后持续正常的时间超过上次的驱逐时间，重置驱逐次数
+	if stat.ejectionCount > 0 && now.Sub(stat.ejectedUntil) > stat.ejectedUntil.Sub(stat.ejectedAt) {
+		stat.ejectionCount = 0
+	}
+	if err != nil {
+		stat.consecutiveErrors++
+	} else {
+		stat.consecutiveErrors = 0
+	}
+	if stat.latencySamples == 0 {
+		stat.avgLatency = latency
+	} else {
+		stat.avgLatency = (stat.avgLatency*4 + latency) / 5
+	}
+	stat.latencySamples++
+
+	if o.config.ConsecutiveErrors > 0 && stat.consecutiveErrors >= o.config.ConsecutiveErrors {
+		o.eject(stat, now)
+		return
+	}
+	if o.config.MaxLatency > 0 && stat.latencySamples >= o.config.MinLatencySamples && stat.avgLatency > o.config.MaxLatency {
+		o.eject(stat, now)
+	}
+}
+
+// 上报一次HTTP调用结果，5xx状态码视为失败
+func (o *OutlierLoadBalancer) ReportStatus(address string, latency time.Duration, statusCode int) {
+	var err error
+	if statusCode >= 500 {
+		err = ErrServerStatus
+	}
+	o.Report(address, latency, err)
+}
+
+// 服务实例当前是否被驱逐
+func (o *OutlierLoadBalancer) IsEjected(address string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	stat, ok := o.stats[address]
+	return ok && o.now().Before(stat.ejectedUntil)
+}
+
+// 服务实例当前是否健康
+func (o *OutlierLoadBalancer) IsHealthy(address string) bool {
+	return !o.IsEjected(address)
+}
+
+// 驱逐服务实例
+func (o *OutlierLoadBalancer) eject(stat *outlierStat, now time.Time) {
+	stat.ejectionCount++
+	ejection := o.config.BaseEjectionTime * time.Duration(stat.ejectionCount)
+	if o.config.MaxEjectionTime > 0 && ejection > o.config.MaxEjectionTime {
+		ejection = o.config.MaxEjectionTime
+	}
+	stat.ejectedAt = now
+	stat.ejectedUntil = now.Add(ejection)
+	stat.consecutiveErrors = 0
+	stat.avgLatency = 0
+	stat.latencySamples = 0
+}
+
+// 过滤被驱逐的服务实例
+func (o *OutlierLoadBalancer) filter(services []*InstanceInfo) []*InstanceInfo {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	now := o.now()
+
+	type ejected struct {
+		instance *InstanceInfo
+		at       time.Time
+	}
+	var ejectedList []ejected
+	available := make([]*InstanceInfo, 0, len(services))
+	for _, instance := range services {
+		if instance == nil {
+			continue
+		}
+		stat, ok := o.stats[instance.Address]
+		if !ok {
+			available = append(available, instance)
+			continue
+		}
+		if now.Before(stat.ejectedUntil) {
+			ejectedList = append(ejectedList, ejected{instance: instance, at: stat.ejectedAt})
+			continue
+		}
+		// 恢复期内按已恢复时间的比例放行流量
+		if o.config.RecoveryWindow > 0 && stat.ejectionCount > 0 {
+			elapsed := now.Sub(stat.ejectedUntil)
+			if elapsed < o.config.RecoveryWindow && o.random() >= float64(elapsed)/float64(o.config.RecoveryWindow) {
+				continue
+			}
+		}
+		available = append(available, instance)
+	}
+	if len(ejectedList) == 0 {
+		if len(available) == 0 {
+			return services
+		}
+		return available
+	}
+	// 超过最大驱逐比例时，只驱逐最早被驱逐的实例，其余实例照常使用
+	maxEjected := len(services) * o.config.MaxEjectionPercent / 100
+	if len(ejectedList) > maxEjected {
+		sort.Slice(ejectedList, func(i, j int) bool {
+			return ejectedList[i].at.Before(ejectedList[j].at)
+		})
+		for _, e := range ejectedList[maxEjected:] {
+			available = append(available, e.instance)
+		}
+	}
+	if len(available) == 0 {
+		return services
+	}
+	return available
+}
@@ -0,0 +1,181 @@
+package loadbalancer
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// 离群检测单元测试
+var errCall = errors.New("call failed")
+
+func newTestOutlierLoadBalancer(config *OutlierConfig) (*OutlierLoadBalancer, *time.Time) {
+	now := time.Unix(1600000000, 0)
+	o := NewOutlierLoadBalancer(&WeightRoundRobinLoadBalancer{}, config)
+	o.now = func() time.Time { return now }
+	o.random = func() float64 { return 0.5 }
+	return o, &now
+}
+
+func newTestInstances() []*InstanceInfo {
+	return []*InstanceInfo{
+		{Address: node1, Weight: 1},
+		{Address: node2, Weight: 1},
+		{Address: node3, Weight: 1},
+	}
+}
+
+func selectCount(t *testing.T, o *OutlierLoadBalancer, services []*InstanceInfo, n int) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		instance, err := o.SelectService(services)
+		if err != nil {
+			t.Fatalf("select service err: %v", err)
+		}
+		counts[instance.Address]++
+	}
+	return counts
+}
+
+func TestOutlierConsecutiveErrors(t *testing.T) {
+	o, now := newTestOutlierLoadBalancer(&OutlierConfig{
+		ConsecutiveErrors:  3,
+		BaseEjectionTime:   10 * time.Second,
+		MaxEjectionTime:    time.Minute,
+		MaxEjectionPercent: 50,
+	})
+	services := newTestInstances()
+
+	o.Report(node1, time.Millisecond, errCall)
+	o.Report(node1, time.Millisecond, errCall)
+	o.Report(node1, time.Millisecond, nil)
+	o.Report(node1, time.Millisecond, errCall)
+	if o.IsEjected(node1) {
+		t.Fatalf("expected %v not ejected after success resets errors", node1)
+	}
+	o.ReportStatus(node1, time.Millisecond, 502)
+	o.ReportStatus(node1, time.Millisecond, 503)
+	if !o.IsEjected(node1) {
+		t.Fatalf("expected %v ejected", node1)
+	}
+	if counts := selectCount(t, o, services, 30); counts[node1] != 0 {
+		t.Fatalf("expected ejected %v not selected, got %v", node1, counts)
+	}
+
+	*now = now.Add(11 * time.Second)
+	if o.IsEjected(node1) {
+		t.Fatalf("expected %v back after ejection time", node1)
+	}
+	if counts := selectCount(t, o, services, 30); counts[node1] == 0 {
+		t.Fatalf("expected %v selected again, got %v", node1, counts)
+	}
+
+	// 再次驱逐时驱逐时间翻倍
+	for i := 0; i < 3; i++ {
+		o.Report(node1, time.Millisecond, errCall)
+	}
+	*now = now.Add(11 * time.Second)
+	if !o.IsEjected(node1) {
+		t.Fatalf("expected %v ejected for twice the base ejection time", node1)
+	}
+	*now = now.Add(10 * time.Second)
+	if o.IsEjected(node1) {
+		t.Fatalf("expected %v back after second ejection", node1)
+	}
+}
+
+func TestOutlierRepeatedEjection(t *testing.T) {
+	// 未设置最大驱逐时间
+	o, now := newTestOutlierLoadBalancer(&OutlierConfig{
+		ConsecutiveErrors:  2,
+		BaseEjectionTime:   10 * time.Second,
+		MaxEjectionPercent: 50,
+	})
+	for i := 1; i <= 3; i++ {
+		o.Report(node1, time.Millisecond, errCall)
+		o.Report(node1, time.Millisecond, errCall)
+		// 持续失败的实例每次驱逐时间递增
+		*now = now.Add(time.Duration(i)*10*time.Second - time.Second)
+		if !o.IsEjected(node1) {
+			t.Fatalf("expected %v ejected for %d times the base ejection time", node1, i)
+		}
+		*now = now.Add(2 * time.Second)
+		if o.IsEjected(node1) {
+			t.Fatalf("expected %v back after ejection %d", node1, i)
+		}
+	}
+
+	// 正常运行超过上次的驱逐时间后，驱逐时间恢复为基础驱逐时间
+	*now = now.Add(31 * time.Second)
+	o.Report(node1, time.Millisecond, errCall)
+	o.Report(node1, time.Millisecond, errCall)
+	*now = now.Add(11 * time.Second)
+	if o.IsEjected(node1) {
+		t.Fatalf("expected %v ejected for the base ejection time after a healthy interval", node1)
+	}
+}
+
+func TestOutlierLatency(t *testing.T) {
+	o, _ := newTestOutlierLoadBalancer(&OutlierConfig{
+		MaxLatency:         100 * time.Millisecond,
+		MinLatencySamples:  3,
+		BaseEjectionTime:   10 * time.Second,
+		MaxEjectionPercent: 50,
+	})
+	o.Report(node2, time.Second, nil)
+	o.Report(node2, time.Second, nil)
+	if o.IsEjected(node2) {
+		t.Fatalf("expected %v not ejected before enough samples", node2)
+	}
+	o.Report(node2, time.Second, nil)
+	if !o.IsEjected(node2) {
+		t.Fatalf("expected slow %v ejected", node2)
+	}
+}
+
+func TestOutlierMaxEjectionPercent(t *testing.T) {
+	o, now := newTestOutlierLoadBalancer(&OutlierConfig{
+		ConsecutiveErrors:  1,
+		BaseEjectionTime:   10 * time.Second,
+		MaxEjectionPercent: 34,
+	})
+	services := newTestInstances()
+	o.Report(node1, time.Millisecond, errCall)
+	*now = now.Add(time.Second)
+	o.Report(node2, time.Millisecond, errCall)
+
+	counts := selectCount(t, o, services, 30)
+	if counts[node1] != 0 {
+		t.Fatalf("expected first ejected %v not selected, got %v", node1, counts)
+	}
+	if counts[node2] == 0 || counts[node3] == 0 {
+		t.Fatalf("expected %v and %v selected above max ejection percent, got %v", node2, node3, counts)
+	}
+
+	// 全部实例都被驱逐时回退到完整列表
+	o.config.MaxEjectionPercent = 100
+	o.Report(node3, time.Millisecond, errCall)
+	if counts := selectCount(t, o, services, 30); len(counts) != 3 {
+		t.Fatalf("expected all instances selected when all ejected, got %v", counts)
+	}
+}
+
+func TestOutlierRecoveryWindow(t *testing.T) {
+	o, now := newTestOutlierLoadBalancer(&OutlierConfig{
+		ConsecutiveErrors:  1,
+		BaseEjectionTime:   10 * time.Second,
+		MaxEjectionPercent: 50,
+		RecoveryWindow:     10 * time.Second,
+	})
+	services := newTestInstances()
+	o.Report(node1, time.Millisecond, errCall)
+
+	*now = now.Add(12 * time.Second)
+	if counts := selectCount(t, o, services, 30); counts[node1] != 0 {
+		t.Fatalf("expected %v throttled early in recovery window, got %v", node1, counts)
+	}
+	*now = now.Add(4 * time.Second)
+	if counts := selectCount(t, o, services, 30); counts[node1] == 0 {
+		t.Fatalf("expected %v selected later in recovery window, got %v", node1, counts)
+	}
+}
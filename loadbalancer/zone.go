@@ -0,0 +1,164 @@
+package loadbalancer
+
+// 可用区及标签感知路由
+// 优先选择与调用方处于同一可用区的服务实例，本地可用区健康实例不足时溢出到其他可用区，
+// 同时支持按标签和元数据选择实例子集，如canary、v2
+
+const (
+	// 元数据中表示可用区的键
+	ZoneMetaKey = "zone"
+	// 默认本地健康实例最低占比
+	DefaultMinHealthyPercent = 70
+)
+
+// 可用区感知配置
+type ZoneAwareConfig struct {
+	// 本地可用区，为空时不区分可用区
+	Zone string
+	// 本地可用区健康实例占比低于该百分比时，溢出到所有可用区
+	MinHealthyPercent int
+	// 实例子集标签，实例需包含全部标签
+	Tags []string
+	// 实例子集元数据，实例需匹配全部键值
+	Meta map[string]string
+}
+
+// 可用区感知负载均衡器，包装任意负载均衡器
+type ZoneAwareLoadBalancer struct {
+	lb LoadBalancer
+	// 健康状态查询，为nil时认为所有实例都健康
+	health HealthChecker
+	config ZoneAwareConfig
+}
+
+// 创建可用区感知负载均衡器，health可以传入离群检测负载均衡器
+func NewZoneAwareLoadBalancer(lb LoadBalancer, health HealthChecker, config *ZoneAwareConfig) *ZoneAwareLoadBalancer {
+	z := &ZoneAwareLoadBalancer{
+		lb:     lb,
+		health: health,
+	}
+	if config != nil {
+		z.config = *config
+	}
+	if z.config.MinHealthyPercent <= 0 {
+		z.config.MinHealthyPercent = DefaultMinHealthyPercent
+	}
+	return z
+}
+
+// 返回选择指定实例子集的负载均衡器，与原负载均衡器共享底层负载均衡器
+func (z *ZoneAwareLoadBalancer) WithSubset(tags []string, meta map[string]string) *ZoneAwareLoadBalancer {
+	subset := *z
+	subset.config.Tags = tags
+	subset.config.Meta = meta
+	return &subset
+}
+
+// 选择服务器
+func (z *ZoneAwareLoadBalancer) SelectService(services []*InstanceInfo) (*InstanceInfo, error) {
+	candidates, err := z.candidates(services)
+	if err != nil {
+		return nil, err
+	}
+	return z.lb.SelectService(candidates)
+}
+
+// 根据key选择服务器
+func (z *ZoneAwareLoadBalancer) SelectServiceByKey(services []*InstanceInfo, key string) (*InstanceInfo, error) {
+	candidates, err := z.candidates(services)
+	if err != nil {
+		return nil, err
+	}
+	return z.lb.SelectServiceByKey(candidates, key)
+}
+
+// 计算候选实例列表
+func (z *ZoneAwareLoadBalancer) candidates(services []*InstanceInfo) ([]*InstanceInfo, error) {
+	subset := FilterByMeta(FilterByTags(services, z.config.Tags...), z.config.Meta)
+	if len(subset) == 0 {
+		return nil, ErrNotExistService
+	}
+	if z.config.Zone == "" {
+		return subset, nil
+	}
+	var local, healthyLocal, healthy []*InstanceInfo
+	for _, instance := range subset {
+		ok := z.isHealthy(instance)
+		if ok {
+			healthy = append(healthy, instance)
+		}
+		if instance.Meta[ZoneMetaKey] != z.config.Zone {
+			continue
+		}
+		local = append(local, instance)
+		if ok {
+			healthyLocal = append(healthyLocal, instance)
+		}
+	}
+	// 本地可用区健康实例充足时只使用本地实例
+	if len(healthyLocal) > 0 && len(healthyLocal)*100 >= len(local)*z.config.MinHealthyPercent {
+		return healthyLocal, nil
+	}
+	if len(healthy) > 0 {
+		return healthy, nil
+	}
+	return subset, nil
+}
+
+func (z *ZoneAwareLoadBalancer) isHealthy(instance *InstanceInfo) bool {
+	return z.health == nil || z.health.IsHealthy(instance.Address)
+}
+
+// 过滤出包含全部标签的实例
+func FilterByTags(services []*InstanceInfo, tags ...string) []*InstanceInfo {
+	if len(tags) == 0 {
+		return services
+	}
+	result := make([]*InstanceInfo, 0, len(services))
+	for _, instance := range services {
+		if instance != nil && hasTags(instance.Tags, tags) {
+			result = append(result, instance)
+		}
+	}
+	return result
+}
+
+// 过滤出元数据匹配全部键值的实例
+func FilterByMeta(services []*InstanceInfo, meta map[string]string) []*InstanceInfo {
+	if len(meta) == 0 {
+		return services
+	}
+	result := make([]*InstanceInfo, 0, len(services))
+	for _, instance := range services {
+		if instance == nil {
+			continue
+		}
+		matched := true
+		for k, v := range meta {
+			if instance.Meta[k] != v {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			result = append(result, instance)
+		}
+	}
+	return result
+}
+
+func hasTags(instanceTags []string, tags []string) bool {
+	for _, tag := range tags {
+		found := false
+		for _, t := range instanceTags {
+			if t == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
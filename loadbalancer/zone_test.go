@@ -0,0 +1,70 @@
+package loadbalancer
+
+import (
+	"testing"
+	"time"
+)
+
+// 可用区感知单元测试
+func newZoneInstances() []*InstanceInfo {
+	return []*InstanceInfo{
+		{Address: node1, Weight: 1, Tags: []string{"v1"}, Meta: map[string]string{ZoneMetaKey: "zone-a"}},
+		{Address: node2, Weight: 1, Tags: []string{"v1", "canary"}, Meta: map[string]string{ZoneMetaKey: "zone-a", "version": "v2"}},
+		{Address: node3, Weight: 1, Tags: []string{"v1"}, Meta: map[string]string{ZoneMetaKey: "zone-b"}},
+	}
+}
+
+func zoneSelectCount(t *testing.T, lb LoadBalancer, services []*InstanceInfo, n int) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		instance, err := lb.SelectService(services)
+		if err != nil {
+			t.Fatalf("select service err: %v", err)
+		}
+		counts[instance.Address]++
+	}
+	return counts
+}
+
+func TestZoneAwarePrefersLocal(t *testing.T) {
+	services := newZoneInstances()
+	z := NewZoneAwareLoadBalancer(&WeightRoundRobinLoadBalancer{}, nil, &ZoneAwareConfig{Zone: "zone-a"})
+	counts := zoneSelectCount(t, z, services, 30)
+	if counts[node3] != 0 || counts[node1] == 0 || counts[node2] == 0 {
+		t.Fatalf("expected only zone-a instances, got %v", counts)
+	}
+}
+
+func TestZoneAwareSpillOver(t *testing.T) {
+	services := newZoneInstances()
+	o, _ := newTestOutlierLoadBalancer(&OutlierConfig{
+		ConsecutiveErrors:  1,
+		BaseEjectionTime:   time.Minute,
+		MaxEjectionPercent: 100,
+	})
+	z := NewZoneAwareLoadBalancer(o, o, &ZoneAwareConfig{Zone: "zone-a", MinHealthyPercent: 60})
+	o.Report(node1, time.Millisecond, errCall)
+
+	counts := zoneSelectCount(t, z, services, 30)
+	if counts[node1] != 0 || counts[node2] == 0 || counts[node3] == 0 {
+		t.Fatalf("expected spill over to zone-b, got %v", counts)
+	}
+}
+
+func TestZoneAwareSubset(t *testing.T) {
+	services := newZoneInstances()
+	z := NewZoneAwareLoadBalancer(&RandomLoadBalancer{}, nil, nil)
+
+	canary := z.WithSubset([]string{"canary"}, nil)
+	if counts := zoneSelectCount(t, canary, services, 10); counts[node2] != 10 {
+		t.Fatalf("expected only canary instance, got %v", counts)
+	}
+	v2 := z.WithSubset(nil, map[string]string{"version": "v2"})
+	if counts := zoneSelectCount(t, v2, services, 10); counts[node2] != 10 {
+		t.Fatalf("expected only v2 instance, got %v", counts)
+	}
+	none := z.WithSubset([]string{"v3"}, nil)
+	if _, err := none.SelectService(services); err != ErrNotExistService {
+		t.Fatalf("expected %v got %v", ErrNotExistService, err)
+	}
+}
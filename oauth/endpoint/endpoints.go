@@ -63,7 +63,9 @@ type CheckTokenRequest struct {
 
 type CheckTokenResponse struct {
 	OAuthDetails *model.OAuth2Details `json:"o_auth_details"`
-	Error        string               `json:"error"`
+	// 令牌过期时间，Unix秒，调用方缓存校验结果时不应超过该时间
+	Exp   int64  `json:"exp,omitempty"`
+	Error string `json:"error"`
 }
 
 // HealthRequest 健康检查请求结构
@@ -184,11 +186,15 @@ func MakeCheckTokenEndpoint(svc service.TokenService) endpoint.Endpoint {
 		req := request.(*CheckTokenRequest)
 		tokenDetails, err := svc.GetOAuth2DetailsByAccessToken(req.Token)
 		var errString = ""
+		var exp int64
 		if err != nil {
 			errString = err.Error()
+		} else if token, err := svc.ReadAccessToken(req.Token); err == nil && token.ExpiresTime != nil {
+			exp = token.ExpiresTime.Unix()
 		}
 		return CheckTokenResponse{
 			OAuthDetails: tokenDetails,
+			Exp:          exp,
 			Error:        errString,
 		}, nil
 	}
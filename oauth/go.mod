@@ -7,6 +7,12 @@ require (
 	github.com/go-kit/kit v0.10.0
 	github.com/gorilla/context v1.1.1 // indirect
 	github.com/gorilla/mux v1.7.4
-	github.com/prometheus/client_golang v1.3.0
+	github.com/openzipkin/zipkin-go v0.2.2
 	github.com/satori/go.uuid v1.2.0
+	github.com/yunfeiyang1916/micro-go-course/instrument v0.0.0
+	github.com/yunfeiyang1916/micro-go-course/tracing v0.0.0
 )
+
+replace github.com/yunfeiyang1916/micro-go-course/instrument => ../instrument
+
+replace github.com/yunfeiyang1916/micro-go-course/tracing => ../tracing
@@ -15,18 +15,28 @@ import (
 	"github.com/yunfeiyang1916/micro-go-course/oauth/model"
 	"github.com/yunfeiyang1916/micro-go-course/oauth/service"
 	"github.com/yunfeiyang1916/micro-go-course/oauth/transport"
+	"github.com/yunfeiyang1916/micro-go-course/tracing"
 )
 
 func main() {
 	var (
 		servicePort = flag.Int("service.port", 10086, "service port")
 	)
+	tracingConfig := tracing.DefaultConfig("oauth", "")
+	tracingConfig.BindFlags(flag.CommandLine)
 
 	flag.Parse()
 
 	ctx := context.Background()
 	errChan := make(chan error)
 
+	tracingConfig.HostPort = ":" + strconv.Itoa(*servicePort)
+	tracer, closeTracer, err := tracing.New(tracingConfig)
+	if err != nil {
+		config.Logger.Fatal(err)
+	}
+	defer closeTracer()
+
 	// 令牌服务
 	var tokenService service.TokenService
 	// 令牌生成器
@@ -97,7 +107,7 @@ func main() {
 	}
 
 	// 创建http.Handler
-	r := transport.MakeHttpHandler(ctx, endpts, tokenService, clientDetailsService, config.KitLogger)
+	r := transport.MakeHttpHandler(ctx, endpts, tokenService, clientDetailsService, config.KitLogger, tracer)
 	go func() {
 		config.Logger.Println("Http Server start at port:" + strconv.Itoa(*servicePort))
 		handler := r
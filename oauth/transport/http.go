@@ -10,9 +10,11 @@ import (
 	"github.com/go-kit/kit/transport"
 	kithttp "github.com/go-kit/kit/transport/http"
 	"github.com/gorilla/mux"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/openzipkin/zipkin-go"
+	"github.com/yunfeiyang1916/micro-go-course/instrument"
 	"github.com/yunfeiyang1916/micro-go-course/oauth/endpoint"
 	"github.com/yunfeiyang1916/micro-go-course/oauth/service"
+	"github.com/yunfeiyang1916/micro-go-course/tracing"
 )
 
 // 传输层，对外暴露项目的服务接口
@@ -28,28 +30,32 @@ var (
 )
 
 // 创建http处理器
-func MakeHttpHandler(ctx context.Context, endpoints endpoint.OAuth2Endpoints, tokenService service.TokenService, clientService service.ClientDetailsService, logger log.Logger) http.Handler {
+func MakeHttpHandler(ctx context.Context, endpoints endpoint.OAuth2Endpoints, tokenService service.TokenService, clientService service.ClientDetailsService, logger log.Logger, tracer *zipkin.Tracer) http.Handler {
 	r := mux.NewRouter()
+	instrument.WrapRouter(r, "oauth")
+	trace := tracing.HTTPServerTrace(tracer)
 	options := []kithttp.ServerOption{
 		kithttp.ServerErrorHandler(transport.NewLogErrorHandler(logger)),
 		kithttp.ServerErrorEncoder(encodeError),
+		trace,
 	}
-	r.Path("/metrics").Handler(promhttp.Handler())
 	clientAuthorizationOptions := []kithttp.ServerOption{
 		kithttp.ServerBefore(makeClientAuthorizationContext(clientService, logger)),
 		kithttp.ServerErrorHandler(transport.NewLogErrorHandler(logger)),
 		kithttp.ServerErrorEncoder(encodeError),
+		trace,
 	}
 	oauth2AuthorizationOptions := []kithttp.ServerOption{
 		kithttp.ServerBefore(makeOAuth2AuthorizationContext(tokenService, logger)),
 		kithttp.ServerErrorHandler(transport.NewLogErrorHandler(logger)),
 		kithttp.ServerErrorEncoder(encodeError),
+		trace,
 	}
 	// 用于客户端携带用户凭证请求访问令牌
 	r.Methods("POST").Path("/oauth/token").Handler(kithttp.NewServer(endpoints.TokenEndpoint, decodeTokenRequest, encodeJsonResponse, clientAuthorizationOptions...))
 
 	// 用于验证访问令牌的有效性，返回访问令牌绑定的客户端和用户信息
-	r.Methods("POST").Path("/oauth/check_token").Handler(kithttp.NewServer(endpoints.TokenEndpoint, decodeCheckTokenRequest, encodeJsonResponse, clientAuthorizationOptions...))
+	r.Methods("POST").Path("/oauth/check_token").Handler(kithttp.NewServer(endpoints.CheckTokenEndpoint, decodeCheckTokenRequest, encodeJsonResponse, clientAuthorizationOptions...))
 
 	// create health check handler
 	r.Methods("GET").Path("/health").Handler(kithttp.NewServer(endpoints.HealthCheckEndpoint, decodeHealthCheckRequest, encodeJsonResponse, options...))
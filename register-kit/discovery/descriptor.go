@@ -0,0 +1,196 @@
+package discovery
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// 服务描述
+// 将服务版本、构建的git提交、支持的协议及端口和对外暴露的路由编码到consul的meta中，
+// 服务发现时再解码。网关转发时只选择声明了路由协议的实例并使用该协议的端口，
+// 按版本选择实例时可在路由的subset中匹配 svc_version。
+// consul限制meta的值最长512个字符，路由列表过长时拆分到多个键中，
+// 路由以逗号分隔，方法和路径以空格分隔，各自经过URL转义
+
+// 支持的协议
+const (
+	ProtocolHTTP   = "http"
+	ProtocolGRPC   = "grpc"
+	ProtocolNetRPC = "net-rpc"
+)
+
+// meta中的键
+const (
+	metaVersion        = "svc_version"
+	metaGitSHA         = "svc_git_sha"
+	metaProtocolPrefix = "svc_proto_"
+	metaRoutesPrefix   = "svc_routes_"
+	// consul限制的meta值最大长度
+	maxMetaValueLength = 512
+)
+
+// 协议及其监听端口
+type ProtocolPort struct {
+	Protocol string `json:"protocol"`
+	Port     int    `json:"port"`
+}
+
+// 对外暴露的路由
+type Route struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+}
+
+func (r Route) String() string {
+	return r.Method + " " + r.Path
+}
+
+// 编码为meta中的一项，转义后不含分隔用的逗号和空格
+func (r Route) encode() string {
+	return url.QueryEscape(r.Method) + " " + url.QueryEscape(r.Path)
+}
+
+func decodeRoute(s string) (Route, error) {
+	parts := strings.SplitN(s, " ", 2)
+	if len(parts) != 2 {
+		return Route{}, fmt.Errorf("invalid route : %s", s)
+	}
+	method, err := url.QueryUnescape(parts[0])
+	if err != nil {
+		return Route{}, fmt.Errorf("invalid route : %s", s)
+	}
+	path, err := url.QueryUnescape(parts[1])
+	if err != nil {
+		return Route{}, fmt.Errorf("invalid route : %s", s)
+	}
+	return Route{Method: method, Path: path}, nil
+}
+
+// 服务描述
+type ServiceDescriptor struct {
+	Version   string         `json:"version,omitempty"`
+	GitSHA    string         `json:"gitSha,omitempty"`
+	Protocols []ProtocolPort `json:"protocols,omitempty"`
+	Routes    []Route        `json:"routes,omitempty"`
+}
+
+// 带服务描述的服务实例
+type ServiceInstance struct {
+	*api.AgentService
+	Descriptor *ServiceDescriptor `json:"descriptor"`
+}
+
+// 编码为consul meta，extra中的键值一并写入，与描述的键冲突时以描述为准
+func (d *ServiceDescriptor) Meta(extra map[string]string) map[string]string {
+	meta := make(map[string]string, len(extra)+4)
+	for k, v := range extra {
+		meta[k] = v
+	}
+	if d == nil {
+		return meta
+	}
+	if d.Version != "" {
+		meta[metaVersion] = d.Version
+	}
+	if d.GitSHA != "" {
+		meta[metaGitSHA] = d.GitSHA
+	}
+	for _, p := range d.Protocols {
+		meta[metaProtocolPrefix+p.Protocol] = strconv.Itoa(p.Port)
+	}
+	chunk, n := "", 0
+	for _, route := range d.Routes {
+		s := route.encode()
+		if chunk != "" && len(chunk)+1+len(s) > maxMetaValueLength {
+			meta[metaRoutesPrefix+strconv.Itoa(n)] = chunk
+			chunk, n = "", n+1
+		}
+		if chunk != "" {
+			chunk += ","
+		}
+		chunk += s
+	}
+	if chunk != "" {
+		meta[metaRoutesPrefix+strconv.Itoa(n)] = chunk
+	}
+	return meta
+}
+
+// 从consul meta中解码服务描述
+func ParseServiceDescriptor(meta map[string]string) (*ServiceDescriptor, error) {
+	d := &ServiceDescriptor{
+		Version: meta[metaVersion],
+		GitSHA:  meta[metaGitSHA],
+	}
+	for k, v := range meta {
+		if !strings.HasPrefix(k, metaProtocolPrefix) {
+			continue
+		}
+		port, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port of %s : %s", k, v)
+		}
+		d.Protocols = append(d.Protocols, ProtocolPort{Protocol: strings.TrimPrefix(k, metaProtocolPrefix), Port: port})
+	}
+	sort.Slice(d.Protocols, func(i, j int) bool {
+		return d.Protocols[i].Protocol < d.Protocols[j].Protocol
+	})
+	for n := 0; ; n++ {
+		chunk, ok := meta[metaRoutesPrefix+strconv.Itoa(n)]
+		if !ok {
+			break
+		}
+		for _, s := range strings.Split(chunk, ",") {
+			route, err := decodeRoute(s)
+			if err != nil {
+				return nil, err
+			}
+			d.Routes = append(d.Routes, route)
+		}
+	}
+	return d, nil
+}
+
+// 获取协议的端口，未声明协议时返回false
+func (d *ServiceDescriptor) Port(protocol string) (int, bool) {
+	for _, p := range d.Protocols {
+		if p.Protocol == protocol {
+			return p.Port, true
+		}
+	}
+	return 0, false
+}
+
+// 是否支持协议，未声明任何协议的实例视为只支持http
+func (d *ServiceDescriptor) Speaks(protocol string) bool {
+	if len(d.Protocols) == 0 {
+		return protocol == ProtocolHTTP
+	}
+	_, ok := d.Port(protocol)
+	return ok
+}
+
+// 版本是否匹配，v1 匹配 v1 和 v1.x.x，空约束匹配任意版本
+func (d *ServiceDescriptor) MatchVersion(version string) bool {
+	return version == "" || d.Version == version || strings.HasPrefix(d.Version, version+".")
+}
+
+// 筛选支持指定协议和版本的实例，参数为空时不做对应筛选
+func FilterInstances(instances []*ServiceInstance, protocol, version string) []*ServiceInstance {
+	result := make([]*ServiceInstance, 0, len(instances))
+	for _, instance := range instances {
+		if protocol != "" && !instance.Descriptor.Speaks(protocol) {
+			continue
+		}
+		if !instance.Descriptor.MatchVersion(version) {
+			continue
+		}
+		result = append(result, instance)
+	}
+	return result
+}
@@ -0,0 +1,92 @@
+package discovery
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestServiceDescriptorMeta(t *testing.T) {
+	d := &ServiceDescriptor{
+		Version: "v1.2.0",
+		GitSHA:  "8fc360e",
+		Protocols: []ProtocolPort{
+			{Protocol: ProtocolGRPC, Port: 9090},
+			{Protocol: ProtocolHTTP, Port: 12312},
+		},
+		// 路径中的分隔符需要转义
+		Routes: []Route{{Method: "GET", Path: "/health"}, {Method: "GET", Path: "/discovery/name"}, {Method: "GET", Path: "/search/a,b c+d"}},
+	}
+	meta := d.Meta(map[string]string{"zone": "a"})
+	if meta["zone"] != "a" || meta["svc_proto_grpc"] != "9090" {
+		t.Fatalf("unexpected meta %v", meta)
+	}
+	parsed, err := ParseServiceDescriptor(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(d, parsed) {
+		t.Fatalf("expected %+v, got %+v", d, parsed)
+	}
+}
+
+func TestServiceDescriptorLongRoutes(t *testing.T) {
+	d := &ServiceDescriptor{}
+	for i := 0; i < 100; i++ {
+		d.Routes = append(d.Routes, Route{Method: "GET", Path: "/api/v1/resources/" + strconv.Itoa(i)})
+	}
+	meta := d.Meta(nil)
+	for k, v := range meta {
+		if len(v) > maxMetaValueLength {
+			t.Fatalf("meta %s exceeds %d characters", k, maxMetaValueLength)
+		}
+	}
+	if _, ok := meta["svc_routes_1"]; !ok {
+		t.Fatalf("expected routes split into multiple keys, got %v", meta)
+	}
+	parsed, err := ParseServiceDescriptor(meta)
+	if err != nil || !reflect.DeepEqual(d.Routes, parsed.Routes) {
+		t.Fatalf("unexpected routes %v %v", parsed, err)
+	}
+}
+
+func TestParseInvalidDescriptor(t *testing.T) {
+	if _, err := ParseServiceDescriptor(map[string]string{"svc_proto_grpc": "abc"}); err == nil {
+		t.Fatal("expected invalid port error")
+	}
+}
+
+func TestFilterInstances(t *testing.T) {
+	newInstance := func(id string, d *ServiceDescriptor) *ServiceInstance {
+		return &ServiceInstance{AgentService: &api.AgentService{ID: id}, Descriptor: d}
+	}
+	instances := []*ServiceInstance{
+		// 未声明协议的旧实例只支持http
+		newInstance("legacy", &ServiceDescriptor{}),
+		newInstance("v1-http", &ServiceDescriptor{Version: "v1.0.1", Protocols: []ProtocolPort{{ProtocolHTTP, 80}}}),
+		newInstance("v1-grpc", &ServiceDescriptor{Version: "v1.1.0", Protocols: []ProtocolPort{{ProtocolHTTP, 80}, {ProtocolGRPC, 90}}}),
+		newInstance("v10-grpc", &ServiceDescriptor{Version: "v10.0.0", Protocols: []ProtocolPort{{ProtocolGRPC, 90}}}),
+	}
+	cases := []struct {
+		protocol, version, expected string
+	}{
+		{"", "", "legacy,v1-http,v1-grpc,v10-grpc"},
+		{ProtocolHTTP, "", "legacy,v1-http,v1-grpc"},
+		{ProtocolGRPC, "", "v1-grpc,v10-grpc"},
+		{ProtocolGRPC, "v1", "v1-grpc"},
+		{"", "v1.0.1", "v1-http"},
+		{ProtocolNetRPC, "", ""},
+	}
+	for _, c := range cases {
+		ids := make([]string, 0)
+		for _, instance := range FilterInstances(instances, c.protocol, c.version) {
+			ids = append(ids, instance.ID)
+		}
+		if got := strings.Join(ids, ","); got != c.expected {
+			t.Fatalf("protocol %q version %q: expected %s, got %s", c.protocol, c.version, c.expected, got)
+		}
+	}
+}
@@ -75,3 +75,22 @@ func (consulClient *DiscoveryClient) DiscoverServices(ctx context.Context, servi
 	}
 	return rsp, err
 }
+
+// 服务发现，并从meta中解码服务描述
+func (consulClient *DiscoveryClient) DiscoverInstances(ctx context.Context, serviceName string) ([]*ServiceInstance, error) {
+	services, err := consulClient.DiscoverServices(ctx, serviceName)
+	if err != nil {
+		return nil, err
+	}
+	instances := make([]*ServiceInstance, 0, len(services))
+	for _, service := range services {
+		descriptor, err := ParseServiceDescriptor(service.Meta)
+		if err != nil {
+			// 描述无法解析时按未声明描述的实例处理
+			log.NewLogfmtLogger(os.Stderr).Log("service", service.ID, "err", err)
+			descriptor = &ServiceDescriptor{}
+		}
+		instances = append(instances, &ServiceInstance{AgentService: service, Descriptor: descriptor})
+	}
+	return instances, nil
+}
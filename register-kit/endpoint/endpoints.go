@@ -3,7 +3,7 @@ package endpoint
 import (
 	"context"
 	"github.com/go-kit/kit/endpoint"
-	"github.com/hashicorp/consul/api"
+	"github.com/yunfeiyang1916/micro-go-course/register-kit/discovery"
 	"github.com/yunfeiyang1916/micro-go-course/register-kit/service"
 )
 
@@ -15,12 +15,16 @@ type RegisterEndpoints struct {
 // 服务发现请求结构体
 type DiscoveryRequest struct {
 	ServiceName string
+	// 实例需支持的协议
+	Protocol string
+	// 实例需匹配的版本
+	Version string
 }
 
 // 服务发现响应结构体
 type DiscoveryResponse struct {
-	Instances []*api.AgentService `json:"instances"`
-	Error     string              `json:"error"`
+	Instances []*discovery.ServiceInstance `json:"instances"`
+	Error     string                       `json:"error"`
 }
 
 // 创建服务发现的 Endpoint
@@ -28,7 +32,7 @@ func MakeDiscoveryEndpoint(svc service.Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
 
 		req := request.(DiscoveryRequest)
-		instances, err := svc.DiscoveryService(ctx, req.ServiceName)
+		instances, err := svc.DiscoveryService(ctx, req.ServiceName, req.Protocol, req.Version)
 		var errString = ""
 
 		if err != nil {
@@ -17,18 +17,22 @@ import (
 	"syscall"
 )
 
+// 构建时通过 -ldflags "-X main.gitSHA=$(git rev-parse --short HEAD)" 注入
+var gitSHA string
+
 func main() {
 	consulAddr := flag.String("consul.addr", "localhost", "consul address")
 	consulPort := flag.Int("consul.port", 8500, "consul port")
 	serviceName := flag.String("service.name", "register", "service name")
 	serviceAddr := flag.String("service.addr", "localhost", "service addr")
 	servicePort := flag.Int("service.port", 12312, "service port")
+	serviceVersion := flag.String("service.version", "v1.0.0", "service version")
 
 	flag.Parse()
 
 	instanceId := *serviceName + "-" + uuid.New().String()
-	client, err := discovery.NewDiscoveryClient(*consulAddr, *consulPort, discovery.NewAgentServiceRegistration(
-		*serviceName, instanceId, "/health", *serviceAddr, *servicePort, nil))
+	registration := discovery.NewAgentServiceRegistration(*serviceName, instanceId, "/health", *serviceAddr, *servicePort, nil)
+	client, err := discovery.NewDiscoveryClient(*consulAddr, *consulPort, registration)
 
 	if err != nil {
 		log.Printf("register service err : %s", err)
@@ -45,6 +49,15 @@ func main() {
 
 	handler := transport.MakeHttpHandler(context.Background(), &endpoints)
 
+	// 将服务描述编码到注册信息的meta中
+	descriptor := &discovery.ServiceDescriptor{
+		Version:   *serviceVersion,
+		GitSHA:    gitSHA,
+		Protocols: []discovery.ProtocolPort{{Protocol: discovery.ProtocolHTTP, Port: *servicePort}},
+		Routes:    transport.Routes(handler),
+	}
+	registration.Meta = descriptor.Meta(registration.Meta)
+
 	go func() {
 		errChan <- http.ListenAndServe(":"+strconv.Itoa(*servicePort), handler)
 	}()
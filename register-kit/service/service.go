@@ -3,7 +3,6 @@ package service
 import (
 	"context"
 	"errors"
-	"github.com/hashicorp/consul/api"
 	"github.com/yunfeiyang1916/micro-go-course/register-kit/discovery"
 	"log"
 )
@@ -11,7 +10,8 @@ import (
 type Service interface {
 	HealthCheck() string
 
-	DiscoveryService(ctx context.Context, serviceName string) ([]*api.AgentService, error)
+	// 查询服务实例，protocol和version不为空时只返回支持该协议和版本的实例
+	DiscoveryService(ctx context.Context, serviceName, protocol, version string) ([]*discovery.ServiceInstance, error)
 }
 
 var ErrNotServiceInstances = errors.New("instances are not existed")
@@ -26,9 +26,9 @@ func NewRegisterServiceImpl(discoveryClient *discovery.DiscoveryClient) Service
 	}
 }
 
-func (service *RegisterServiceImpl) DiscoveryService(ctx context.Context, serviceName string) ([]*api.AgentService, error) {
+func (service *RegisterServiceImpl) DiscoveryService(ctx context.Context, serviceName, protocol, version string) ([]*discovery.ServiceInstance, error) {
 
-	instances, err := service.discoveryClient.DiscoverServices(ctx, serviceName)
+	instances, err := service.discoveryClient.DiscoverInstances(ctx, serviceName)
 
 	if err != nil {
 		log.Printf("get service info err: %s", err)
@@ -36,7 +36,7 @@ func (service *RegisterServiceImpl) DiscoveryService(ctx context.Context, servic
 	if instances == nil || len(instances) == 0 {
 		return nil, ErrNotServiceInstances
 	}
-	return instances, nil
+	return discovery.FilterInstances(instances, protocol, version), nil
 }
 
 func (*RegisterServiceImpl) HealthCheck() string {
@@ -8,6 +8,7 @@ import (
 	"github.com/go-kit/kit/transport"
 	kithttp "github.com/go-kit/kit/transport/http"
 	"github.com/gorilla/mux"
+	"github.com/yunfeiyang1916/micro-go-course/register-kit/discovery"
 	"github.com/yunfeiyang1916/micro-go-course/register-kit/endpoint"
 	"net/http"
 	"os"
@@ -54,9 +55,32 @@ func decodeDiscoveryRequest(ctx context.Context, r *http.Request) (interface{},
 	}
 	return endpoint.DiscoveryRequest{
 		ServiceName: serviceName,
+		Protocol:    r.URL.Query().Get("protocol"),
+		Version:     r.URL.Query().Get("version"),
 	}, nil
 }
 
+// 获取路由器中注册的路由，用于填充服务描述
+func Routes(handler http.Handler) []discovery.Route {
+	router, ok := handler.(*mux.Router)
+	if !ok {
+		return nil
+	}
+	routes := make([]discovery.Route, 0)
+	router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, _ := route.GetMethods()
+		for _, method := range methods {
+			routes = append(routes, discovery.Route{Method: method, Path: path})
+		}
+		return nil
+	})
+	return routes
+}
+
 func decodeHealthCheckRequest(ctx context.Context, r *http.Request) (interface{}, error) {
 	return endpoint.HealthRequest{}, nil
 }
@@ -0,0 +1,395 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/yunfeiyang1916/micro-go-course/loadbalancer"
+	"github.com/yunfeiyang1916/micro-go-course/register/discovery"
+)
+
+// 客户端负载均衡的HTTP客户端
+// 请求地址中的host为服务名，如 http://comments/comments/detail，
+// 客户端通过服务发现解析服务实例，使用负载均衡器选择实例，并对幂等请求换实例重试
+
+var (
+	ErrNoAvailableInstance = errors.New("no available service instance")
+)
+
+// 服务实例解析接口，discovery.DiscoveryClient 实现了该接口
+type Resolver interface {
+	DiscoverServices(ctx context.Context, serviceName string) ([]*discovery.InstanceInfo, error)
+}
+
+// 服务实例监听接口，discovery.DiscoveryClient 实现了该接口
+type Watcher interface {
+	Watch(ctx context.Context, serviceName string) <-chan []*discovery.InstanceInfo
+}
+
+// 客户端配置
+type Config struct {
+	// 负载均衡器，默认使用权重平滑负载均衡器
+	LoadBalancer loadbalancer.LoadBalancer
+	// 服务实例列表刷新间隔，解析器实现了 Watcher 接口时不定期刷新而是监听变化
+	RefreshInterval time.Duration
+	// 幂等请求失败后的最大重试次数，0表示不重试
+	Retries int
+	// 实际发送请求的Transport，默认使用 http.DefaultTransport
+	Transport http.RoundTripper
+	// 请求超时时间
+	Timeout time.Duration
+	// 提取一致性哈希key，不为nil时使用 SelectServiceByKey 选择实例
+	KeyFunc func(req *http.Request) string
+}
+
+// 默认客户端配置
+func DefaultConfig() *Config {
+	return &Config{
+		LoadBalancer:    &loadbalancer.WeightRoundRobinLoadBalancer{},
+		RefreshInterval: 10 * time.Second,
+		Retries:         2,
+		Transport:       http.DefaultTransport,
+		Timeout:         5 * time.Second,
+	}
+}
+
+// 负载均衡客户端
+type Client struct {
+	resolver Resolver
+	config   Config
+	// 以服务名为键的实例缓存
+	services map[string]*serviceCache
+	mu       sync.Mutex
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// 服务实例缓存
+type serviceCache struct {
+	// 首次加载完成后关闭
+	ready     chan struct{}
+	err       error
+	instances []*loadbalancer.InstanceInfo
+	mu        sync.RWMutex
+}
+
+// 创建负载均衡客户端，config为nil时使用默认配置
+func NewClient(resolver Resolver, config *Config) *Client {
+	c := DefaultConfig()
+	if config != nil {
+		if config.LoadBalancer != nil {
+			c.LoadBalancer = config.LoadBalancer
+		}
+		if config.RefreshInterval > 0 {
+			c.RefreshInterval = config.RefreshInterval
+		}
+		if config.Retries >= 0 {
+			c.Retries = config.Retries
+		}
+		if config.Transport != nil {
+			c.Transport = config.Transport
+		}
+		if config.Timeout > 0 {
+			c.Timeout = config.Timeout
+		}
+		c.KeyFunc = config.KeyFunc
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Client{
+		resolver: resolver,
+		config:   *c,
+		services: make(map[string]*serviceCache),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// 返回使用该客户端作为Transport的 http.Client
+func (c *Client) HTTPClient() *http.Client {
+	return &http.Client{
+		Transport: c,
+		Timeout:   c.config.Timeout,
+	}
+}
+
+// 停止刷新服务实例列表
+func (c *Client) Close() {
+	c.cancel()
+}
+
+// 获取服务实例列表的副本，首次调用时加载并开始定期刷新
+func (c *Client) Instances(ctx context.Context, serviceName string) ([]*loadbalancer.InstanceInfo, error) {
+	cache, err := c.load(ctx, serviceName)
+	if err != nil {
+		return nil, err
+	}
+	cache.mu.RLock()
+	defer cache.mu.RUnlock()
+	if err := cache.available(); err != nil {
+		return nil, err
+	}
+	result := make([]*loadbalancer.InstanceInfo, 0, len(cache.instances))
+	for _, instance := range cache.instances {
+		info := *instance
+		result = append(result, &info)
+	}
+	return result, nil
+}
+
+// 获取服务实例缓存，等待首次加载完成
+func (c *Client) load(ctx context.Context, serviceName string) (*serviceCache, error) {
+	c.mu.Lock()
+	cache, ok := c.services[serviceName]
+	if !ok {
+		cache = &serviceCache{ready: make(chan struct{})}
+		c.services[serviceName] = cache
+		go c.watch(serviceName, cache)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-cache.ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return cache, nil
+}
+
+// 实例列表为空时返回刷新错误，调用方需持有锁
+func (cache *serviceCache) available() error {
+	if len(cache.instances) == 0 {
+		if cache.err != nil {
+			return cache.err
+		}
+		return ErrNoAvailableInstance
+	}
+	return nil
+}
+
+// 监听或定期刷新服务实例列表
+func (c *Client) watch(serviceName string, cache *serviceCache) {
+	if watcher, ok := c.resolver.(Watcher); ok {
+		c.watchChanges(watcher, serviceName, cache)
+		return
+	}
+	c.refresh(serviceName, cache)
+	close(cache.ready)
+	ticker := time.NewTicker(c.config.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			c.refresh(serviceName, cache)
+		}
+	}
+}
+
+// 监听服务实例变化，首次加载超时后先返回，之后继续等待变化
+func (c *Client) watchChanges(watcher Watcher, serviceName string, cache *serviceCache) {
+	ch := watcher.Watch(c.ctx, serviceName)
+	timer := time.NewTimer(c.config.Timeout)
+	defer timer.Stop()
+	ready := false
+	for {
+		select {
+		case instances, ok := <-ch:
+			if !ok {
+				if !ready {
+					close(cache.ready)
+				}
+				return
+			}
+			cache.update(instances)
+		case <-timer.C:
+			log.Printf("watch service %s instances timeout", serviceName)
+		}
+		if !ready {
+			ready = true
+			close(cache.ready)
+		}
+	}
+}
+
+func (c *Client) refresh(serviceName string, cache *serviceCache) {
+	ctx, cancel := context.WithTimeout(c.ctx, c.config.Timeout)
+	defer cancel()
+	instances, err := c.resolver.DiscoverServices(ctx, serviceName)
+	if err != nil {
+		// 刷新失败时继续使用旧的实例列表
+		log.Printf("refresh service %s instances err: %s", serviceName, err)
+		cache.mu.Lock()
+		cache.err = err
+		cache.mu.Unlock()
+		return
+	}
+	cache.update(instances)
+}
+
+// 更新实例列表，复用已有实例以保留负载均衡状态
+func (cache *serviceCache) update(instances []*discovery.InstanceInfo) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	old := make(map[string]*loadbalancer.InstanceInfo, len(cache.instances))
+	for _, instance := range cache.instances {
+		old[instance.Address] = instance
+	}
+	result := make([]*loadbalancer.InstanceInfo, 0, len(instances))
+	for _, instance := range instances {
+		info := ToInstanceInfo(instance)
+		if prev, ok := old[info.Address]; ok {
+			info.CurWeight = prev.CurWeight
+		}
+		result = append(result, info)
+	}
+	cache.instances = result
+	cache.err = nil
+}
+
+// 发送请求，实现 http.RoundTripper 接口
+func (c *Client) RoundTrip(req *http.Request) (*http.Response, error) {
+	serviceName := req.URL.Host
+	cache, err := c.load(req.Context(), serviceName)
+	if err != nil {
+		return nil, err
+	}
+	attempts := 1
+	if isIdempotent(req) {
+		attempts += c.config.Retries
+	}
+	tried := make(map[string]bool)
+	var lastErr error
+	for i := 0; i < attempts; i++ {
+		address, remaining, err := c.selectInstance(req, cache, tried)
+		if err != nil {
+			if i == 0 {
+				return nil, err
+			}
+			break
+		}
+		tried[address] = true
+
+		outReq, err := c.rewrite(req, address, i > 0)
+		if err != nil {
+			return nil, err
+		}
+		start := time.Now()
+		resp, err := c.config.Transport.RoundTrip(outReq)
+		c.report(address, time.Since(start), resp, err)
+		if err == nil {
+			// 5xx响应在还有重试机会时换实例重试，否则直接返回
+			if resp.StatusCode < 500 || i == attempts-1 || remaining == 0 {
+				return resp, nil
+			}
+			resp.Body.Close()
+			lastErr = loadbalancer.ErrServerStatus
+			continue
+		}
+		lastErr = err
+		log.Printf("request service %s instance %s err: %s", serviceName, address, err)
+		if req.Context().Err() != nil {
+			break
+		}
+	}
+	if lastErr == nil {
+		lastErr = ErrNoAvailableInstance
+	}
+	return nil, lastErr
+}
+
+// 选择一个未尝试过的实例，返回实例地址及剩余未尝试的实例数
+func (c *Client) selectInstance(req *http.Request, cache *serviceCache, tried map[string]bool) (string, int, error) {
+	var key string
+	if c.config.KeyFunc != nil {
+		key = c.config.KeyFunc(req)
+	}
+	// 负载均衡器会修改缓存实例的当前权重，选择期间持有写锁，与并发请求及实例列表更新互斥
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if err := cache.available(); err != nil {
+		return "", 0, err
+	}
+	candidates := cache.instances
+	if len(tried) > 0 {
+		candidates = make([]*loadbalancer.InstanceInfo, 0, len(cache.instances))
+		for _, instance := range cache.instances {
+			if !tried[instance.Address] {
+				candidates = append(candidates, instance)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return "", 0, ErrNoAvailableInstance
+	}
+	var instance *loadbalancer.InstanceInfo
+	var err error
+	if c.config.KeyFunc != nil {
+		instance, err = c.config.LoadBalancer.SelectServiceByKey(candidates, key)
+	} else {
+		instance, err = c.config.LoadBalancer.SelectService(candidates)
+	}
+	if err == nil && instance == nil {
+		err = ErrNoAvailableInstance
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	return instance.Address, len(candidates) - 1, nil
+}
+
+// 将请求地址改写为服务实例地址
+func (c *Client) rewrite(req *http.Request, address string, retry bool) (*http.Request, error) {
+	outReq := req.Clone(req.Context())
+	if retry && req.Body != nil && req.Body != http.NoBody {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		outReq.Body = body
+	}
+	outReq.URL.Host = address
+	outReq.Host = ""
+	return outReq, nil
+}
+
+// 上报调用结果给负载均衡器
+func (c *Client) report(address string, latency time.Duration, resp *http.Response, err error) {
+	reporter, ok := c.config.LoadBalancer.(loadbalancer.ResultReporter)
+	if !ok {
+		return
+	}
+	if err == nil && resp.StatusCode >= 500 {
+		err = loadbalancer.ErrServerStatus
+	}
+	reporter.Report(address, latency, err)
+}
+
+// 判断请求是否可以安全重试
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// 将服务发现的实例信息转换为负载均衡器的实例信息
+func ToInstanceInfo(instance *discovery.InstanceInfo) *loadbalancer.InstanceInfo {
+	weight := instance.Weights.Passing
+	if weight <= 0 {
+		weight = 1
+	}
+	return &loadbalancer.InstanceInfo{
+		Weight:  weight,
+		Address: instance.Address + ":" + strconv.Itoa(instance.Port),
+		Tags:    instance.Tags,
+		Meta:    instance.Meta,
+	}
+}
@@ -0,0 +1,139 @@
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/yunfeiyang1916/micro-go-course/register/discovery"
+)
+
+type staticResolver struct {
+	instances []*discovery.InstanceInfo
+	calls     int32
+}
+
+func (r *staticResolver) DiscoverServices(ctx context.Context, serviceName string) ([]*discovery.InstanceInfo, error) {
+	atomic.AddInt32(&r.calls, 1)
+	return r.instances, nil
+}
+
+func newInstance(t *testing.T, server *httptest.Server) *discovery.InstanceInfo {
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := strconv.Atoi(u.Port())
+	return &discovery.InstanceInfo{ID: u.Host, Name: "comments", Address: u.Hostname(), Port: port}
+}
+
+func TestClientRetryOnDifferentInstance(t *testing.T) {
+	var badHits, goodHits int32
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&badHits, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer bad.Close()
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&goodHits, 1)
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write([]byte(r.URL.Path + ":" + string(body)))
+	}))
+	defer good.Close()
+
+	resolver := &staticResolver{instances: []*discovery.InstanceInfo{newInstance(t, bad), newInstance(t, good)}}
+	c := NewClient(resolver, nil)
+	defer c.Close()
+	httpClient := c.HTTPClient()
+
+	for i := 0; i < 4; i++ {
+		resp, err := httpClient.Post("http://comments/comments/detail", "text/plain", strings.NewReader("x"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	// POST请求不重试，每个实例各处理一半
+	if badHits != 2 || goodHits != 2 {
+		t.Fatalf("expected POST not retried, got bad %d good %d", badHits, goodHits)
+	}
+
+	req, _ := http.NewRequest(http.MethodPut, "http://comments/comments/detail", strings.NewReader("body"))
+	for i := 0; i < 4; i++ {
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != "/comments/detail:body" {
+			t.Fatalf("expected retried PUT to succeed, got %d %q", resp.StatusCode, body)
+		}
+	}
+	if resolver.calls != 1 {
+		t.Fatalf("expected instances cached, resolver called %d times", resolver.calls)
+	}
+}
+
+func TestClientNoInstances(t *testing.T) {
+	c := NewClient(&staticResolver{}, nil)
+	defer c.Close()
+	_, err := c.HTTPClient().Get("http://comments/comments/detail")
+	if err == nil || !strings.Contains(err.Error(), ErrNoAvailableInstance.Error()) {
+		t.Fatalf("expected %v got %v", ErrNoAvailableInstance, err)
+	}
+}
+
+// 并发请求共享同一个客户端，使用 -race 运行可检查负载均衡状态的数据竞争
+func TestClientConcurrentRoundTrip(t *testing.T) {
+	var hits [2]int32
+	var servers [2]*httptest.Server
+	for i := range servers {
+		i := i
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&hits[i], 1)
+		}))
+		defer servers[i].Close()
+	}
+	resolver := &staticResolver{instances: []*discovery.InstanceInfo{newInstance(t, servers[0]), newInstance(t, servers[1])}}
+	c := NewClient(resolver, nil)
+	defer c.Close()
+	httpClient := c.HTTPClient()
+	if _, err := c.Instances(context.Background(), "comments"); err != nil {
+		t.Fatal(err)
+	}
+	cache := c.services["comments"]
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				resp, err := httpClient.Get("http://comments/comments/detail")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				resp.Body.Close()
+			}
+		}()
+		// 同时更新实例列表
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cache.update(resolver.instances)
+		}()
+	}
+	wg.Wait()
+	if hits[0] != 100 || hits[1] != 100 {
+		t.Fatalf("expected requests spread evenly, got %v", hits)
+	}
+}
@@ -3,11 +3,15 @@ package discovery
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -33,6 +37,8 @@ type InstanceInfo struct {
 	Check `json:"check,omitempty"`
 	// 权重
 	Weights `json:"weights,omitempty"`
+	// 健康状态，服务发现时根据健康检查结果填充
+	Status string `json:"status,omitempty"`
 }
 
 // 健康检查相关配置
@@ -42,7 +48,7 @@ type Check struct {
 	// 请求参数
 	Args []string `json:"args,omitempty"`
 	// 健康检查地址
-	HTTP string `json:"http"`
+	HTTP string `json:"http,omitempty"`
 	// Consul 主动检查间隔
 	Interval string `json:"interval,omitempty"`
 	// 服务实例主动维持心跳间隔，与Interval只存其一
@@ -55,19 +61,95 @@ type Weights struct {
 	Warning int `json:"warning"`
 }
 
-// 服务发现客户端
-type DiscoveryClient struct {
+// 服务发现客户端配置
+type Config struct {
 	// consul的host
-	host string
+	Host string
 	// consul的端口
-	port int
+	Port int
+	// 访问consul的协议，http或https
+	Scheme string
+	// https时使用的TLS配置
+	TLSConfig *tls.Config
+	// ACL令牌
+	Token string
+	// 数据中心，为空时使用agent所在的数据中心
+	Datacenter string
+	// 发送请求的客户端，为nil时根据Scheme和TLSConfig创建，客户端在所有请求间复用
+	HTTPClient *http.Client
+	// 非阻塞请求的超时时间
+	Timeout time.Duration
+	// 服务实例健康检查使用的协议
+	CheckScheme string
+	// 服务发现时是否返回未通过健康检查的实例，默认只返回健康实例
+	IncludeUnhealthy bool
+}
+
+// 默认服务发现客户端配置
+func DefaultConfig() *Config {
+	return &Config{
+		Host:        "127.0.0.1",
+		Port:        8500,
+		Scheme:      "http",
+		Timeout:     2 * time.Second,
+		CheckScheme: "http",
+	}
+}
+
+// 服务发现客户端
+type DiscoveryClient struct {
+	config Config
+	client *http.Client
+	// 以服务名为键的服务实例缓存，consul不可用时返回缓存数据
+	cache   map[string][]*InstanceInfo
+	cacheMu sync.RWMutex
+	// 阻塞查询的最长等待时间
+	watchWait time.Duration
+	// 阻塞查询出错后的重试退避时间
+	minBackoff time.Duration
+	maxBackoff time.Duration
 }
 
 // 实例化服务发现客户端
 func NewDiscoveryClient(host string, port int) *DiscoveryClient {
+	config := DefaultConfig()
+	config.Host = host
+	config.Port = port
+	return NewDiscoveryClientWithConfig(config)
+}
+
+// 根据配置实例化服务发现客户端，未设置的配置项使用默认值
+func NewDiscoveryClientWithConfig(config *Config) *DiscoveryClient {
+	c := *config
+	defaults := DefaultConfig()
+	if c.Host == "" {
+		c.Host = defaults.Host
+	}
+	if c.Port == 0 {
+		c.Port = defaults.Port
+	}
+	if c.Scheme == "" {
+		c.Scheme = defaults.Scheme
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaults.Timeout
+	}
+	if c.CheckScheme == "" {
+		c.CheckScheme = defaults.CheckScheme
+	}
+	client := c.HTTPClient
+	if client == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = c.TLSConfig
+		client = &http.Client{Transport: transport}
+	}
 	return &DiscoveryClient{
-		host: host,
-		port: port,
+		config:     c,
+		client:     client,
+		cache:      make(map[string][]*InstanceInfo),
+		watchWait:  5 * time.Minute,
+		minBackoff: time.Second,
+		maxBackoff: 30 * time.Second,
 	}
 }
 
@@ -82,7 +164,7 @@ func (consulClient *DiscoveryClient) Register(ctx context.Context, serviceName,
 		EnableTagOverride: false,
 		Check: Check{
 			DeregisterCriticalServiceAfter: "30s",
-			HTTP:                           "https//" + instanceHost + ":" + strconv.Itoa(instancePort) + healthCheckUrl,
+			HTTP:                           consulClient.config.CheckScheme + "://" + instanceHost + ":" + strconv.Itoa(instancePort) + healthCheckUrl,
 			Interval:                       "15s",
 		},
 	}
@@ -94,24 +176,24 @@ func (consulClient *DiscoveryClient) Register(ctx context.Context, serviceName,
 			Warning: 1,
 		}
 	}
+	return consulClient.RegisterInstance(ctx, instanceInfo)
+}
+
+// 向consul agent注册服务实例，实例的健康检查和权重由调用方设置
+func (consulClient *DiscoveryClient) RegisterInstance(ctx context.Context, instanceInfo *InstanceInfo) error {
 	byteData, err := json.Marshal(instanceInfo)
 	if err != nil {
 		log.Printf("json format err:%s", err)
 		return err
 	}
-	req, err := http.NewRequest("PUT", "https://"+consulClient.host+":"+strconv.Itoa(consulClient.port)+"/v1/agent/service/register", bytes.NewReader(byteData))
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Content-Type", "application/json;charset=UTF-8")
-	client := http.Client{}
-	client.Timeout = time.Second * 2
-	resp, err := client.Do(req)
+	ctx, cancel := context.WithTimeout(ctx, consulClient.config.Timeout)
+	defer cancel()
+	resp, err := consulClient.do(ctx, "PUT", "/v1/agent/service/register", nil, bytes.NewReader(byteData))
 	if err != nil {
 		log.Printf("register service err : %s", err)
 		return err
 	}
-	defer req.Body.Close()
+	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
 		log.Printf("register service http request errCode : %v", resp.StatusCode)
 		return fmt.Errorf("register service http request errCode : %v", resp.StatusCode)
@@ -122,25 +204,14 @@ func (consulClient *DiscoveryClient) Register(ctx context.Context, serviceName,
 
 // 注销服务注册
 func (consulClient *DiscoveryClient) Deregister(ctx context.Context, instanceId string) error {
-	req, err := http.NewRequest("PUT",
-		"http://"+consulClient.host+":"+strconv.Itoa(consulClient.port)+"/v1/agent/service/deregister/"+instanceId, nil)
-
-	if err != nil {
-		log.Printf("req format err: %s", err)
-		return err
-	}
-
-	client := http.Client{}
-	client.Timeout = time.Second * 2
-
-	resp, err := client.Do(req)
-
+	ctx, cancel := context.WithTimeout(ctx, consulClient.config.Timeout)
+	defer cancel()
+	resp, err := consulClient.do(ctx, "PUT", "/v1/agent/service/deregister/"+instanceId, nil, nil)
 	if err != nil {
 		log.Printf("deregister service err : %s", err)
 		return err
 	}
-
-	resp.Body.Close()
+	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
 		log.Printf("deresigister service http request errCode : %v", resp.StatusCode)
@@ -152,41 +223,196 @@ func (consulClient *DiscoveryClient) Deregister(ctx context.Context, instanceId
 	return nil
 }
 
-// 服务发现
-func (consulClient *DiscoveryClient) DiscoverServices(ctx context.Context, serviceName string) ([]*InstanceInfo, error) {
-	req, err := http.NewRequest("GET",
-		"http://"+consulClient.host+":"+strconv.Itoa(consulClient.port)+"/v1/health/service/"+serviceName, nil)
+// 开启或关闭服务实例的维护模式，维护模式下实例被视为critical，不再出现在健康实例列表中
+func (consulClient *DiscoveryClient) EnableMaintenance(ctx context.Context, instanceId string, enable bool, reason string) error {
+	ctx, cancel := context.WithTimeout(ctx, consulClient.config.Timeout)
+	defer cancel()
+	query := url.Values{}
+	query.Set("enable", strconv.FormatBool(enable))
+	if reason != "" {
+		query.Set("reason", reason)
+	}
+	resp, err := consulClient.do(ctx, "PUT", "/v1/agent/service/maintenance/"+instanceId, query, nil)
+	if err != nil {
+		log.Printf("maintenance service err : %s", err)
+		return err
+	}
+	defer resp.Body.Close()
 
+	if resp.StatusCode != 200 {
+		log.Printf("maintenance service http request errCode : %v", resp.StatusCode)
+		return fmt.Errorf("maintenance service http request errCode : %v", resp.StatusCode)
+	}
+	return nil
+}
+
+// 服务发现，consul不可用时返回缓存的服务实例
+func (consulClient *DiscoveryClient) DiscoverServices(ctx context.Context, serviceName string) ([]*InstanceInfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, consulClient.config.Timeout)
+	defer cancel()
+	instances, _, err := consulClient.queryServices(ctx, serviceName, 0, 0)
 	if err != nil {
-		log.Printf("req format err: %s", err)
+		if cached, ok := consulClient.cached(serviceName); ok {
+			log.Printf("discover service %s err: %s, use cached instances", serviceName, err)
+			return cached, nil
+		}
 		return nil, err
 	}
+	consulClient.setCache(serviceName, instances)
+	return instances, nil
+}
+
+// 监听服务实例变化
+// 使用consul阻塞查询，服务实例列表变化时将最新列表发送到返回的通道中，通道只保留最新的列表；
+// 查询出错时按指数退避重试，期间通道中保留的仍是最近一次成功获取的列表。ctx取消后关闭通道
+func (consulClient *DiscoveryClient) Watch(ctx context.Context, serviceName string) <-chan []*InstanceInfo {
+	ch := make(chan []*InstanceInfo, 1)
+	go consulClient.watch(ctx, serviceName, ch)
+	return ch
+}
 
-	client := http.Client{}
-	client.Timeout = time.Second * 2
+func (consulClient *DiscoveryClient) watch(ctx context.Context, serviceName string, ch chan []*InstanceInfo) {
+	defer close(ch)
+	// 先发送缓存数据，consul不可用时调用方也能立即拿到实例列表
+	if cached, ok := consulClient.cached(serviceName); ok {
+		ch <- cached
+	}
+	// 阻塞查询的超时时间需要大于等待时间，consul会在等待时间上增加最多1/16的随机抖动
+	timeout := consulClient.watchWait + consulClient.watchWait/16 + consulClient.config.Timeout
+	var index uint64
+	backoff := consulClient.minBackoff
+	first := true
+	for {
+		queryCtx, cancel := context.WithTimeout(ctx, timeout)
+		instances, newIndex, err := consulClient.queryServices(queryCtx, serviceName, index, consulClient.watchWait)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("watch service %s err: %s, retry after %s", serviceName, err, backoff)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > consulClient.maxBackoff {
+				backoff = consulClient.maxBackoff
+			}
+			continue
+		}
+		backoff = consulClient.minBackoff
+		// 索引回退时需要重置，避免一直阻塞
+		if newIndex < index {
+			index = 0
+			continue
+		}
+		changed := first || newIndex != index
+		first = false
+		index = newIndex
+		if index == 0 {
+			index = 1
+		}
+		if !changed {
+			continue
+		}
+		consulClient.setCache(serviceName, instances)
+		// 丢弃调用方尚未读取的旧列表
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- instances
+	}
+}
 
-	resp, err := client.Do(req)
+// 查询服务实例，index大于0时使用阻塞查询
+func (consulClient *DiscoveryClient) queryServices(ctx context.Context, serviceName string, index uint64, wait time.Duration) ([]*InstanceInfo, uint64, error) {
+	query := url.Values{}
+	if !consulClient.config.IncludeUnhealthy {
+		query.Set("passing", "true")
+	}
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", strconv.Itoa(int(wait/time.Second))+"s")
+	}
+	resp, err := consulClient.do(ctx, "GET", "/v1/health/service/"+serviceName, query, nil)
 	if err != nil {
 		log.Printf("discover service err : %s", err)
-		return nil, err
+		return nil, 0, err
 	}
 
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
 		log.Printf("discover service http request errCode : %v", resp.StatusCode)
-		return nil, fmt.Errorf("discover service http request errCode : %v", resp.StatusCode)
+		return nil, 0, fmt.Errorf("discover service http request errCode : %v", resp.StatusCode)
 	}
 	var serviceList []struct {
 		Service InstanceInfo `json:"service"`
+		Checks  []struct {
+			Status string `json:"status"`
+		} `json:"checks"`
 	}
 	err = json.NewDecoder(resp.Body).Decode(&serviceList)
 	if err != nil {
 		log.Printf("format service info err : %s", err)
-		return nil, err
+		return nil, 0, err
 	}
 	instances := make([]*InstanceInfo, len(serviceList))
 	for i := 0; i < len(instances); i++ {
 		instances[i] = &serviceList[i].Service
+		// 实例状态取所有检查中最差的状态
+		instances[i].Status = HealthPassing
+		for _, check := range serviceList[i].Checks {
+			if check.Status == HealthCritical || (check.Status == HealthWarning && instances[i].Status == HealthPassing) {
+				instances[i].Status = check.Status
+			}
+		}
 	}
-	return instances, nil
+	newIndex, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	return instances, newIndex, nil
+}
+
+// 发送consul请求，统一处理地址、ACL令牌和数据中心
+func (consulClient *DiscoveryClient) do(ctx context.Context, method, path string, query url.Values, body io.Reader) (*http.Response, error) {
+	if query == nil {
+		query = url.Values{}
+	}
+	if consulClient.config.Datacenter != "" {
+		query.Set("dc", consulClient.config.Datacenter)
+	}
+	reqUrl := url.URL{
+		Scheme:   consulClient.config.Scheme,
+		Host:     consulClient.config.Host + ":" + strconv.Itoa(consulClient.config.Port),
+		Path:     path,
+		RawQuery: query.Encode(),
+	}
+	req, err := http.NewRequestWithContext(ctx, method, reqUrl.String(), body)
+	if err != nil {
+		log.Printf("req format err: %s", err)
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json;charset=UTF-8")
+	}
+	if consulClient.config.Token != "" {
+		req.Header.Set("X-Consul-Token", consulClient.config.Token)
+	}
+	return consulClient.client.Do(req)
+}
+
+// 获取缓存的服务实例
+func (consulClient *DiscoveryClient) cached(serviceName string) ([]*InstanceInfo, bool) {
+	consulClient.cacheMu.RLock()
+	defer consulClient.cacheMu.RUnlock()
+	instances, ok := consulClient.cache[serviceName]
+	return instances, ok
+}
+
+// 缓存服务实例
+func (consulClient *DiscoveryClient) setCache(serviceName string, instances []*InstanceInfo) {
+	consulClient.cacheMu.Lock()
+	defer consulClient.cacheMu.Unlock()
+	consulClient.cache[serviceName] = instances
 }
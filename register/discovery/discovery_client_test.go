@@ -0,0 +1,250 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 模拟consul的服务发现接口，支持阻塞查询
+type fakeConsul struct {
+	mu        sync.Mutex
+	index     uint64
+	instances []InstanceInfo
+	fail      bool
+	changed   chan struct{}
+}
+
+func newFakeConsul(instances ...InstanceInfo) *fakeConsul {
+	return &fakeConsul{index: 10, instances: instances, changed: make(chan struct{})}
+}
+
+func (f *fakeConsul) update(instances ...InstanceInfo) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.index++
+	f.instances = instances
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeConsul) setFail(fail bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fail = fail
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, "/v1/health/service/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	f.mu.Lock()
+	if f.fail {
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	if index > 0 && index >= f.index {
+		wait, _ := time.ParseDuration(r.URL.Query().Get("wait"))
+		changed := f.changed
+		f.mu.Unlock()
+		select {
+		case <-changed:
+		case <-time.After(wait):
+		case <-r.Context().Done():
+			return
+		}
+		f.mu.Lock()
+	}
+	type entry struct {
+		Service InstanceInfo
+	}
+	entries := make([]entry, 0, len(f.instances))
+	for _, instance := range f.instances {
+		entries = append(entries, entry{Service: instance})
+	}
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+	f.mu.Unlock()
+	json.NewEncoder(w).Encode(entries)
+}
+
+func newTestConfig(t *testing.T, server *httptest.Server) *Config {
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := strconv.Atoi(u.Port())
+	return &Config{Scheme: u.Scheme, Host: u.Hostname(), Port: port}
+}
+
+func newTestDiscoveryClient(t *testing.T, consul *fakeConsul) (*DiscoveryClient, func()) {
+	server := httptest.NewServer(consul)
+	client := NewDiscoveryClientWithConfig(newTestConfig(t, server))
+	client.watchWait = time.Second
+	client.minBackoff = 10 * time.Millisecond
+	client.maxBackoff = 50 * time.Millisecond
+	return client, server.Close
+}
+
+func receive(t *testing.T, ch <-chan []*InstanceInfo) []*InstanceInfo {
+	select {
+	case instances, ok := <-ch:
+		if !ok {
+			t.Fatal("watch channel closed")
+		}
+		return instances
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for instances")
+	}
+	return nil
+}
+
+func TestWatch(t *testing.T) {
+	consul := newFakeConsul(InstanceInfo{ID: "a", Address: "10.0.0.1", Port: 80})
+	client, closeServer := newTestDiscoveryClient(t, consul)
+	defer closeServer()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := client.Watch(ctx, "comments")
+	if instances := receive(t, ch); len(instances) != 1 || instances[0].ID != "a" {
+		t.Fatalf("expected instance a, got %v", instances)
+	}
+
+	consul.update(InstanceInfo{ID: "a", Address: "10.0.0.1", Port: 80}, InstanceInfo{ID: "b", Address: "10.0.0.2", Port: 80})
+	if instances := receive(t, ch); len(instances) != 2 {
+		t.Fatalf("expected 2 instances, got %d", len(instances))
+	}
+
+	cancel()
+	for range ch {
+	}
+}
+
+func TestDiscoverServicesServesStale(t *testing.T) {
+	consul := newFakeConsul(InstanceInfo{ID: "a", Address: "10.0.0.1", Port: 80})
+	client, closeServer := newTestDiscoveryClient(t, consul)
+	defer closeServer()
+
+	instances, err := client.DiscoverServices(context.Background(), "comments")
+	if err != nil || len(instances) != 1 {
+		t.Fatalf("expected 1 instance, got %v %v", instances, err)
+	}
+
+	consul.setFail(true)
+	instances, err = client.DiscoverServices(context.Background(), "comments")
+	if err != nil || len(instances) != 1 {
+		t.Fatalf("expected cached instance, got %v %v", instances, err)
+	}
+	if _, err = client.DiscoverServices(context.Background(), "unknown"); err == nil {
+		t.Fatal("expected error for uncached service")
+	}
+
+	// consul恢复后继续推送变化
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := client.Watch(ctx, "comments")
+	if instances := receive(t, ch); len(instances) != 1 {
+		t.Fatalf("expected cached instance from watch, got %v", instances)
+	}
+	consul.setFail(false)
+	consul.update()
+	if instances := receive(t, ch); len(instances) != 0 {
+		t.Fatalf("expected empty instances after recovery, got %v", instances)
+	}
+}
+
+// 模拟consul agent，记录收到的请求
+type fakeAgent struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   []InstanceInfo
+}
+
+func (f *fakeAgent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r)
+	var body InstanceInfo
+	if r.Body != nil {
+		json.NewDecoder(r.Body).Decode(&body)
+	}
+	f.bodies = append(f.bodies, body)
+	switch {
+	case r.URL.Path == "/v1/agent/service/register" && r.Method == "PUT":
+	case strings.HasPrefix(r.URL.Path, "/v1/agent/service/deregister/") && r.Method == "PUT":
+	case strings.HasPrefix(r.URL.Path, "/v1/health/service/") && r.Method == "GET":
+		w.Write([]byte("[]"))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestRegisterAndDeregister(t *testing.T) {
+	agent := &fakeAgent{}
+	server := httptest.NewTLSServer(agent)
+	defer server.Close()
+
+	config := newTestConfig(t, server)
+	config.TLSConfig = server.Client().Transport.(*http.Transport).TLSClientConfig
+	config.Token = "secret"
+	config.Datacenter = "dc2"
+	client := NewDiscoveryClientWithConfig(config)
+
+	err := client.Register(context.Background(), "register", "register-1", "/health", "10.0.0.1", 12312, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.DiscoverServices(context.Background(), "register"); err != nil {
+		t.Fatal(err)
+	}
+	if err = client.Deregister(context.Background(), "register-1"); err != nil {
+		t.Fatal(err)
+	}
+	if len(agent.requests) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(agent.requests))
+	}
+	for _, r := range agent.requests {
+		if r.Header.Get("X-Consul-Token") != "secret" {
+			t.Fatalf("expected acl token on %s", r.URL.Path)
+		}
+		if r.URL.Query().Get("dc") != "dc2" {
+			t.Fatalf("expected datacenter on %s", r.URL.Path)
+		}
+	}
+	if check := agent.bodies[0].Check.HTTP; check != "http://10.0.0.1:12312/health" {
+		t.Fatalf("unexpected health check url %s", check)
+	}
+	if agent.requests[1].URL.Query().Get("passing") != "true" {
+		t.Fatal("expected only passing instances by default")
+	}
+	if agent.requests[2].URL.Path != "/v1/agent/service/deregister/register-1" {
+		t.Fatalf("unexpected deregister path %s", agent.requests[2].URL.Path)
+	}
+}
+
+func TestRegisterHonoursContext(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+	client := NewDiscoveryClientWithConfig(newTestConfig(t, server))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := client.Register(ctx, "register", "register-1", "/health", "10.0.0.1", 12312, nil, nil)
+	if err == nil || time.Since(start) > time.Second {
+		t.Fatalf("expected register canceled by context, got %v after %s", err, time.Since(start))
+	}
+}
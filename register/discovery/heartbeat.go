@@ -0,0 +1,148 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+)
+
+// TTL心跳健康检查
+// 服务实例注册TTL类型的健康检查后，由实例自己定期向consul上报健康状态，
+// consul在TTL时间内未收到心跳时将实例标记为不健康
+
+// 健康状态
+const (
+	HealthPassing  = "passing"
+	HealthWarning  = "warning"
+	HealthCritical = "critical"
+)
+
+// 进程内健康状态上报接口
+type HealthReporter interface {
+	// 返回健康状态和附加说明
+	Health() (status string, output string)
+}
+
+// 函数形式的健康状态上报
+type HealthReporterFunc func() (status string, output string)
+
+func (f HealthReporterFunc) Health() (string, string) {
+	return f()
+}
+
+// TTL方式的服务注册参数
+type TTLRegistration struct {
+	// 服务名
+	ServiceName string
+	// 服务实例ID
+	InstanceId string
+	// 服务实例地址
+	InstanceHost string
+	// 服务实例端口
+	InstancePort int
+	// 元数据
+	Meta map[string]string
+	// 权重，为nil时使用默认权重
+	Weights *Weights
+	// consul等待心跳的时间
+	TTL time.Duration
+	// 心跳间隔，默认为TTL的三分之一
+	Interval time.Duration
+}
+
+// 服务实例健康检查的ID
+func (registration *TTLRegistration) CheckId() string {
+	return "service:" + registration.InstanceId
+}
+
+// 使用TTL健康检查注册服务
+func (consulClient *DiscoveryClient) RegisterTTL(ctx context.Context, registration *TTLRegistration) error {
+	instanceInfo := &InstanceInfo{
+		ID:                registration.InstanceId,
+		Name:              registration.ServiceName,
+		Address:           registration.InstanceHost,
+		Port:              registration.InstancePort,
+		Meta:              registration.Meta,
+		EnableTagOverride: false,
+		Check: Check{
+			DeregisterCriticalServiceAfter: "30s",
+			TTL:                            registration.TTL.String(),
+		},
+		Weights: Weights{
+			Passing: 10,
+			Warning: 1,
+		},
+	}
+	if registration.Weights != nil {
+		instanceInfo.Weights = *registration.Weights
+	}
+	return consulClient.RegisterInstance(ctx, instanceInfo)
+}
+
+// 更新TTL健康检查状态
+func (consulClient *DiscoveryClient) UpdateTTL(ctx context.Context, checkId, status, output string) error {
+	var action string
+	switch status {
+	case HealthPassing:
+		action = "pass"
+	case HealthWarning:
+		action = "warn"
+	case HealthCritical:
+		action = "fail"
+	default:
+		return fmt.Errorf("unknown health status : %s", status)
+	}
+	query := url.Values{}
+	if output != "" {
+		query.Set("note", output)
+	}
+	ctx, cancel := context.WithTimeout(ctx, consulClient.config.Timeout)
+	defer cancel()
+	resp, err := consulClient.do(ctx, "PUT", "/v1/agent/check/"+action+"/"+checkId, query, nil)
+	if err != nil {
+		log.Printf("update ttl check err : %s", err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		log.Printf("update ttl check http request errCode : %v", resp.StatusCode)
+		return fmt.Errorf("update ttl check http request errCode : %v", resp.StatusCode)
+	}
+	return nil
+}
+
+// 运行心跳循环，直到ctx取消
+// 每个心跳间隔向consul上报reporter返回的健康状态，上报失败时认为consul丢失了服务实例（如agent重启），
+// 重新注册服务后再次上报
+func (consulClient *DiscoveryClient) RunHeartbeat(ctx context.Context, registration *TTLRegistration, reporter HealthReporter) {
+	interval := registration.Interval
+	if interval <= 0 {
+		interval = registration.TTL / 3
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		consulClient.heartbeat(ctx, registration, reporter)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// 发送一次心跳
+func (consulClient *DiscoveryClient) heartbeat(ctx context.Context, registration *TTLRegistration, reporter HealthReporter) {
+	status, output := reporter.Health()
+	err := consulClient.UpdateTTL(ctx, registration.CheckId(), status, output)
+	if err == nil || ctx.Err() != nil {
+		return
+	}
+	log.Printf("heartbeat err : %s, re-register service %s", err, registration.InstanceId)
+	if err = consulClient.RegisterTTL(ctx, registration); err != nil {
+		return
+	}
+	consulClient.UpdateTTL(ctx, registration.CheckId(), status, output)
+}
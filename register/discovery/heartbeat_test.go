@@ -0,0 +1,123 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 模拟支持TTL检查的consul agent
+type fakeTTLAgent struct {
+	mu        sync.Mutex
+	checks    map[string]string
+	registers int
+}
+
+func (f *fakeTTLAgent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.URL.Path == "/v1/agent/service/register":
+		var instance InstanceInfo
+		json.NewDecoder(r.Body).Decode(&instance)
+		if instance.Check.TTL == "" || instance.Check.HTTP != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.registers++
+		f.checks["service:"+instance.ID] = HealthCritical
+	case strings.HasPrefix(r.URL.Path, "/v1/agent/check/"):
+		parts := strings.Split(r.URL.Path, "/")
+		checkId := parts[len(parts)-1]
+		if _, ok := f.checks[checkId]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		f.checks[checkId] = map[string]string{"pass": HealthPassing, "warn": HealthWarning, "fail": HealthCritical}[parts[4]]
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeTTLAgent) status(checkId string) (string, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.checks[checkId], f.registers
+}
+
+func (f *fakeTTLAgent) forget() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.checks = make(map[string]string)
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	agent := &fakeTTLAgent{checks: make(map[string]string)}
+	server := httptest.NewServer(agent)
+	defer server.Close()
+	client := NewDiscoveryClientWithConfig(newTestConfig(t, server))
+
+	registration := &TTLRegistration{
+		ServiceName:  "register",
+		InstanceId:   "register-1",
+		InstanceHost: "10.0.0.1",
+		InstancePort: 12312,
+		TTL:          time.Second,
+		Interval:     10 * time.Millisecond,
+	}
+	if err := client.RegisterTTL(context.Background(), registration); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	health := HealthPassing
+	reporter := HealthReporterFunc(func() (string, string) {
+		mu.Lock()
+		defer mu.Unlock()
+		return health, ""
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		client.RunHeartbeat(ctx, registration, reporter)
+		close(done)
+	}()
+
+	waitFor(t, func() bool {
+		status, _ := agent.status(registration.CheckId())
+		return status == HealthPassing
+	})
+
+	mu.Lock()
+	health = HealthWarning
+	mu.Unlock()
+	waitFor(t, func() bool {
+		status, _ := agent.status(registration.CheckId())
+		return status == HealthWarning
+	})
+
+	// agent丢失服务实例后自动重新注册
+	agent.forget()
+	waitFor(t, func() bool {
+		status, registers := agent.status(registration.CheckId())
+		return status == HealthWarning && registers == 2
+	})
+
+	cancel()
+	<-done
+}
@@ -2,6 +2,8 @@ package endpoint
 
 import (
 	"context"
+	"time"
+
 	"github.com/go-kit/kit/endpoint"
 	"github.com/yunfeiyang1916/micro-go-course/register/discovery"
 	"github.com/yunfeiyang1916/micro-go-course/register/service"
@@ -15,11 +17,21 @@ type RegisterEndpoints struct {
 // 服务发现请求结构体
 type DiscoveryRequest struct {
 	ServiceName string
+	// 过滤条件
+	Filter *service.Filter
+	// 是否只返回负载均衡选出的一个实例
+	Pick bool
+	// 一致性哈希键
+	Key string
+	// 长轮询版本号及等待时间，Wait为0时直接返回
+	Index uint64
+	Wait  time.Duration
 }
 
 // 服务发现响应结构体
 type DiscoveryResponse struct {
 	Instances []*discovery.InstanceInfo `json:"instances"`
+	Index     uint64                    `json:"index,omitempty"`
 	Error     string                    `json:"error"`
 }
 
@@ -28,15 +40,31 @@ func MakeDiscoveryEndpoint(svc service.Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
 
 		req := request.(DiscoveryRequest)
-		instances, err := svc.DiscoveryService(ctx, req.ServiceName)
-		var errString = ""
-
+		if req.Pick {
+			instance, err := svc.SelectService(ctx, req.ServiceName, req.Filter, req.Key)
+			if err != nil {
+				return nil, err
+			}
+			return &DiscoveryResponse{
+				Instances: []*discovery.InstanceInfo{instance},
+			}, nil
+		}
+		if req.Wait > 0 {
+			instances, index, err := svc.WatchService(ctx, req.ServiceName, req.Filter, req.Index, req.Wait)
+			if err != nil {
+				return nil, err
+			}
+			return &DiscoveryResponse{
+				Instances: instances,
+				Index:     index,
+			}, nil
+		}
+		instances, err := svc.DiscoveryService(ctx, req.ServiceName, req.Filter)
 		if err != nil {
-			errString = err.Error()
+			return nil, err
 		}
 		return &DiscoveryResponse{
 			Instances: instances,
-			Error:     errString,
 		}, nil
 	}
 }
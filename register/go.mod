@@ -7,4 +7,18 @@ require (
 	github.com/google/uuid v1.0.0
 	github.com/gorilla/mux v1.7.4
 	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
-)
\ No newline at end of file
+	github.com/openzipkin/zipkin-go v0.2.2
+	github.com/prometheus/client_golang v1.3.0
+	github.com/yunfeiyang1916/micro-go-course/instrument v0.0.0
+	github.com/yunfeiyang1916/micro-go-course/loadbalancer v0.0.0
+	github.com/yunfeiyang1916/micro-go-course/tracing v0.0.0
+	go.etcd.io/bbolt v1.3.5 // indirect
+	go.etcd.io/etcd v0.0.0-20191023171146-3cf2f69b5738
+	gopkg.in/yaml.v2 v2.2.8
+)
+
+replace (
+	github.com/yunfeiyang1916/micro-go-course/instrument => ../instrument
+	github.com/yunfeiyang1916/micro-go-course/loadbalancer => ../loadbalancer
+	github.com/yunfeiyang1916/micro-go-course/tracing => ../tracing
+)
@@ -0,0 +1,178 @@
+package lifecycle
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/yunfeiyang1916/micro-go-course/register/registry"
+)
+
+// 服务实例生命周期管理
+// 收到退出信号后按以下顺序优雅下线：
+// 0. 执行 BeforeStop，如停止TTL心跳，避免心跳在注销后重新注册实例
+// 1. 在注册中心将实例标记为不健康（consul维护模式），调用方不再选择该实例
+// 2. 等待摘流量时间，让调用方的缓存和长轮询感知到变化
+// 3. 在截止时间内关闭HTTP服务器，处理完进行中的请求
+// 4. 从注册中心注销实例
+
+// 注册中心中与下线相关的操作，registry.Registry 满足该接口
+type Deregisterer interface {
+	Deregister(ctx context.Context, instanceId string) error
+}
+
+// 可优雅关闭的服务器，*http.Server 满足该接口
+type Server interface {
+	Shutdown(ctx context.Context) error
+}
+
+// 生命周期配置
+type Config struct {
+	// 注册中心中的实例ID
+	InstanceId string
+	// 标记不健康后等待调用方摘除流量的时间
+	DrainPeriod time.Duration
+	// 关闭服务器的最长等待时间
+	ShutdownTimeout time.Duration
+	// 注销实例的超时时间
+	DeregisterTimeout time.Duration
+	// 触发下线的信号，默认 SIGINT 和 SIGTERM
+	Signals []os.Signal
+	// 下线前调用，返回后不应再有请求修改注册信息
+	BeforeStop func()
+}
+
+// 默认配置
+func DefaultConfig(instanceId string) *Config {
+	return &Config{
+		InstanceId:        instanceId,
+		DrainPeriod:       5 * time.Second,
+		ShutdownTimeout:   10 * time.Second,
+		DeregisterTimeout: 3 * time.Second,
+		Signals:           []os.Signal{syscall.SIGINT, syscall.SIGTERM},
+	}
+}
+
+// 服务实例生命周期
+type Lifecycle struct {
+	config   Config
+	registry Deregisterer
+	server   Server
+	// 测试时替换等待函数
+	sleep func(ctx context.Context, d time.Duration)
+}
+
+// 创建生命周期，registry实现 registry.Drainer 时下线前先摘除流量
+func New(config *Config, registry Deregisterer, server Server) *Lifecycle {
+	c := *config
+	if len(c.Signals) == 0 {
+		c.Signals = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+	}
+	if c.DeregisterTimeout <= 0 {
+		c.DeregisterTimeout = 3 * time.Second
+	}
+	return &Lifecycle{
+		config:   c,
+		registry: registry,
+		server:   server,
+		sleep:    sleep,
+	}
+}
+
+// 运行服务，serve返回或收到退出信号后执行下线流程
+// serve通常为 server.ListenAndServe，Shutdown后返回的 http.ErrServerClosed 不视为错误
+func (l *Lifecycle) Run(serve func() error) error {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, l.config.Signals...)
+	defer signal.Stop(c)
+	return l.run(serve, c)
+}
+
+func (l *Lifecycle) run(serve func() error, signals <-chan os.Signal) error {
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- serve()
+	}()
+	select {
+	case err := <-serveErr:
+		// 服务异常退出时直接注销
+		log.Printf("listen err : %s", err)
+		l.beforeStop()
+		l.deregister()
+		return err
+	case sig := <-signals:
+		log.Printf("receive signal %s, shutting down", sig)
+	}
+	err := l.Stop(context.Background())
+	if serr := <-serveErr; serr != nil && serr != http.ErrServerClosed {
+		log.Printf("listen err : %s", serr)
+	}
+	return err
+}
+
+// 按顺序执行摘流量、关闭服务器和注销实例
+func (l *Lifecycle) Stop(ctx context.Context) error {
+	l.beforeStop()
+	if drainer, ok := l.registry.(registry.Drainer); ok {
+		if err := drainer.Drain(ctx, l.config.InstanceId); err != nil {
+			// 摘流量失败不影响后续下线流程
+			log.Printf("drain instance %s err : %s", l.config.InstanceId, err)
+		} else {
+			log.Printf("instance %s is draining, wait %s", l.config.InstanceId, l.config.DrainPeriod)
+			l.sleep(ctx, l.config.DrainPeriod)
+		}
+	}
+
+	var shutdownErr error
+	if l.server != nil {
+		shutdownCtx := ctx
+		if l.config.ShutdownTimeout > 0 {
+			var cancel context.CancelFunc
+			shutdownCtx, cancel = context.WithTimeout(ctx, l.config.ShutdownTimeout)
+			defer cancel()
+		}
+		if shutdownErr = l.server.Shutdown(shutdownCtx); shutdownErr != nil {
+			log.Printf("shutdown server err : %s", shutdownErr)
+			shutdownErr = fmt.Errorf("shutdown server err : %s", shutdownErr)
+		}
+	}
+
+	if err := l.deregister(); err != nil && shutdownErr == nil {
+		return err
+	}
+	return shutdownErr
+}
+
+func (l *Lifecycle) beforeStop() {
+	if l.config.BeforeStop != nil {
+		l.config.BeforeStop()
+	}
+}
+
+// 从注册中心注销实例
+func (l *Lifecycle) deregister() error {
+	ctx, cancel := context.WithTimeout(context.Background(), l.config.DeregisterTimeout)
+	defer cancel()
+	if err := l.registry.Deregister(ctx, l.config.InstanceId); err != nil {
+		log.Printf("deregister instance %s err : %s", l.config.InstanceId, err)
+		return err
+	}
+	return nil
+}
+
+func sleep(ctx context.Context, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
@@ -0,0 +1,195 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/yunfeiyang1916/micro-go-course/register/discovery"
+	"github.com/yunfeiyang1916/micro-go-course/register/registry"
+)
+
+// 记录调用顺序
+type recorder struct {
+	mu    sync.Mutex
+	steps []string
+}
+
+func (r *recorder) add(step string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.steps = append(r.steps, step)
+}
+
+func (r *recorder) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return strings.Join(r.steps, ",")
+}
+
+type fakeRegistry struct {
+	rec      *recorder
+	drainErr error
+}
+
+func (f *fakeRegistry) Drain(ctx context.Context, instanceId string) error {
+	f.rec.add("drain:" + instanceId)
+	return f.drainErr
+}
+
+func (f *fakeRegistry) Deregister(ctx context.Context, instanceId string) error {
+	f.rec.add("deregister:" + instanceId)
+	return nil
+}
+
+// 不支持摘流量的注册中心
+type plainRegistry struct {
+	rec *recorder
+}
+
+func (f *plainRegistry) Deregister(ctx context.Context, instanceId string) error {
+	f.rec.add("deregister:" + instanceId)
+	return nil
+}
+
+type fakeServer struct {
+	rec *recorder
+}
+
+func (f *fakeServer) Shutdown(ctx context.Context) error {
+	if _, ok := ctx.Deadline(); !ok {
+		f.rec.add("shutdown-without-deadline")
+	}
+	f.rec.add("shutdown")
+	return nil
+}
+
+func newTestLifecycle(reg Deregisterer, server Server, rec *recorder) *Lifecycle {
+	l := New(&Config{InstanceId: "user-1", DrainPeriod: time.Second, ShutdownTimeout: time.Second}, reg, server)
+	l.sleep = func(ctx context.Context, d time.Duration) {
+		rec.add("sleep:" + d.String())
+	}
+	return l
+}
+
+func TestStopOrder(t *testing.T) {
+	cases := []struct {
+		name     string
+		reg      func(rec *recorder) Deregisterer
+		expected string
+	}{
+		{"drain", func(rec *recorder) Deregisterer {
+			return &fakeRegistry{rec: rec}
+		}, "drain:user-1,sleep:1s,shutdown,deregister:user-1"},
+		// 摘流量失败时跳过等待，继续下线
+		{"drain failed", func(rec *recorder) Deregisterer {
+			return &fakeRegistry{rec: rec, drainErr: errors.New("consul unavailable")}
+		}, "drain:user-1,shutdown,deregister:user-1"},
+		{"no drainer", func(rec *recorder) Deregisterer {
+			return &plainRegistry{rec: rec}
+		}, "shutdown,deregister:user-1"},
+	}
+	for _, c := range cases {
+		rec := &recorder{}
+		l := newTestLifecycle(c.reg(rec), &fakeServer{rec: rec}, rec)
+		if err := l.Stop(context.Background()); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if steps := rec.String(); steps != c.expected {
+			t.Fatalf("%s: expected %s, got %s", c.name, c.expected, steps)
+		}
+	}
+}
+
+func TestBeforeStop(t *testing.T) {
+	rec := &recorder{}
+	l := newTestLifecycle(&fakeRegistry{rec: rec}, &fakeServer{rec: rec}, rec)
+	l.config.BeforeStop = func() {
+		rec.add("before-stop")
+	}
+	if err := l.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if steps := rec.String(); steps != "before-stop,drain:user-1,sleep:1s,shutdown,deregister:user-1" {
+		t.Fatalf("unexpected steps %s", steps)
+	}
+}
+
+func TestRunOnSignal(t *testing.T) {
+	rec := &recorder{}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inFlight := make(chan struct{})
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(inFlight)
+		// 进行中的请求应在关闭服务器前处理完
+		time.Sleep(100 * time.Millisecond)
+		rec.add("request")
+	})}
+	l := newTestLifecycle(&fakeRegistry{rec: rec}, server, rec)
+	signals := make(chan os.Signal, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- l.run(func() error {
+			return server.Serve(listener)
+		}, signals)
+	}()
+
+	go http.Get("http://" + listener.Addr().String())
+	<-inFlight
+	signals <- syscall.SIGTERM
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for shutdown")
+	}
+	if steps := rec.String(); steps != "drain:user-1,sleep:1s,request,deregister:user-1" {
+		t.Fatalf("unexpected steps %s", steps)
+	}
+}
+
+func TestRunServeError(t *testing.T) {
+	rec := &recorder{}
+	l := newTestLifecycle(&fakeRegistry{rec: rec}, &fakeServer{rec: rec}, rec)
+	err := l.run(func() error {
+		return errors.New("address already in use")
+	}, make(chan os.Signal))
+	if err == nil {
+		t.Fatal("expected serve error")
+	}
+	if steps := rec.String(); steps != "deregister:user-1" {
+		t.Fatalf("unexpected steps %s", steps)
+	}
+}
+
+// 与内存注册中心集成：摘流量后实例仍在列表中但状态为critical
+func TestDrainMemoryRegistry(t *testing.T) {
+	reg := registry.NewMemoryRegistry()
+	reg.Register(context.Background(), &discovery.InstanceInfo{ID: "user-1", Name: "user", Address: "127.0.0.1", Port: 10086})
+	rec := &recorder{}
+	l := newTestLifecycle(reg, nil, rec)
+	l.sleep = func(ctx context.Context, d time.Duration) {
+		instances, _ := reg.Discover(ctx, "user")
+		if len(instances) != 1 || instances[0].Status != discovery.HealthCritical {
+			t.Fatalf("expected drained instance, got %v", instances)
+		}
+	}
+	if err := l.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if instances, _ := reg.Discover(context.Background(), "user"); len(instances) != 0 {
+		t.Fatalf("expected deregistered, got %v", instances)
+	}
+}
@@ -3,60 +3,174 @@ package main
 import (
 	"context"
 	"flag"
-	"fmt"
+	kitzipkin "github.com/go-kit/kit/tracing/zipkin"
 	"github.com/google/uuid"
+	"github.com/yunfeiyang1916/micro-go-course/instrument"
 	"github.com/yunfeiyang1916/micro-go-course/register/discovery"
 	"github.com/yunfeiyang1916/micro-go-course/register/endpoint"
+	"github.com/yunfeiyang1916/micro-go-course/register/lifecycle"
+	"github.com/yunfeiyang1916/micro-go-course/register/registry"
+	"github.com/yunfeiyang1916/micro-go-course/register/registryserver"
 	"github.com/yunfeiyang1916/micro-go-course/register/service"
 	"github.com/yunfeiyang1916/micro-go-course/register/transport"
+	"github.com/yunfeiyang1916/micro-go-course/tracing"
 	"log"
+	"net"
 	"net/http"
 	"os"
-	"os/signal"
 	"strconv"
-	"syscall"
+	"strings"
+	"time"
 )
 
 func main() {
 	consulAddr := flag.String("consul.addr", "127.0.0.1", "consul address")
 	consulPort := flag.Int("consul.port", 8500, "consul port")
+	consulScheme := flag.String("consul.scheme", "http", "consul scheme, http or https")
+	consulToken := flag.String("consul.token", "", "consul acl token")
+	consulDatacenter := flag.String("consul.dc", "", "consul datacenter")
+	consulEmbedded := flag.Bool("consul.embedded", false, "start an embedded registry server on consul.addr:consul.port instead of using consul")
 	serviceName := flag.String("service.name", "register", "service name")
 	serviceAddr := flag.String("service.addr", "localhost", "service addr")
 	servicePort := flag.Int("service.port", 12312, "service port")
+	checkMode := flag.String("check.mode", "http", "health check mode, http or ttl")
+	checkTTL := flag.Duration("check.ttl", 15*time.Second, "ttl of health check in ttl mode")
+	registryType := flag.String("registry", "consul", "registry backend, consul, etcd, memory or file")
+	etcdEndpoints := flag.String("registry.etcd.endpoints", "http://127.0.0.1:2379", "comma separated etcd endpoints")
+	registryFile := flag.String("registry.file", "services.yaml", "static registry file, yaml or json")
+	drainPeriod := flag.Duration("drain.period", 5*time.Second, "time to wait for callers to drain traffic before shutdown")
+	shutdownTimeout := flag.Duration("shutdown.timeout", 10*time.Second, "max time to wait for in-flight requests on shutdown")
+	tracingConfig := tracing.DefaultConfig("", "")
+	tracingConfig.BindFlags(flag.CommandLine)
 
 	flag.Parse()
 
-	client := discovery.NewDiscoveryClient(*consulAddr, *consulPort)
+	if *consulEmbedded {
+		// 本地开发时使用嵌入式注册中心代替consul
+		registryServer := registryserver.NewServer()
+		defer registryServer.Close()
+		listener, err := net.Listen("tcp", *consulAddr+":"+strconv.Itoa(*consulPort))
+		if err != nil {
+			log.Printf("embedded registry server listen err : %s", err)
+			os.Exit(-1)
+		}
+		go http.Serve(listener, registryServer)
+	}
 
-	errChan := make(chan error)
+	client := discovery.NewDiscoveryClientWithConfig(&discovery.Config{
+		Host:       *consulAddr,
+		Port:       *consulPort,
+		Scheme:     *consulScheme,
+		Token:      *consulToken,
+		Datacenter: *consulDatacenter,
+		// 由服务层按健康状态过滤
+		IncludeUnhealthy: true,
+	})
 
-	srv := service.NewRegisterServiceImpl(client)
+	var reg registry.Registry
+	switch *registryType {
+	case "etcd":
+		etcdRegistry, err := registry.NewEtcdRegistry(&registry.EtcdConfig{
+			Endpoints: strings.Split(*etcdEndpoints, ","),
+			TTL:       *checkTTL,
+		})
+		if err != nil {
+			log.Printf("connect etcd err : %s", err)
+			os.Exit(-1)
+		}
+		defer etcdRegistry.Close()
+		reg = etcdRegistry
+	case "memory":
+		reg = registry.NewMemoryRegistry()
+	case "file":
+		fileRegistry, err := registry.NewFileRegistry(*registryFile, 0)
+		if err != nil {
+			log.Printf("load registry file err : %s", err)
+			os.Exit(-1)
+		}
+		reg = fileRegistry
+	default:
+		reg = registry.NewConsulRegistry(client)
+	}
 
+	tracingConfig.ServiceName = *serviceName
+	tracingConfig.HostPort = *serviceAddr + ":" + strconv.Itoa(*servicePort)
+	tracer, closeTracer, err := tracing.New(tracingConfig)
+	if err != nil {
+		log.Printf("create tracer err : %s", err)
+		os.Exit(-1)
+	}
+	defer closeTracer()
+
+	srv := service.NewRegisterServiceImpl(reg)
+
+	discoveryEndpoint := endpoint.MakeDiscoveryEndpoint(srv)
+	discoveryEndpoint = kitzipkin.TraceEndpoint(tracer, "Discovery")(discoveryEndpoint)
+	discoveryEndpoint = instrument.DefaultMetrics.EndpointMiddleware("register", "Discovery")(discoveryEndpoint)
+	healthCheckEndpoint := endpoint.MakeHealthCheckEndpoint(srv)
+	healthCheckEndpoint = instrument.DefaultMetrics.EndpointMiddleware("register", "HealthCheck")(healthCheckEndpoint)
 	endpoints := endpoint.RegisterEndpoints{
-		DiscoveryEndpoint:   endpoint.MakeDiscoveryEndpoint(srv),
-		HealthCheckEndpoint: endpoint.MakeHealthCheckEndpoint(srv),
+		DiscoveryEndpoint:   discoveryEndpoint,
+		HealthCheckEndpoint: healthCheckEndpoint,
+	}
+	handler := transport.MakeHttpHandler(context.Background(), &endpoints, tracer)
+	server := &http.Server{
+		Addr:    ":" + strconv.Itoa(*servicePort),
+		Handler: handler,
 	}
-	handler := transport.MakeHttpHandler(context.Background(), &endpoints)
-	go func() {
-		errChan <- http.ListenAndServe(":"+strconv.Itoa(*servicePort), handler)
-	}()
 
-	go func() {
-		// 监控系统信号，等待 ctrl + c 系统信号通知服务关闭
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
-		errChan <- fmt.Errorf("%s", <-c)
-	}()
 	instanceId := *serviceName + "-" + uuid.New().String()
-	err := client.Register(context.Background(), *serviceName, instanceId, "/health", *serviceAddr, *servicePort, nil, nil)
+	var stopHeartbeat func()
+	if *registryType != "consul" {
+		// 非consul注册中心由注册中心自身维护实例存活
+		err = reg.Register(context.Background(), &discovery.InstanceInfo{
+			ID:      instanceId,
+			Name:    *serviceName,
+			Address: *serviceAddr,
+			Port:    *servicePort,
+		})
+	} else if *checkMode == "ttl" {
+		// TTL模式下由服务实例主动上报心跳
+		registration := &discovery.TTLRegistration{
+			ServiceName:  *serviceName,
+			InstanceId:   instanceId,
+			InstanceHost: *serviceAddr,
+			InstancePort: *servicePort,
+			TTL:          *checkTTL,
+		}
+		err = client.RegisterTTL(context.Background(), registration)
+		if err == nil {
+			heartbeatCtx, cancel := context.WithCancel(context.Background())
+			heartbeatDone := make(chan struct{})
+			go func() {
+				defer close(heartbeatDone)
+				client.RunHeartbeat(heartbeatCtx, registration, discovery.HealthReporterFunc(func() (string, string) {
+					if status := srv.HealthCheck(); status != "OK" {
+						return discovery.HealthCritical, status
+					}
+					return discovery.HealthPassing, ""
+				}))
+			}()
+			// 下线前停止心跳并等待进行中的心跳结束，心跳失败时会重新注册，不能与注销并发
+			stopHeartbeat = func() {
+				cancel()
+				<-heartbeatDone
+			}
+		}
+	} else {
+		err = client.Register(context.Background(), *serviceName, instanceId, "/health", *serviceAddr, *servicePort, nil, nil)
+	}
 	if err != nil {
 		log.Printf("register service err : %s", err)
 		os.Exit(-1)
 	}
 
-	err = <-errChan
-	log.Printf("listen err : %s", err)
-	client.Deregister(context.Background(), instanceId)
+	// 收到退出信号后先摘除流量，再关闭服务器并注销实例
+	config := lifecycle.DefaultConfig(instanceId)
+	config.DrainPeriod = *drainPeriod
+	config.ShutdownTimeout = *shutdownTimeout
+	config.BeforeStop = stopHeartbeat
+	lifecycle.New(config, reg, server).Run(server.ListenAndServe)
 }
 func init() {
 	file := "./" + "register.log"
@@ -0,0 +1,42 @@
+package registry
+
+import (
+	"context"
+
+	"github.com/yunfeiyang1916/micro-go-course/register/discovery"
+)
+
+// consul注册中心
+type ConsulRegistry struct {
+	client *discovery.DiscoveryClient
+}
+
+// 基于consul服务发现客户端创建注册中心
+func NewConsulRegistry(client *discovery.DiscoveryClient) *ConsulRegistry {
+	return &ConsulRegistry{client: client}
+}
+
+// 注册服务实例，实例需要设置健康检查
+func (r *ConsulRegistry) Register(ctx context.Context, instance *discovery.InstanceInfo) error {
+	return r.client.RegisterInstance(ctx, instance)
+}
+
+// 注销服务实例
+func (r *ConsulRegistry) Deregister(ctx context.Context, instanceId string) error {
+	return r.client.Deregister(ctx, instanceId)
+}
+
+// 开启维护模式，实例在consul中呈现为critical
+func (r *ConsulRegistry) Drain(ctx context.Context, instanceId string) error {
+	return r.client.EnableMaintenance(ctx, instanceId, true, "draining")
+}
+
+// 获取服务实例列表
+func (r *ConsulRegistry) Discover(ctx context.Context, serviceName string) ([]*discovery.InstanceInfo, error) {
+	return r.client.DiscoverServices(ctx, serviceName)
+}
+
+// 监听服务实例变化
+func (r *ConsulRegistry) Watch(ctx context.Context, serviceName string) <-chan []*discovery.InstanceInfo {
+	return r.client.Watch(ctx, serviceName)
+}
@@ -0,0 +1,306 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yunfeiyang1916/micro-go-course/register/discovery"
+	"go.etcd.io/etcd/clientv3"
+)
+
+// etcd注册中心
+// 服务实例以JSON形式保存在 <prefix>/<服务名>/<实例ID> 键下，
+// 每个实例绑定一个租约，由clientv3在后台续约，进程退出或续约失败后实例自动过期
+
+// etcd注册中心配置
+type EtcdConfig struct {
+	// etcd地址列表，如 http://127.0.0.1:2379
+	Endpoints []string
+	// 键前缀
+	Prefix string
+	// 租约时间
+	TTL time.Duration
+	// 连接及非watch请求的超时时间
+	Timeout time.Duration
+}
+
+// etcd注册中心
+type EtcdRegistry struct {
+	config EtcdConfig
+	client *clientv3.Client
+	mu     sync.Mutex
+	// 以实例ID为键的租约续约取消函数
+	leases map[string]context.CancelFunc
+	// 以实例ID为键的租约ID
+	leaseIds map[string]clientv3.LeaseID
+	// 以实例ID为键的已注册实例，摘流量后为标记了状态的副本
+	instances map[string]*discovery.InstanceInfo
+	// watch及重新注册出错后的重试退避时间
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+// 创建etcd注册中心
+func NewEtcdRegistry(config *EtcdConfig) (*EtcdRegistry, error) {
+	c := *config
+	if len(c.Endpoints) == 0 {
+		c.Endpoints = []string{"http://127.0.0.1:2379"}
+	}
+	if c.Prefix == "" {
+		c.Prefix = "/services"
+	}
+	c.Prefix = strings.TrimSuffix(c.Prefix, "/")
+	if c.TTL <= 0 {
+		c.TTL = 15 * time.Second
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 2 * time.Second
+	}
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   c.Endpoints,
+		DialTimeout: c.Timeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &EtcdRegistry{
+		config:     c,
+		client:     client,
+		leases:     make(map[string]context.CancelFunc),
+		leaseIds:   make(map[string]clientv3.LeaseID),
+		instances:  make(map[string]*discovery.InstanceInfo),
+		minBackoff: time.Second,
+		maxBackoff: 30 * time.Second,
+	}, nil
+}
+
+// 注册服务实例，并在后台续约
+func (r *EtcdRegistry) Register(ctx context.Context, instance *discovery.InstanceInfo) error {
+	leaseId, err := r.put(ctx, instance)
+	if err != nil {
+		return err
+	}
+	keepCtx, cancel := context.WithCancel(context.Background())
+	r.mu.Lock()
+	if stop, ok := r.leases[instance.ID]; ok {
+		stop()
+	}
+	r.leases[instance.ID] = cancel
+	r.leaseIds[instance.ID] = leaseId
+	r.instances[instance.ID] = instance
+	r.mu.Unlock()
+	go r.keepAlive(keepCtx, instance.ID, leaseId)
+	log.Printf("register service %s to etcd success", instance.ID)
+	return nil
+}
+
+// 注销服务实例，撤销租约后实例键随之删除
+func (r *EtcdRegistry) Deregister(ctx context.Context, instanceId string) error {
+	r.mu.Lock()
+	stop, ok := r.leases[instanceId]
+	leaseId := r.leaseIds[instanceId]
+	delete(r.leases, instanceId)
+	delete(r.leaseIds, instanceId)
+	delete(r.instances, instanceId)
+	r.mu.Unlock()
+	if !ok {
+		return ErrInstanceNotRegistered
+	}
+	stop()
+	ctx, cancel := context.WithTimeout(ctx, r.config.Timeout)
+	defer cancel()
+	_, err := r.client.Revoke(ctx, leaseId)
+	return err
+}
+
+// 将实例状态标记为critical，实例仍绑定原租约
+func (r *EtcdRegistry) Drain(ctx context.Context, instanceId string) error {
+	r.mu.Lock()
+	instance, ok := r.instances[instanceId]
+	leaseId := r.leaseIds[instanceId]
+	if ok {
+		// 替换为副本，避免修改调用方持有的实例
+		drained := *instance
+		drained.Status = discovery.HealthCritical
+		instance = &drained
+		r.instances[instanceId] = instance
+	}
+	r.mu.Unlock()
+	if !ok {
+		return ErrInstanceNotRegistered
+	}
+	return r.putInstance(ctx, instance, leaseId)
+}
+
+// 获取服务实例列表
+func (r *EtcdRegistry) Discover(ctx context.Context, serviceName string) ([]*discovery.InstanceInfo, error) {
+	instances, _, err := r.get(ctx, serviceName)
+	return instances, err
+}
+
+// 监听服务实例变化
+func (r *EtcdRegistry) Watch(ctx context.Context, serviceName string) <-chan []*discovery.InstanceInfo {
+	ch := make(chan []*discovery.InstanceInfo, 1)
+	go func() {
+		defer close(ch)
+		backoff := r.minBackoff
+		for {
+			instances, revision, err := r.get(ctx, serviceName)
+			if err == nil {
+				sendLatest(ch, instances)
+				// 阻塞直到有变化或出错
+				err = r.watchOnce(ctx, serviceName, revision+1)
+				if err == nil {
+					backoff = r.minBackoff
+					continue
+				}
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("watch service %s err: %s, retry after %s", serviceName, err, backoff)
+			if !r.sleep(ctx, &backoff) {
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// 关闭etcd客户端，已注册的实例在租约到期后过期
+func (r *EtcdRegistry) Close() error {
+	r.mu.Lock()
+	for _, stop := range r.leases {
+		stop()
+	}
+	r.mu.Unlock()
+	return r.client.Close()
+}
+
+// 申请租约并写入服务实例，返回绑定的租约ID
+func (r *EtcdRegistry) put(ctx context.Context, instance *discovery.InstanceInfo) (clientv3.LeaseID, error) {
+	grantCtx, cancel := context.WithTimeout(ctx, r.config.Timeout)
+	defer cancel()
+	grant, err := r.client.Grant(grantCtx, int64(r.config.TTL/time.Second))
+	if err != nil {
+		return 0, err
+	}
+	return grant.ID, r.putInstance(ctx, instance, grant.ID)
+}
+
+// 以指定租约写入服务实例
+func (r *EtcdRegistry) putInstance(ctx context.Context, instance *discovery.InstanceInfo, leaseId clientv3.LeaseID) error {
+	value, err := json.Marshal(instance)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, r.config.Timeout)
+	defer cancel()
+	_, err = r.client.Put(ctx, r.instanceKey(instance.Name, instance.ID), string(value), clientv3.WithLease(leaseId))
+	return err
+}
+
+// 持续续约，租约失效时以新租约重新注册，直到ctx取消
+func (r *EtcdRegistry) keepAlive(ctx context.Context, instanceId string, leaseId clientv3.LeaseID) {
+	backoff := r.minBackoff
+	for {
+		ch, err := r.client.KeepAlive(ctx, leaseId)
+		if err == nil {
+			// 续约应答由clientv3按租约时间的三分之一发送，通道关闭表示租约已失效或ctx已取消
+			for range ch {
+				backoff = r.minBackoff
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		// 重新写入实例，已摘流量的实例保持摘流量状态
+		r.mu.Lock()
+		instance, ok := r.instances[instanceId]
+		r.mu.Unlock()
+		if !ok {
+			return
+		}
+		log.Printf("lease of %s expired, re-register", instanceId)
+		newLeaseId, err := r.put(ctx, instance)
+		if err != nil {
+			log.Printf("re-register %s err: %s, retry after %s", instanceId, err, backoff)
+			if !r.sleep(ctx, &backoff) {
+				return
+			}
+			continue
+		}
+		leaseId = newLeaseId
+		r.mu.Lock()
+		if _, ok := r.leaseIds[instanceId]; ok {
+			r.leaseIds[instanceId] = leaseId
+		}
+		r.mu.Unlock()
+	}
+}
+
+// 读取服务下的全部实例，返回读取时的版本号
+func (r *EtcdRegistry) get(ctx context.Context, serviceName string) ([]*discovery.InstanceInfo, int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.config.Timeout)
+	defer cancel()
+	resp, err := r.client.Get(ctx, r.servicePrefix(serviceName), clientv3.WithPrefix())
+	if err != nil {
+		return nil, 0, err
+	}
+	instances := make([]*discovery.InstanceInfo, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		var instance discovery.InstanceInfo
+		if err = json.Unmarshal(kv.Value, &instance); err != nil {
+			return nil, 0, err
+		}
+		instances = append(instances, &instance)
+	}
+	return instances, resp.Header.Revision, nil
+}
+
+// 从指定版本开始监听服务前缀，收到第一个变化事件后返回
+func (r *EtcdRegistry) watchOnce(ctx context.Context, serviceName string, startRevision int64) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// 要求连接的节点有leader，避免在与集群隔离的节点上一直等待
+	ch := r.client.Watch(clientv3.WithRequireLeader(ctx), r.servicePrefix(serviceName), clientv3.WithPrefix(), clientv3.WithRev(startRevision))
+	for resp := range ch {
+		if err := resp.Err(); err != nil {
+			return err
+		}
+		if len(resp.Events) > 0 {
+			return nil
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return errors.New("watch channel closed")
+}
+
+// 等待退避时间并将其翻倍，ctx取消时返回false
+func (r *EtcdRegistry) sleep(ctx context.Context, backoff *time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(*backoff):
+	}
+	*backoff *= 2
+	if *backoff > r.maxBackoff {
+		*backoff = r.maxBackoff
+	}
+	return true
+}
+
+func (r *EtcdRegistry) servicePrefix(serviceName string) string {
+	return r.config.Prefix + "/" + serviceName + "/"
+}
+
+func (r *EtcdRegistry) instanceKey(serviceName, instanceId string) string {
+	return r.servicePrefix(serviceName) + instanceId
+}
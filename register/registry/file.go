@@ -0,0 +1,148 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/yunfeiyang1916/micro-go-course/register/discovery"
+)
+
+// 静态文件注册中心
+// 从YAML或JSON文件中读取服务实例，文件以服务名为键、实例列表为值，例如：
+//
+//	comments:
+//	  - id: comments-1
+//	    address: 127.0.0.1
+//	    port: 10087
+//
+// 静态文件是只读的，注册和注销不做任何操作，文件修改后会通知监听者
+type FileRegistry struct {
+	path string
+	// 检查文件修改的间隔
+	interval time.Duration
+	mu       sync.Mutex
+	modTime  time.Time
+	// 每次重新加载后递增，监听者各自记录已通知的版本
+	version  uint64
+	services map[string][]*discovery.InstanceInfo
+}
+
+// 创建静态文件注册中心，.json 后缀的文件按JSON解析，其余按YAML解析
+func NewFileRegistry(path string, interval time.Duration) (*FileRegistry, error) {
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	r := &FileRegistry{path: path, interval: interval}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// 静态文件不支持注册
+func (r *FileRegistry) Register(ctx context.Context, instance *discovery.InstanceInfo) error {
+	log.Printf("file registry is read only, skip register %s", instance.ID)
+	return nil
+}
+
+// 静态文件不支持注销
+func (r *FileRegistry) Deregister(ctx context.Context, instanceId string) error {
+	return nil
+}
+
+// 获取服务实例列表
+func (r *FileRegistry) Discover(ctx context.Context, serviceName string) ([]*discovery.InstanceInfo, error) {
+	if err := r.load(); err != nil {
+		log.Printf("load registry file err: %s, use last loaded instances", err)
+	}
+	instances, _ := r.snapshot(serviceName)
+	return instances, nil
+}
+
+// 返回服务实例列表及其版本
+func (r *FileRegistry) snapshot(serviceName string) ([]*discovery.InstanceInfo, uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.services[serviceName], r.version
+}
+
+// 监听服务实例变化，定期检查文件修改时间
+func (r *FileRegistry) Watch(ctx context.Context, serviceName string) <-chan []*discovery.InstanceInfo {
+	ch := make(chan []*discovery.InstanceInfo, 1)
+	r.Discover(ctx, serviceName)
+	instances, seen := r.snapshot(serviceName)
+	ch <- instances
+	go func() {
+		defer close(ch)
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := r.load(); err != nil {
+				log.Printf("load registry file err: %s", err)
+				continue
+			}
+			// 文件可能已被其他监听者或Discover重新加载，按版本判断是否需要通知
+			instances, version := r.snapshot(serviceName)
+			if version != seen {
+				seen = version
+				sendLatest(ch, instances)
+			}
+		}
+	}()
+	return ch
+}
+
+// 文件修改后重新加载
+func (r *FileRegistry) load() error {
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	unchanged := r.services != nil && info.ModTime().Equal(r.modTime)
+	r.mu.Unlock()
+	if unchanged {
+		return nil
+	}
+	data, err := ioutil.ReadFile(r.path)
+	if err != nil {
+		return err
+	}
+	var services map[string][]*discovery.InstanceInfo
+	if filepath.Ext(r.path) == ".json" {
+		err = json.Unmarshal(data, &services)
+	} else {
+		err = yaml.Unmarshal(data, &services)
+	}
+	if err != nil {
+		return err
+	}
+	if services == nil {
+		services = make(map[string][]*discovery.InstanceInfo)
+	}
+	for serviceName, instances := range services {
+		for _, instance := range instances {
+			instance.Name = serviceName
+			instance.Service = serviceName
+		}
+	}
+	r.mu.Lock()
+	r.modTime = info.ModTime()
+	r.version++
+	r.services = services
+	r.mu.Unlock()
+	return nil
+}
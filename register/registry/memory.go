@@ -0,0 +1,128 @@
+package registry
+
+import (
+	"context"
+	"sync"
+
+	"github.com/yunfeiyang1916/micro-go-course/register/discovery"
+)
+
+// 内存注册中心，用于测试和单机运行
+type MemoryRegistry struct {
+	mu sync.Mutex
+	// 以服务名为键的服务实例
+	services map[string][]*discovery.InstanceInfo
+	// 以服务名为键的监听者
+	watchers map[string][]chan []*discovery.InstanceInfo
+}
+
+// 创建内存注册中心
+func NewMemoryRegistry() *MemoryRegistry {
+	return &MemoryRegistry{
+		services: make(map[string][]*discovery.InstanceInfo),
+		watchers: make(map[string][]chan []*discovery.InstanceInfo),
+	}
+}
+
+// 注册服务实例，已存在的同ID实例会被替换
+func (r *MemoryRegistry) Register(ctx context.Context, instance *discovery.InstanceInfo) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	instances := r.remove(instance.Name, instance.ID)
+	r.services[instance.Name] = append(instances, instance)
+	r.notify(instance.Name)
+	return nil
+}
+
+// 注销服务实例
+func (r *MemoryRegistry) Deregister(ctx context.Context, instanceId string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for serviceName, instances := range r.services {
+		for _, instance := range instances {
+			if instance.ID == instanceId {
+				r.services[serviceName] = r.remove(serviceName, instanceId)
+				r.notify(serviceName)
+				return nil
+			}
+		}
+	}
+	return ErrInstanceNotRegistered
+}
+
+// 将实例状态标记为critical
+func (r *MemoryRegistry) Drain(ctx context.Context, instanceId string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for serviceName, instances := range r.services {
+		for i, instance := range instances {
+			if instance.ID == instanceId {
+				// 替换为副本，避免修改调用方持有的实例
+				drained := *instance
+				drained.Status = discovery.HealthCritical
+				instances[i] = &drained
+				r.notify(serviceName)
+				return nil
+			}
+		}
+	}
+	return ErrInstanceNotRegistered
+}
+
+// 获取服务实例列表
+func (r *MemoryRegistry) Discover(ctx context.Context, serviceName string) ([]*discovery.InstanceInfo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.snapshot(serviceName), nil
+}
+
+// 监听服务实例变化
+func (r *MemoryRegistry) Watch(ctx context.Context, serviceName string) <-chan []*discovery.InstanceInfo {
+	ch := make(chan []*discovery.InstanceInfo, 1)
+	r.mu.Lock()
+	r.watchers[serviceName] = append(r.watchers[serviceName], ch)
+	ch <- r.snapshot(serviceName)
+	r.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		watchers := r.watchers[serviceName]
+		for i, w := range watchers {
+			if w == ch {
+				r.watchers[serviceName] = append(watchers[:i:i], watchers[i+1:]...)
+				break
+			}
+		}
+		close(ch)
+	}()
+	return ch
+}
+
+// 移除服务实例，返回剩余实例
+func (r *MemoryRegistry) remove(serviceName, instanceId string) []*discovery.InstanceInfo {
+	instances := r.services[serviceName]
+	result := make([]*discovery.InstanceInfo, 0, len(instances))
+	for _, instance := range instances {
+		if instance.ID != instanceId {
+			result = append(result, instance)
+		}
+	}
+	return result
+}
+
+// 服务实例列表的副本
+func (r *MemoryRegistry) snapshot(serviceName string) []*discovery.InstanceInfo {
+	instances := r.services[serviceName]
+	result := make([]*discovery.InstanceInfo, len(instances))
+	copy(result, instances)
+	return result
+}
+
+// 通知监听者
+func (r *MemoryRegistry) notify(serviceName string) {
+	for _, ch := range r.watchers[serviceName] {
+		sendLatest(ch, r.snapshot(serviceName))
+	}
+}
@@ -0,0 +1,54 @@
+package registry
+
+import (
+	"context"
+	"errors"
+
+	"github.com/yunfeiyang1916/micro-go-course/register/discovery"
+)
+
+// 服务注册中心抽象
+// 屏蔽consul、etcd、内存和静态文件等不同的注册中心实现
+
+var (
+	ErrInstanceNotRegistered = errors.New("instance is not registered")
+)
+
+// 服务注册中心
+type Registry interface {
+	// 注册服务实例
+	Register(ctx context.Context, instance *discovery.InstanceInfo) error
+	// 注销服务实例
+	Deregister(ctx context.Context, instanceId string) error
+	// 获取服务实例列表
+	Discover(ctx context.Context, serviceName string) ([]*discovery.InstanceInfo, error)
+	// 监听服务实例变化，变化时将最新列表发送到返回的通道中，ctx取消后关闭通道
+	Watch(ctx context.Context, serviceName string) <-chan []*discovery.InstanceInfo
+}
+
+// 支持摘除流量的注册中心，实例下线前将其标记为不健康，使调用方不再选择该实例
+type Drainer interface {
+	Drain(ctx context.Context, instanceId string) error
+}
+
+// 将注册中心适配为负载均衡客户端使用的解析器
+type Resolver struct {
+	Registry Registry
+}
+
+func (r Resolver) DiscoverServices(ctx context.Context, serviceName string) ([]*discovery.InstanceInfo, error) {
+	return r.Registry.Discover(ctx, serviceName)
+}
+
+func (r Resolver) Watch(ctx context.Context, serviceName string) <-chan []*discovery.InstanceInfo {
+	return r.Registry.Watch(ctx, serviceName)
+}
+
+// 发送最新的实例列表，丢弃调用方尚未读取的旧列表
+func sendLatest(ch chan []*discovery.InstanceInfo, instances []*discovery.InstanceInfo) {
+	select {
+	case <-ch:
+	default:
+	}
+	ch <- instances
+}
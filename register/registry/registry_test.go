@@ -0,0 +1,215 @@
+package registry
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yunfeiyang1916/micro-go-course/register/discovery"
+	"go.etcd.io/etcd/embed"
+)
+
+func receive(t *testing.T, ch <-chan []*discovery.InstanceInfo) []*discovery.InstanceInfo {
+	select {
+	case instances, ok := <-ch:
+		if !ok {
+			t.Fatal("watch channel closed")
+		}
+		return instances
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for instances")
+	}
+	return nil
+}
+
+func instanceIds(instances []*discovery.InstanceInfo) string {
+	ids := make([]string, 0, len(instances))
+	for _, instance := range instances {
+		ids = append(ids, instance.ID)
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
+
+// 各注册中心实现的公共测试
+func testRegistry(t *testing.T, r Registry) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := r.Watch(ctx, "comments")
+	if ids := instanceIds(receive(t, ch)); ids != "" {
+		t.Fatalf("expected no instances, got %s", ids)
+	}
+
+	a := &discovery.InstanceInfo{ID: "comments-a", Name: "comments", Address: "10.0.0.1", Port: 10087}
+	b := &discovery.InstanceInfo{ID: "comments-b", Name: "comments", Address: "10.0.0.2", Port: 10087}
+	if err := r.Register(ctx, a); err != nil {
+		t.Fatal(err)
+	}
+	if ids := instanceIds(receive(t, ch)); ids != "comments-a" {
+		t.Fatalf("expected comments-a, got %s", ids)
+	}
+	if err := r.Register(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	if ids := instanceIds(receive(t, ch)); ids != "comments-a,comments-b" {
+		t.Fatalf("expected both instances, got %s", ids)
+	}
+	if err := r.Deregister(ctx, "comments-a"); err != nil {
+		t.Fatal(err)
+	}
+	if ids := instanceIds(receive(t, ch)); ids != "comments-b" {
+		t.Fatalf("expected comments-b, got %s", ids)
+	}
+	instances, err := r.Discover(ctx, "comments")
+	if err != nil || instanceIds(instances) != "comments-b" {
+		t.Fatalf("expected discover comments-b, got %v %v", instances, err)
+	}
+	if err = r.Deregister(ctx, "unknown"); err != ErrInstanceNotRegistered {
+		t.Fatalf("expected %v got %v", ErrInstanceNotRegistered, err)
+	}
+	drainer, ok := r.(Drainer)
+	if !ok {
+		t.Fatalf("expected %T to implement Drainer", r)
+	}
+	if err = drainer.Drain(ctx, "comments-b"); err != nil {
+		t.Fatal(err)
+	}
+	if instances := receive(t, ch); len(instances) != 1 || instances[0].Status != discovery.HealthCritical {
+		t.Fatalf("expected comments-b drained, got %v", instances)
+	}
+	if err = drainer.Drain(ctx, "unknown"); err != ErrInstanceNotRegistered {
+		t.Fatalf("expected %v got %v", ErrInstanceNotRegistered, err)
+	}
+}
+
+func TestMemoryRegistry(t *testing.T) {
+	testRegistry(t, NewMemoryRegistry())
+}
+
+func TestEtcdRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "etcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// 启动进程内的单节点etcd
+	config := embed.NewConfig()
+	config.Dir = dir
+	config.Logger = "zap"
+	config.LogOutputs = []string{filepath.Join(dir, "etcd.log")}
+	clientURL, _ := url.Parse("http://" + freeAddr(t))
+	peerURL, _ := url.Parse("http://" + freeAddr(t))
+	config.LCUrls, config.ACUrls = []url.URL{*clientURL}, []url.URL{*clientURL}
+	config.LPUrls, config.APUrls = []url.URL{*peerURL}, []url.URL{*peerURL}
+	config.InitialCluster = config.InitialClusterFromName(config.Name)
+	etcd, err := embed.StartEtcd(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer etcd.Close()
+	select {
+	case <-etcd.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for etcd")
+	}
+
+	r, err := NewEtcdRegistry(&EtcdConfig{Endpoints: []string{clientURL.String()}, TTL: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	testRegistry(t, r)
+
+	// 租约失效后以新租约重新注册
+	ctx := context.Background()
+	r.mu.Lock()
+	leaseId := r.leaseIds["comments-b"]
+	r.mu.Unlock()
+	if _, err = r.client.Revoke(ctx, leaseId); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		instances, _ := r.Discover(ctx, "comments")
+		r.mu.Lock()
+		renewed := r.leaseIds["comments-b"] != leaseId
+		r.mu.Unlock()
+		if renewed && len(instances) == 1 && instances[0].Status == discovery.HealthCritical {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected drained comments-b re-registered, got %v", instances)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// 获取一个空闲的本地地址
+func freeAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func TestFileRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "services.yaml")
+	write := func(content string, modTime time.Time) {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, modTime, modTime)
+	}
+	write("comments:\n  - id: comments-a\n    address: 10.0.0.1\n    port: 10087\n", time.Unix(1600000000, 0))
+
+	r, err := NewFileRegistry(path, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := r.Watch(ctx, "comments")
+	instances := receive(t, ch)
+	if len(instances) != 1 || instances[0].Name != "comments" || instances[0].Port != 10087 {
+		t.Fatalf("unexpected instances %v", instances)
+	}
+	// 多个监听者及并发的Discover都不应错过变化
+	other := r.Watch(ctx, "comments")
+	receive(t, other)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				r.Discover(ctx, "comments")
+			}
+		}
+	}()
+
+	write("comments:\n  - id: comments-a\n    address: 10.0.0.1\n    port: 10087\n  - id: comments-b\n    address: 10.0.0.2\n    port: 10087\n", time.Unix(1600000100, 0))
+	for _, watch := range []<-chan []*discovery.InstanceInfo{ch, other} {
+		if ids := instanceIds(receive(t, watch)); ids != "comments-a,comments-b" {
+			t.Fatalf("expected both instances after reload, got %s", ids)
+		}
+	}
+	close(stop)
+	<-done
+}
@@ -0,0 +1,585 @@
+package registryserver
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 嵌入式服务注册中心
+// 实现本仓库用到的consul HTTP接口子集，包括服务注册注销、健康查询、目录查询和TTL检查更新，
+// 并对注册了HTTP检查的服务实例主动进行健康检查，便于在单机上运行和集成测试整个系统，不依赖真实的consul
+
+// 健康状态
+const (
+	StatusPassing  = "passing"
+	StatusWarning  = "warning"
+	StatusCritical = "critical"
+)
+
+// 嵌入式注册中心的节点名
+const NodeName = "registry-server"
+
+// 服务注册请求，兼容consul接口的驼峰和下划线两种字段名
+type serviceRegistration struct {
+	ID                string
+	Name              string
+	Tags              []string
+	Address           string
+	Port              int
+	Meta              map[string]string
+	EnableTagOverride bool
+	Check             *checkDefinition
+	Weights           *weights
+}
+
+// 健康检查定义
+type checkDefinition struct {
+	HTTP                                string
+	Interval                            string
+	Timeout                             string
+	TTL                                 string
+	DeregisterCriticalServiceAfter      string
+	DeregisterCriticalServiceAfterSnake string `json:"deregister_critical_service_after"`
+}
+
+type weights struct {
+	Passing int
+	Warning int
+}
+
+// 已注册的服务实例
+type service struct {
+	registration serviceRegistration
+	checkId      string
+	status       string
+	output       string
+	// 状态变为critical的时间
+	criticalSince time.Time
+	// TTL检查最近一次更新时间
+	ttlUpdated time.Time
+	ttl        time.Duration
+	// critical持续超过该时间后自动注销
+	deregisterAfter time.Duration
+	// 停止主动健康检查
+	stop context.CancelFunc
+	// 维护模式，开启时实例视为critical
+	maintenance       bool
+	maintenanceReason string
+}
+
+// 实例对外呈现的健康状态，维护模式优先
+func (svc *service) effectiveStatus() string {
+	if svc.maintenance {
+		return StatusCritical
+	}
+	return svc.status
+}
+
+// 嵌入式注册中心服务器
+type Server struct {
+	mu sync.Mutex
+	// 以实例ID为键的服务实例
+	services map[string]*service
+	// 数据变化时递增，用于阻塞查询
+	index   uint64
+	changed chan struct{}
+	client  *http.Client
+	mux     *http.ServeMux
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// 创建嵌入式注册中心服务器
+func NewServer() *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Server{
+		services: make(map[string]*service),
+		index:    1,
+		changed:  make(chan struct{}),
+		client:   &http.Client{},
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/agent/service/register", s.handleRegister)
+	mux.HandleFunc("/v1/agent/service/deregister/", s.handleDeregister)
+	mux.HandleFunc("/v1/agent/service/maintenance/", s.handleMaintenance)
+	mux.HandleFunc("/v1/agent/check/", s.handleCheckUpdate)
+	mux.HandleFunc("/v1/health/service/", s.handleHealthService)
+	mux.HandleFunc("/v1/catalog/service/", s.handleCatalogService)
+	s.mux = mux
+	go s.reap()
+	return s
+}
+
+// 处理HTTP请求
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// 停止所有健康检查
+func (s *Server) Close() {
+	s.cancel()
+}
+
+// 注册服务实例
+func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var registration serviceRegistration
+	if err := json.NewDecoder(r.Body).Decode(&registration); err != nil {
+		http.Error(w, "invalid registration: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if registration.Name == "" {
+		http.Error(w, "missing service name", http.StatusBadRequest)
+		return
+	}
+	if registration.ID == "" {
+		registration.ID = registration.Name
+	}
+	svc := &service{
+		registration: registration,
+		checkId:      "service:" + registration.ID,
+		status:       StatusPassing,
+	}
+	var interval, timeout time.Duration
+	if check := registration.Check; check != nil {
+		var err error
+		if svc.ttl, err = parseDuration(check.TTL); err != nil {
+			http.Error(w, "invalid ttl: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if interval, err = parseDuration(check.Interval); err != nil {
+			http.Error(w, "invalid interval: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if timeout, err = parseDuration(check.Timeout); err != nil {
+			http.Error(w, "invalid timeout: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		deregister := check.DeregisterCriticalServiceAfter
+		if deregister == "" {
+			deregister = check.DeregisterCriticalServiceAfterSnake
+		}
+		if svc.deregisterAfter, err = parseDuration(deregister); err != nil {
+			http.Error(w, "invalid deregister_critical_service_after: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if check.HTTP != "" && svc.ttl > 0 {
+			http.Error(w, "http and ttl check are exclusive", http.StatusBadRequest)
+			return
+		}
+		// 与consul一致，新注册的带检查实例初始状态为critical
+		if check.HTTP != "" || svc.ttl > 0 {
+			svc.status = StatusCritical
+			svc.criticalSince = time.Now()
+			svc.ttlUpdated = time.Now()
+		}
+	}
+
+	s.mu.Lock()
+	if old, ok := s.services[registration.ID]; ok && old.stop != nil {
+		old.stop()
+	}
+	if registration.Check != nil && registration.Check.HTTP != "" {
+		if interval <= 0 {
+			interval = 10 * time.Second
+		}
+		if timeout <= 0 {
+			timeout = 10 * time.Second
+		}
+		ctx, cancel := context.WithCancel(s.ctx)
+		svc.stop = cancel
+		go s.runHTTPCheck(ctx, registration.ID, registration.Check.HTTP, interval, timeout)
+	}
+	s.services[registration.ID] = svc
+	s.notify()
+	s.mu.Unlock()
+	log.Printf("embedded registry register service %s", registration.ID)
+}
+
+// 注销服务实例
+func (s *Server) handleDeregister(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/v1/agent/service/deregister/")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	svc, ok := s.services[id]
+	if !ok {
+		http.Error(w, "unknown service id: "+id, http.StatusNotFound)
+		return
+	}
+	s.remove(svc)
+}
+
+// 开启或关闭实例维护模式，路径为 /v1/agent/service/maintenance/<id>?enable=true&reason=
+func (s *Server) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/v1/agent/service/maintenance/")
+	enable, err := strconv.ParseBool(r.URL.Query().Get("enable"))
+	if err != nil {
+		http.Error(w, "invalid enable: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	svc, ok := s.services[id]
+	if !ok {
+		http.Error(w, "unknown service id: "+id, http.StatusNotFound)
+		return
+	}
+	if svc.maintenance != enable {
+		svc.maintenance = enable
+		svc.maintenanceReason = r.URL.Query().Get("reason")
+		s.notify()
+	}
+}
+
+// 更新TTL检查状态，路径为 /v1/agent/check/pass|warn|fail/<checkId>
+func (s *Server) handleCheckUpdate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/v1/agent/check/"), "/", 2)
+	if len(parts) != 2 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	status, ok := map[string]string{"pass": StatusPassing, "warn": StatusWarning, "fail": StatusCritical}[parts[0]]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, svc := range s.services {
+		if svc.checkId != parts[1] {
+			continue
+		}
+		if svc.ttl <= 0 {
+			http.Error(w, "check "+parts[1]+" does not have associated TTL", http.StatusInternalServerError)
+			return
+		}
+		svc.ttlUpdated = time.Now()
+		s.setStatus(svc, status, r.URL.Query().Get("note"))
+		return
+	}
+	http.Error(w, "unknown check id: "+parts[1], http.StatusNotFound)
+}
+
+// 健康查询响应中的服务实例
+type healthService struct {
+	ID                string
+	Service           string
+	Tags              []string
+	Address           string
+	Port              int
+	Meta              map[string]string
+	EnableTagOverride bool
+	Weights           weights
+}
+
+type healthNode struct {
+	Node    string
+	Address string
+}
+
+type healthCheck struct {
+	Node        string
+	CheckID     string
+	Name        string
+	Status      string
+	Output      string
+	ServiceID   string
+	ServiceName string
+}
+
+type healthEntry struct {
+	Node    healthNode
+	Service healthService
+	Checks  []healthCheck
+}
+
+// 查询服务实例及健康状态，支持 passing、tag 过滤和阻塞查询
+func (s *Server) handleHealthService(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/v1/health/service/")
+	query := r.URL.Query()
+	_, passingOnly := query["passing"]
+	if v := query.Get("passing"); v == "false" || v == "0" {
+		passingOnly = false
+	}
+	index := s.block(r)
+	s.mu.Lock()
+	entries := make([]healthEntry, 0)
+	for _, svc := range s.matching(name, query["tag"]) {
+		if passingOnly && svc.effectiveStatus() != StatusPassing {
+			continue
+		}
+		reg := svc.registration
+		entry := healthEntry{
+			Node: healthNode{Node: NodeName, Address: "127.0.0.1"},
+			Service: healthService{
+				ID:                reg.ID,
+				Service:           reg.Name,
+				Tags:              reg.Tags,
+				Address:           reg.Address,
+				Port:              reg.Port,
+				Meta:              reg.Meta,
+				EnableTagOverride: reg.EnableTagOverride,
+				Weights:           serviceWeights(reg),
+			},
+			Checks: []healthCheck{{
+				Node:        NodeName,
+				CheckID:     svc.checkId,
+				Name:        "Service '" + reg.Name + "' check",
+				Status:      svc.status,
+				Output:      svc.output,
+				ServiceID:   reg.ID,
+				ServiceName: reg.Name,
+			}},
+		}
+		if svc.maintenance {
+			// 与consul一致，维护模式以单独的critical检查呈现
+			entry.Checks = append(entry.Checks, healthCheck{
+				Node:        NodeName,
+				CheckID:     "_service_maintenance:" + reg.ID,
+				Name:        "Service Maintenance Mode",
+				Status:      StatusCritical,
+				Output:      svc.maintenanceReason,
+				ServiceID:   reg.ID,
+				ServiceName: reg.Name,
+			})
+		}
+		entries = append(entries, entry)
+	}
+	s.mu.Unlock()
+	writeJSON(w, index, entries)
+}
+
+// 目录查询响应中的服务实例
+type catalogService struct {
+	Node                     string
+	Address                  string
+	ServiceID                string
+	ServiceName              string
+	ServiceTags              []string
+	ServiceAddress           string
+	ServicePort              int
+	ServiceMeta              map[string]string
+	ServiceWeights           weights
+	ServiceEnableTagOverride bool
+}
+
+// 查询服务目录，与consul一致，不区分健康状态
+func (s *Server) handleCatalogService(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/v1/catalog/service/")
+	index := s.block(r)
+	s.mu.Lock()
+	result := make([]catalogService, 0)
+	for _, svc := range s.matching(name, r.URL.Query()["tag"]) {
+		reg := svc.registration
+		result = append(result, catalogService{
+			Node:                     NodeName,
+			Address:                  "127.0.0.1",
+			ServiceID:                reg.ID,
+			ServiceName:              reg.Name,
+			ServiceTags:              reg.Tags,
+			ServiceAddress:           reg.Address,
+			ServicePort:              reg.Port,
+			ServiceMeta:              reg.Meta,
+			ServiceWeights:           serviceWeights(reg),
+			ServiceEnableTagOverride: reg.EnableTagOverride,
+		})
+	}
+	s.mu.Unlock()
+	writeJSON(w, index, result)
+}
+
+// 阻塞查询：请求的index不小于当前index时等待数据变化或超时，返回当前index
+func (s *Server) block(r *http.Request) uint64 {
+	index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	wait, err := parseDuration(r.URL.Query().Get("wait"))
+	if err != nil || wait <= 0 {
+		wait = 5 * time.Minute
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		s.mu.Lock()
+		current, changed := s.index, s.changed
+		s.mu.Unlock()
+		if index == 0 || current > index {
+			return current
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return current
+		case <-r.Context().Done():
+			return current
+		}
+	}
+}
+
+// 按服务名和标签过滤服务实例，调用方需持有锁
+func (s *Server) matching(name string, tags []string) []*service {
+	var result []*service
+	for _, svc := range s.services {
+		if svc.registration.Name != name || !hasTags(svc.registration.Tags, tags) {
+			continue
+		}
+		result = append(result, svc)
+	}
+	return result
+}
+
+// 主动HTTP健康检查，2xx为passing，429为warning，其余为critical
+func (s *Server) runHTTPCheck(ctx context.Context, id, url string, interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		status, output := s.checkHTTP(ctx, url, timeout)
+		if ctx.Err() != nil {
+			return
+		}
+		s.mu.Lock()
+		if svc, ok := s.services[id]; ok {
+			s.setStatus(svc, status, output)
+		}
+		s.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) checkHTTP(ctx context.Context, url string, timeout time.Duration) (string, string) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return StatusCritical, err.Error()
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return StatusCritical, err.Error()
+	}
+	resp.Body.Close()
+	output := "HTTP GET " + url + ": " + resp.Status
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return StatusPassing, output
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return StatusWarning, output
+	default:
+		return StatusCritical, output
+	}
+}
+
+// 定期检查TTL超时和需要自动注销的实例
+func (s *Server) reap() {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		s.mu.Lock()
+		for _, svc := range s.services {
+			if svc.ttl > 0 && svc.status != StatusCritical && now.Sub(svc.ttlUpdated) > svc.ttl {
+				s.setStatus(svc, StatusCritical, "TTL expired")
+			}
+			if svc.deregisterAfter > 0 && svc.status == StatusCritical && now.Sub(svc.criticalSince) > svc.deregisterAfter {
+				log.Printf("embedded registry deregister critical service %s", svc.registration.ID)
+				s.remove(svc)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// 更新实例状态，调用方需持有锁
+func (s *Server) setStatus(svc *service, status, output string) {
+	svc.output = output
+	if svc.status == status {
+		return
+	}
+	if status == StatusCritical {
+		svc.criticalSince = time.Now()
+	}
+	svc.status = status
+	s.notify()
+}
+
+// 移除实例，调用方需持有锁
+func (s *Server) remove(svc *service) {
+	if svc.stop != nil {
+		svc.stop()
+	}
+	delete(s.services, svc.registration.ID)
+	s.notify()
+}
+
+// 通知阻塞查询数据已变化，调用方需持有锁
+func (s *Server) notify() {
+	s.index++
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func serviceWeights(reg serviceRegistration) weights {
+	if reg.Weights != nil {
+		return *reg.Weights
+	}
+	return weights{Passing: 1, Warning: 1}
+}
+
+func hasTags(serviceTags, tags []string) bool {
+	for _, tag := range tags {
+		found := false
+		for _, t := range serviceTags {
+			if t == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func parseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(s)
+}
+
+func writeJSON(w http.ResponseWriter, index uint64, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,193 @@
+package registryserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yunfeiyang1916/micro-go-course/register/discovery"
+)
+
+// 使用服务发现客户端对嵌入式注册中心进行集成测试
+func newTestClient(t *testing.T) (*discovery.DiscoveryClient, *httptest.Server, func()) {
+	s := NewServer()
+	server := httptest.NewServer(s)
+	u, _ := url.Parse(server.URL)
+	port, _ := strconv.Atoi(u.Port())
+	client := discovery.NewDiscoveryClient(u.Hostname(), port)
+	return client, server, func() {
+		s.Close()
+		server.Close()
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func discoverCount(client *discovery.DiscoveryClient, serviceName string) func() bool {
+	return func() bool {
+		instances, err := client.DiscoverServices(context.Background(), serviceName)
+		return err == nil && len(instances) == 1
+	}
+}
+
+func TestHTTPCheck(t *testing.T) {
+	client, _, closeAll := newTestClient(t)
+	defer closeAll()
+
+	var healthy int32 = 1
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer backend.Close()
+	u, _ := url.Parse(backend.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	err := client.RegisterInstance(context.Background(), &discovery.InstanceInfo{
+		ID:      "comments-1",
+		Name:    "comments",
+		Address: u.Hostname(),
+		Port:    port,
+		Tags:    []string{"v1"},
+		Check: discovery.Check{
+			HTTP:     backend.URL + "/health",
+			Interval: "50ms",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, discoverCount(client, "comments"))
+
+	instances, _ := client.DiscoverServices(context.Background(), "comments")
+	if instances[0].Port != port || instances[0].Tags[0] != "v1" {
+		t.Fatalf("unexpected instance %+v", instances[0])
+	}
+
+	// 健康检查失败后不再返回该实例
+	atomic.StoreInt32(&healthy, 0)
+	waitFor(t, func() bool {
+		instances, err := client.DiscoverServices(context.Background(), "comments")
+		return err == nil && len(instances) == 0
+	})
+
+	if err = client.Deregister(context.Background(), "comments-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = client.Deregister(context.Background(), "comments-1"); err == nil {
+		t.Fatal("expected deregister unknown instance to fail")
+	}
+}
+
+func TestTTLCheckAndCatalog(t *testing.T) {
+	client, server, closeAll := newTestClient(t)
+	defer closeAll()
+
+	registration := &discovery.TTLRegistration{
+		ServiceName:  "register",
+		InstanceId:   "register-1",
+		InstanceHost: "127.0.0.1",
+		InstancePort: 12312,
+		TTL:          200 * time.Millisecond,
+	}
+	if err := client.RegisterTTL(context.Background(), registration); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	reporter := discovery.HealthReporterFunc(func() (string, string) {
+		return discovery.HealthPassing, ""
+	})
+	go client.RunHeartbeat(ctx, registration, reporter)
+	waitFor(t, discoverCount(client, "register"))
+
+	// 目录查询不区分健康状态
+	resp, err := http.Get(server.URL + "/v1/catalog/service/register")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var catalog []catalogService
+	json.NewDecoder(resp.Body).Decode(&catalog)
+	resp.Body.Close()
+	if len(catalog) != 1 || catalog[0].ServicePort != 12312 || catalog[0].ServiceID != "register-1" {
+		t.Fatalf("unexpected catalog %+v", catalog)
+	}
+
+	// 停止心跳后TTL超时
+	cancel()
+	waitFor(t, func() bool {
+		instances, err := client.DiscoverServices(context.Background(), "register")
+		return err == nil && len(instances) == 0
+	})
+}
+
+func TestWatch(t *testing.T) {
+	client, _, closeAll := newTestClient(t)
+	defer closeAll()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := client.Watch(ctx, "goods")
+	select {
+	case instances := <-ch:
+		if len(instances) != 0 {
+			t.Fatalf("expected no instances, got %v", instances)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for watch")
+	}
+	err := client.RegisterInstance(context.Background(), &discovery.InstanceInfo{ID: "goods-1", Name: "goods", Address: "127.0.0.1", Port: 10086})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case instances := <-ch:
+		if len(instances) != 1 {
+			t.Fatalf("expected 1 instance, got %v", instances)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for watch")
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	client, _, closeAll := newTestClient(t)
+	defer closeAll()
+
+	err := client.RegisterInstance(context.Background(), &discovery.InstanceInfo{ID: "user-1", Name: "user", Address: "127.0.0.1", Port: 10086})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, discoverCount(client, "user"))
+
+	if err = client.EnableMaintenance(context.Background(), "user-1", true, "draining"); err != nil {
+		t.Fatal(err)
+	}
+	instances, err := client.DiscoverServices(context.Background(), "user")
+	if err != nil || len(instances) != 0 {
+		t.Fatalf("expected no passing instances in maintenance, got %v %v", instances, err)
+	}
+
+	if err = client.EnableMaintenance(context.Background(), "user-1", false, ""); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, discoverCount(client, "user"))
+
+	if err = client.EnableMaintenance(context.Background(), "unknown", true, ""); err == nil {
+		t.Fatal("expected maintenance unknown instance to fail")
+	}
+}
@@ -2,42 +2,234 @@ package service
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
-	"github.com/yunfeiyang1916/micro-go-course/register/discovery"
+	"hash/fnv"
 	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/yunfeiyang1916/micro-go-course/loadbalancer"
+	"github.com/yunfeiyang1916/micro-go-course/register/client"
+	"github.com/yunfeiyang1916/micro-go-course/register/discovery"
+	"github.com/yunfeiyang1916/micro-go-course/register/registry"
 )
 
 type Service interface {
 	HealthCheck() string
 
-	DiscoveryService(ctx context.Context, serviceName string) ([]*discovery.InstanceInfo, error)
+	// 查询服务实例，filter为nil时返回所有健康实例
+	DiscoveryService(ctx context.Context, serviceName string, filter *Filter) ([]*discovery.InstanceInfo, error)
+
+	// 使用负载均衡从符合条件的实例中选择一个，key不为空时使用一致性哈希
+	SelectService(ctx context.Context, serviceName string, filter *Filter, key string) (*discovery.InstanceInfo, error)
+
+	// 长轮询查询服务实例，index与当前结果版本相同时等待变化，最多等待wait，返回结果及其版本
+	WatchService(ctx context.Context, serviceName string, filter *Filter, index uint64, wait time.Duration) ([]*discovery.InstanceInfo, uint64, error)
+}
+
+var (
+	ErrNotServiceInstances = errors.New("instances are not existed")
+	ErrNoAvailableInstance = errors.New("no available instance matches the filter")
+)
+
+// 访问注册中心出错，如consul不可用，与服务不存在区分开
+type RegistryError struct {
+	Err error
 }
 
-var ErrNotServiceInstances = errors.New("instances are not existed")
+func (e *RegistryError) Error() string {
+	return "registry unavailable: " + e.Err.Error()
+}
+
+func (e *RegistryError) Unwrap() error {
+	return e.Err
+}
+
+// 健康状态过滤条件
+const (
+	HealthPassing = discovery.HealthPassing
+	HealthWarning = discovery.HealthWarning
+	// 返回任意状态的实例
+	HealthAny = "any"
+)
+
+// 服务实例过滤条件
+type Filter struct {
+	// 实例需包含全部标签
+	Tags []string
+	// 实例元数据需匹配全部键值
+	Meta map[string]string
+	// 健康状态，passing只返回健康实例，warning返回健康和警告实例，any返回全部实例，默认passing
+	Health string
+}
+
+// 判断实例是否符合过滤条件
+func (filter *Filter) match(instance *discovery.InstanceInfo) bool {
+	if filter == nil {
+		return isHealthy(instance, HealthPassing)
+	}
+	if !isHealthy(instance, filter.Health) {
+		return false
+	}
+	for _, tag := range filter.Tags {
+		found := false
+		for _, t := range instance.Tags {
+			if t == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for k, v := range filter.Meta {
+		if instance.Meta[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// 未填充健康状态的注册中心（如内存、静态文件）视为健康
+func isHealthy(instance *discovery.InstanceInfo, health string) bool {
+	status := instance.Status
+	if status == "" {
+		status = HealthPassing
+	}
+	switch health {
+	case HealthAny:
+		return true
+	case HealthWarning:
+		return status == HealthPassing || status == HealthWarning
+	default:
+		return status == HealthPassing
+	}
+}
 
 type RegisterServiceImpl struct {
-	discoveryClient *discovery.DiscoveryClient
+	registry registry.Registry
+	// 负载均衡器
+	lb     loadbalancer.LoadBalancer
+	hashLb loadbalancer.LoadBalancer
+	// 以服务名、实例地址为键的权重平滑负载均衡当前权重
+	curWeights map[string]map[string]int
+	mu         sync.Mutex
 }
 
-func NewRegisterServiceImpl(discoveryClient *discovery.DiscoveryClient) Service {
+func NewRegisterServiceImpl(registry registry.Registry) Service {
 	return &RegisterServiceImpl{
-		discoveryClient: discoveryClient,
+		registry:   registry,
+		lb:         &loadbalancer.WeightRoundRobinLoadBalancer{},
+		hashLb:     &loadbalancer.HashLoadBalancer{},
+		curWeights: make(map[string]map[string]int),
 	}
 }
 
-func (service *RegisterServiceImpl) DiscoveryService(ctx context.Context, serviceName string) ([]*discovery.InstanceInfo, error) {
+func (service *RegisterServiceImpl) DiscoveryService(ctx context.Context, serviceName string, filter *Filter) ([]*discovery.InstanceInfo, error) {
 
-	instances, err := service.discoveryClient.DiscoverServices(ctx, serviceName)
+	instances, err := service.registry.Discover(ctx, serviceName)
 
 	if err != nil {
 		log.Printf("get service info err: %s", err)
+		return nil, &RegistryError{Err: err}
 	}
-	if instances == nil || len(instances) == 0 {
+	if len(instances) == 0 {
 		return nil, ErrNotServiceInstances
 	}
-	return instances, nil
+	return filterInstances(instances, filter), nil
+}
+
+func (service *RegisterServiceImpl) SelectService(ctx context.Context, serviceName string, filter *Filter, key string) (*discovery.InstanceInfo, error) {
+	instances, err := service.DiscoveryService(ctx, serviceName, filter)
+	if err != nil {
+		return nil, err
+	}
+	if len(instances) == 0 {
+		return nil, ErrNoAvailableInstance
+	}
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	lbInstances := make([]*loadbalancer.InstanceInfo, len(instances))
+	byAddress := make(map[string]*discovery.InstanceInfo, len(instances))
+	for i, instance := range instances {
+		info := client.ToInstanceInfo(instance)
+		info.CurWeight = service.curWeights[serviceName][info.Address]
+		lbInstances[i] = info
+		byAddress[info.Address] = instance
+	}
+	var selected *loadbalancer.InstanceInfo
+	if key != "" {
+		selected, err = service.hashLb.SelectServiceByKey(lbInstances, key)
+	} else {
+		selected, err = service.lb.SelectService(lbInstances)
+		// 只保留本次参与选择的实例，已下线的实例不再占用内存
+		curWeights := make(map[string]int, len(lbInstances))
+		for _, info := range lbInstances {
+			curWeights[info.Address] = info.CurWeight
+		}
+		service.curWeights[serviceName] = curWeights
+	}
+	if err != nil {
+		return nil, err
+	}
+	if selected == nil {
+		return nil, ErrNoAvailableInstance
+	}
+	return byAddress[selected.Address], nil
+}
+
+func (service *RegisterServiceImpl) WatchService(ctx context.Context, serviceName string, filter *Filter, index uint64, wait time.Duration) ([]*discovery.InstanceInfo, uint64, error) {
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+	var instances []*discovery.InstanceInfo
+	var current uint64
+	for instances = range service.registry.Watch(ctx, serviceName) {
+		if index == 0 && len(instances) == 0 {
+			return nil, 0, ErrNotServiceInstances
+		}
+		instances = filterInstances(instances, filter)
+		current = version(instances)
+		if index == 0 || current != index {
+			return instances, current, nil
+		}
+	}
+	// 等待超时，返回当前结果
+	if instances == nil {
+		var err error
+		instances, err = service.DiscoveryService(context.Background(), serviceName, filter)
+		if err != nil {
+			return nil, 0, err
+		}
+		current = version(instances)
+	}
+	return instances, current, nil
 }
 
 func (*RegisterServiceImpl) HealthCheck() string {
 	return "OK"
 }
+
+func filterInstances(instances []*discovery.InstanceInfo, filter *Filter) []*discovery.InstanceInfo {
+	result := make([]*discovery.InstanceInfo, 0, len(instances))
+	for _, instance := range instances {
+		if filter.match(instance) {
+			result = append(result, instance)
+		}
+	}
+	return result
+}
+
+// 实例列表的版本号，列表内容变化时版本号随之变化，与实例顺序无关
+func version(instances []*discovery.InstanceInfo) uint64 {
+	sorted := make([]*discovery.InstanceInfo, len(instances))
+	copy(sorted, instances)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].ID < sorted[j].ID
+	})
+	h := fnv.New64a()
+	json.NewEncoder(h).Encode(sorted)
+	return h.Sum64()
+}
@@ -0,0 +1,135 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/yunfeiyang1916/micro-go-course/register/discovery"
+	"github.com/yunfeiyang1916/micro-go-course/register/registry"
+)
+
+func newTestService(t *testing.T) (Service, registry.Registry) {
+	r := registry.NewMemoryRegistry()
+	instances := []*discovery.InstanceInfo{
+		{ID: "comments-a", Name: "comments", Address: "10.0.0.1", Port: 10087, Tags: []string{"v1"}, Meta: map[string]string{"zone": "a"}},
+		{ID: "comments-b", Name: "comments", Address: "10.0.0.2", Port: 10087, Tags: []string{"v2"}, Meta: map[string]string{"zone": "b"}, Status: discovery.HealthWarning},
+		{ID: "comments-c", Name: "comments", Address: "10.0.0.3", Port: 10087, Tags: []string{"v1"}, Meta: map[string]string{"zone": "b"}, Status: discovery.HealthCritical},
+	}
+	for _, instance := range instances {
+		if err := r.Register(context.Background(), instance); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return NewRegisterServiceImpl(r), r
+}
+
+func ids(instances []*discovery.InstanceInfo) string {
+	s := ""
+	for _, instance := range instances {
+		s += instance.ID + ","
+	}
+	return s
+}
+
+func TestDiscoveryServiceFilter(t *testing.T) {
+	svc, _ := newTestService(t)
+	ctx := context.Background()
+	cases := []struct {
+		filter   *Filter
+		expected int
+	}{
+		{nil, 1},
+		{&Filter{Health: HealthWarning}, 2},
+		{&Filter{Health: HealthAny}, 3},
+		{&Filter{Health: HealthAny, Tags: []string{"v1"}}, 2},
+		{&Filter{Health: HealthAny, Meta: map[string]string{"zone": "b"}}, 2},
+		{&Filter{Health: HealthWarning, Meta: map[string]string{"zone": "b"}}, 1},
+		{&Filter{Tags: []string{"v3"}}, 0},
+	}
+	for i, c := range cases {
+		instances, err := svc.DiscoveryService(ctx, "comments", c.filter)
+		if err != nil || len(instances) != c.expected {
+			t.Fatalf("case %d: expected %d instances, got %s %v", i, c.expected, ids(instances), err)
+		}
+	}
+	if _, err := svc.DiscoveryService(ctx, "unknown", nil); err != ErrNotServiceInstances {
+		t.Fatalf("expected %v, got %v", ErrNotServiceInstances, err)
+	}
+}
+
+// 不可用的注册中心
+type unavailableRegistry struct {
+	registry.Registry
+}
+
+func (unavailableRegistry) Discover(ctx context.Context, serviceName string) ([]*discovery.InstanceInfo, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestDiscoveryServiceRegistryError(t *testing.T) {
+	svc := NewRegisterServiceImpl(unavailableRegistry{})
+	_, err := svc.DiscoveryService(context.Background(), "comments", nil)
+	var registryErr *RegistryError
+	if !errors.As(err, &registryErr) || err == ErrNotServiceInstances {
+		t.Fatalf("expected registry error, got %v", err)
+	}
+}
+
+func TestSelectService(t *testing.T) {
+	svc, _ := newTestService(t)
+	ctx := context.Background()
+	filter := &Filter{Health: HealthWarning}
+	seen := make(map[string]int)
+	for i := 0; i < 10; i++ {
+		instance, err := svc.SelectService(ctx, "comments", filter, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[instance.ID]++
+	}
+	// 平滑加权轮询在等权重时交替选择
+	if seen["comments-a"] != 5 || seen["comments-b"] != 5 {
+		t.Fatalf("expected round robin, got %v", seen)
+	}
+	first, _ := svc.SelectService(ctx, "comments", filter, "user-1")
+	for i := 0; i < 5; i++ {
+		instance, _ := svc.SelectService(ctx, "comments", filter, "user-1")
+		if instance.ID != first.ID {
+			t.Fatalf("expected same instance for same key, got %s and %s", first.ID, instance.ID)
+		}
+	}
+	if _, err := svc.SelectService(ctx, "comments", &Filter{Tags: []string{"v3"}}, ""); err != ErrNoAvailableInstance {
+		t.Fatalf("expected %v, got %v", ErrNoAvailableInstance, err)
+	}
+	// 下线实例的当前权重被清理
+	svc.SelectService(ctx, "comments", nil, "")
+	if weights := svc.(*RegisterServiceImpl).curWeights["comments"]; len(weights) != 1 {
+		t.Fatalf("expected weights of removed instances pruned, got %v", weights)
+	}
+}
+
+func TestWatchService(t *testing.T) {
+	svc, r := newTestService(t)
+	ctx := context.Background()
+	instances, index, err := svc.WatchService(ctx, "comments", nil, 0, time.Second)
+	if err != nil || len(instances) != 1 || index == 0 {
+		t.Fatalf("unexpected watch result %s %d %v", ids(instances), index, err)
+	}
+
+	// 版本号未变化时等待超时后返回原结果
+	_, same, err := svc.WatchService(ctx, "comments", nil, index, 50*time.Millisecond)
+	if err != nil || same != index {
+		t.Fatalf("expected index %d, got %d %v", index, same, err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		r.Register(context.Background(), &discovery.InstanceInfo{ID: "comments-d", Name: "comments", Address: "10.0.0.4", Port: 10087})
+	}()
+	instances, changed, err := svc.WatchService(ctx, "comments", nil, index, 3*time.Second)
+	if err != nil || len(instances) != 2 || changed == index {
+		t.Fatalf("expected change, got %s %d %v", ids(instances), changed, err)
+	}
+}
@@ -8,17 +8,27 @@ import (
 	"github.com/go-kit/kit/transport"
 	kithttp "github.com/go-kit/kit/transport/http"
 	"github.com/gorilla/mux"
+	"github.com/openzipkin/zipkin-go"
+	"github.com/yunfeiyang1916/micro-go-course/instrument"
 	"github.com/yunfeiyang1916/micro-go-course/register/endpoint"
+	"github.com/yunfeiyang1916/micro-go-course/register/service"
+	"github.com/yunfeiyang1916/micro-go-course/tracing"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 var (
 	ErrorBadRequest = errors.New("invalid request parameter")
 )
 
+// 长轮询最长等待时间
+const maxWait = 10 * time.Minute
+
 // MakeHttpHandler make http handler use mux
-func MakeHttpHandler(ctx context.Context, endpoints *endpoint.RegisterEndpoints) http.Handler {
+func MakeHttpHandler(ctx context.Context, endpoints *endpoint.RegisterEndpoints, tracer *zipkin.Tracer) http.Handler {
 	r := mux.NewRouter()
 
 	kitLog := log.NewLogfmtLogger(os.Stderr)
@@ -26,9 +36,11 @@ func MakeHttpHandler(ctx context.Context, endpoints *endpoint.RegisterEndpoints)
 	kitLog = log.With(kitLog, "ts", log.DefaultTimestampUTC)
 	kitLog = log.With(kitLog, "caller", log.DefaultCaller)
 
+	instrument.WrapRouter(r, "register")
 	options := []kithttp.ServerOption{
 		kithttp.ServerErrorHandler(transport.NewLogErrorHandler(kitLog)),
 		kithttp.ServerErrorEncoder(encodeError),
+		tracing.HTTPServerTrace(tracer),
 	}
 
 	r.Methods("GET").Path("/health").Handler(kithttp.NewServer(
@@ -47,14 +59,64 @@ func MakeHttpHandler(ctx context.Context, endpoints *endpoint.RegisterEndpoints)
 	return r
 }
 func decodeDiscoveryRequest(ctx context.Context, r *http.Request) (interface{}, error) {
-	serviceName := r.URL.Query().Get("serviceName")
+	query := r.URL.Query()
+	serviceName := query.Get("serviceName")
 
 	if serviceName == "" {
 		return nil, ErrorBadRequest
 	}
-	return endpoint.DiscoveryRequest{
+	filter := &service.Filter{
+		Tags:   query["tag"],
+		Health: query.Get("health"),
+	}
+	switch filter.Health {
+	case "", service.HealthPassing, service.HealthWarning, service.HealthAny:
+	default:
+		return nil, ErrorBadRequest
+	}
+	// 元数据过滤格式为 meta=key:value，可重复
+	for _, meta := range query["meta"] {
+		kv := strings.SplitN(meta, ":", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, ErrorBadRequest
+		}
+		if filter.Meta == nil {
+			filter.Meta = make(map[string]string)
+		}
+		filter.Meta[kv[0]] = kv[1]
+	}
+	req := endpoint.DiscoveryRequest{
 		ServiceName: serviceName,
-	}, nil
+		Filter:      filter,
+		Key:         query.Get("key"),
+	}
+	if pick := query.Get("pick"); pick != "" {
+		var err error
+		if req.Pick, err = strconv.ParseBool(pick); err != nil {
+			return nil, ErrorBadRequest
+		}
+	}
+	if index := query.Get("index"); index != "" {
+		var err error
+		if req.Index, err = strconv.ParseUint(index, 10, 64); err != nil {
+			return nil, ErrorBadRequest
+		}
+		// 指定版本号但未指定等待时间时默认等待5分钟
+		req.Wait = 5 * time.Minute
+	}
+	if wait := query.Get("wait"); wait != "" {
+		var err error
+		if req.Wait, err = time.ParseDuration(wait); err != nil || req.Wait < 0 {
+			return nil, ErrorBadRequest
+		}
+	}
+	if req.Wait > maxWait {
+		req.Wait = maxWait
+	}
+	if req.Pick && req.Wait > 0 {
+		return nil, ErrorBadRequest
+	}
+	return req, nil
 }
 
 func decodeHealthCheckRequest(ctx context.Context, r *http.Request) (interface{}, error) {
@@ -68,11 +130,19 @@ func encodeJSONResponse(ctx context.Context, w http.ResponseWriter, response int
 
 func encodeError(_ context.Context, err error, w http.ResponseWriter) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	switch err {
+	var registryErr *service.RegistryError
+	switch {
+	case err == ErrorBadRequest:
+		w.WriteHeader(http.StatusBadRequest)
+	case err == service.ErrNotServiceInstances:
+		// 只有注册中心正常返回空结果时才是服务不存在
+		w.WriteHeader(http.StatusNotFound)
+	case err == service.ErrNoAvailableInstance, errors.As(err, &registryErr):
+		w.WriteHeader(http.StatusServiceUnavailable)
 	default:
 		w.WriteHeader(http.StatusInternalServerError)
 	}
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"error": err.Error(),
+	json.NewEncoder(w).Encode(&endpoint.DiscoveryResponse{
+		Error: err.Error(),
 	})
 }
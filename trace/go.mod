@@ -1,8 +0,0 @@
-module github.com/yunfeiyang1916/micro-go-course/trace
-
-go 1.14
-
-require (
-    github.com/openzipkin/zipkin-go v0.2.5 // indirect
-    github.com/go-kit/kit v0.10.0
-)
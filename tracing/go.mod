@@ -0,0 +1,9 @@
+module github.com/yunfeiyang1916/micro-go-course/tracing
+
+go 1.14
+
+require (
+	github.com/afex/hystrix-go v0.0.0-20180502004556-fa1af6a1f4f5
+	github.com/go-kit/kit v0.10.0
+	github.com/openzipkin/zipkin-go v0.2.2
+)
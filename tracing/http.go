@@ -0,0 +1,12 @@
+package tracing
+
+import (
+	kitzipkin "github.com/go-kit/kit/tracing/zipkin"
+	kithttp "github.com/go-kit/kit/transport/http"
+	"github.com/openzipkin/zipkin-go"
+)
+
+// go-kit HTTP服务端的追踪选项：从请求头中提取追踪上下文，创建服务端span，需加入每个kithttp.Server的选项
+func HTTPServerTrace(tracer *zipkin.Tracer) kithttp.ServerOption {
+	return kitzipkin.HTTPServerTrace(tracer)
+}
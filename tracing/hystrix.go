@@ -0,0 +1,27 @@
+package tracing
+
+import (
+	"context"
+
+	"github.com/afex/hystrix-go/hystrix"
+	"github.com/openzipkin/zipkin-go"
+)
+
+// 执行熔断器命令，命令记录为ctx中span的子span，
+// run和fallback收到的ctx携带该span，使用带追踪的transport调用其他服务时传递追踪上下文
+func Do(ctx context.Context, tracer *zipkin.Tracer, name string, run func(ctx context.Context) error, fallback func(ctx context.Context, err error) error) error {
+	span, ctx := tracer.StartSpanFromContext(ctx, name)
+	defer span.Finish()
+	err := hystrix.DoC(ctx, name, run, func(ctx context.Context, err error) error {
+		// 熔断、超时或run返回错误时执行降级
+		span.Tag("hystrix.fallback", err.Error())
+		if fallback == nil {
+			return err
+		}
+		return fallback(ctx, err)
+	})
+	if err != nil {
+		zipkin.TagError.Set(span, err.Error())
+	}
+	return err
+}
@@ -0,0 +1,267 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/openzipkin/zipkin-go/model"
+)
+
+// 以OTLP/HTTP JSON格式批量上报span，兼容OpenTelemetry Collector的 /v1/traces 接口
+type otlpReporter struct {
+	url       string
+	client    *http.Client
+	interval  time.Duration
+	batchSize int
+	spans     chan *model.SpanModel
+	quit      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	logger    *log.Logger
+}
+
+// 每隔interval或积累batchSize个span时上报一次
+func newOTLPReporter(url string, interval time.Duration, batchSize int) *otlpReporter {
+	r := &otlpReporter{
+		url:       url,
+		client:    &http.Client{Timeout: 5 * time.Second},
+		interval:  interval,
+		batchSize: batchSize,
+		spans:     make(chan *model.SpanModel, 1000),
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+		logger:    log.New(os.Stderr, "", log.LstdFlags),
+	}
+	go r.loop()
+	return r
+}
+
+// 队列已满时丢弃span，不阻塞请求
+func (r *otlpReporter) Send(s model.SpanModel) {
+	select {
+	case r.spans <- &s:
+	default:
+	}
+}
+
+// 上报剩余的span
+func (r *otlpReporter) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.quit)
+		<-r.done
+	})
+	return nil
+}
+
+func (r *otlpReporter) loop() {
+	defer close(r.done)
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	var batch []*model.SpanModel
+	for {
+		select {
+		case s := <-r.spans:
+			if batch = append(batch, s); len(batch) >= r.batchSize {
+				r.flush(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			r.flush(batch)
+			batch = nil
+		case <-r.quit:
+			for {
+				select {
+				case s := <-r.spans:
+					batch = append(batch, s)
+				default:
+					r.flush(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (r *otlpReporter) flush(batch []*model.SpanModel) {
+	if len(batch) == 0 {
+		return
+	}
+	body, err := json.Marshal(otlpRequestOf(batch))
+	if err != nil {
+		r.logger.Printf("failed to encode spans: %s", err)
+		return
+	}
+	resp, err := r.client.Post(r.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		r.logger.Printf("failed to send spans: %s", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		r.logger.Printf("failed to send spans: status %d", resp.StatusCode)
+	}
+}
+
+// OTLP/HTTP JSON请求，字段按protobuf的JSON映射命名，id为十六进制，时间为纳秒字符串
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Events            []otlpEvent    `json:"events,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string `json:"timeUnixNano"`
+	Name         string `json:"name"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// span类型及状态码
+const (
+	otlpKindInternal = 1
+	otlpKindServer   = 2
+	otlpKindClient   = 3
+	otlpKindProducer = 4
+	otlpKindConsumer = 5
+
+	otlpStatusError = 2
+)
+
+// 按服务名分组转换span
+func otlpRequestOf(batch []*model.SpanModel) *otlpRequest {
+	req := &otlpRequest{}
+	services := make(map[string]int)
+	for _, s := range batch {
+		service := ""
+		if s.LocalEndpoint != nil {
+			service = s.LocalEndpoint.ServiceName
+		}
+		i, ok := services[service]
+		if !ok {
+			i = len(req.ResourceSpans)
+			services[service] = i
+			req.ResourceSpans = append(req.ResourceSpans, otlpResourceSpans{
+				Resource: otlpResource{Attributes: []otlpKeyValue{attribute("service.name", service)}},
+				ScopeSpans: []otlpScopeSpans{{
+					Scope: otlpScope{Name: "github.com/yunfeiyang1916/micro-go-course/tracing"},
+				}},
+			})
+		}
+		scope := &req.ResourceSpans[i].ScopeSpans[0]
+		scope.Spans = append(scope.Spans, otlpSpanOf(s))
+	}
+	return req
+}
+
+func otlpSpanOf(s *model.SpanModel) otlpSpan {
+	start := s.Timestamp.UnixNano()
+	span := otlpSpan{
+		TraceID:           fmt.Sprintf("%016x%016x", s.TraceID.High, s.TraceID.Low),
+		SpanID:            fmt.Sprintf("%016x", uint64(s.ID)),
+		Name:              s.Name,
+		Kind:              otlpKindOf(s.Kind),
+		StartTimeUnixNano: strconv.FormatInt(start, 10),
+		EndTimeUnixNano:   strconv.FormatInt(start+int64(s.Duration), 10),
+	}
+	if s.ParentID != nil {
+		span.ParentSpanID = fmt.Sprintf("%016x", uint64(*s.ParentID))
+	}
+	keys := make([]string, 0, len(s.Tags))
+	for k := range s.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		span.Attributes = append(span.Attributes, attribute(k, s.Tags[k]))
+	}
+	if v, ok := s.Tags["error"]; ok {
+		span.Status = otlpStatus{Code: otlpStatusError, Message: v}
+	}
+	if e := s.RemoteEndpoint; e != nil {
+		if e.ServiceName != "" {
+			span.Attributes = append(span.Attributes, attribute("peer.service", e.ServiceName))
+		}
+		if ip := e.IPv4; ip != nil {
+			span.Attributes = append(span.Attributes, attribute("net.peer.ip", ip.String()))
+		} else if ip := e.IPv6; ip != nil {
+			span.Attributes = append(span.Attributes, attribute("net.peer.ip", ip.String()))
+		}
+		if e.Port != 0 {
+			span.Attributes = append(span.Attributes, attribute("net.peer.port", strconv.Itoa(int(e.Port))))
+		}
+	}
+	for _, a := range s.Annotations {
+		span.Events = append(span.Events, otlpEvent{
+			TimeUnixNano: strconv.FormatInt(a.Timestamp.UnixNano(), 10),
+			Name:         a.Value,
+		})
+	}
+	return span
+}
+
+func otlpKindOf(kind model.Kind) int {
+	switch kind {
+	case model.Server:
+		return otlpKindServer
+	case model.Client:
+		return otlpKindClient
+	case model.Producer:
+		return otlpKindProducer
+	case model.Consumer:
+		return otlpKindConsumer
+	}
+	return otlpKindInternal
+}
+
+func attribute(key, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpValue{StringValue: value}}
+}
@@ -0,0 +1,134 @@
+package tracing
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/openzipkin/zipkin-go"
+	"github.com/openzipkin/zipkin-go/reporter"
+	zipkinhttp "github.com/openzipkin/zipkin-go/reporter/http"
+)
+
+// 追踪数据的上报方式
+const (
+	// 只传播追踪上下文，不上报
+	ExporterNone = "none"
+	// 以zipkin v2格式上报到zipkin
+	ExporterZipkin = "zipkin"
+	// 以OTLP/HTTP JSON格式上报到OpenTelemetry Collector
+	ExporterOTLP = "otlp"
+)
+
+// 追踪配置
+type Config struct {
+	// 上报的服务名
+	ServiceName string
+	// 本地端点，host:port，只指定端口时使用localhost
+	HostPort string
+	// 上报方式
+	Exporter string
+	// zipkin span上报地址
+	ZipkinURL string
+	// OTLP/HTTP traces接口地址
+	OTLPURL string
+	// 新建追踪的采样率，0到1之间，请求已携带采样决定时沿用上游的决定
+	SampleRate float64
+}
+
+// 默认只传播追踪上下文，全部采样
+func DefaultConfig(serviceName, hostPort string) *Config {
+	return &Config{
+		ServiceName: serviceName,
+		HostPort:    hostPort,
+		Exporter:    ExporterNone,
+		ZipkinURL:   "http://127.0.0.1:9411/api/v2/spans",
+		OTLPURL:     "http://127.0.0.1:4318/v1/traces",
+		SampleRate:  1,
+	}
+}
+
+// 注册上报方式及采样率的命令行参数
+func (c *Config) BindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Exporter, "tracing.exporter", c.Exporter, "tracing exporter: none, zipkin or otlp")
+	fs.StringVar(&c.ZipkinURL, "zipkin.url", c.ZipkinURL, "Zipkin server url")
+	fs.StringVar(&c.OTLPURL, "otlp.url", c.OTLPURL, "OTLP/HTTP traces endpoint of OpenTelemetry Collector")
+	fs.Float64Var(&c.SampleRate, "tracing.sample.rate", c.SampleRate, "ratio of new traces to sample, between 0 and 1")
+}
+
+// 校验配置
+func (c *Config) Validate() error {
+	if c.ServiceName == "" {
+		return fmt.Errorf("tracing requires service name")
+	}
+	switch c.Exporter {
+	case ExporterNone:
+	case ExporterZipkin:
+		if c.ZipkinURL == "" {
+			return fmt.Errorf("tracing exporter zipkin requires zipkin url")
+		}
+	case ExporterOTLP:
+		if c.OTLPURL == "" {
+			return fmt.Errorf("tracing exporter otlp requires otlp url")
+		}
+	default:
+		return fmt.Errorf("unknown tracing exporter %s", c.Exporter)
+	}
+	if c.SampleRate < 0 || c.SampleRate > 1 {
+		return fmt.Errorf("tracing sample rate %v out of range [0, 1]", c.SampleRate)
+	}
+	return nil
+}
+
+// 创建追踪器，返回的函数用于上报剩余的span
+func New(config *Config) (*zipkin.Tracer, func(), error) {
+	if err := config.Validate(); err != nil {
+		return nil, nil, err
+	}
+	// 只指定端口的监听地址使用localhost作为本地端点
+	hostPort := config.HostPort
+	if host, port, err := net.SplitHostPort(hostPort); err == nil && host == "" {
+		hostPort = net.JoinHostPort("localhost", port)
+	}
+	endpoint, err := zipkin.NewEndpoint(config.ServiceName, hostPort)
+	if err != nil {
+		return nil, nil, err
+	}
+	sampler, err := newSampler(config.SampleRate)
+	if err != nil {
+		return nil, nil, err
+	}
+	var rep reporter.Reporter
+	switch config.Exporter {
+	case ExporterZipkin:
+		rep = zipkinhttp.NewReporter(config.ZipkinURL)
+	case ExporterOTLP:
+		rep = newOTLPReporter(config.OTLPURL, time.Second, 100)
+	default:
+		rep = reporter.NewNoopReporter()
+	}
+	tracer, err := zipkin.NewTracer(rep,
+		zipkin.WithLocalEndpoint(endpoint),
+		zipkin.WithSampler(sampler),
+		// OpenTelemetry不支持客户端和服务端共用span id，服务端创建子span
+		zipkin.WithSharedSpans(config.Exporter != ExporterOTLP),
+	)
+	if err != nil {
+		rep.Close()
+		return nil, nil, err
+	}
+	return tracer, func() {
+		rep.Close()
+	}, nil
+}
+
+func newSampler(rate float64) (zipkin.Sampler, error) {
+	switch {
+	case rate >= 1:
+		return zipkin.AlwaysSample, nil
+	case rate <= 0:
+		return zipkin.NeverSample, nil
+	}
+	return zipkin.NewBoundarySampler(rate, time.Now().UnixNano())
+}
@@ -0,0 +1,191 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	kithttp "github.com/go-kit/kit/transport/http"
+	"github.com/openzipkin/zipkin-go"
+	"github.com/openzipkin/zipkin-go/model"
+	"github.com/openzipkin/zipkin-go/reporter/recorder"
+)
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		name  string
+		apply func(c *Config)
+	}{
+		{"no service", func(c *Config) { c.ServiceName = "" }},
+		{"unknown exporter", func(c *Config) { c.Exporter = "jaeger" }},
+		{"zipkin without url", func(c *Config) { c.Exporter, c.ZipkinURL = ExporterZipkin, "" }},
+		{"otlp without url", func(c *Config) { c.Exporter, c.OTLPURL = ExporterOTLP, "" }},
+		{"sample rate", func(c *Config) { c.SampleRate = 1.5 }},
+	}
+	if err := DefaultConfig("goods", ":10086").Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range cases {
+		config := DefaultConfig("goods", ":10086")
+		c.apply(config)
+		if err := config.Validate(); err == nil {
+			t.Fatalf("%s: expected error", c.name)
+		}
+	}
+}
+
+// 接收上报的请求
+type collector struct {
+	mu     sync.Mutex
+	bodies [][]byte
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body json.RawMessage
+	json.NewDecoder(r.Body).Decode(&body)
+	c.mu.Lock()
+	c.bodies = append(c.bodies, body)
+	c.mu.Unlock()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func TestNew(t *testing.T) {
+	t.Run("zipkin", func(t *testing.T) {
+		c := &collector{}
+		server := httptest.NewServer(c)
+		defer server.Close()
+		config := DefaultConfig("goods", ":10086")
+		config.Exporter, config.ZipkinURL = ExporterZipkin, server.URL
+		tracer, closer, err := New(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tracer.StartSpan("detail").Finish()
+		closer()
+		var spans []model.SpanModel
+		if len(c.bodies) != 1 || json.Unmarshal(c.bodies[0], &spans) != nil || len(spans) != 1 {
+			t.Fatalf("unexpected spans %s", c.bodies)
+		}
+		if e := spans[0].LocalEndpoint; e == nil || e.ServiceName != "goods" || e.Port != 10086 {
+			t.Fatalf("unexpected local endpoint %+v", e)
+		}
+	})
+
+	t.Run("sampling", func(t *testing.T) {
+		config := DefaultConfig("goods", "")
+		config.SampleRate = 0
+		tracer, closer, err := New(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer closer()
+		if tracer.StartSpan("detail").Context().Sampled == nil || *tracer.StartSpan("detail").Context().Sampled {
+			t.Fatal("expected new traces not sampled")
+		}
+		// 沿用上游的采样决定
+		sampled := true
+		parent := model.SpanContext{TraceID: model.TraceID{Low: 1}, ID: 2, Sampled: &sampled}
+		if span := tracer.StartSpan("detail", zipkin.Parent(parent)); !*span.Context().Sampled {
+			t.Fatal("expected upstream sampling decision kept")
+		}
+	})
+}
+
+func TestOTLPReporter(t *testing.T) {
+	c := &collector{}
+	server := httptest.NewServer(c)
+	defer server.Close()
+	config := DefaultConfig("goods", "127.0.0.1:10086")
+	config.Exporter, config.OTLPURL = ExporterOTLP, server.URL
+	tracer, closer, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 服务端不与客户端共用span id
+	upstream := model.SpanContext{TraceID: model.TraceID{High: 1, Low: 2}, ID: 3}
+	span := tracer.StartSpan("get /goods/detail", zipkin.Kind(model.Server), zipkin.Parent(upstream))
+	span.Tag("http.path", "/goods/detail")
+	span.Annotate(time.Now(), "wr")
+	zipkin.TagError.Set(span, "timeout")
+	span.Finish()
+	closer()
+
+	var req otlpRequest
+	if len(c.bodies) != 1 || json.Unmarshal(c.bodies[0], &req) != nil || len(req.ResourceSpans) != 1 {
+		t.Fatalf("unexpected request %s", c.bodies)
+	}
+	rs := req.ResourceSpans[0]
+	if a := rs.Resource.Attributes; len(a) != 1 || a[0].Key != "service.name" || a[0].Value.StringValue != "goods" {
+		t.Fatalf("unexpected resource %+v", rs.Resource)
+	}
+	got := rs.ScopeSpans[0].Spans[0]
+	if got.TraceID != "00000000000000010000000000000002" || got.ParentSpanID != "0000000000000003" || got.SpanID == got.ParentSpanID || len(got.SpanID) != 16 {
+		t.Fatalf("unexpected ids %+v", got)
+	}
+	if got.Kind != otlpKindServer || got.Status.Code != otlpStatusError || got.Status.Message != "timeout" || len(got.Events) != 1 {
+		t.Fatalf("unexpected span %+v", got)
+	}
+	if !strings.Contains(string(c.bodies[0]), `{"key":"http.path","value":{"stringValue":"/goods/detail"}}`) {
+		t.Fatalf("expected tags as attributes, got %s", c.bodies[0])
+	}
+}
+
+func TestDo(t *testing.T) {
+	rec := recorder.NewReporter()
+	tracer, err := zipkin.NewTracer(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent, ctx := tracer.StartSpanFromContext(context.Background(), "detail")
+	var runParent *model.ID
+	err = Do(ctx, tracer, "Comments", func(ctx context.Context) error {
+		runParent = zipkin.SpanFromContext(ctx).Context().ParentID
+		return errors.New("unavailable")
+	}, func(ctx context.Context, err error) error {
+		if zipkin.SpanFromContext(ctx) == nil {
+			t.Error("expected span in fallback context")
+		}
+		return err
+	})
+	parent.Finish()
+	if err == nil || runParent == nil || *runParent != parent.Context().ID {
+		t.Fatalf("expected command span as child of request span, got %v %v", err, runParent)
+	}
+	spans := rec.Flush()
+	if len(spans) != 2 || spans[0].Name != "Comments" || !strings.Contains(spans[0].Tags["error"], "unavailable") || spans[0].Tags["hystrix.fallback"] != "unavailable" {
+		t.Fatalf("unexpected spans %+v", spans)
+	}
+}
+
+func TestHTTPServerTrace(t *testing.T) {
+	rec := recorder.NewReporter()
+	tracer, err := zipkin.NewTracer(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := kithttp.NewServer(
+		func(ctx context.Context, request interface{}) (interface{}, error) {
+			return nil, nil
+		},
+		kithttp.NopRequestDecoder,
+		func(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+			return nil
+		},
+		HTTPServerTrace(tracer),
+	)
+	req := httptest.NewRequest("GET", "/detail", nil)
+	req.Header.Set("X-B3-TraceId", "463ac35c9f6413ad")
+	req.Header.Set("X-B3-SpanId", "a2fb4a1d1a96d312")
+	req.Header.Set("X-B3-Sampled", "1")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	// 服务端span沿用请求头中的追踪上下文
+	if spans := rec.Flush(); len(spans) != 1 || spans[0].TraceID.String() != "463ac35c9f6413ad" {
+		t.Fatalf("expected server span joined to trace, got %v", spans)
+	}
+}
@@ -6,7 +6,20 @@ require (
 	github.com/go-kit/kit v0.10.0
 	github.com/go-redsync/redsync v1.4.2
 	github.com/go-sql-driver/mysql v1.5.0
+	github.com/google/uuid v1.0.0
 	github.com/gomodule/redigo v2.0.0+incompatible
 	github.com/gorilla/mux v1.8.0
 	github.com/jinzhu/gorm v1.9.16
+	github.com/openzipkin/zipkin-go v0.2.2
+	github.com/prometheus/client_golang v1.3.0
+	github.com/yunfeiyang1916/micro-go-course/instrument v0.0.0
+	github.com/yunfeiyang1916/micro-go-course/register v0.0.0
+	github.com/yunfeiyang1916/micro-go-course/tracing v0.0.0
+)
+
+replace (
+	github.com/yunfeiyang1916/micro-go-course/instrument => ../instrument
+	github.com/yunfeiyang1916/micro-go-course/loadbalancer => ../loadbalancer
+	github.com/yunfeiyang1916/micro-go-course/register => ../register
+	github.com/yunfeiyang1916/micro-go-course/tracing => ../tracing
 )
@@ -3,7 +3,13 @@ package main
 import (
 	"context"
 	"flag"
-	"fmt"
+	kitzipkin "github.com/go-kit/kit/tracing/zipkin"
+	"github.com/google/uuid"
+	"github.com/yunfeiyang1916/micro-go-course/instrument"
+	"github.com/yunfeiyang1916/micro-go-course/register/discovery"
+	"github.com/yunfeiyang1916/micro-go-course/register/lifecycle"
+	"github.com/yunfeiyang1916/micro-go-course/register/registry"
+	"github.com/yunfeiyang1916/micro-go-course/tracing"
 	"github.com/yunfeiyang1916/micro-go-course/user-server/dao"
 	"github.com/yunfeiyang1916/micro-go-course/user-server/endpoint"
 	"github.com/yunfeiyang1916/micro-go-course/user-server/redis"
@@ -11,10 +17,7 @@ import (
 	"github.com/yunfeiyang1916/micro-go-course/user-server/transport"
 	"log"
 	"net/http"
-	"os"
-	"os/signal"
 	"strconv"
-	"syscall"
 	"time"
 )
 
@@ -23,14 +26,22 @@ func main() {
 	var (
 		// 服务监听端口
 		servicePort = flag.Int("service.port", 10086, "service port")
+		// 服务注册配置
+		serviceName     = flag.String("service.name", "user", "service name")
+		serviceAddr     = flag.String("service.addr", "localhost", "service addr")
+		consulAddr      = flag.String("consul.addr", "127.0.0.1", "consul address")
+		consulPort      = flag.Int("consul.port", 8500, "consul port")
+		drainPeriod     = flag.Duration("drain.period", 5*time.Second, "time to wait for callers to drain traffic before shutdown")
+		shutdownTimeout = flag.Duration("shutdown.timeout", 10*time.Second, "max time to wait for in-flight requests on shutdown")
+		tracingConfig   = tracing.DefaultConfig("", "")
 	)
+	tracingConfig.BindFlags(flag.CommandLine)
 	flag.Parse()
 
 	// 使用k8s部署时，延时启动，等待 MySQL 和 Redis 准备好
 	time.Sleep(10 * time.Second)
 
 	ctx := context.Background()
-	errChan := make(chan error)
 	err := dao.InitMysql("localhost", "3306", "root", "root123456", "user")
 	if err != nil {
 		log.Fatal(err)
@@ -40,24 +51,45 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// 从请求头中获取上游的追踪上下文，未配置上报方式时只传播不上报
+	tracingConfig.ServiceName = *serviceName
+	tracingConfig.HostPort = *serviceAddr + ":" + strconv.Itoa(*servicePort)
+	tracer, closeTracer, err := tracing.New(tracingConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closeTracer()
+
 	userService := service.MakeUserServiceImpl(&dao.UserDAOImpl{})
 
+	registerEndpoint := endpoint.MakeRegisterEndpoint(userService)
+	registerEndpoint = kitzipkin.TraceEndpoint(tracer, "Register")(registerEndpoint)
+	registerEndpoint = instrument.DefaultMetrics.EndpointMiddleware("user", "Register")(registerEndpoint)
+	loginEndpoint := endpoint.MakeLoginEndpoint(userService)
+	loginEndpoint = kitzipkin.TraceEndpoint(tracer, "Login")(loginEndpoint)
+	loginEndpoint = instrument.DefaultMetrics.EndpointMiddleware("user", "Login")(loginEndpoint)
 	userEndpoints := &endpoint.UserEndpoints{
-		RegisterEndpoint: endpoint.MakeRegisterEndpoint(userService),
-		LoginEndpoint:    endpoint.MakeLoginEndpoint(userService),
+		RegisterEndpoint: registerEndpoint,
+		LoginEndpoint:    loginEndpoint,
+	}
+	r := transport.MakeHttpHandler(ctx, userEndpoints, tracer)
+
+	server := &http.Server{
+		Addr:    ":" + strconv.Itoa(*servicePort),
+		Handler: r,
 	}
-	r := transport.MakeHttpHandler(ctx, userEndpoints)
-
-	go func() {
-		errChan <- http.ListenAndServe(":"+strconv.Itoa(*servicePort), r)
-	}()
-
-	go func() {
-		// 监控系统信号，等待ctrl+c系统信号通知服务关闭
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
-		errChan <- fmt.Errorf("%s", <-c)
-	}()
-	error := <-errChan
-	log.Println(error)
+
+	client := discovery.NewDiscoveryClient(*consulAddr, *consulPort)
+	instanceId := *serviceName + "-" + uuid.New().String()
+	err = client.Register(ctx, *serviceName, instanceId, "/health", *serviceAddr, *servicePort, nil, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// 收到退出信号后先摘除流量，再关闭服务器并注销实例
+	config := lifecycle.DefaultConfig(instanceId)
+	config.DrainPeriod = *drainPeriod
+	config.ShutdownTimeout = *shutdownTimeout
+	err = lifecycle.New(config, registry.NewConsulRegistry(client), server).Run(server.ListenAndServe)
+	log.Println(err)
 }
@@ -11,6 +11,9 @@ import (
 	"github.com/go-kit/kit/transport"
 	kithttp "github.com/go-kit/kit/transport/http"
 	"github.com/gorilla/mux"
+	"github.com/openzipkin/zipkin-go"
+	"github.com/yunfeiyang1916/micro-go-course/instrument"
+	"github.com/yunfeiyang1916/micro-go-course/tracing"
 	"github.com/yunfeiyang1916/micro-go-course/user-server/endpoint"
 )
 
@@ -20,20 +23,26 @@ var (
 )
 
 // http处理请求
-func MakeHttpHandler(ctx context.Context, endpoints *endpoint.UserEndpoints) http.Handler {
+func MakeHttpHandler(ctx context.Context, endpoints *endpoint.UserEndpoints, tracer *zipkin.Tracer) http.Handler {
 	r := mux.NewRouter()
 	kitLog := log.NewLogfmtLogger(os.Stderr)
 	kitLog = log.With(kitLog, "ts", log.DefaultTimestampUTC)
 	kitLog = log.With(kitLog, "caller", log.DefaultCaller)
 
+	instrument.WrapRouter(r, "user")
 	options := []kithttp.ServerOption{
 		kithttp.ServerErrorHandler(transport.NewLogErrorHandler(kitLog)),
 		kithttp.ServerErrorEncoder(encodeError),
+		tracing.HTTPServerTrace(tracer),
 	}
 	// 用户注册路由
 	r.Methods("POST").Path("/register").Handler(kithttp.NewServer(endpoints.RegisterEndpoint, decodeRegisterRequest, encodeJSONResponse, options...))
 	// 用户登录路由
 	r.Methods("POST").Path("/login").Handler(kithttp.NewServer(endpoints.LoginEndpoint, decodeLoginRequest, encodeJSONResponse, options...))
+	// 注册中心健康检查路由
+	r.Methods("GET").Path("/health").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encodeJSONResponse(r.Context(), w, map[string]string{"status": "OK"})
+	})
 
 	return r
 }